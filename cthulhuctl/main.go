@@ -0,0 +1,422 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/metahook/client"
+)
+
+const USAGE string = `Usage: cthulhuctl [flags] <command> [args]
+
+Manages the live configuration of a Cthulhu component over its MetaHook socket (or named pipe on Windows).
+
+Commands:
+  get [flags] <key>          Print the value of a key
+  set [flags] <key> <value>  Set a key and run its update hooks
+  cas [flags] <key> <expected> <value>
+                             Set a key only if its current value is expected
+  delete <key>...            Remove keys and run their delete hooks
+  dump                       Print the full configuration
+  export [-format f]         Print the full configuration as json, yaml or native config file
+  flush                      Write the configuration to disk and print the size and checksum of the file
+  watch [prefix]             Stream changes of the configuration
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), USAGE)
+		flag.PrintDefaults()
+	}
+	socket := flag.String("socket", os.Getenv("CTHULHU_METAHOOK_SOCKET"), "Path of the MetaHook socket (env CTHULHU_METAHOOK_SOCKET)")
+	pipe := flag.String("pipe", os.Getenv("CTHULHU_METAHOOK_PIPE"), "Name of the MetaHook named pipe on Windows, used instead of the socket (env CTHULHU_METAHOOK_PIPE)")
+	token := flag.String("token", os.Getenv("CTHULHU_METAHOOK_TOKEN"), "Bearer token of the MetaHook (env CTHULHU_METAHOOK_TOKEN)")
+	config := flag.String("config", os.Getenv("CTHULHU_METAHOOK_CONFIG"), "Name of the MetaConfig to operate on, the default one if empty (env CTHULHU_METAHOOK_CONFIG)")
+	namespace := flag.String("namespace", os.Getenv("CTHULHU_METAHOOK_NAMESPACE"), "Name of the namespace to operate on, keys are passed without its prefix (env CTHULHU_METAHOOK_NAMESPACE)")
+	timeout := flag.Duration("timeout", client.DEFAULT_TIMEOUT, "Timeout of a single request")
+	flag.Parse()
+
+	if (*socket==""&&*pipe=="") || flag.NArg()<1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []client.Option{client.WithToken(*token), client.WithTimeout(*timeout), client.WithIdempotencyKeys()}
+	if *config!=""&&*namespace!="" {
+		fmt.Fprintln(os.Stderr, "The flags -config and -namespace are mutually exclusive")
+		os.Exit(2)
+	}
+	if *config!="" {
+		opts = append(opts, client.WithConfig(*config))
+	}
+	if *namespace!="" {
+		opts = append(opts, client.WithNamespace(*namespace))
+	}
+	var c *client.Client
+	if *pipe!="" {
+		c = client.CreatePipeClient(*pipe, opts...)
+	} else {
+		c = client.CreateUnixClient(*socket, opts...)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "get":
+		err = get(ctx, c, args)
+	case "set":
+		err = set(ctx, c, args)
+	case "cas":
+		err = cas(ctx, c, args)
+	case "delete":
+		err = deleteKeys(ctx, c, args)
+	case "dump":
+		err = dump(ctx, c, args)
+	case "export":
+		err = export(ctx, c, args)
+	case "flush":
+		err = flush(ctx, c, args)
+	case "watch":
+		err = watch(ctx, c, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err!=nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+/**
+ * Prints the value of a single key
+ */
+func get(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	printVersion := flags.Bool("version", false, "Print the config version the value was read from to stderr (see set -if-version)")
+	if err := flags.Parse(args); err!=nil {
+		return err
+	}
+	if flags.NArg()!=1 {
+		return errors.New("Usage: cthulhuctl get [-version] <key>")
+	}
+
+	value, exists, version, err := c.GetVersioned(ctx, flags.Arg(0))
+	if err!=nil {
+		return err
+	}
+	if *printVersion {
+		fmt.Fprintf(os.Stderr, "version: %d\n", version)
+	}
+	if !exists {
+		return fmt.Errorf("Key '%s' not found", flags.Arg(0))
+	}
+	fmt.Println(value)
+	return nil
+}
+
+/**
+ * Sets a single key through the update endpoint
+ *
+ * The value is sent with the specified type, so that typed hooks of the key are called.
+ * List values are taken from all remaining arguments.
+ */
+func set(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("set", flag.ContinueOnError)
+	valueType := flags.String("type", "string", "Type of the value (string, bool, int, double, list, duration, time)")
+	persist := flags.Bool("persist", false, "Write the configuration to disk after the hooks succeeded")
+	atomic := flags.Bool("atomic", false, "Roll back the value if a hook fails")
+	dryRun := flags.Bool("dry-run", false, "Only print the planned change and the hooks that would be called")
+	ifVersion := flags.Int64("if-version", -1, "Only set the value if the config still has this version (see get -version)")
+	sealed := flags.Bool("sealed", false, "Encrypt the string value with the sealing key of the config before sending it")
+	if err := flags.Parse(args); err!=nil {
+		return err
+	}
+	if flags.NArg()<2 && !(*valueType=="list"&&flags.NArg()==1) {
+		return errors.New("Usage: cthulhuctl set [-type string|bool|int|double|list|duration|time] [-persist] [-atomic] [-dry-run] [-if-version n] [-sealed] <key> <value>")
+	}
+	if *sealed&&*valueType!="string" {
+		return errors.New("Only string values can be sealed")
+	}
+	key, values := flags.Arg(0), flags.Args()[1:]
+
+	req := client.UpdateRequest{Persist: *persist, Atomic: *atomic, DryRun: *dryRun}
+	if *ifVersion>=0 {
+		version := uint64(*ifVersion)
+		req.IfVersion = &version
+	}
+	switch *valueType {
+	case "string":
+		value := strings.Join(values, " ")
+		if *sealed {
+			var err error
+			if value, err = c.Seal(ctx, key, value); err!=nil {
+				return err
+			}
+		}
+		req.StringFields = []client.StringField{{Key: key, Value: value, Sealed: *sealed}}
+	case "bool":
+		b, err := strconv.ParseBool(values[0])
+		if err!=nil {
+			return fmt.Errorf("Invalid bool value '%s'", values[0])
+		}
+		req.BoolFields = []client.BoolField{{Key: key, Value: b}}
+	case "int":
+		n, err := strconv.ParseInt(values[0], 10, 64)
+		if err!=nil {
+			return fmt.Errorf("Invalid int value '%s'", values[0])
+		}
+		req.IntFields = []client.IntField{{Key: key, Value: n}}
+	case "double":
+		d, err := strconv.ParseFloat(values[0], 64)
+		if err!=nil {
+			return fmt.Errorf("Invalid double value '%s'", values[0])
+		}
+		req.DoubleFields = []client.DoubleField{{Key: key, Value: d}}
+	case "list":
+		req.ListFields = []client.ListField{{Key: key, Value: values}}
+	case "duration":
+		d, err := time.ParseDuration(values[0])
+		if err!=nil {
+			return fmt.Errorf("Invalid duration value '%s'", values[0])
+		}
+		req.DurationFields = []client.DurationField{{Key: key, Value: d}}
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, values[0])
+		if err!=nil {
+			return fmt.Errorf("Invalid RFC3339 time value '%s'", values[0])
+		}
+		req.TimeFields = []client.TimeField{{Key: key, Value: t}}
+	default:
+		return fmt.Errorf("Unknown type '%s'", *valueType)
+	}
+
+	res, err := c.Update(ctx, req)
+	if *dryRun {
+		printPlan(res)
+	} else {
+		printResult(res)
+	}
+	return err
+}
+
+/**
+ * Sets a string value through the compare-and-swap endpoint
+ *
+ * If the value differs, the current value is printed to stderr.
+ */
+func cas(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("cas", flag.ContinueOnError)
+	absent := flags.Bool("absent", false, "Only set the value if the key does not exist (no expected value is passed)")
+	if err := flags.Parse(args); err!=nil {
+		return err
+	}
+	var expected *string
+	switch {
+	case *absent&&flags.NArg()==2:
+	case !*absent&&flags.NArg()==3:
+		current := flags.Arg(1)
+		expected = &current
+	default:
+		return errors.New("Usage: cthulhuctl cas <key> <expected> <value> | cthulhuctl cas -absent <key> <value>")
+	}
+	key, value := flags.Arg(0), flags.Arg(flags.NArg()-1)
+
+	res, err := c.CompareAndSwap(ctx, key, expected, value)
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr)&&apiErr.Status==http.StatusPreconditionFailed&&len(res.Fields)>0 {
+		if res.Fields[0].Existed {
+			fmt.Fprintf(os.Stderr, "current: %q\n", res.Fields[0].Old)
+		} else {
+			fmt.Fprintln(os.Stderr, "current: key does not exist")
+		}
+	}
+	printResult(res)
+	return err
+}
+
+/**
+ * Removes keys through the delete endpoint
+ */
+func deleteKeys(ctx context.Context, c *client.Client, args []string) error {
+	if len(args)<1 {
+		return errors.New("Usage: cthulhuctl delete <key>...")
+	}
+	res, err := c.Delete(ctx, args...)
+	printResult(res)
+	return err
+}
+
+/**
+ * Prints the full configuration as sorted key="value" lines
+ */
+func dump(ctx context.Context, c *client.Client, args []string) error {
+	if len(args)!=0 {
+		return errors.New("Usage: cthulhuctl dump")
+	}
+
+	config, err := c.GetConfig(ctx)
+	if err!=nil {
+		return err
+	}
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s=%s\n", k, strconv.Quote(config[k]))
+	}
+	return nil
+}
+
+/**
+ * Prints the full configuration in the export format of the MetaHook
+ */
+func export(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "json", "Format of the export (json, yaml, native)")
+	if err := flags.Parse(args); err!=nil {
+		return err
+	}
+	if flags.NArg()!=0 {
+		return errors.New("Usage: cthulhuctl export [-format json|yaml|native]")
+	}
+
+	data, err := c.Export(ctx, *format)
+	if err!=nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+/**
+ * Prints every change of the configuration until the stream is closed or interrupted
+ */
+func watch(ctx context.Context, c *client.Client, args []string) error {
+	if len(args)>1 {
+		return errors.New("Usage: cthulhuctl watch [prefix]")
+	}
+	prefix := ""
+	if len(args)==1 {
+		prefix = args[0]
+	}
+
+	changes, wait, err := c.Watch(ctx, prefix)
+	if err!=nil {
+		return err
+	}
+	for change := range changes {
+		actor := ""
+		if change.Actor!="" {
+			actor = " by " + change.Actor
+		}
+		if change.Deleted {
+			fmt.Printf("%s %s deleted (%s%s)\n", change.Time.Format(time.RFC3339), change.Key, change.Source, actor)
+		} else {
+			fmt.Printf("%s %s=%s (%s%s)\n", change.Time.Format(time.RFC3339), change.Key, strconv.Quote(change.New), change.Source, actor)
+		}
+	}
+	return wait()
+}
+
+/**
+ * Writes the configuration to disk and prints the written file
+ */
+func flush(ctx context.Context, c *client.Client, args []string) error {
+	if len(args)!=0 {
+		return errors.New("Usage: cthulhuctl flush")
+	}
+	res, err := c.Flush(ctx)
+	if err!=nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes, sha256 %s, version %d\n", res.Path, res.Bytes, res.Checksum, res.Version)
+	return nil
+}
+
+/**
+ * Prints the planned changes of a dry run
+ */
+func printPlan(res *client.UpdateResult) {
+	if res==nil {
+		return
+	}
+	for _, field := range res.Fields {
+		if field.Err!="" {
+			continue
+		}
+		if field.Changed {
+			fmt.Printf("%s: %s -> %s\n", field.Key, strconv.Quote(field.Old), strconv.Quote(field.New))
+		} else {
+			fmt.Printf("%s: unchanged\n", field.Key)
+		}
+		for _, hook := range field.Hooks {
+			fmt.Printf("  hook %s\n", hook)
+		}
+	}
+}
+
+/**
+ * Prints the per-field results of an update or delete
+ *
+ * Field errors are part of the returned error and are not printed here.
+ */
+func printResult(res *client.UpdateResult) {
+	if res==nil {
+		return
+	}
+	for _, field := range res.Fields {
+		if field.Set&&field.Err=="" {
+			if field.Existed {
+				fmt.Printf("%s: ok (was %q)\n", field.Key, field.Old)
+			} else {
+				fmt.Printf("%s: ok\n", field.Key)
+			}
+		}
+		if len(field.Result)>0 {
+			fmt.Printf("  result: %s\n", field.Result)
+		}
+		for _, warning := range field.Warnings {
+			fmt.Printf("  warning: %s\n", warning)
+		}
+	}
+	if res.Job!="" {
+		fmt.Printf("job: %s\n", res.Job)
+	}
+}
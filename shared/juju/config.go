@@ -0,0 +1,133 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package juju
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/megakuul/cthulhu/shared/metahook/client"
+)
+
+/**
+ * Decodes the output of `config-get --format=json`
+ *
+ * Numbers are kept as json.Number, so that integers are not mangled through float64.
+ */
+func ParseConfig(data []byte) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	config := make(map[string]any)
+	if err := decoder.Decode(&config); err!=nil {
+		return nil, fmt.Errorf("Failed to decode juju config: %w", err)
+	}
+	return config, nil
+}
+
+/**
+ * Translates charm config options into a MetaHook update request
+ *
+ * Options are sent as typed fields, so that the typed hooks of the keys are called:
+ * strings as string fields, booleans as bool fields, integers as int fields and other numbers as double fields.
+ * Unset options (null, see `config-get --all`) are returned as keys to delete.
+ *
+ * Fields and keys are sorted by option name, so that hooks are called in a deterministic order.
+ */
+func ConfigUpdate(config map[string]any, opts ...Option) (client.UpdateRequest, []string, error) {
+	t := newTranslation(opts)
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var req client.UpdateRequest
+	var deleted []string
+	for _, name := range names {
+		key := t.key("", name)
+		switch value := config[name].(type) {
+		case nil:
+			deleted = append(deleted, key)
+		case string:
+			req.StringFields = append(req.StringFields, client.StringField{Key: key, Value: value})
+		case bool:
+			req.BoolFields = append(req.BoolFields, client.BoolField{Key: key, Value: value})
+		case json.Number:
+			if n, err := value.Int64(); err==nil {
+				req.IntFields = append(req.IntFields, client.IntField{Key: key, Value: n})
+			} else if f, err := value.Float64(); err==nil {
+				req.DoubleFields = append(req.DoubleFields, client.DoubleField{Key: key, Value: f})
+			} else {
+				return client.UpdateRequest{}, nil, fmt.Errorf("Invalid number of option '%s': %w", name, err)
+			}
+		case int:
+			req.IntFields = append(req.IntFields, client.IntField{Key: key, Value: int64(value)})
+		case int64:
+			req.IntFields = append(req.IntFields, client.IntField{Key: key, Value: value})
+		case float64:
+			// Config decoded without ParseConfig, integral values are assumed to be integers
+			if value==math.Trunc(value)&&math.Abs(value)<(1<<53) {
+				req.IntFields = append(req.IntFields, client.IntField{Key: key, Value: int64(value)})
+			} else {
+				req.DoubleFields = append(req.DoubleFields, client.DoubleField{Key: key, Value: value})
+			}
+		default:
+			return client.UpdateRequest{}, nil, fmt.Errorf("Unsupported type %T of option '%s'", value, name)
+		}
+	}
+	return req, deleted, nil
+}
+
+/**
+ * Applies the current charm config to the MetaHook
+ *
+ * Reads all options with `config-get`, sends them as one atomic update and deletes the keys of unset options.
+ * Intended to be called from the config-changed hook of the charm.
+ *
+ * Returns the result of the update (nil if no option is set).
+ */
+func SyncConfig(ctx context.Context, c *client.Client, opts ...Option) (*client.UpdateResult, error) {
+	config, err := ConfigGet(ctx)
+	if err!=nil {
+		return nil, err
+	}
+	req, deleted, err := ConfigUpdate(config, opts...)
+	if err!=nil {
+		return nil, err
+	}
+	req.Atomic = true
+
+	var res *client.UpdateResult
+	if len(req.StringFields)+len(req.BoolFields)+len(req.IntFields)+len(req.DoubleFields)+len(req.ListFields)>0 {
+		if res, err = c.Update(ctx, req); err!=nil {
+			return res, err
+		}
+	}
+	if len(deleted)>0 {
+		if _, err := c.Delete(ctx, deleted...); err!=nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
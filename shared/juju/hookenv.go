@@ -0,0 +1,118 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package juju
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+/**
+ * Reads all charm config options with `config-get`
+ *
+ * Unset options are included as nil (see ConfigUpdate).
+ * Must be called from a juju hook context.
+ */
+func ConfigGet(ctx context.Context) (map[string]any, error) {
+	out, err := run(ctx, nil, "config-get", "--format=json", "--all")
+	if err!=nil {
+		return nil, err
+	}
+	return ParseConfig(out)
+}
+
+/**
+ * Reads the relation data of a unit (or application) with `relation-get`
+ *
+ * An empty relation id or unit uses the relation and remote unit of the current relation hook.
+ */
+func RelationGet(ctx context.Context, relationID string, unit string) (map[string]string, error) {
+	args := []string{"--format=json"}
+	if relationID!="" {
+		args = append(args, "-r", relationID)
+	}
+	args = append(args, "-")
+	if unit!="" {
+		args = append(args, unit)
+	}
+	out, err := run(ctx, nil, "relation-get", args...)
+	if err!=nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	if err := json.Unmarshal(out, &data); err!=nil {
+		return nil, fmt.Errorf("Failed to decode juju relation data: %w", err)
+	}
+	return data, nil
+}
+
+/**
+ * Publishes relation data of the local unit with `relation-set`
+ *
+ * Keys with empty values are removed from the relation. The data is passed on stdin,
+ * so that values may contain line breaks and any other char.
+ */
+func RelationSet(ctx context.Context, relationID string, data map[string]string) error {
+	// JSON is valid YAML, which is expected by --file
+	content, err := json.Marshal(data)
+	if err!=nil {
+		return err
+	}
+	args := []string{"--file", "-"}
+	if relationID!="" {
+		args = append(args, "-r", relationID)
+	}
+	_, err = run(ctx, content, "relation-set", args...)
+	return err
+}
+
+/**
+ * Sets the workload status of the unit with `status-set` (see Status)
+ */
+func StatusSet(ctx context.Context, status string, message string) error {
+	_, err := run(ctx, nil, "status-set", status, message)
+	return err
+}
+
+/**
+ * Runs a juju hook tool and returns its stdout
+ *
+ * The stderr of the tool is part of the returned error.
+ */
+func run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin!=nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err!=nil {
+		if msg := strings.TrimSpace(stderr.String()); msg!="" {
+			return nil, fmt.Errorf("%s failed: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
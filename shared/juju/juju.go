@@ -0,0 +1,81 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package juju
+
+import (
+	"strings"
+)
+
+/**
+ * Option to customize the translation between juju keys and MetaConfig keys
+ */
+type Option func(*translation)
+
+type translation struct {
+	// Prepended to every MetaConfig key
+	prefix string
+	// Maps juju keys to MetaConfig keys (identity if nil)
+	mapKey func(string) string
+}
+
+/**
+ * Prepends the prefix to every MetaConfig key (e.g. "juju.")
+ */
+func WithPrefix(prefix string) Option {
+	return func(t *translation) {
+		t.prefix = prefix
+	}
+}
+
+/**
+ * Maps juju keys to MetaConfig keys before the prefix is prepended (e.g. DashesToDots)
+ *
+ * The mapping is only applied to data coming from juju, RelationData only strips the prefix.
+ */
+func WithKeyMapper(mapper func(string) string) Option {
+	return func(t *translation) {
+		t.mapKey = mapper
+	}
+}
+
+/**
+ * Replaces the dashes of juju option names with dots (e.g. "log-level" becomes "log.level")
+ */
+func DashesToDots(key string) string {
+	return strings.ReplaceAll(key, "-", ".")
+}
+
+func newTranslation(opts []Option) *translation {
+	t := &translation{}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+/**
+ * Returns the MetaConfig key of a juju key, base is inserted between the prefix and the mapped key
+ */
+func (t* translation) key(base string, key string) string {
+	if t.mapKey!=nil {
+		key = t.mapKey(key)
+	}
+	return t.prefix + base + key
+}
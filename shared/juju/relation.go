@@ -0,0 +1,97 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package juju
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/megakuul/cthulhu/shared/metahook/client"
+)
+
+/**
+ * Translates the data of a related unit (or application) into a MetaHook update request
+ *
+ * Keys are stored below "<relation>." (after the prefix, e.g. "juju.database.host") as string fields.
+ * Keys of the current MetaConfig below the relation which are missing in the data are returned as keys to delete,
+ * pass nil as current config if no keys should be deleted (e.g. in relation-changed with partial data).
+ * Pass nil as data in relation-broken to delete all keys of the relation.
+ */
+func RelationUpdate(
+	relation string,
+	data map[string]string,
+	current map[string]string,
+	opts ...Option) (client.UpdateRequest, []string) {
+
+	t := newTranslation(opts)
+	var req client.UpdateRequest
+	keys := make(map[string]bool, len(data))
+	for name, value := range data {
+		key := t.key(relation + ".", name)
+		keys[key] = true
+		req.StringFields = append(req.StringFields, client.StringField{Key: key, Value: value})
+	}
+	sort.Slice(req.StringFields, func(i, j int) bool {
+		return req.StringFields[i].Key<req.StringFields[j].Key
+	})
+
+	var deleted []string
+	for key := range current {
+		if strings.HasPrefix(key, t.prefix + relation + ".")&&!keys[key] {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+	return req, deleted
+}
+
+/**
+ * Selects the MetaConfig keys below the prefix as relation data (e.g. to publish them with RelationSet)
+ *
+ * The prefix is stripped from the keys, the key mapper is not reversed.
+ */
+func RelationData(config map[string]string, opts ...Option) map[string]string {
+	t := newTranslation(opts)
+	data := make(map[string]string)
+	for key, value := range config {
+		if name, found := strings.CutPrefix(key, t.prefix); found&&name!="" {
+			data[name] = value
+		}
+	}
+	return data
+}
+
+/**
+ * Translates the outcome of a MetaHook request into a juju workload status and message (see StatusSet)
+ *
+ * Successful requests are "active", rejected configurations (4xx) and failed hooks (5xx) are "blocked"
+ * as they require an operator to change the config, unreachable MetaHooks are "waiting".
+ */
+func Status(err error) (string, string) {
+	if err==nil {
+		return "active", ""
+	}
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		return "blocked", "Config rejected: " + apiErr.Msg
+	}
+	return "waiting", "MetaHook unavailable: " + err.Error()
+}
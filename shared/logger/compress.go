@@ -0,0 +1,145 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/**
+ * Compresses the uncompressed backups in a background goroutine if the policy enables compression
+ *
+ * The backups are collected while the lock is held, the goroutine compresses them without the lock.
+ * Rotations are postponed while the goroutine runs (see Write), Rotate, SetPolicy and Close wait for it
+ * without holding the lock (see waitCompression).
+ * A backup that fails to compress is kept uncompressed and retried after the next rotation,
+ * the failure is reported by the next Write, Rotate or Close.
+ */
+func (r* RotatingFile) compressBackups() {
+	if !r.policy.Compress {
+		return
+	}
+	first := 1
+	if r.policy.DelayCompress {
+		first = 2
+	}
+	var paths []string
+	for i := first; i<=r.policy.Backups; i++ {
+		if _, err := os.Stat(r.backup(i)); err==nil {
+			paths = append(paths, r.backup(i))
+		}
+	}
+	if len(paths)<1 {
+		return
+	}
+	done := make(chan struct{})
+	r.compressDone = done
+	go func() {
+		var errs []error
+		for _, path := range paths {
+			if err := compressFile(path); err!=nil {
+				errs = append(errs, fmt.Errorf("Failed to compress rotated log file '%s': %w", path, err))
+			}
+		}
+		r.lock.Lock()
+		r.compressErr = errors.Join(r.compressErr, errors.Join(errs...))
+		r.compressDone = nil
+		r.lock.Unlock()
+		close(done)
+	}()
+}
+
+/**
+ * Waits until no compression of the backups is running, the lock must be held and is released while waiting
+ *
+ * Writes proceed while waiting, a compression started by a rotation in the meantime is waited for aswell.
+ */
+func (r* RotatingFile) waitCompression() {
+	for r.compressDone!=nil {
+		done := r.compressDone
+		r.lock.Unlock()
+		<-done
+		r.lock.Lock()
+	}
+}
+
+/**
+ * Returns and clears the failures of the background compression, the lock must be held
+ */
+func (r* RotatingFile) takeCompressErr() error {
+	err := r.compressErr
+	r.compressErr = nil
+	return err
+}
+
+/**
+ * Compresses the file at the path to <path>.gz and removes the original
+ *
+ * The archive is written to a temporary file first, so that an interrupted compression never leaves a truncated archive.
+ * The archive keeps the permissions and the modification time of the original (used for the age based retention).
+ */
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err!=nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err!=nil {
+		return err
+	}
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err!=nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	writer.Name = info.Name()
+	writer.ModTime = info.ModTime()
+	_, err = io.Copy(writer, src)
+	if err==nil {
+		err = writer.Close()
+	}
+	if err==nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err==nil {
+		err = cerr
+	}
+	if err==nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err==nil {
+		err = os.Rename(tmp, path + ".gz")
+	}
+	if err!=nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Closed before the removal, open files cannot be removed on windows
+	src.Close()
+	return os.Remove(path)
+}
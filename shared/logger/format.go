@@ -0,0 +1,124 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package logger
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Output format of a log sink
+ */
+type LOGFORMAT int
+const (
+	// Multi-line entries for humans (default)
+	LOG_FORMAT_TEXT LOGFORMAT = iota
+	// One JSON object per line for log ingestion (e.g. Loki, Elasticsearch)
+	LOG_FORMAT_JSON
+	// One line of key=value pairs per entry (e.g. for the grafana agent)
+	LOG_FORMAT_LOGFMT
+)
+
+/**
+ * Destination of log entries
+ */
+type LOGSINK int
+const (
+	// Log file passed to InitLogger
+	SINK_FILE LOGSINK = iota
+	// Standard output and error (if enabled on InitLogger)
+	SINK_STD
+)
+
+/**
+ * Sets the output format of every sink (default LOG_FORMAT_TEXT)
+ *
+ * In the JSON format every entry is a single line with time, level, message, caller and fields, e.g.
+ * {"time":"2024-05-01T10:00:00.123+02:00","level":"INFO","message":"Started","caller":"cthulhu/main.go:42","fields":{"port":80}}
+ * In the logfmt format the fields follow the same keys, e.g.
+ * time=2024-05-01T10:00:00.123+02:00 level=info msg=Started caller=cthulhu/main.go:42 port=80
+ */
+func (l* Logger) SetFormat(format LOGFORMAT) {
+	l.SetSinkFormat(SINK_FILE, format)
+	l.SetSinkFormat(SINK_STD, format)
+}
+
+/**
+ * Sets the output format of a sink, e.g. JSON for the log file and text for the terminal
+ */
+func (l* Logger) SetSinkFormat(sink LOGSINK, format LOGFORMAT) {
+	l.formats[sink].Store(int32(format))
+}
+
+/**
+ * Returns the output format of a sink
+ */
+func (l* Logger) SinkFormat(sink LOGSINK) LOGFORMAT {
+	return LOGFORMAT(l.formats[sink].Load())
+}
+
+/**
+ * Encodes the message in the format
+ */
+func encodeMessage(msg *LogMessage, format LOGFORMAT) []byte {
+	switch format {
+	case LOG_FORMAT_JSON:
+		return jsonLine(msg)
+	case LOG_FORMAT_LOGFMT:
+		return logfmtLine(msg)
+	default:
+		return textEntry(msg)
+	}
+}
+
+/**
+ * Returns the source location of the caller as "dir/file.go:line" (skip as in runtime.Caller)
+ */
+func logCaller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(file)) + "/" + filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+/**
+ * Formats the fields as sorted key=value pairs for the text format
+ */
+func textFields(fields map[string]any) string {
+	if len(fields)==0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", k, fields[k])
+	}
+	return "\n" + strings.Join(pairs, " ")
+}
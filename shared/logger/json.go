@@ -0,0 +1,61 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type jsonEntry struct {
+	Time string `json:"time"`
+	Level string `json:"level"`
+	Message string `json:"message"`
+	Caller string `json:"caller,omitempty"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+/**
+ * Encodes the message as single JSON line
+ */
+func jsonLine(msg *LogMessage) []byte {
+	entry := jsonEntry{
+		Time: msg.time.Format(time.RFC3339Nano),
+		Level: msg.loglevel.String(),
+		Message: msg.message,
+		Caller: msg.caller,
+		Fields: msg.fields,
+	}
+	line, err := json.Marshal(&entry)
+	if err!=nil {
+		// Fields that can't be encoded (e.g. channels) are replaced by their text representation
+		entry.Fields = make(map[string]any, len(msg.fields))
+		for k, v := range msg.fields {
+			if _, err := json.Marshal(v); err!=nil {
+				v = fmt.Sprint(v)
+			}
+			entry.Fields[k] = v
+		}
+		line, _ = json.Marshal(&entry)
+	}
+	return append(line, '\n')
+}
@@ -0,0 +1,92 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/**
+ * Encodes the message as single logfmt line
+ *
+ * Fields follow time, level, msg and caller sorted by key, keys colliding with them are prefixed with "field.".
+ */
+func logfmtLine(msg *LogMessage) []byte {
+	var b strings.Builder
+	appendLogfmt(&b, "time", msg.time.Format(time.RFC3339Nano))
+	appendLogfmt(&b, "level", strings.ToLower(msg.loglevel.String()))
+	appendLogfmt(&b, "msg", msg.message)
+	if msg.caller!="" {
+		appendLogfmt(&b, "caller", msg.caller)
+	}
+	keys := make([]string, 0, len(msg.fields))
+	for k := range msg.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := logfmtKey(k)
+		switch key {
+		case "time", "level", "msg", "caller":
+			key = "field." + key
+		}
+		appendLogfmt(&b, key, fmt.Sprint(msg.fields[k]))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+/**
+ * Appends the pair to the line, the value is quoted if it is empty or contains spaces, quotes, '=' or control characters
+ */
+func appendLogfmt(b *strings.Builder, key string, value string) {
+	if b.Len()>0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	if value==""||strings.IndexFunc(value, func(r rune) bool {
+		return r<=' '||r=='='||r=='"'||r==unicode.ReplacementChar||unicode.IsControl(r)
+	})>=0 {
+		b.WriteString(strconv.Quote(value))
+	} else {
+		b.WriteString(value)
+	}
+}
+
+/**
+ * Replaces the characters that are invalid in logfmt keys with '_'
+ */
+func logfmtKey(key string) string {
+	if key=="" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r<=' '||r=='='||r=='"'||unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, key)
+}
@@ -22,45 +22,139 @@ package logger
 import (
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"runtime"
 )
 
 type LOGLEVEL int
 const (
-	ERROR LOGLEVEL = iota
+	// Always logged, the process is shut down afterwards (see LogFatal)
+	FATAL LOGLEVEL = iota-1
+	ERROR
 	WARN
 	INFO
+	// Verbose diagnostics, not intended for production
+	DEBUG
+	// Most verbose diagnostics (e.g. every step of an operation)
+	TRACE
 )
 
+/**
+ * Returns the name of the level (e.g. "DEBUG")
+ */
+func (l LOGLEVEL) String() string {
+	switch l {
+	case FATAL:
+		return "FATAL"
+	case ERROR:
+		return "ERROR"
+	case WARN:
+		return "WARN"
+	case INFO:
+		return "INFO"
+	case DEBUG:
+		return "DEBUG"
+	case TRACE:
+		return "TRACE"
+	default:
+		return fmt.Sprintf("LOGLEVEL(%d)", int(l))
+	}
+}
+
+/**
+ * Parses the name of a level case-insensitively (e.g. "debug"), "WARNING" is accepted aswell
+ */
+func ParseLogLevel(name string) (LOGLEVEL, error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "FATAL":
+		return FATAL, nil
+	case "ERROR":
+		return ERROR, nil
+	case "WARN", "WARNING":
+		return WARN, nil
+	case "INFO":
+		return INFO, nil
+	case "DEBUG":
+		return DEBUG, nil
+	case "TRACE":
+		return TRACE, nil
+	default:
+		return ERROR, fmt.Errorf("Unknown log level '%s'", name)
+	}
+}
+
+/**
+ * Exit code of the process after a fatal message (see SetExitCode)
+ */
+const DEFAULT_FATAL_EXIT_CODE = 1
+
 type LogMessage struct {
 	message string
 	debuginfo string
 	loglevel LOGLEVEL
+	// Time the message was logged
+	time time.Time
+	// Source location of the log call as "dir/file.go:line" (only recorded for structured formats)
+	caller string
+	// Structured fields of the message (see LogFields)
+	fields map[string]any
+	// Closed by the log worker instead of logging the message, once all messages queued before are written (see Flush)
+	flushed chan struct{}
 }
 
 type Logger struct {
 	logLevel LOGLEVEL
-	logFile *os.File
+	// Log file, rotated according to its policy (see SetRotationPolicy)
+	logFile *RotatingFile
+	// Last failure of the log file reported on stderr, only used by the log worker (see reportFileError)
+	logFileErr string
 	logToStd bool
 	logDebug bool
 	logChanThreshold int
 	logChan chan *LogMessage
+	// Guards logChan against sends after CloseLogger closed it
+	logChanLock sync.RWMutex
+	logChanClosed bool
+	// Output format by sink (see SetSinkFormat)
+	formats [2]atomic.Int32
+	// Closed when the log worker exited
+	logDone chan struct{}
+	// Exit code and callbacks of the shutdown after a fatal message
+	shutdownLock sync.Mutex
+	exitCode int
+	shutdownCallbacks []func()
+	// Set by the first fatal message, later fatal messages exit immediately (see shutdown)
+	shuttingDown bool
 }
 
-func InitLogger(logLevel LOGLEVEL, logPath string, logToStd bool, logDebug bool, logQueueSize int8) error {
-	// Create Logfile path if not existent
-	logPathParent, _ := filepath.Split(logPath)
-	if err := os.MkdirAll(logPathParent, 0755); err!=nil {
-		return err
-	}
-	
-	var logger Logger
+/**
+ * Opens the logger writing to the log file at logPath, the log file is never rotated
+ *
+ * Use InitLoggerWithPolicy or SetRotationPolicy to rotate the log file.
+ */
+func InitLogger(logLevel LOGLEVEL, logPath string, logToStd bool, logDebug bool, logQueueSize int8) (*Logger, error) {
+	return InitLoggerWithPolicy(logLevel, logPath, logToStd, logDebug, logQueueSize, RotationPolicy{})
+}
+
+/**
+ * Opens the logger like InitLogger, the log file is rotated according to the policy (see RotatingFile)
+ *
+ * The log file is created with mode 0600 if it does not exist.
+ * Rotated files are compressed in the background if the policy enables it (see RotationPolicy.Compress, RotationPolicy.DelayCompress),
+ * CloseLogger waits for a running compression.
+ * Failures to write, rotate or compress the log file are reported on stderr.
+ */
+func InitLoggerWithPolicy(
+	logLevel LOGLEVEL, logPath string, logToStd bool, logDebug bool, logQueueSize int8, policy RotationPolicy) (*Logger, error) {
+	logger := &Logger{}
 	var err error
-	logger.logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	// Creates the log file path if not existent
+	logger.logFile, err = OpenRotatingFileWithPolicy(logPath, policy)
 	if err!=nil {
-		return err
+		return nil, err
 	}
 
 	logger.logToStd = logToStd
@@ -69,45 +163,196 @@ func InitLogger(logLevel LOGLEVEL, logPath string, logToStd bool, logDebug bool,
 	// Queue threshold is set to 50%. If it goes beyond, this is already very critical
 	logger.logChanThreshold = int(logQueueSize) / 2
 	logger.logChan = make(chan *LogMessage, logQueueSize)
+	logger.logDone = make(chan struct{})
+	logger.exitCode = DEFAULT_FATAL_EXIT_CODE
 
-	logger.startLogWorker()
+	go logger.startLogWorker()
 	
-	return err
+	return logger, nil
 }
 
+/**
+ * Closes the logger after all queued messages are written
+ *
+ * Messages logged afterwards are written to stderr, closing the logger again has no effect.
+ */
 func (l* Logger) CloseLogger() {
+	l.logChanLock.Lock()
+	if l.logChanClosed {
+		l.logChanLock.Unlock()
+		return
+	}
+	l.logChanClosed = true
 	l.closeLogWorker()
-	l.logFile.Close()
+	l.logChanLock.Unlock()
+	<-l.logDone
+	if err := l.logFile.Close(); err!=nil {
+		l.reportFileError(err)
+	}
 }
 
-func (l* Logger) LogError(msg string) {
-	debuginfo := ""
-	if l.logDebug {
-		debuginfo = l.getDebugInfo(2)
+/**
+ * Replaces the rotation policy of the log file, rotated files exceeding the new limits are removed immediately
+ */
+func (l* Logger) SetRotationPolicy(policy RotationPolicy) {
+	l.logFile.SetPolicy(policy)
+}
+
+/**
+ * Returns the rotation policy of the log file
+ */
+func (l* Logger) RotationPolicy() RotationPolicy {
+	return l.logFile.Policy()
+}
+
+/**
+ * Rotates the log file regardless of its policy (e.g. on request of an external log rotation)
+ *
+ * Messages queued before are not necessarily written to the rotated file, call Flush first if they must be.
+ */
+func (l* Logger) Rotate() error {
+	return l.logFile.Rotate()
+}
+
+/**
+ * Sets the exit code of the process after a fatal message (default DEFAULT_FATAL_EXIT_CODE)
+ */
+func (l* Logger) SetExitCode(code int) {
+	l.shutdownLock.Lock()
+	defer l.shutdownLock.Unlock()
+	l.exitCode = code
+}
+
+/**
+ * Registers a callback called on the shutdown after a fatal message (e.g. to remove sockets or pid files)
+ *
+ * Callbacks are called in reverse order of their registration after the queued messages are written,
+ * messages logged by the callbacks are written before the process exits.
+ */
+func (l* Logger) OnShutdown(callback func()) {
+	l.shutdownLock.Lock()
+	defer l.shutdownLock.Unlock()
+	l.shutdownCallbacks = append(l.shutdownCallbacks, callback)
+}
+
+/**
+ * Blocks until all messages queued before are written
+ */
+func (l* Logger) Flush() {
+	flushed := make(chan struct{})
+	if !l.send(&LogMessage{flushed: flushed}) {
+		return
 	}
-	l.logChan<-&LogMessage{msg, debuginfo, ERROR}
+	<-flushed
 }
 
-func (l* Logger) LogWarn(msg string) {
-	if l.logLevel>ERROR {
-		debuginfo := ""
-		if l.logDebug {
-			debuginfo = l.getDebugInfo(2)
+/**
+ * Queues the message for the log worker, returns false if the logger is closed
+ */
+func (l* Logger) send(msg *LogMessage) bool {
+	l.logChanLock.RLock()
+	defer l.logChanLock.RUnlock()
+	if l.logChanClosed {
+		return false
+	}
+	l.logChan<-msg
+	return true
+}
+
+/**
+ * Logs the message, runs the shutdown callbacks (see OnShutdown) and exits the process with the exit code (see SetExitCode)
+ *
+ * Queued messages are written before the process exits.
+ * Fatal messages logged while the shutdown runs (e.g. by a shutdown callback or another goroutine) are written
+ * and exit the process immediately, the remaining callbacks are skipped.
+ */
+func (l* Logger) LogFatal(msg string) {
+	l.enqueue(FATAL, msg, nil)
+	l.shutdown()
+}
+
+/**
+ * Writes the queued messages, runs the shutdown callbacks and exits the process
+ */
+func (l* Logger) shutdown() {
+	l.shutdownLock.Lock()
+	callbacks, code, running := l.shutdownCallbacks, l.exitCode, l.shuttingDown
+	l.shuttingDown = true
+	l.shutdownLock.Unlock()
+	if !running {
+		l.Flush()
+		for i := len(callbacks)-1; i>=0; i-- {
+			callbacks[i]()
 		}
-		l.logChan<-&LogMessage{msg, debuginfo, WARN}
 	}
+	// Fatal messages during the running shutdown (e.g. of a callback) exit directly, waiting for the shutdown would deadlock
+	l.Flush()
+	l.logFile.Sync()
+	os.Exit(code)
+}
+
+func (l* Logger) LogError(msg string) {
+	l.enqueue(ERROR, msg, nil)
+}
+
+func (l* Logger) LogWarn(msg string) {
+	l.enqueue(WARN, msg, nil)
 }
 
 func (l* Logger) LogInfo(msg string) {
-	if l.logLevel>WARN {
-		debuginfo := ""
-		if l.logDebug {
-			debuginfo = l.getDebugInfo(2)
-		}
-		l.logChan<-&LogMessage{msg, debuginfo, INFO}
+	l.enqueue(INFO, msg, nil)
+}
+
+func (l* Logger) LogDebug(msg string) {
+	l.enqueue(DEBUG, msg, nil)
+}
+
+func (l* Logger) LogTrace(msg string) {
+	l.enqueue(TRACE, msg, nil)
+}
+
+/**
+ * Logs the message with structured fields at the level
+ *
+ * Fields are encoded as object in the JSON format and as key=value pairs in the text format (see SetFormat).
+ * A FATAL message shuts the process down (see LogFatal).
+ */
+func (l* Logger) LogFields(level LOGLEVEL, msg string, fields map[string]any) {
+	l.enqueue(level, msg, fields)
+	if level==FATAL {
+		l.shutdown()
+	}
+}
+
+/**
+ * Queues the message if its level is enabled
+ *
+ * Must be called directly by the exported log function, so that the caller of the logger is recorded.
+ */
+func (l* Logger) enqueue(level LOGLEVEL, msg string, fields map[string]any) {
+	if !l.Enabled(level) {
+		return
+	}
+	message := &LogMessage{message: msg, loglevel: level, fields: fields, time: time.Now()}
+	if l.logDebug {
+		message.debuginfo = l.getDebugInfo(2)
+	}
+	if l.SinkFormat(SINK_FILE)!=LOG_FORMAT_TEXT||(l.logToStd&&l.SinkFormat(SINK_STD)!=LOG_FORMAT_TEXT) {
+		message.caller = logCaller(3)
+	}
+	if !l.send(message) {
+		// Closed logger, the message is not lost (e.g. the reason of a fatal message)
+		os.Stderr.Write(encodeMessage(message, l.SinkFormat(SINK_STD)))
 	}
 }
 
+/**
+ * Checks if messages of the level are logged, so that expensive messages are only built if needed
+ */
+func (l* Logger) Enabled(level LOGLEVEL) bool {
+	return level<=ERROR||level<=l.logLevel
+}
+
 func (l* Logger) getDebugInfo(stackdepth int) string {
 	debuginfo := "[ RUNTIME INFORMATION ]:\n"
 	// Get stack information from the callerstack + stackdepth
@@ -119,52 +364,77 @@ func (l* Logger) getDebugInfo(stackdepth int) string {
 }
 
 func (l* Logger) log(msg *LogMessage) {
-	outstr := time.Now().Format("\n[ 05:04:15 - 02.01.2006 ]\n")
+	if _, err := l.logFile.Write(encodeMessage(msg, l.SinkFormat(SINK_FILE))); err!=nil {
+		l.reportFileError(err)
+	} else {
+		l.logFileErr = ""
+	}
+	if l.logToStd {
+		entry := encodeMessage(msg, l.SinkFormat(SINK_STD))
+		if msg.loglevel<=WARN {
+			os.Stderr.Write(entry)
+		} else {
+			os.Stdout.Write(entry)
+		}
+	}
+}
+
+/**
+ * Reports a failure of the log file on stderr, repeated failures are only reported once
+ *
+ * A failed rotation is retried on every write, reporting each of them would flood stderr.
+ */
+func (l* Logger) reportFileError(err error) {
+	if err.Error()==l.logFileErr {
+		return
+	}
+	l.logFileErr = err.Error()
+	fmt.Fprintf(os.Stderr, "Failed to write log file: %v\n", err)
+}
+
+/**
+ * Encodes the message as multi-line text block
+ */
+func textEntry(msg *LogMessage) []byte {
+	outstr := msg.time.Format("\n[ 05:04:15 - 02.01.2006 ]\n")
 	switch msg.loglevel {
+	case FATAL:
+		outstr += "[ FATAL ]:\n"
 	case ERROR:
 		outstr += "[ ERROR ]:\n"
-		outstr += msg.message
-		outstr += "\n"
-		outstr += msg.debuginfo
-		outstr += "\n"
-		l.logFile.Write([]byte(outstr))
-		if l.logToStd {
-			os.Stderr.Write([]byte(outstr))
-		}
 	case WARN:
 		outstr += "[ WARNING ]:\n"
-		outstr += msg.message
-		outstr += "\n"
-		outstr += msg.debuginfo
-		outstr += "\n"
-		l.logFile.Write([]byte(outstr))
-		if l.logToStd {
-			os.Stderr.Write([]byte(outstr))
-		}
 	case INFO:
 		outstr += "[ INFORMATION ]:\n"
-		outstr += msg.message
-		outstr += "\n"
-		outstr += msg.debuginfo
-		outstr += "\n"
-		l.logFile.Write([]byte(outstr))
-		if l.logToStd {
-			os.Stdout.Write([]byte(outstr))
-		}
+	case DEBUG:
+		outstr += "[ DEBUG ]:\n"
+	case TRACE:
+		outstr += "[ TRACE ]:\n"
 	}
+	outstr += msg.message + textFields(msg.fields)
+	outstr += "\n"
+	outstr += msg.debuginfo
+	outstr += "\n"
+	return []byte(outstr)
 }
 
 
 func (l* Logger) startLogWorker() {
+	defer close(l.logDone)
 	for {
 		select {
 		case msg, ok := <-l.logChan:
 			if ok {
+				if msg.flushed!=nil {
+					close(msg.flushed)
+					continue
+				}
 				if len(l.logChan) > l.logChanThreshold {
 					l.log(&LogMessage{
-						"Log Queue is under high pressure!",
-						l.getDebugInfo(1),
-						WARN,
+						message: "Log Queue is under high pressure!",
+						debuginfo: l.getDebugInfo(1),
+						loglevel: WARN,
+						time: time.Now(),
 					})
 				}
 				l.log(msg)
@@ -0,0 +1,379 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Interval at which a RotatingFile is rotated regardless of its size
+ */
+type ROTATEINTERVAL int
+const (
+	// Only rotated by size
+	ROTATE_NEVER ROTATEINTERVAL = iota
+	// Rotated on the first write of a new day (local time)
+	ROTATE_DAILY
+	// Rotated on the first write of a new week, weeks start on monday (local time)
+	ROTATE_WEEKLY
+)
+
+/**
+ * Parses the name of an interval case-insensitively ("never" or empty, "daily", "weekly")
+ */
+func ParseRotateInterval(name string) (ROTATEINTERVAL, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "never":
+		return ROTATE_NEVER, nil
+	case "daily":
+		return ROTATE_DAILY, nil
+	case "weekly":
+		return ROTATE_WEEKLY, nil
+	default:
+		return ROTATE_NEVER, fmt.Errorf("Unknown rotation interval '%s'", name)
+	}
+}
+
+/**
+ * Rotation and retention of a RotatingFile
+ */
+type RotationPolicy struct {
+	// Rotate before a write would exceed the size in bytes (disabled if <= 0),
+	// exceeded by the writes during a running compression of the backups
+	MaxSize int64
+	// Rotate on the first write of a new day or week
+	Interval ROTATEINTERVAL
+	// Number of rotated files kept
+	Backups int
+	// Rotated files last written longer ago are removed (disabled if <= 0)
+	MaxAge time.Duration
+	// Rotated files are compressed with gzip (<path>.N.gz) in the background after the rotation
+	Compress bool
+	// The most recent rotated file (<path>.1) is left uncompressed until the next rotation
+	DelayCompress bool
+}
+
+/**
+ * Append-only file rotated by size or age (see RotationPolicy)
+ *
+ * On rotation the file is renamed to <path>.1, older backups are shifted (<path>.1 to <path>.2, ...)
+ * and backups beyond the backup count or the maximum age are removed.
+ * Compressed backups (<path>.N.gz) are shifted and removed the same way.
+ * RotatingFile is safe for concurrent use, every Write is appended in one piece.
+ */
+type RotatingFile struct {
+	lock sync.Mutex
+	path string
+	policy RotationPolicy
+	// Current file (nil if it could not be reopened after a rotation, see reopen)
+	file *os.File
+	// Closed by Close, subsequent writes fail with os.ErrClosed
+	closed bool
+	size int64
+	// Start of the interval the current file was written in
+	period time.Time
+	// Closed when the running background compression of the backups completes (nil if none is running)
+	compressDone chan struct{}
+	// Failures of the background compression, reported by the next Write, Rotate or Close
+	compressErr error
+}
+
+/**
+ * Opens (or creates with mode 0600) the file at the path
+ *
+ * The file is rotated before a write would exceed maxSize bytes, pass a maxSize <= 0 to disable the rotation.
+ * Backups holds the number of rotated files kept.
+ */
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	return OpenRotatingFileWithPolicy(path, RotationPolicy{MaxSize: maxSize, Backups: backups})
+}
+
+/**
+ * Opens (or creates with mode 0600) the file at the path, rotated according to the policy
+ *
+ * A file last written in an earlier interval is rotated on the first write.
+ * Uncompressed backups left by an earlier process are compressed if the policy enables compression.
+ */
+func OpenRotatingFileWithPolicy(path string, policy RotationPolicy) (*RotatingFile, error) {
+	// Create file path if not existent
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err!=nil {
+		return nil, err
+	}
+	r := &RotatingFile{path: path, policy: policy}
+	if err := r.open(); err!=nil {
+		return nil, err
+	}
+	r.prune()
+	r.compressBackups()
+	return r, nil
+}
+
+/**
+ * Replaces the policy of the file, backups exceeding the new limits are removed immediately
+ *
+ * Waits for a running compression of the backups before the policy is replaced.
+ */
+func (r* RotatingFile) SetPolicy(policy RotationPolicy) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waitCompression()
+	r.policy = policy
+	r.prune()
+	r.compressBackups()
+}
+
+/**
+ * Returns the current policy of the file
+ */
+func (r* RotatingFile) Policy() RotationPolicy {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.policy
+}
+
+func (r* RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err!=nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err!=nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.period = periodStart(time.Now(), r.policy.Interval)
+	if r.size>0 {
+		r.period = periodStart(info.ModTime(), r.policy.Interval)
+	}
+	return nil
+}
+
+/**
+ * Appends the data to the file, rotating it first if it would exceed the maximum size
+ *
+ * If the rotation fails, the data is still appended to the unrotated file and the rotation error is returned,
+ * the rotation is retried on the next write.
+ * While backups are compressed, the rotation is postponed to the first write after the compression completed,
+ * so that writers never wait for the compression.
+ */
+func (r* RotatingFile) Write(data []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.reopen(); err!=nil {
+		return 0, err
+	}
+	var rotateErr error
+	if r.compressDone==nil&&r.size>0&&(r.policy.MaxSize>0&&r.size+int64(len(data))>r.policy.MaxSize||r.expired(time.Now())) {
+		if rotateErr = r.rotate(); r.file==nil {
+			return 0, errors.Join(rotateErr, r.takeCompressErr())
+		}
+	}
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	if err!=nil {
+		return n, err
+	}
+	return n, errors.Join(rotateErr, r.takeCompressErr())
+}
+
+/**
+ * Rotates the file regardless of its size (e.g. on request of an external log rotation)
+ *
+ * Waits for a running compression of the backups before the file is rotated.
+ */
+func (r* RotatingFile) Rotate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waitCompression()
+	if err := r.reopen(); err!=nil {
+		return errors.Join(err, r.takeCompressErr())
+	}
+	return errors.Join(r.rotate(), r.takeCompressErr())
+}
+
+/**
+ * Opens the file again if a previous rotation could not reopen it
+ *
+ * Returns os.ErrClosed if the file was closed with Close.
+ */
+func (r* RotatingFile) reopen() error {
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.file==nil {
+		return r.open()
+	}
+	return nil
+}
+
+/**
+ * Rotates the file, the file is reopened even if the rotation fails (see Write)
+ *
+ * Must not be called while backups are compressed, the compression reads the backups without the lock.
+ */
+func (r* RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err==nil {
+		err = r.shift()
+	}
+	// Reopened in append mode, so that a failed rotation keeps writing to the unrotated file
+	if openErr := r.open(); openErr!=nil||err!=nil {
+		return errors.Join(err, openErr)
+	}
+	// The new file belongs to the current interval, even if it was modified externally
+	r.period = periodStart(time.Now(), r.policy.Interval)
+	r.prune()
+	r.compressBackups()
+	return nil
+}
+
+/**
+ * Moves the file to the first backup and shifts the older backups (removes the file without backups)
+ */
+func (r* RotatingFile) shift() error {
+	if r.policy.Backups<=0 {
+		if err := os.Remove(r.path); err!=nil&&!os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		os.Remove(r.backup(r.policy.Backups))
+		os.Remove(r.backup(r.policy.Backups) + ".gz")
+		for i := r.policy.Backups-1; i>0; i-- {
+			if err := os.Rename(r.backup(i), r.backup(i+1)); err!=nil&&!os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Rename(r.backup(i) + ".gz", r.backup(i+1) + ".gz"); err!=nil&&!os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(r.path, r.backup(1)); err!=nil&&!os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Returns the path of the nth backup
+ */
+func (r* RotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+/**
+ * Checks if the current file was written in an earlier interval than now
+ */
+func (r* RotatingFile) expired(now time.Time) bool {
+	if r.policy.Interval==ROTATE_NEVER {
+		return false
+	}
+	return periodStart(now, r.policy.Interval).After(r.period)
+}
+
+/**
+ * Removes the backups beyond the backup count and the backups older than the maximum age
+ *
+ * Backups are shifted on rotation, so that every backup is older than the one before it.
+ */
+func (r* RotatingFile) prune() {
+	keep := max(r.policy.Backups, 0)
+	if r.policy.MaxAge>0 {
+		cutoff := time.Now().Add(-r.policy.MaxAge)
+		for i := 1; i<=keep; i++ {
+			info, err := os.Stat(r.backup(i))
+			if err!=nil {
+				// Compressed backups keep the modification time of the rotated file
+				if info, err = os.Stat(r.backup(i) + ".gz"); err!=nil {
+					continue
+				}
+			}
+			if info.ModTime().Before(cutoff) {
+				keep = i-1
+				break
+			}
+		}
+	}
+	// Backups of a previously larger backup count are removed aswell
+	for i := keep+1; ; i++ {
+		errPlain := os.Remove(r.backup(i))
+		errGzip := os.Remove(r.backup(i) + ".gz")
+		if errPlain!=nil&&errGzip!=nil {
+			break
+		}
+	}
+}
+
+/**
+ * Returns the start of the interval containing t (t if the interval is ROTATE_NEVER)
+ */
+func periodStart(t time.Time, interval ROTATEINTERVAL) time.Time {
+	switch interval {
+	case ROTATE_DAILY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case ROTATE_WEEKLY:
+		// Days since monday
+		offset := (int(t.Weekday())+6)%7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+	default:
+		return t
+	}
+}
+
+/**
+ * Commits the current file to stable storage
+ */
+func (r* RotatingFile) Sync() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file==nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+/**
+ * Closes the file, subsequent writes fail with os.ErrClosed
+ *
+ * Waits for a running compression of the backups to complete and returns its failures aswell.
+ */
+func (r* RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// Set before waiting, so that no rotation starts another compression in the meantime
+	r.closed = true
+	r.waitCompression()
+	if r.file==nil {
+		return r.takeCompressErr()
+	}
+	err := r.file.Close()
+	r.file = nil
+	return errors.Join(err, r.takeCompressErr())
+}
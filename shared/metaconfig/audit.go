@@ -0,0 +1,174 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"time"
+)
+
+/**
+ * Record of a single mutation of the inmem config
+ */
+type Change struct {
+	// Time of the mutation
+	Time time.Time `json:"time"`
+	// Mutated key
+	Key string `json:"key"`
+	// Value before the mutation (empty if the key did not exist)
+	Old string `json:"old"`
+	// Value after the mutation (empty if the key was deleted)
+	New string `json:"new"`
+	// True if the key was removed
+	Deleted bool `json:"deleted"`
+	// Origin of the mutation
+	Source Source `json:"source"`
+	// Layer the mutation was applied to
+	Layer string `json:"layer"`
+	// Identity of the remote client that caused the mutation (empty for local mutations)
+	Actor string `json:"actor,omitempty"`
+}
+
+/**
+ * Ring buffer holding the most recent changes
+ */
+type auditRing struct {
+	records []Change
+	// Index of the next record to write
+	next int
+	// True once the buffer wrapped around
+	full bool
+}
+
+/**
+ * Enables the in-memory audit trail
+ *
+ * The most recent size mutations are kept in a ring buffer, older records are discarded.
+ * Passing size <= 0 disables the audit trail and drops all records.
+ */
+func (m* MetaConfig) EnableAudit(size int) {
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+
+	if size<=0 {
+		m.audit = nil
+	} else {
+		m.audit = &auditRing{records: make([]Change, size)}
+	}
+}
+
+/**
+ * Returns the recorded changes ordered from oldest to newest
+ *
+ * Values of redacted keys are replaced by REDACTED_VALUE.
+ *
+ * If the audit trail is disabled, it will return an empty list
+ */
+func (m* MetaConfig) AuditLog() []Change {
+	m.auditLock.RLock()
+	var records []Change
+	if m.audit!=nil {
+		if m.audit.full {
+			records = append(records, m.audit.records[m.audit.next:]...)
+		}
+		records = append(records, m.audit.records[:m.audit.next]...)
+	}
+	m.auditLock.RUnlock()
+
+	m.redactLock.RLock()
+	defer m.redactLock.RUnlock()
+	for i := range records {
+		if m.redacted[records[i].Key] {
+			records[i].Old = REDACTED_VALUE
+			records[i].New = REDACTED_VALUE
+		}
+	}
+	return records
+}
+
+/**
+ * Records changes of a mutation, increases the version and notifies the watchers
+ *
+ * The caller must hold the config write lock, so that changes are recorded in mutation order.
+ */
+func (m* MetaConfig) recordChanges(changes []Change) {
+	if len(changes)==0 {
+		return
+	}
+	version := m.allocateVersion()
+	m.recordChangesAt(changes, version)
+	m.version.Store(version)
+}
+
+/**
+ * Allocates the version of a mutation
+ *
+ * Versions of concurrent writers are allocated in the order they enter the store (see configStore.pipeline).
+ */
+func (m* MetaConfig) allocateVersion() uint64 {
+	return m.sequence.Add(1)
+}
+
+/**
+ * Records changes of a mutation with the allocated version and notifies the watchers
+ *
+ * The caller must hold the config write lock or the shard locks of the changed keys (see configStore),
+ * so that the changes of a key are recorded in mutation order.
+ */
+func (m* MetaConfig) recordChangesAt(changes []Change, version uint64) {
+	if len(changes)==0 {
+		return
+	}
+	for _, change := range changes {
+		m.config.setVersion(change.Key, version)
+	}
+	m.notifyWatchers(changes)
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+
+	if m.audit!=nil {
+		for _, change := range changes {
+			m.audit.records[m.audit.next] = change
+			m.audit.next++
+			if m.audit.next==len(m.audit.records) {
+				m.audit.next = 0
+				m.audit.full = true
+			}
+		}
+	}
+}
+
+/**
+ * Computes the changes between two configurations
+ */
+func diffConfig(old map[string]string, new map[string]string, source Source, layer string) []Change {
+	now := time.Now()
+	var changes []Change
+	for k,v := range new {
+		if oldVal, exists := old[k]; !exists||oldVal!=v {
+			changes = append(changes, Change{now, k, oldVal, v, false, source, layer, ""})
+		}
+	}
+	for k,v := range old {
+		if _, exists := new[k]; !exists {
+			changes = append(changes, Change{now, k, v, "", true, source, layer, ""})
+		}
+	}
+	return changes
+}
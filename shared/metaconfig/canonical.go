@@ -0,0 +1,63 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"strings"
+)
+
+/**
+ * Canonicalizes keys to lowercase without surrounding whitespace
+ *
+ * Keys are canonicalized when parsed and on every operation that takes a key,
+ * so that e.g. "LogLevel" and "loglevel" address the same entry.
+ *
+ * If a file contains multiple spellings of the same key, only the first one is evaluated.
+ */
+func WithCanonicalKeys() Option {
+	return func(m *MetaConfig) {
+		m.canonical = true
+	}
+}
+
+/**
+ * Returns the key as it is stored in the inmem config (see WithCanonicalKeys)
+ */
+func (m* MetaConfig) CanonicalKey(key string) string {
+	return m.canonicalKey(key)
+}
+
+/**
+ * Returns the canonical form of the key if canonicalization is enabled
+ */
+func (m* MetaConfig) canonicalKey(key string) string {
+	if !m.canonical {
+		return key
+	}
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+/**
+ * Maps a parsed key to its canonical form and skips it if it doesn't match the loaded prefixes
+ */
+func (m* MetaConfig) parseKey(key string) (string, bool) {
+	key = m.canonicalKey(key)
+	return key, m.matchPrefixes(key)
+}
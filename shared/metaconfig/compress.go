@@ -0,0 +1,92 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+/**
+ * Maximum size in bytes of decompressed config content (64 MiB)
+ *
+ * Bounds the memory used to read compressed config files, so that a small crafted file
+ * cannot expand to an arbitrary size (gzip compresses repetitive content by up to ~1000:1).
+ */
+const MAX_DECOMPRESSED_SIZE int64 = 64 << 20
+
+/**
+ * Enables gzip compression of config files
+ *
+ * If enabled, WriteToDisk stores the config file gzip-compressed.
+ *
+ * Compressed files are detected by their magic bytes on ReadFromDisk,
+ * so files can be read regardless of this option.
+ */
+func (m* MetaConfig) SetCompression(enabled bool) {
+	m.lockConfigFile()
+	defer m.configFileLock.Unlock()
+
+	m.compress = enabled
+}
+
+/**
+ * Returns true if the content starts with the gzip magic bytes
+ */
+func isCompressed(content []byte) bool {
+	return len(content)>=2&&content[0]==0x1f&&content[1]==0x8b
+}
+
+/**
+ * Compresses the content with gzip
+ */
+func compressContent(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(content); err!=nil {
+		return nil, err
+	}
+	if err := writer.Close(); err!=nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/**
+ * Decompresses gzip content, content expanding beyond MAX_DECOMPRESSED_SIZE is rejected
+ */
+func decompressContent(content []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err!=nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// Reads one byte beyond the maximum to detect oversized content
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MAX_DECOMPRESSED_SIZE+1))
+	if err!=nil {
+		return nil, err
+	}
+	if int64(len(decompressed))>MAX_DECOMPRESSED_SIZE {
+		return nil, fmt.Errorf("Decompressed content exceeds the maximum size of %d bytes", MAX_DECOMPRESSED_SIZE)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,100 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+/**
+ * Error returned by WriteToDisk if the config file was modified externally (see WithConflictDetection)
+ */
+var ErrConflict = errors.New("Config file was modified on disk since it was last read or written")
+
+/**
+ * State of the config file when it was last read or written
+ */
+type fileStamp struct {
+	modTime time.Time
+	size int64
+	checksum [sha256.Size]byte
+}
+
+/**
+ * Detects external modifications of the config file on write
+ *
+ * The state of the config file is recorded on every ReadFromDisk and WriteToDisk.
+ * If the file was modified in the meantime (e.g. manual edits by an operator),
+ * WriteToDisk fails with ErrConflict instead of overwriting the modifications.
+ *
+ * To resolve the conflict, call ReadFromDisk to load the external modifications
+ * (discarding unsaved inmem changes) and apply the inmem changes again.
+ *
+ * Touching the file without changing its content is not considered a conflict.
+ */
+func WithConflictDetection() Option {
+	return func(m *MetaConfig) {
+		m.conflictDetection = true
+	}
+}
+
+/**
+ * Creates a stamp of the config file content
+ *
+ * The file is stat'ed before it's read, if it is modified in between,
+ * the modification time is outdated and checkConflict falls back to the checksum.
+ */
+func newFileStamp(info os.FileInfo, content []byte) *fileStamp {
+	return &fileStamp{info.ModTime(), info.Size(), sha256.Sum256(content)}
+}
+
+/**
+ * Returns ErrConflict if the config file differs from the last recorded stamp
+ *
+ * The caller must hold the config file lock.
+ */
+func (m* MetaConfig) checkConflict() error {
+	stamp := m.stamp.Load()
+	if !m.conflictDetection||stamp==nil {
+		return nil
+	}
+	info, err := os.Stat(m.configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Can't write config file at: %s\n%w (file was removed)", m.configPath, ErrConflict)
+	} else if err!=nil {
+		return err
+	}
+	// Skip the checksum if the file was evidently not touched
+	if info.ModTime().Equal(stamp.modTime)&&info.Size()==stamp.size {
+		return nil
+	}
+	content, err := os.ReadFile(m.configPath)
+	if err!=nil {
+		return err
+	}
+	if sha256.Sum256(content)!=stamp.checksum {
+		return fmt.Errorf("Can't write config file at: %s\n%w", m.configPath, ErrConflict)
+	}
+	return nil
+}
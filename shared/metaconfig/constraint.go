@@ -0,0 +1,150 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Declarative constraint for a config value
+ *
+ * Constraints are part of the schema entry of a key (see KeySchema, Constrain).
+ */
+type Constraint struct {
+	// Human readable rule (e.g. "one of [error, warn]"), included in the schema
+	Rule string
+	// Returns an error describing the violation if the value does not satisfy the constraint
+	Check func(value string) error
+}
+
+func (c Constraint) String() string {
+	return c.Rule
+}
+
+/**
+ * Constrains the values of a key
+ *
+ * The constraints are layered on top of the schema: they are kept separate from the registered schema,
+ * so SetSchema never drops them, and are added to the schema entry of the key by Schema and CheckSchema.
+ * Constraining a key does not register a schema, CheckSchema only rejects unknown keys if SetSchema was called.
+ *
+ * Like validators, constraints are enforced on every Set* operation and on ReadFromDisk.
+ *
+ * All constraints are evaluated, violations are aggregated into one error.
+ *
+ * Example:
+ *
+ * ```
+ * cfg.Constrain("loglevel", metaconfig.Enum("error", "warn", "info"))
+ * cfg.Constrain("port", metaconfig.Range(1, 65535))
+ * ```
+ */
+func (m* MetaConfig) Constrain(key string, constraints ...Constraint) {
+	m.validatorLock.Lock()
+	defer m.validatorLock.Unlock()
+
+	if m.constraints==nil {
+		m.constraints = make(map[string][]Constraint)
+	}
+	key = m.canonicalKey(key)
+	// Copied, so that schemas returned by Schema are not modified
+	m.constraints[key] = append(append([]Constraint{}, m.constraints[key]...), constraints...)
+}
+
+/**
+ * Returns the constraints of the schema entry and the constraints added with Constrain, the validator lock must be held
+ */
+func (m* MetaConfig) keyConstraints(key string) []Constraint {
+	schemaConstraints := m.schema[key].Constraints
+	if len(m.constraints[key])<1 {
+		return schemaConstraints
+	}
+	return append(append([]Constraint{}, schemaConstraints...), m.constraints[key]...)
+}
+
+/**
+ * Evaluates the constraints against the value, violations are joined together
+ */
+func checkConstraints(key string, constraints []Constraint, value string) error {
+	var violations []error
+	for _, constraint := range constraints {
+		if err := constraint.Check(value); err!=nil {
+			violations = append(violations, fmt.Errorf("Constraint violation on key '%s': %w", key, err))
+		}
+	}
+	return errors.Join(violations...)
+}
+
+/**
+ * Constraint that only allows the specified values
+ */
+func Enum(values ...string) Constraint {
+	rule := fmt.Sprintf("one of [%s]", strings.Join(values, ", "))
+	return Constraint{Rule: rule, Check: func(value string) error {
+		for _, allowed := range values {
+			if value==allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("value '%s' is not %s", value, rule)
+	}}
+}
+
+/**
+ * Constraint that only allows numeric values in the range [min, max]
+ */
+func Range(min float64, max float64) Constraint {
+	rule := fmt.Sprintf("in range [%g, %g]", min, max)
+	return Constraint{Rule: rule, Check: func(value string) error {
+		numval, err := strconv.ParseFloat(value, 64)
+		if err!=nil {
+			return fmt.Errorf("value '%s' is not numeric", value)
+		}
+		// NaN fails no comparison, so it would pass every range
+		if math.IsNaN(numval)||numval<min||numval>max {
+			return fmt.Errorf("value '%s' is not %s", value, rule)
+		}
+		return nil
+	}}
+}
+
+/**
+ * Constraint that only allows values matching the regular expression
+ *
+ * The expression must match the whole value.
+ *
+ * Like regexp.MustCompile, this panics if the expression cannot be parsed.
+ */
+func Regexp(expr string) Constraint {
+	re := regexp.MustCompile("^(?:" + expr + ")$")
+	rule := fmt.Sprintf("matches '%s'", expr)
+	return Constraint{Rule: rule, Check: func(value string) error {
+		if !re.MatchString(value) {
+			return fmt.Errorf("value '%s' does not match '%s'", value, expr)
+		}
+		return nil
+	}}
+}
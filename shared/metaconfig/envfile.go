@@ -0,0 +1,235 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**
+ * Imports a systemd EnvironmentFile / dotenv file into the inmem config
+ *
+ * Supported syntax:
+ *
+ * ```
+ * # Comment
+ * KEY=unquoted value # trailing comment
+ * export KEY2="double quoted, supports \n \" \\ escapes"
+ * KEY3='single quoted, taken literally' # trailing comment
+ * KEY4=continued \
+ * on the next line
+ * ```
+ *
+ * Keys are imported as they are, existing keys are overwritten.
+ * Anything but a comment after the closing quote of a quoted value is rejected.
+ *
+ * The import is all-or-nothing, if a line can't be parsed
+ * or a value is rejected by a registered validator, nothing is applied.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) ImportEnvFile(path string) error {
+	file, err := os.Open(path)
+	if err!=nil {
+		return err
+	}
+	defer file.Close()
+
+	mapBuffer, err := parseEnvFile(bufio.NewScanner(file), path)
+	if err!=nil {
+		return err
+	}
+	if _, err := m.setMany(mapBuffer, SOURCE_FILE, false, "", nil, nil); err!=nil {
+		return fmt.Errorf("Failed to import env file at: %s\n%w", path, err)
+	}
+	return nil
+}
+
+/**
+ * Parses dotenv lines into a key-value map
+ *
+ * Path is only used for error messages.
+ */
+func parseEnvFile(scanner *bufio.Scanner, path string) (map[string]string, error) {
+	mapBuffer := make(map[string]string)
+	lineCount := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineCount++
+		// Join continuation lines
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			line = strings.TrimSuffix(line, "\\") + scanner.Text()
+			lineCount++
+		}
+
+		line = strings.TrimSpace(line)
+		if line==""||strings.HasPrefix(line, "#")||strings.HasPrefix(line, ";") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, rawVal, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found||key=="" {
+			return nil, &ParseError{path, lineCount, "Expected KEY=VALUE"}
+		}
+		value, err := parseEnvValue(strings.TrimSpace(rawVal))
+		if err!=nil {
+			return nil, &ParseError{path, lineCount, err.Error()}
+		}
+		mapBuffer[key] = value
+	}
+	if err := scanner.Err(); err!=nil {
+		return nil, err
+	}
+	return mapBuffer, nil
+}
+
+/**
+ * Parses a single dotenv value (quoted or unquoted)
+ *
+ * A quoted value may only be followed by whitespace and a comment.
+ */
+func parseEnvValue(raw string) (string, error) {
+	if raw=="" {
+		return "", nil
+	}
+	switch raw[0] {
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end<0 {
+			return "", errors.New("Unterminated single quote")
+		}
+		if err := checkEnvTrailing(raw[end+2:]); err!=nil {
+			return "", err
+		}
+		return raw[1:end+1], nil
+	case '"':
+		var val strings.Builder
+		for i := 1; i<len(raw); i++ {
+			c := raw[i]
+			if c=='"' {
+				if err := checkEnvTrailing(raw[i+1:]); err!=nil {
+					return "", err
+				}
+				return val.String(), nil
+			} else if c=='\\'&&i+1<len(raw) {
+				i++
+				switch raw[i] {
+				case 'n':
+					val.WriteByte('\n')
+				case 't':
+					val.WriteByte('\t')
+				case 'r':
+					val.WriteByte('\r')
+				default:
+					val.WriteByte(raw[i])
+				}
+				continue
+			}
+			val.WriteByte(c)
+		}
+		return "", errors.New("Unterminated double quote")
+	default:
+		// Strip trailing comment of unquoted values
+		if idx := strings.Index(raw, " #"); idx>=0 {
+			raw = raw[:idx]
+		}
+		return strings.TrimSpace(raw), nil
+	}
+}
+
+/**
+ * Rejects anything but whitespace and a comment after the closing quote of a value
+ */
+func checkEnvTrailing(rest string) error {
+	if trailing := strings.TrimSpace(rest); trailing!=""&&!strings.HasPrefix(trailing, "#") {
+		return fmt.Errorf("Unexpected '%s' after closing quote", trailing)
+	}
+	return nil
+}
+
+/**
+ * Writes the full configuration in shell-sourceable env format to the writer
+ *
+ * Every key is emitted as `export <EnvName(prefix, key)>='value'` line, sorted by key.
+ * Single quotes inside values are escaped, so the output can be sourced safely.
+ *
+ * Redacted values are replaced by REDACTED_VALUE.
+ *
+ * Distinct keys mapping to the same variable name (e.g. "a.b" and "a_b") are rejected before anything is written,
+ * sourcing the output would silently keep only one of them.
+ * Variable names that are no valid shell identifiers ([A-Za-z_][A-Za-z0-9_]*),
+ * e.g. because the key starts with a digit or the prefix contains invalid chars, are rejected the same way.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) ExportEnv(w io.Writer, prefix string) error {
+	config := m.GetRedactedConfig()
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	names := make([]string, len(keys))
+	owners := make(map[string]string, len(keys))
+	for i, k := range keys {
+		names[i] = EnvName(prefix, k)
+		if !isEnvName(names[i]) {
+			return fmt.Errorf("Key '%s' maps to the invalid environment variable name '%s'", k, names[i])
+		}
+		if owner, exists := owners[names[i]]; exists {
+			return fmt.Errorf("Keys '%s' and '%s' map to the same environment variable '%s'", owner, k, names[i])
+		}
+		owners[names[i]] = k
+	}
+
+	writer := bufio.NewWriter(w)
+	for i, k := range keys {
+		quoted := "'" + strings.ReplaceAll(config[k], "'", "'\\''") + "'"
+		if _, err := writer.WriteString("export " + names[i] + "=" + quoted + "\n"); err!=nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+/**
+ * Checks if the name is a valid shell identifier ([A-Za-z_][A-Za-z0-9_]*)
+ */
+func isEnvName(name string) bool {
+	if name=="" {
+		return false
+	}
+	for i, c := range []byte(name) {
+		if c=='_'||(c>='a'&&c<='z')||(c>='A'&&c<='Z')||(i>0&&c>='0'&&c<='9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
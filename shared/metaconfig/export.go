@@ -0,0 +1,129 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metaconfig
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+)
+
+/**
+ * Formats supported by Export
+ */
+const EXPORT_JSON string = "json"
+const EXPORT_YAML string = "yaml"
+const EXPORT_NATIVE string = "native"
+
+var ErrUnknownFormat = errors.New("Unknown export format")
+
+/**
+ * Writes the full configuration in the format to the writer
+ *
+ * EXPORT_JSON writes a JSON object (see ExportJSON), EXPORT_YAML a flat YAML mapping with double-quoted strings
+ * and EXPORT_NATIVE the config file syntax (without profile sections), which can be loaded as config file.
+ * Keys are sorted, keys for which keep returns false are omitted (nil keeps every key).
+ * The pairs are written one by one, so that large configurations are streamed instead of serialized in memory.
+ *
+ * Redacted values are replaced by REDACTED_VALUE.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Export(w io.Writer, format string, keep func(key string) bool) error {
+	return m.ExportMapped(w, format, func(key string) (string, bool) {
+		return key, keep==nil||keep(key)
+	})
+}
+
+/**
+ * Writes the configuration like Export with every key replaced by the key returned by mapKey
+ *
+ * Keys for which mapKey returns false are omitted, e.g. to export a key space without its prefix.
+ * If multiple keys are mapped to the same key, only one of them is written.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) ExportMapped(w io.Writer, format string, mapKey func(key string) (string, bool)) error {
+	if _, supported := exportFormats[format]; !supported {
+		return ErrUnknownFormat
+	}
+	type pair struct {
+		key string
+		value string
+	}
+	var pairs []pair
+	for k, v := range m.GetRedactedConfig() {
+		if mapped, keep := mapKey(k); keep {
+			pairs = append(pairs, pair{mapped, v})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].key < pairs[j].key
+	})
+
+	// Pairs are serialized one by one into the buffered writer,
+	// so that the serialized configuration is never held in memory as a whole
+	writer := bufio.NewWriter(w)
+	if format==EXPORT_JSON {
+		writer.WriteString("{")
+	}
+	written := 0
+	for i, p := range pairs {
+		if i>0&&pairs[i-1].key==p.key {
+			continue
+		}
+		switch format {
+		case EXPORT_JSON:
+			if written>0 {
+				writer.WriteString(",")
+			}
+			writer.WriteString("\n  " + quoteJSON(p.key) + ": " + quoteJSON(p.value))
+		case EXPORT_YAML:
+			// Go escapes are a subset of the YAML double-quoted escapes
+			writer.WriteString(strconv.Quote(p.key) + ": " + strconv.Quote(p.value) + "\n")
+		case EXPORT_NATIVE:
+			writer.WriteString(serializePair(p.key, p.value))
+		}
+		written++
+	}
+	switch {
+	case format==EXPORT_JSON&&written>0:
+		writer.WriteString("\n}\n")
+	case format==EXPORT_JSON:
+		writer.WriteString("}\n")
+	case format==EXPORT_YAML&&written==0:
+		writer.WriteString("{}\n")
+	}
+	return writer.Flush()
+}
+
+var exportFormats = map[string]bool{EXPORT_JSON: true, EXPORT_YAML: true, EXPORT_NATIVE: true}
+
+/**
+ * Returns the string as JSON string like encoding/json (including its HTML escaping)
+ */
+func quoteJSON(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
@@ -0,0 +1,84 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"errors"
+	"time"
+)
+
+/**
+ * Error returned by every mutation of a frozen MetaConfig
+ */
+var ErrFrozen = errors.New("MetaConfig is frozen and can't be modified")
+
+/**
+ * Makes the MetaConfig immutable
+ *
+ * After Freeze, every mutation (Set*, layer changes, imports, ReadFromDisk) returns ErrFrozen.
+ * Read operations no longer acquire the config lock.
+ *
+ * Freezing is irreversible.
+ */
+func (m* MetaConfig) Freeze() {
+	// Wait for running mutations to complete
+	m.lockConfig()
+	defer m.configLock.Unlock()
+	m.frozen.Store(true)
+}
+
+/**
+ * Returns true if the MetaConfig is frozen
+ */
+func (m* MetaConfig) IsFrozen() bool {
+	return m.frozen.Load()
+}
+
+/**
+ * Acquire write lock on the inmem config for a mutation
+ *
+ * Returns ErrFrozen without holding the lock if the MetaConfig is frozen.
+ */
+func (m* MetaConfig) lockConfigMutable() error {
+	m.ensureLoaded()
+	m.lockConfig()
+	if m.frozen.Load() {
+		m.configLock.Unlock()
+		return ErrFrozen
+	}
+	return nil
+}
+
+/**
+ * Acquire read lock on the inmem config for a mutation of the shards (see configStore)
+ *
+ * Returns ErrFrozen without holding the lock if the MetaConfig is frozen.
+ */
+func (m* MetaConfig) rlockConfigMutable() error {
+	m.ensureLoaded()
+	start := time.Now()
+	m.configLock.RLock()
+	m.stats.lockWaitTime.Add(int64(time.Since(start)))
+	if m.frozen.Load() {
+		m.configLock.RUnlock()
+		return ErrFrozen
+	}
+	return nil
+}
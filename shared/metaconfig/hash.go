@@ -0,0 +1,88 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+)
+
+/**
+ * Returns true if both configurations hold the same key-value pairs
+ *
+ * Layers are resolved, sources and registered validators are not compared.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Equals(other *MetaConfig) bool {
+	if m==other {
+		return true
+	}
+	// Snapshots are taken one after another, so that the locks are never held simultaneously
+	config, otherConfig := m.GetConfig(nil), other.GetConfig(nil)
+	if len(config)!=len(otherConfig) {
+		return false
+	}
+	for k,v := range config {
+		if otherVal, exists := otherConfig[k]; !exists||otherVal!=v {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Returns a stable SHA-256 hash (hex encoded) of the configuration
+ *
+ * The hash only depends on the key-value pairs (layers resolved),
+ * two configurations with the same pairs always produce the same hash.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Hash() string {
+	return hashConfig(m.GetConfig(nil))
+}
+
+/**
+ * Hashes the sorted pairs of a configuration
+ *
+ * Every key and value is length-prefixed, so that no two different configurations share the same input.
+ */
+func hashConfig(config map[string]string) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	lenBuf := make([]byte, 8)
+	for _, k := range keys {
+		binary.BigEndian.PutUint64(lenBuf, uint64(len(k)))
+		hash.Write(lenBuf)
+		hash.Write([]byte(k))
+		binary.BigEndian.PutUint64(lenBuf, uint64(len(config[k])))
+		hash.Write(lenBuf)
+		hash.Write([]byte(config[k]))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,436 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/**
+ * Name of the primary layer, which is the config file the MetaConfig was created with
+ *
+ * The primary layer always has priority 0.
+ */
+const PRIMARY_LAYER string = "primary"
+
+/**
+ * Configuration layer stacked on top or below the primary configuration
+ */
+type configLayer struct {
+	// Unique name of the layer
+	name string
+	// Priority of the layer, higher priorities shadow lower ones
+	priority int
+	// Path of the backing config file, empty for inmem only layers
+	path string
+	// In memory configuration of the layer
+	config map[string]string
+}
+
+/**
+ * Adds a configuration layer
+ *
+ * Layers are resolved top-down by priority, the primary configuration has priority 0.
+ * Use negative priorities for layers below the primary config (e.g. shipped defaults)
+ * and positive priorities for layers above it (e.g. runtime overrides).
+ *
+ * If path is not empty, the layer is backed by a config file that is loaded
+ * on every ReadFromDisk (and once initially) and can be persisted with WriteLayerToDisk.
+ *
+ * Example (defaults < shipped file < host file < runtime overrides):
+ *
+ * ```
+ * cfg, _ := metaconfig.CreateMetaConfig("/etc/cthulhu/host.conf")
+ * cfg.AddLayer("defaults", -20, "")
+ * cfg.AddLayer("shipped", -10, "/usr/share/cthulhu/cthulhu.conf")
+ * cfg.AddLayer("overrides", 10, "")
+ * ```
+ */
+func (m* MetaConfig) AddLayer(name string, priority int, path string) error {
+	if name==PRIMARY_LAYER||priority==0 {
+		return fmt.Errorf("Layer name '%s' and priority 0 are reserved for the primary layer", PRIMARY_LAYER)
+	}
+
+	// Perform pending lazy load before the file lock is acquired
+	m.ensureLoaded()
+	// Hold the file lock so that layers don't change during ReadFromDisk
+	m.lockConfigFile()
+	defer m.configFileLock.Unlock()
+
+	layerConfig := make(map[string]string)
+	if path!="" {
+		loaded, err := m.readConfigFile(path)
+		if err!=nil {
+			return err
+		}
+		layerConfig = loaded.config
+	}
+
+	if err := m.lockConfigMutable(); err!=nil {
+		return err
+	}
+	defer m.configLock.Unlock()
+	for _, l := range m.layers {
+		if l.name==name {
+			return fmt.Errorf("Layer '%s' already exists", name)
+		} else if l.priority==priority {
+			return fmt.Errorf("Layer '%s' already uses priority %d", l.name, priority)
+		}
+	}
+	m.layers = append(m.layers, &configLayer{name, priority, path, layerConfig})
+	m.recordChanges(diffConfig(nil, layerConfig, SOURCE_LAYER, name))
+	sort.Slice(m.layers, func(i, j int) bool {
+		return m.layers[i].priority > m.layers[j].priority
+	})
+	return nil
+}
+
+/**
+ * Removes a configuration layer
+ */
+func (m* MetaConfig) RemoveLayer(name string) error {
+	m.ensureLoaded()
+	m.lockConfigFile()
+	defer m.configFileLock.Unlock()
+	if err := m.lockConfigMutable(); err!=nil {
+		return err
+	}
+	defer m.configLock.Unlock()
+
+	for i, l := range m.layers {
+		if l.name==name {
+			m.layers = append(m.layers[:i], m.layers[i+1:]...)
+			m.recordChanges(diffConfig(l.config, nil, SOURCE_LAYER, name))
+			return nil
+		}
+	}
+	return fmt.Errorf("Layer '%s' not found", name)
+}
+
+/**
+ * Set raw string value to specific key on the specified layer
+ *
+ * Setting a value on PRIMARY_LAYER is equivalent to SetString.
+ *
+ * Returns an error if the layer does not exist or the value is rejected by a registered validator.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SetLayer(layer string, key *string, value *string) error {
+	k := m.canonicalKey(*key)
+	if layer==PRIMARY_LAYER {
+		return m.set(k, *value, SOURCE_API)
+	}
+	if err := checkKey(k); err!=nil {
+		return err
+	}
+	if err := m.validate(k, *value); err!=nil {
+		return err
+	}
+
+	if err := m.lockConfigMutable(); err!=nil {
+		return err
+	}
+	defer m.configLock.Unlock()
+	m.stats.writes.Add(1)
+
+	l := m.findLayer(layer)
+	if l==nil {
+		return fmt.Errorf("Layer '%s' not found", layer)
+	}
+	old, existed := l.config[k]
+	l.config[k] = *value
+	if !existed||old!=*value {
+		m.recordChanges([]Change{{time.Now(), k, old, *value, false, SOURCE_LAYER, layer, ""}})
+	}
+	return nil
+}
+
+/**
+ * Removes a key from the specified layer, exposing the value of the layers below
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) UnsetLayer(layer string, key *string) error {
+	return m.unsetLayer(layer, *key, "")
+}
+
+/**
+ * Removes a key from the specified layer and records the actor of the removal
+ */
+func (m* MetaConfig) unsetLayer(layer string, key string, actor string) error {
+	_, _, err := m.swapUnsetLayer(layer, key, actor)
+	return err
+}
+
+/**
+ * Removes a key from the specified layer like unsetLayer
+ *
+ * Returns the value of the key in the layer before the removal and whether it existed.
+ */
+func (m* MetaConfig) swapUnsetLayer(layer string, key string, actor string) (string, bool, error) {
+	k := m.canonicalKey(key)
+	if err := m.lockConfigMutable(); err!=nil {
+		return "", false, err
+	}
+	defer m.configLock.Unlock()
+	m.stats.writes.Add(1)
+
+	if layer==PRIMARY_LAYER {
+		// Expose the common value if the key was set by the active profile
+		if base, shadowed := m.profileBase[k]; shadowed&&m.profileKeys[k] {
+			old, _ := m.config.put(k, base, SOURCE_FILE)
+			delete(m.profileKeys, k)
+			delete(m.profileBase, k)
+			m.recordChanges([]Change{{time.Now(), k, old, base, false, SOURCE_API, layer, actor}})
+			return old, true, nil
+		}
+		delete(m.profileKeys, k)
+		old, existed := m.config.peek(k)
+		if existed {
+			m.config.remove(k)
+			m.recordChanges([]Change{{time.Now(), k, old, "", true, SOURCE_API, layer, actor}})
+		}
+		return old, existed, nil
+	}
+	l := m.findLayer(layer)
+	if l==nil {
+		return "", false, fmt.Errorf("Layer '%s' not found", layer)
+	}
+	old, existed := l.config[k]
+	if existed {
+		delete(l.config, k)
+		m.recordChanges([]Change{{time.Now(), k, old, "", true, SOURCE_LAYER, layer, actor}})
+	}
+	return old, existed, nil
+}
+
+/**
+ * Returns the name of the layer that the value of the key is resolved from
+ *
+ * If key is not found, it will return an empty string
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Layer(key *string) string {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	_, layer, _ := m.lookupLayer(*key)
+	return layer
+}
+
+/**
+ * Returns a copy of the configuration of the specified layer
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetLayerConfig(layer string) (map[string]string, error) {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	if layer==PRIMARY_LAYER {
+		defer m.config.rlockAll()()
+		mapBuf, _ := m.config.copy()
+		return mapBuf, nil
+	}
+	l := m.findLayer(layer)
+	if l==nil {
+		return nil, fmt.Errorf("Layer '%s' not found", layer)
+	}
+	source := l.config
+	mapBuf := make(map[string]string, len(source))
+	for k,v := range source {
+		mapBuf[k] = v
+	}
+	return mapBuf, nil
+}
+
+/**
+ * Writes a file-backed layer directly to disk
+ *
+ * Profiles of layers are resolved on load, the layer is written without profile sections.
+ *
+ * Writing PRIMARY_LAYER is equivalent to WriteToDisk.
+ *
+ * Function will throw a runtime error if it fails
+ */
+func (m* MetaConfig) WriteLayerToDisk(layer string) error {
+	if layer==PRIMARY_LAYER {
+		return m.WriteToDisk()
+	}
+
+	m.ensureLoaded()
+	m.lockConfigFile()
+	defer m.configFileLock.Unlock()
+	defer m.runlockConfig(m.rlockConfig())
+
+	l := m.findLayer(layer)
+	if l==nil {
+		return fmt.Errorf("Layer '%s' not found", layer)
+	} else if l.path=="" {
+		return fmt.Errorf("Layer '%s' is not backed by a config file", layer)
+	}
+	_, _, err := m.writeConfigFile(l.path, l.config, nil)
+	return err
+}
+
+/**
+ * Returns the layer with the specified name or nil
+ *
+ * The caller must hold the config lock.
+ */
+func (m* MetaConfig) findLayer(name string) *configLayer {
+	for _, l := range m.layers {
+		if l.name==name {
+			return l
+		}
+	}
+	return nil
+}
+
+/**
+ * Resolves the value of a key top-down through all layers
+ *
+ * The caller must hold the config lock.
+ */
+func (m* MetaConfig) lookup(key string) (string, bool) {
+	key = m.canonicalKey(key)
+	if len(m.layers)==0 {
+		return m.config.get(key)
+	}
+	val, _, exists := m.lookupLayer(key)
+	return val, exists
+}
+
+/**
+ * Resolves the value of a key top-down through all layers
+ * and returns the name of the layer it was resolved from
+ *
+ * The caller must hold the config lock.
+ */
+func (m* MetaConfig) lookupLayer(key string) (string, string, bool) {
+	return m.resolveLayer(m.canonicalKey(key), m.config.get)
+}
+
+/**
+ * Resolves the value of a canonical key like lookupLayer, primary returns the value of the primary layer
+ *
+ * Pass m.config.peek as primary if the shard locks are already held (see configStore).
+ */
+func (m* MetaConfig) resolveLayer(key string, primary func(key string) (string, bool)) (string, string, bool) {
+	for _, l := range m.layers {
+		if l.priority<0 {
+			break
+		}
+		if val, exists := l.config[key]; exists {
+			return val, l.name, true
+		}
+	}
+	if val, exists := primary(key); exists {
+		return val, PRIMARY_LAYER, true
+	}
+	for _, l := range m.layers {
+		if l.priority<0 {
+			if val, exists := l.config[key]; exists {
+				return val, l.name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+/**
+ * Returns a copy of the configuration with all layers resolved
+ *
+ * The caller must hold the config lock.
+ */
+func (m* MetaConfig) resolve() map[string]string {
+	defer m.config.rlockAll()()
+	mapBuf := make(map[string]string, m.config.len())
+	// Apply layers bottom-up, so that higher priorities overwrite lower ones
+	for i := len(m.layers)-1; i>=0; i-- {
+		if m.layers[i].priority>0 {
+			break
+		}
+		for k,v := range m.layers[i].config {
+			mapBuf[k] = v
+		}
+	}
+	m.config.each(func(k string, v string) bool {
+		mapBuf[k] = v
+		return true
+	})
+	for i := len(m.layers)-1; i>=0; i-- {
+		if m.layers[i].priority<0 {
+			continue
+		}
+		for k,v := range m.layers[i].config {
+			mapBuf[k] = v
+		}
+	}
+	return mapBuf
+}
+
+/**
+ * Iterates over the configuration with all layers resolved
+ *
+ * Iteration stops if the callback returns false, order is not specified.
+ *
+ * The callback runs under the read locks of the inmem config and of all its shards and must not call
+ * mutating MetaConfig operations, as this would deadlock.
+ * Reading operations (Get*) must not be called either, read locks are not reentrant:
+ * once a writer waits for the locks, the nested read blocks behind the writer and the writer behind Range.
+ * Collect the required keys in the callback and read them after Range returned instead.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Range(callback func(key string, value string) bool) {
+	defer m.runlockConfig(m.rlockConfig())
+	defer m.config.rlockAll()()
+	m.stats.reads.Add(1)
+
+	if len(m.layers)==0 {
+		m.config.each(callback)
+		return
+	}
+
+	// Only visit the pairs of a layer if they are not shadowed by another layer
+	// The shard locks are held, so the primary layer is resolved without locking
+	if !m.config.each(func(k string, v string) bool {
+		if _, layer, _ := m.resolveLayer(k, m.config.peek); layer==PRIMARY_LAYER {
+			return callback(k, v)
+		}
+		return true
+	}) {
+		return
+	}
+	for _, l := range m.layers {
+		for k,v := range l.config {
+			if _, layer, _ := m.resolveLayer(k, m.config.peek); layer==l.name {
+				if !callback(k, v) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"strings"
+)
+
+/**
+ * Loads the config file lazily on the first access
+ *
+ * The first read or write operation performs the initial ReadFromDisk,
+ * short-lived processes that never touch the config don't pay for parsing it.
+ *
+ * Errors of the initial load are reported by LoadError.
+ * Calling ReadFromDisk explicitly cancels the pending lazy load.
+ */
+func WithLazyLoad() Option {
+	return func(m *MetaConfig) {
+		m.lazyPending.Store(true)
+	}
+}
+
+/**
+ * Only loads keys starting with one of the specified prefixes
+ *
+ * Other keys are skipped while parsing and never held in memory.
+ *
+ * As the inmem config only holds a subset of the file,
+ * writing it back would drop keys, WriteToDisk therefore fails for such configs.
+ */
+func WithPrefixes(prefixes ...string) Option {
+	return func(m *MetaConfig) {
+		m.prefixes = append(m.prefixes, prefixes...)
+	}
+}
+
+/**
+ * Returns the error of the lazy initial load
+ *
+ * Triggers the lazy initial load if it is still pending.
+ */
+func (m* MetaConfig) LoadError() error {
+	m.ensureLoaded()
+	m.lazyLock.Lock()
+	defer m.lazyLock.Unlock()
+	return m.lazyErr
+}
+
+/**
+ * Performs the lazy initial load if it is still pending
+ *
+ * Concurrent callers block until the load is completed.
+ */
+func (m* MetaConfig) ensureLoaded() {
+	if !m.lazyPending.Load() {
+		return
+	}
+	m.lazyLock.Lock()
+	defer m.lazyLock.Unlock()
+	// ReadFromDisk resets the pending flag, so that it does not recurse into ensureLoaded
+	if m.lazyPending.Load() {
+		m.lazyErr = m.ReadFromDisk()
+	}
+}
+
+/**
+ * Returns true if the key matches the configured prefixes
+ */
+func (m* MetaConfig) matchPrefixes(key string) bool {
+	if len(m.prefixes)==0 {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
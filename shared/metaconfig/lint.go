@@ -0,0 +1,308 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Expected type of a config value
+ */
+type KeyType int
+
+const (
+	TYPE_STRING KeyType = iota
+	// Strict bool tokens (see GetBoolStrict)
+	TYPE_BOOL
+	TYPE_INT
+	TYPE_DOUBLE
+	TYPE_LIST
+	TYPE_INT_LIST
+	TYPE_DOUBLE_LIST
+	// Go duration (e.g. "30s", see time.ParseDuration)
+	TYPE_DURATION
+	// RFC3339 timestamp
+	TYPE_TIME
+)
+
+/**
+ * Description of a single key of the config file
+ */
+type KeySchema struct {
+	// Expected type of the value
+	Type KeyType
+	// Key must be present in the common section
+	Required bool
+	// Deprecation note (e.g. the replacement key), empty if the key is not deprecated
+	Deprecated string
+	// Constraints of the value (see Constrain), enforced like validators
+	Constraints []Constraint
+}
+
+/**
+ * Known keys of a config file
+ */
+type Schema map[string]KeySchema
+
+/**
+ * Registers the schema of the configuration
+ *
+ * Types and unknown keys are not enforced by the Set* operations, they are used by tooling
+ * (e.g. MetaHook) to reject unknown keys and type mismatches with CheckSchema.
+ * Constraints of the entries are enforced on every Set* operation and on ReadFromDisk.
+ * Passing nil removes the schema including the constraints of its entries,
+ * constraints added with Constrain are kept in either case.
+ */
+func (m* MetaConfig) SetSchema(schema Schema) {
+	m.validatorLock.Lock()
+	defer m.validatorLock.Unlock()
+
+	if schema==nil {
+		m.schema = nil
+		return
+	}
+	m.schema = make(Schema, len(schema))
+	for k,v := range schema {
+		v.Constraints = append([]Constraint{}, v.Constraints...)
+		m.schema[m.canonicalKey(k)] = v
+	}
+}
+
+/**
+ * Returns a copy of the schema with the constraints added with Constrain (nil if neither is registered)
+ *
+ * Constrained keys that are not part of the registered schema are included as TYPE_STRING entries.
+ */
+func (m* MetaConfig) Schema() Schema {
+	m.validatorLock.RLock()
+	defer m.validatorLock.RUnlock()
+
+	if m.schema==nil&&m.constraints==nil {
+		return nil
+	}
+	schema := make(Schema, len(m.schema))
+	for k,v := range m.schema {
+		schema[k] = v
+	}
+	for k := range m.constraints {
+		spec := schema[k]
+		spec.Constraints = m.keyConstraints(k)
+		schema[k] = spec
+	}
+	return schema
+}
+
+/**
+ * Checks a pair against the registered schema
+ *
+ * Returns an error if the key is unknown, the value does not match the type of the key or violates its constraints
+ * (of the schema entry and added with Constrain).
+ * If no schema is registered, every key is known and only the constraints are checked.
+ */
+func (m* MetaConfig) CheckSchema(key *string, value *string) error {
+	m.validatorLock.RLock()
+	defer m.validatorLock.RUnlock()
+
+	k := m.canonicalKey(*key)
+	if m.schema!=nil {
+		spec, known := m.schema[k]
+		if !known {
+			return fmt.Errorf("Unknown key '%s'", k)
+		}
+		if err := checkType(spec.Type, *value); err!=nil {
+			return fmt.Errorf("Invalid value for key '%s': %w", k, err)
+		}
+	}
+	return checkConstraints(k, m.keyConstraints(k), *value)
+}
+
+/**
+ * Kind of a lint finding
+ */
+type FindingKind string
+
+const (
+	FINDING_UNKNOWN_KEY FindingKind = "unknown_key"
+	FINDING_DEPRECATED_KEY FindingKind = "deprecated_key"
+	FINDING_TYPE_MISMATCH FindingKind = "type_mismatch"
+	FINDING_DUPLICATE_KEY FindingKind = "duplicate_key"
+	FINDING_MISSING_KEY FindingKind = "missing_key"
+	FINDING_CONSTRAINT_VIOLATION FindingKind = "constraint_violation"
+)
+
+/**
+ * Single issue found by Lint
+ */
+type Finding struct {
+	// Path of the linted config file
+	Path string `json:"path"`
+	// Line of the affected pair (1-based, 0 if the finding is not bound to a line)
+	Line int `json:"line"`
+	// Profile section of the affected pair (empty for the common section)
+	Profile string `json:"profile,omitempty"`
+	// Affected key
+	Key string `json:"key"`
+	// Kind of the finding
+	Kind FindingKind `json:"kind"`
+	// Human readable description
+	Msg string `json:"msg"`
+}
+
+func (f Finding) String() string {
+	location := f.Path + ":" + strconv.Itoa(f.Line)
+	if f.Profile!="" {
+		location += " [" + PROFILE_SECTION_PREFIX + f.Profile + "]"
+	}
+	return fmt.Sprintf("%s: %s: %s", location, f.Kind, f.Msg)
+}
+
+/**
+ * Lints a config file against a schema
+ *
+ * Unlike ReadFromDisk, Lint reports soft issues that don't prevent the file from loading:
+ * unknown keys, deprecated keys, type mismatches, constraint violations, duplicated keys and missing required keys.
+ * Findings are sorted by line, intended to be rendered by CI pipelines or tooling.
+ *
+ * Gzip-compressed files are decompressed, signatures are not verified.
+ *
+ * Hard failures (unreadable file, syntax errors) are returned as error (*ParseError for syntax errors).
+ */
+func Lint(path string, schema Schema) ([]Finding, error) {
+	content, err := os.ReadFile(path)
+	if err!=nil {
+		return nil, err
+	}
+	if isCompressed(content) {
+		content, err = decompressContent(content)
+		if err!=nil {
+			return nil, fmt.Errorf("Failed to decompress config file at: %s\n%w", path, err)
+		}
+	}
+	parsed, err := parseConfig(bytes.NewReader(content), path, nil)
+	if err!=nil {
+		return nil, err
+	}
+
+	findings := []Finding{}
+	// Line of the first occurrence by profile and key
+	seen := make(map[string]map[string]int)
+	for _, pair := range parsed.pairs {
+		finding := Finding{path, pair.line, pair.profile, pair.key, "", ""}
+		if seen[pair.profile]==nil {
+			seen[pair.profile] = make(map[string]int)
+		}
+		if line, exists := seen[pair.profile][pair.key]; exists {
+			finding.Kind = FINDING_DUPLICATE_KEY
+			finding.Msg = fmt.Sprintf("Key '%s' is already defined on line %d, this value is ignored", pair.key, line)
+			findings = append(findings, finding)
+			continue
+		}
+		seen[pair.profile][pair.key] = pair.line
+
+		spec, known := schema[pair.key]
+		if !known {
+			finding.Kind = FINDING_UNKNOWN_KEY
+			finding.Msg = fmt.Sprintf("Unknown key '%s'", pair.key)
+			findings = append(findings, finding)
+			continue
+		}
+		if spec.Deprecated!="" {
+			finding.Kind = FINDING_DEPRECATED_KEY
+			finding.Msg = fmt.Sprintf("Key '%s' is deprecated: %s", pair.key, spec.Deprecated)
+			findings = append(findings, finding)
+		}
+		if err := checkType(spec.Type, pair.value); err!=nil {
+			finding.Kind = FINDING_TYPE_MISMATCH
+			finding.Msg = fmt.Sprintf("Invalid value for key '%s': %s", pair.key, err)
+			findings = append(findings, finding)
+		} else if err := checkConstraints(pair.key, spec.Constraints, pair.value); err!=nil {
+			finding.Kind = FINDING_CONSTRAINT_VIOLATION
+			finding.Msg = err.Error()
+			findings = append(findings, finding)
+		}
+	}
+
+	var required []string
+	for key, spec := range schema {
+		if _, exists := parsed.common[key]; spec.Required&&!exists {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	for _, key := range required {
+		findings = append(findings, Finding{
+			path, 0, "", key, FINDING_MISSING_KEY, fmt.Sprintf("Required key '%s' is missing", key),
+		})
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+/**
+ * Checks if the raw value can be parsed as the specified type
+ */
+func checkType(keyType KeyType, value string) error {
+	switch keyType {
+	case TYPE_BOOL:
+		switch strings.ToLower(value) {
+		case "true", "yes", "1", "false", "no", "0":
+			return nil
+		}
+		return fmt.Errorf("Expected bool, got '%s'", value)
+	case TYPE_INT:
+		if _, err := strconv.Atoi(value); err!=nil {
+			return fmt.Errorf("Expected int, got '%s'", value)
+		}
+	case TYPE_DOUBLE:
+		if _, err := strconv.ParseFloat(value, 64); err!=nil {
+			return fmt.Errorf("Expected double, got '%s'", value)
+		}
+	case TYPE_INT_LIST:
+		for i, tok := range splitList(value) {
+			if _, err := strconv.Atoi(strings.TrimSpace(tok)); err!=nil {
+				return fmt.Errorf("Expected int at index %d, got '%s'", i, tok)
+			}
+		}
+	case TYPE_DOUBLE_LIST:
+		for i, tok := range splitList(value) {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(tok), 64); err!=nil {
+				return fmt.Errorf("Expected double at index %d, got '%s'", i, tok)
+			}
+		}
+	case TYPE_DURATION:
+		if _, err := ParseDuration(value); err!=nil {
+			return fmt.Errorf("Expected duration, got '%s'", value)
+		}
+	case TYPE_TIME:
+		if _, err := ParseTime(value); err!=nil {
+			return fmt.Errorf("Expected RFC3339 time, got '%s'", value)
+		}
+	}
+	return nil
+}
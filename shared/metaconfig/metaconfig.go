@@ -20,18 +20,28 @@
 package metaconfig
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const TMP_FILE_EXTENSION string = ".tmp"
 
+/**
+ * Error returned by disk operations of an in-memory MetaConfig (see NewMemoryConfig)
+ */
+var ErrMemoryOnly = errors.New("MetaConfig has no backing config file")
+
 /**
  * Object holding a inmem configuration
  *
@@ -50,6 +60,12 @@ const TMP_FILE_EXTENSION string = ".tmp"
  *
  * wellplacedkey=""
  * / I'm also a comment until newline
+ * rawkey=<<EOF
+ * Raw block, "quotes" need no escaping
+ * EOF
+ *
+ * [profile:production]
+ * somekey="I'm only used if the production profile is active"
  * ```
  */
 type MetaConfig struct {
@@ -59,24 +75,157 @@ type MetaConfig struct {
 	configLock sync.RWMutex
 	// Path of the configuration
 	configPath string
-	// In memory configuration object
-	config map[string]string
+	// In memory configuration object (primary layer, see configStore)
+	config configStore
+	// Additional configuration layers sorted by descending priority
+	layers []*configLayer
+	// Operation metrics
+	stats metaStats
+	// Frozen configs reject every mutation
+	frozen atomic.Bool
+	// Mutex lock for the validators
+	validatorLock sync.RWMutex
+	// Validators registered per key
+	validators map[string][]Validator
+	// Schema of the configuration (guarded by the validator lock, nil if not registered)
+	schema Schema
+	// Constraints added per key with Constrain, kept separate from the replaceable schema (guarded by the validator lock)
+	constraints map[string][]Constraint
+	// HMAC key used to sign and verify config files (guarded by the config file lock)
+	signingKey []byte
+	// X25519 key used to unseal sealed values (nil if not set)
+	sealingKey atomic.Pointer[ecdh.PrivateKey]
+	// Write config files gzip-compressed (guarded by the config file lock)
+	compress bool
+	// Mutex lock for the audit trail
+	auditLock sync.RWMutex
+	// Audit trail of recent changes (nil if disabled)
+	audit *auditRing
+	// Active profile (guarded by the config file lock)
+	profile string
+	// Pairs of every profile section of the config file
+	profiles map[string]map[string]string
+	// Keys of the inmem config that are set by the active profile
+	profileKeys map[string]bool
+	// Common values shadowed by the active profile
+	profileBase map[string]string
+	// Perform ReadFromDisk in OpenMetaConfig
+	initialLoad bool
+	// Mutex lock for the lazy initial load
+	lazyLock sync.Mutex
+	// True until the lazy initial load was performed
+	lazyPending atomic.Bool
+	// Error of the lazy initial load
+	lazyErr error
+	// Only keys with one of these prefixes are loaded (all keys if empty)
+	prefixes []string
+	// Canonicalize keys (lowercase, trimmed)
+	canonical bool
+	// Mutex lock for the redacted keys
+	redactLock sync.RWMutex
+	// Keys that are redacted in plaintext exports
+	redacted map[string]bool
+	// Detect external modifications of the config file on write
+	conflictDetection bool
+	// State of the config file when it was last read or written (nil if unknown)
+	stamp atomic.Pointer[fileStamp]
+	// Mutex lock for the watchers
+	watchLock sync.Mutex
+	// Subscriptions to changes of the inmem config
+	watchers map[*watcher]bool
+	// Version of the last completed mutation that changed the inmem config (see Version)
+	version atomic.Uint64
+	// Last version allocated by a mutation (see allocateVersion)
+	sequence atomic.Uint64
+}
+
+/**
+ * Option to customize the MetaConfig on creation
+ */
+type Option func(*MetaConfig)
+
+/**
+ * Performs the initial ReadFromDisk when the MetaConfig is opened with OpenMetaConfig
+ *
+ * Has no effect in combination with WithLazyLoad, the lazy load is performed instead.
+ */
+func WithInitialLoad() Option {
+	return func(m *MetaConfig) {
+		m.initialLoad = true
+	}
+}
+
+/**
+ * Initializes MetaConfig and creates the config file
+ *
+ * An existing config file is truncated, use OpenMetaConfig to keep its content.
+ */
+func CreateMetaConfig(path string, opts ...Option) (*MetaConfig, error) {
+	return initMetaConfig(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, opts)
+}
+
+/**
+ * Initializes MetaConfig and creates the config file only if not existent
+ *
+ * Existing config files are left untouched, use WithInitialLoad to read them immediately.
+ */
+func OpenMetaConfig(path string, opts ...Option) (*MetaConfig, error) {
+	config, err := initMetaConfig(path, os.O_CREATE|os.O_RDONLY, opts)
+	if err!=nil {
+		return config, err
+	}
+	if config.initialLoad&&!config.lazyPending.Load() {
+		err = config.ReadFromDisk()
+	}
+	return config, err
 }
 
 /**
- * Initializes MetaConfig and creates the config file if not existent
+ * Initializes a pure in-memory MetaConfig without backing config file
+ *
+ * The full Get / Set API is available, ReadFromDisk and WriteToDisk return ErrMemoryOnly.
+ *
+ * Useful for tests and components that receive their entire configuration at runtime (e.g. through MetaHook).
  */
-func CreateMetaConfig(path string) (*MetaConfig, error) {
+func NewMemoryConfig(opts ...Option) *MetaConfig {
+	config := &MetaConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+/**
+ * Initializes MetaConfig and opens the config file once with the specified flags
+ */
+func initMetaConfig(path string, flag int, opts []Option) (*MetaConfig, error) {
 	config := &MetaConfig{}
 	config.configPath = path
+	for _, opt := range opts {
+		opt(config)
+	}
 	// Generate file path recursively
 	parentpath := filepath.Dir(config.configPath)
 	if err := os.MkdirAll(parentpath, 0755); err!=nil {
 		return config, err
 	}
 	// Generate file
-	_, err := os.Create(config.configPath);
-	return config, err
+	file, err := os.OpenFile(config.configPath, flag, 0755)
+	if err!=nil {
+		return config, err
+	}
+	if err = file.Close(); err!=nil {
+		return config, err
+	}
+	// Record the created file, so that modifications before the first load are detected
+	if config.conflictDetection&&flag&os.O_TRUNC!=0 {
+		info, err := os.Stat(config.configPath)
+		if err!=nil {
+			return config, err
+		}
+		config.stamp.Store(newFileStamp(info, nil))
+	}
+	return config, nil
 }
 
 /**
@@ -85,27 +234,50 @@ func CreateMetaConfig(path string) (*MetaConfig, error) {
  * This operation does not read / parse anything from disk!
  */
 func (m* MetaConfig) Exists(key *string) bool {
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()
-	_, exists := m.config[*key]
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+	_, exists := m.lookup(*key)
 	return exists
 }
 
+/**
+ * Verifies that all specified keys exist and are not empty
+ *
+ * Returns a single error enumerating all missing keys, intended to be called after ReadFromDisk
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Require(keys ...string) error {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	var missing []string
+	for _, key := range keys {
+		if val, exists := m.lookup(key); !exists||val=="" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing)>0 {
+		return fmt.Errorf(
+			"Missing required keys in config file at: %s\n%s",
+			m.configPath, strings.Join(missing, ", "),
+		)
+	}
+	return nil
+}
+
 /**
  * Get full parsed configuration object
  *
+ * Layers are resolved, the returned map is a copy.
+ *
  * This operation does not read / parse anything from disk!
  */
 func (m* MetaConfig) GetConfig(key *string) map[string]string {
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
 
-	mapBuf := make(map[string]string)
-
-	for k,v := range m.config {
-		mapBuf[k] = v
-	}
-	return mapBuf
+	return m.resolve()
 }
 
 /**
@@ -116,9 +288,9 @@ func (m* MetaConfig) GetConfig(key *string) map[string]string {
  * This operation does not read / parse anything from disk!
  */
 func (m* MetaConfig) GetString(key *string) string {
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()	
-	val, _ := m.config[*key]
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)	
+	val, _ := m.lookup(*key)
 	return val
 }
 
@@ -132,10 +304,10 @@ func (m* MetaConfig) GetString(key *string) string {
  * This operation does not read / parse anything from disk!
  */
 func (m* MetaConfig) GetBool(key *string) bool {
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
 	
-	val, exists := m.config[*key]
+	val, exists := m.lookup(*key)
 	if exists {
 		return strings.ToLower(val)=="true"||strings.ToLower(val)=="yes"
 	} else {
@@ -143,6 +315,34 @@ func (m* MetaConfig) GetBool(key *string) bool {
 	}
 }
 
+/**
+ * Get bool value of specific key with strict parsing
+ *
+ * Underlying string is evaluated case-insensitive and must be one of:
+ * "true", "yes", "1" (true) or "false", "no", "0" (false)
+ *
+ * If key is not found or the value is not a recognized token, it will return false and an error
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetBoolStrict(key *string) (bool, error) {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	val, exists := m.lookup(*key)
+	if !exists {
+		return false, fmt.Errorf("Key '%s' not found", *key)
+	}
+	switch strings.ToLower(val) {
+	case "true", "yes", "1":
+		return true, nil
+	case "false", "no", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid bool value '%s' for key '%s'", val, *key)
+	}
+}
+
 /**
  * Get double value of specific key
  *
@@ -153,10 +353,10 @@ func (m* MetaConfig) GetBool(key *string) bool {
  * This operation does not read / parse anything from disk!
  */
 func (m* MetaConfig) GetDouble(key *string) float64 {
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
 	
-	val, exists := m.config[*key]
+	val, exists := m.lookup(*key)
 	if exists {
 		numval, err := strconv.ParseFloat(val, 64)
 		if err!=nil {
@@ -168,6 +368,81 @@ func (m* MetaConfig) GetDouble(key *string) float64 {
 	}
 }
 
+/**
+ * Get duration value of specific key
+ *
+ * If the conversion fails (invalid duration in config) it will return 0
+ *
+ * If key is not found, it will return 0 aswell
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetDuration(key *string) time.Duration {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	val, exists := m.lookup(*key)
+	if exists {
+		duration, err := ParseDuration(val)
+		if err!=nil {
+			return 0
+		}
+		return duration
+	} else {
+		return 0
+	}
+}
+
+/**
+ * Get time value of specific key
+ *
+ * If the conversion fails (invalid RFC3339 time in config) it will return the zero time
+ *
+ * If key is not found, it will return the zero time aswell
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetTime(key *string) time.Time {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	val, exists := m.lookup(*key)
+	if exists {
+		t, err := ParseTime(val)
+		if err!=nil {
+			return time.Time{}
+		}
+		return t
+	} else {
+		return time.Time{}
+	}
+}
+
+/**
+ * Get int value of specific key
+ *
+ * If the conversion fails (invalid int in config) it will return 0
+ *
+ * If key is not found, it will return 0 aswell
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetInt(key *string) int64 {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	val, exists := m.lookup(*key)
+	if exists {
+		numval, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		if err!=nil {
+			return 0
+		}
+		return numval
+	} else {
+		return 0
+	}
+}
+
 /**
  * Get list value of specific key
  *
@@ -179,264 +454,775 @@ func (m* MetaConfig) GetDouble(key *string) float64 {
  * This operation does not read / parse anything from disk!
  */
 func (m* MetaConfig) GetList(key *string) []string {
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
 	
-	val, exists := m.config[*key]
+	val, exists := m.lookup(*key)
 	if exists {
-		// Split tokens
-		listval := strings.Split(val, ",")
-		// Remove empty fields
-		var tokens []string
-		for _, tokBuf := range listval {
-			if tokBuf!="" {
-				tokens = append(tokens, tokBuf)
-			}
-		}
-		return tokens
+		return splitList(val)
 	} else {
 		return []string{}
 	}
 }
 
+/**
+ * Get int list value of specific key
+ *
+ * Underlying string is splitted like in GetList, every element is parsed as int
+ *
+ * If an element fails to parse, it will return nil and an error that reports the failing index
+ *
+ * If key is not found, it will return a empty list
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetIntList(key *string) ([]int, error) {
+	tokens := m.GetList(key)
+	list := make([]int, 0, len(tokens))
+	for i, tok := range tokens {
+		numval, err := strconv.Atoi(strings.TrimSpace(tok))
+		if err!=nil {
+			return nil, fmt.Errorf("Invalid int at index %d of key '%s': %w", i, *key, err)
+		}
+		list = append(list, numval)
+	}
+	return list, nil
+}
+
+/**
+ * Get double list value of specific key
+ *
+ * Underlying string is splitted like in GetList, every element is parsed as double
+ *
+ * If an element fails to parse, it will return nil and an error that reports the failing index
+ *
+ * If key is not found, it will return a empty list
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetDoubleList(key *string) ([]float64, error) {
+	tokens := m.GetList(key)
+	list := make([]float64, 0, len(tokens))
+	for i, tok := range tokens {
+		numval, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err!=nil {
+			return nil, fmt.Errorf("Invalid double at index %d of key '%s': %w", i, *key, err)
+		}
+		list = append(list, numval)
+	}
+	return list, nil
+}
+
+/**
+ * Splits a raw list value based on ','
+ * empty fields ("") are omitted
+ */
+func splitList(val string) []string {
+	// Split tokens
+	listval := strings.Split(val, ",")
+	// Remove empty fields
+	var tokens []string
+	for _, tokBuf := range listval {
+		if tokBuf!="" {
+			tokens = append(tokens, tokBuf)
+		}
+	}
+	return tokens
+}
+
 /**
  * Set string value to specific key
  *
+ * Returns an error if the value is rejected by a registered validator.
+ *
  * This operation does not write anything to disk!
  */
-func (m* MetaConfig) SetString(key *string, value *string) {
-	m.configLock.Lock()
-	defer m.configLock.Unlock()
-
-	m.config[*key] = *value
+func (m* MetaConfig) SetString(key *string, value *string) error {
+	return m.set(*key, *value, SOURCE_API)
 }
 
 /**
  * Set bool value to specific key
  *
+ * Returns an error if the value is rejected by a registered validator.
+ *
  * This operation does not write anything to disk!
  */
-func (m* MetaConfig) SetBool(key *string, value *bool) {
-	m.configLock.Lock()
-	defer m.configLock.Unlock()
-
-	if *value {
-		m.config[*key] = "true"
-	} else {
-		m.config[*key] = "false"
-	}
+func (m* MetaConfig) SetBool(key *string, value *bool) error {
+	return m.set(*key, FormatBool(*value), SOURCE_API)
 }
 
 /**
  * Set double value to specific key
  *
+ * Returns an error if the value is rejected by a registered validator.
+ *
  * This operation does not write anything to disk!
  */
-func (m* MetaConfig) SetDouble(key *string, value *float64) {
-	m.configLock.Lock()
-	defer m.configLock.Unlock()
+func (m* MetaConfig) SetDouble(key *string, value *float64) error {
+	return m.set(*key, FormatDouble(*value), SOURCE_API)
+}
 
-	m.config[*key] = strconv.FormatFloat(*value, 'f', -1, 64)
+/**
+ * Set int value to specific key
+ *
+ * Returns an error if the value is rejected by a registered validator.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SetInt(key *string, value *int64) error {
+	return m.set(*key, FormatInt(*value), SOURCE_API)
 }
 
 
 /**
  * Set list value to specific key
  *
+ * Returns an error if the value is rejected by a registered validator.
+ *
  * This operation does not write anything to disk!
  */
-func (m* MetaConfig) SetList(key *string, value *[]string) {
-	m.configLock.Lock()
-	defer m.configLock.Unlock()
+func (m* MetaConfig) SetList(key *string, value *[]string) error {
+	return m.set(*key, FormatList(*value), SOURCE_API)
+}
+
+/**
+ * Formats a bool value like SetBool stores it
+ */
+func FormatBool(value bool) string {
+	if value {
+		return "true"
+	} else {
+		return "false"
+	}
+}
+
+/**
+ * Formats a double value like SetDouble stores it
+ */
+func FormatDouble(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+/**
+ * Formats an int value like SetInt stores it
+ */
+func FormatInt(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
+
+/**
+ * Formats a duration value (e.g. "1m30s"), the value can be parsed with ParseDuration
+ */
+func FormatDuration(value time.Duration) string {
+	return value.String()
+}
+
+/**
+ * Formats a time value as RFC3339 timestamp with nanoseconds, the value can be parsed with ParseTime
+ */
+func FormatTime(value time.Time) string {
+	return value.Format(time.RFC3339Nano)
+}
+
+/**
+ * Parses a duration value (see time.ParseDuration), surrounding whitespace is ignored
+ */
+func ParseDuration(value string) (time.Duration, error) {
+	return time.ParseDuration(strings.TrimSpace(value))
+}
+
+/**
+ * Parses an RFC3339 time value (with optional fractional seconds), surrounding whitespace is ignored
+ */
+func ParseTime(value string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+}
 
+/**
+ * Formats a list value like SetList stores it
+ */
+func FormatList(value []string) string {
 	outstr := ""
-	for _,val := range *value {
+	for _,val := range value {
 		outstr+=val
 		outstr+=","
 	}
-	m.config[*key] = outstr
+	return outstr
 }
 
 /**
- * Read and Parse configuration directly from disk to inmem config
- *
- * If a key is placed multiple times, only the first one is evaluated
+ * Validates and sets the raw string value of a key and records its source
  *
- * Function will throw a runtime error if it fails
+ * Every Set* operation ends up here.
  */
-func (m* MetaConfig) ReadFromDisk() error {
-	// Read lock the file config lock
-	m.configFileLock.RLock()
-	defer m.configFileLock.RUnlock()
-
-	mapBuffer := make(map[string]string)
-	// Read config file
-	file, err := os.OpenFile(m.configPath, os.O_RDONLY, 0755)
-	if err!=nil {
+func (m* MetaConfig) set(key string, value string, source Source) error {
+	key = m.canonicalKey(key)
+	if err := checkKey(key); err!=nil {
+		return err
+	}
+	if err := m.validate(key, value); err!=nil {
 		return err
 	}
-	defer file.Close()
 
-	// Create buffered reader
-	reader := bufio.NewReader(file)
-	
-	// Char buffer
-	var c byte
-	// Keeps track of lines for debug messages
-	var lineCount int = 0
-	// Current key buffer
-	var curKey strings.Builder 
-	// Current value buffer
-	var curVal strings.Builder
-
-	// Unnamed helper function to read one char at a time
-	getChar := func(char *byte) bool {
-		var val byte
-		// Read next byte from stream
-		val, err = reader.ReadByte()
-		if err!=nil {
-			return false
-		}
-		*char = val
-		return true
+	_, err := m.setShared(map[string]string{key: value}, []string{key}, source, "", nil)
+	return err
+}
+
+/**
+ * Applies the validated pairs while other writers hold the config lock concurrently (see configStore.pipeline)
+ *
+ * Keys holds the keys of config, the replaced values of keys that existed are stored in previous (if not nil).
+ *
+ * Returns the version after the mutation.
+ */
+func (m* MetaConfig) setShared(
+	config map[string]string,
+	keys []string,
+	source Source,
+	actor string,
+	previous map[string]string) (uint64, error) {
+
+	if err := m.rlockConfigMutable(); err!=nil {
+		return 0, err
 	}
+	defer m.configLock.RUnlock()
+	m.stats.writes.Add(1)
 
-	// Iterate over chars
-	for {
-		// Eat next char
-		if !getChar(&c) {
-			break
+	now := time.Now()
+	var version uint64
+	changed := false
+	m.config.pipeline(keys, func() {
+		version = m.allocateVersion()
+	}, func(keys []string) {
+		changes := make([]Change, 0, len(keys))
+		for _, k := range keys {
+			v := config[k]
+			old, existed := m.config.put(k, v, source)
+			if existed&&previous!=nil {
+				previous[k] = old
+			}
+			if !existed||old!=v {
+				changes = append(changes, Change{now, k, old, v, false, source, PRIMARY_LAYER, actor})
+			}
 		}
-		// Skip newline
-		if c=='\n' {
-			lineCount++
-			continue
+		// Changes are recorded per shard, so that the changes of a key are recorded in mutation order
+		m.recordChangesAt(changes, version)
+		changed = changed||len(changes)>0
+	}, func() {
+		if changed {
+			m.version.Store(version)
 		}
-		// Skip space, tab
-		if c==' '||c=='\t'||c=='\r' {
-			continue
+	})
+	return m.version.Load(), nil
+}
+
+/**
+ * Removes a key from the inmem configuration
+ *
+ * Equivalent to UnsetLayer on PRIMARY_LAYER, values of other layers are still resolved.
+ * Removing a key that does not exist is not an error.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) Delete(key *string) error {
+	return m.unsetLayer(PRIMARY_LAYER, *key, "")
+}
+
+/**
+ * Removes a key from the inmem configuration like Delete
+ * and records the actor (e.g. a remote client identity) in the audit trail
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) DeleteAs(actor string, key *string) error {
+	return m.unsetLayer(PRIMARY_LAYER, *key, actor)
+}
+
+/**
+ * Set multiple raw string values at once
+ *
+ * Concurrent updates are applied in parallel on different shards of the store (see configStore),
+ * full reads (e.g. GetConfig, Range, WriteToDisk) observe the update entirely or not at all.
+ *
+ * The operation is all-or-nothing, if any key or value is rejected
+ * (e.g. by a registered validator), nothing is applied.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SetConfig(config map[string]string) error {
+	_, err := m.setMany(config, SOURCE_API, false, "", nil, nil)
+	return err
+}
+
+/**
+ * Set multiple raw string values like SetConfig
+ * and records the actor (e.g. a remote client identity) in the audit trail
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SetConfigAs(actor string, config map[string]string) error {
+	_, err := m.setMany(config, SOURCE_API, false, actor, nil, nil)
+	return err
+}
+
+/**
+ * Replace the inmem configuration under a single lock acquisition
+ *
+ * Keys not present in config are removed, defaults (see SetDefault) are retained.
+ * Layers are not affected.
+ *
+ * The operation is all-or-nothing, if any key or value is rejected
+ * (e.g. by a registered validator), nothing is applied.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) ReplaceConfig(config map[string]string) error {
+	_, err := m.setMany(config, SOURCE_API, true, "", nil, nil)
+	return err
+}
+
+/**
+ * Validates and applies multiple pairs at once
+ *
+ * If replace is true, every key that is not present in config is removed (except defaults).
+ * Actor is recorded in the audit trail.
+ * If expected is not nil, nothing is applied unless the configuration has the expected version.
+ * If previous is not nil, the replaced values of all keys of config that existed are stored in it.
+ *
+ * Returns the version after the mutation.
+ */
+func (m* MetaConfig) setMany(
+	config map[string]string,
+	source Source,
+	replace bool,
+	actor string,
+	expected *uint64,
+	previous map[string]string) (uint64, error) {
+
+	mapBuffer := make(map[string]string, len(config))
+	keys := make([]string, 0, len(config))
+	var validationErrs []error
+	for k,v := range config {
+		k = m.canonicalKey(k)
+		if err := checkKey(k); err!=nil {
+			validationErrs = append(validationErrs, err)
+		} else if err := m.validate(k, v); err!=nil {
+			validationErrs = append(validationErrs, err)
 		}
-		// # | / indicate a comment
-		if c=='#'||c=='/' {
-			// Skip til EOF or newline
-			for {
-				if !(getChar(&c)&&c!='\n') {
-					break
-				}
-			}
-			lineCount++
-			continue
+		if _, exists := mapBuffer[k]; !exists {
+			keys = append(keys, k)
 		}
+		mapBuffer[k] = v
+	}
+	if len(validationErrs)>0 {
+		return 0, errors.Join(validationErrs...)
+	}
 
-		// Eat key
-		curKey.Reset()
-		for {
-			curKey.WriteByte(c)
-			// EOF or newline in key is not allowed
-			if !getChar(&c)||c=='\n' {
-				return fmt.Errorf(
-					"Failed to parse config file at: %s\nUnexpected EOF or newline on line: %d",
-					m.configPath, lineCount,
-				)
-			}
-			// Read until '=' char
-			if c=='=' {
-				break
+	// Concurrent updates only contend on the shards they currently apply
+	if !replace&&expected==nil {
+		return m.setShared(mapBuffer, keys, source, actor, previous)
+	}
+
+	// Replacements and versioned updates must not interleave with other writers
+	if err := m.lockConfigMutable(); err!=nil {
+		return 0, err
+	}
+	defer m.configLock.Unlock()
+	if expected!=nil&&*expected!=m.version.Load() {
+		return m.version.Load(), ErrVersionMismatch
+	}
+	m.stats.writes.Add(1)
+	if previous!=nil {
+		for k := range mapBuffer {
+			if old, existed := m.config.peek(k); existed {
+				previous[k] = old
 			}
 		}
+	}
 
-		// Read next char which is expected to be '"'
-		if !getChar(&c)||c!='"' {
-			return fmt.Errorf(
-				"Failed to parse config file at: %s\nExpected '\"' after '=' on line: %d",
-				m.configPath, lineCount,
-			)
+	if !replace {
+		var changes []Change
+		now := time.Now()
+		for k,v := range mapBuffer {
+			if old, existed := m.config.put(k, v, source); !existed||old!=v {
+				changes = append(changes, Change{now, k, old, v, false, source, PRIMARY_LAYER, actor})
+			}
 		}
+		m.recordChanges(changes)
+		return m.version.Load(), nil
+	}
 
-		// Eat value
-		curVal.Reset()
-		for {
-			// EOF is not expected in value, every other char can be used
-			if !getChar(&c) {
-				return fmt.Errorf(
-					"Failed to parse config file at: %s\nUnexpected EOF on line: %d",
-					m.configPath, lineCount,
-				)
-			} else if c=='"' {
-				// Read until '"' char
-				break
-			}
-			// Add linecount
-			if c=='\n' {
-				lineCount++
+	current, currentSources := m.config.copy()
+	sourceBuffer := make(map[string]Source, len(mapBuffer))
+	for k := range mapBuffer {
+		sourceBuffer[k] = source
+	}
+	for k,v := range current {
+		if _, exists := mapBuffer[k]; !exists {
+			if currentSources[k]==SOURCE_DEFAULT {
+				mapBuffer[k] = v
+				sourceBuffer[k] = SOURCE_DEFAULT
+			} else {
+				// Removed keys are removed from the active profile aswell
+				delete(m.profileKeys, k)
+				delete(m.profileBase, k)
 			}
-			curVal.WriteByte(c)
-		}
-		// Insert first pair, the later pairs with same key are ignored
-		strKey, strVal := curKey.String(), curVal.String()
-		if _, exists := mapBuffer[strKey]; !exists {
-			mapBuffer[strKey] = strVal
 		}
 	}
+	changes := diffConfig(current, mapBuffer, source, PRIMARY_LAYER)
+	for i := range changes {
+		changes[i].Actor = actor
+	}
+	m.config.replace(mapBuffer, sourceBuffer)
+	m.recordChanges(changes)
+	return m.version.Load(), nil
+}
 
-	// Error is expected to be EOF, if not there was a reading failure
-	if err!=io.EOF {
+/**
+ * Returns the path of the backing config file (empty if the MetaConfig is memory-only)
+ */
+func (m* MetaConfig) Path() string {
+	return m.configPath
+}
+
+/**
+ * Read and Parse configuration directly from disk to inmem config
+ *
+ * If a key is placed multiple times, only the first one is evaluated
+ *
+ * Defaults (see SetDefault) of keys that are not present in the file are retained,
+ * every other key is replaced with the file content.
+ *
+ * File-backed layers (see AddLayer) are reloaded aswell,
+ * if any file fails to load, the inmem config is left untouched.
+ *
+ * Function will throw a runtime error if it fails
+ */
+func (m* MetaConfig) ReadFromDisk() error {
+	// Read lock the file config lock
+	m.rlockConfigFile()
+	defer m.configFileLock.RUnlock()
+	return m.readFromDisk()
+}
+
+/**
+ * Reads the config file like ReadFromDisk, the config file lock must be held
+ */
+func (m* MetaConfig) readFromDisk() error {
+	// Explicit loads supersede the lazy initial load
+	m.lazyPending.Store(false)
+	if m.configPath=="" {
+		return ErrMemoryOnly
+	}
+	m.stats.diskReads.Add(1)
+	defer func(start time.Time) {
+		m.stats.diskReadTime.Add(int64(time.Since(start)))
+	}(time.Now())
+
+	loaded, err := m.readConfigFile(m.configPath)
+	if err!=nil {
 		return err
 	}
+	if _, exists := loaded.profiles[m.profile]; m.profile!=""&&!exists {
+		return fmt.Errorf("Profile '%s' not found in config file at: %s", m.profile, m.configPath)
+	}
+	mapBuffer := loaded.config
+	m.stamp.Store(loaded.stamp)
+
+	// Collect file-backed layers, layers can't be added or removed while the file lock is held
+	locked := m.rlockConfig()
+	var fileLayers []*configLayer
+	for _, l := range m.layers {
+		if l.path!="" {
+			fileLayers = append(fileLayers, l)
+		}
+	}
+	m.runlockConfig(locked)
+
+	layerBuffers := make([]map[string]string, len(fileLayers))
+	for i, l := range fileLayers {
+		layerLoaded, err := m.readConfigFile(l.path)
+		if err!=nil {
+			return err
+		}
+		layerBuffers[i] = layerLoaded.config
+	}
 
 	// Write lock the inmen config lock
-	m.configLock.Lock()
+	if err := m.lockConfigMutable(); err!=nil {
+		return err
+	}
 	defer m.configLock.Unlock()
-	m.config = mapBuffer
+	current, currentSources := m.config.copy()
+	sourceBuffer := make(map[string]Source, len(mapBuffer))
+	for k := range mapBuffer {
+		sourceBuffer[k] = SOURCE_FILE
+	}
+	for k,v := range current {
+		if _, exists := mapBuffer[k]; !exists&&currentSources[k]==SOURCE_DEFAULT {
+			mapBuffer[k] = v
+			sourceBuffer[k] = SOURCE_DEFAULT
+		}
+	}
+	changes := diffConfig(current, mapBuffer, SOURCE_FILE, PRIMARY_LAYER)
+	m.config.replace(mapBuffer, sourceBuffer)
+	m.profiles = loaded.profiles
+	m.profileKeys = loaded.profileKeys
+	m.profileBase = loaded.profileBase
+	for i, l := range fileLayers {
+		changes = append(changes, diffConfig(l.config, layerBuffers[i], SOURCE_LAYER, l.name)...)
+		l.config = layerBuffers[i]
+	}
+	m.recordChanges(changes)
 	return nil
 }
 
+/**
+ * Written config file of a Flush
+ */
+type FlushResult struct {
+	Path string `json:"path"`
+	// Size of the written file in bytes
+	Bytes int64 `json:"bytes"`
+	// Hex encoded SHA-256 checksum of the written file
+	Checksum string `json:"checksum"`
+	// Version of the written configuration (see Version)
+	Version uint64 `json:"version"`
+}
+
 /**
  * Writes inmem configuration directly to disk
  *
+ * Only the primary configuration is written, layers are persisted with WriteLayerToDisk.
+ *
  * Function will throw a runtime error if it fails
  */
 func (m* MetaConfig) WriteToDisk() error {
+	_, err := m.Flush()
+	return err
+}
+
+/**
+ * Writes inmem configuration to disk like WriteToDisk and reports what was written
+ */
+func (m* MetaConfig) Flush() (res FlushResult, err error) {
+	if m.configPath=="" {
+		return res, ErrMemoryOnly
+	}
+	m.stats.diskWrites.Add(1)
+	defer func(start time.Time) {
+		m.stats.diskWriteTime.Add(int64(time.Since(start)))
+		if err!=nil {
+			m.stats.writeErrors.Add(1)
+		}
+	}(time.Now())
+
+	// Perform pending lazy load before the file lock is acquired
+	m.ensureLoaded()
 	// Write lock the file config lock
-	m.configFileLock.Lock()
+	m.lockConfigFile()
 	defer m.configFileLock.Unlock()
-	// Read lock the inmem config lock
-	m.configLock.RLock()
-	defer m.configLock.RUnlock()
+	// Read lock the inmem config lock and all shards, so that concurrent writers are not written halfway
+	defer m.runlockConfig(m.rlockConfig())
+	defer m.config.rlockAll()()
+
+	if err := m.checkConflict(); err!=nil {
+		return res, err
+	}
+
+	// Split the inmem config back into the common and the profile sections
+	common := make(map[string]string, m.config.len())
+	profiles := make(map[string]map[string]string, len(m.profiles))
+	for name, section := range m.profiles {
+		profiles[name] = section
+	}
+	if m.profile!="" {
+		profiles[m.profile] = make(map[string]string)
+	}
+	m.config.each(func(k string, v string) bool {
+		if m.profileKeys[k] {
+			profiles[m.profile][k] = v
+		} else {
+			common[k] = v
+		}
+		return true
+	})
+	for k,v := range m.profileBase {
+		common[k] = v
+	}
+	stamp, content, err := m.writeConfigFile(m.configPath, common, profiles)
+	if err!=nil {
+		return res, err
+	}
+	m.stamp.Store(stamp)
+	checksum := sha256.Sum256(content)
+	return FlushResult{
+		Path: m.configPath,
+		Bytes: int64(len(content)),
+		Checksum: hex.EncodeToString(checksum[:]),
+		Version: m.Version(),
+	}, nil
+}
+
+/**
+ * Config file content with the active profile applied
+ */
+type loadedConfig struct {
+	// Common pairs merged with the pairs of the active profile
+	config map[string]string
+	// Keys that are set by the active profile
+	profileKeys map[string]bool
+	// Common values shadowed by the active profile
+	profileBase map[string]string
+	// Pairs of every profile section by profile name
+	profiles map[string]map[string]string
+	// State of the config file (nil if conflict detection is disabled)
+	stamp *fileStamp
+}
+
+/**
+ * Reads, parses and validates a config file
+ *
+ * The active profile is applied to the parsed configuration before it is validated.
+ *
+ * The caller must hold the config file lock.
+ */
+func (m* MetaConfig) readConfigFile(path string) (*loadedConfig, error) {
+	// Stat config file before reading it, so that the stamp never outdates the content
+	var info os.FileInfo
+	var err error
+	if m.conflictDetection {
+		info, err = os.Stat(path)
+		if err!=nil {
+			return nil, err
+		}
+	}
+	// Read config file
+	content, err := os.ReadFile(path)
+	if err!=nil {
+		return nil, err
+	}
+	var stamp *fileStamp
+	if info!=nil {
+		stamp = newFileStamp(info, content)
+	}
+
+	// Decompress gzip files, detected by their magic bytes
+	if isCompressed(content) {
+		content, err = decompressContent(content)
+		if err!=nil {
+			return nil, fmt.Errorf("Failed to decompress config file at: %s\n%w", path, err)
+		}
+	}
+
+	// Verify and strip signature if a signing key is set
+	if m.signingKey!=nil {
+		content, err = verifyContent(m.signingKey, content)
+		if err!=nil {
+			return nil, fmt.Errorf("Failed to verify config file at: %s\n%w", path, err)
+		}
+	}
+
+	parsed, err := parseConfig(bytes.NewReader(content), path, m.parseKey)
+	if err!=nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			m.stats.parseErrors.Add(1)
+		}
+		return nil, err
+	}
+	loaded := parsed.applyProfile(m.profile)
+	loaded.stamp = stamp
+	mapBuffer := loaded.config
 
+	// Reject the whole configuration if any value is invalid
+	var validationErrs []error
+	for k,v := range mapBuffer {
+		if err := m.validate(k, v); err!=nil {
+			validationErrs = append(validationErrs, err)
+		}
+	}
+	if len(validationErrs)>0 {
+		return nil, fmt.Errorf(
+			"Failed to validate config file at: %s\n%w",
+			path, errors.Join(validationErrs...),
+		)
+	}
+	return loaded, nil
+}
+
+/**
+ * Serializes and writes a configuration to the config file
+ *
+ * Profile sections are appended after the common pairs.
+ *
+ * If a signing key is set, the content is signed.
+ * If compression is enabled, the (signed) content is gzip-compressed.
+ *
+ * Returns the stamp of the written file (nil if conflict detection is disabled) and the written content.
+ *
+ * The caller must hold the config file lock.
+ */
+func (m* MetaConfig) writeConfigFile(path string, config map[string]string, profiles map[string]map[string]string) (*fileStamp, []byte, error) {
+	if len(m.prefixes)>0 {
+		return nil, nil, fmt.Errorf("Can't write config file at: %s\nOnly a subset of the keys is loaded (WithPrefixes)", path)
+	}
 	// Outstr buffer
 	var outstr string
 	// Open tmp config file
-	file, err := os.OpenFile(m.configPath+TMP_FILE_EXTENSION, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	file, err := os.OpenFile(path+TMP_FILE_EXTENSION, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
 	if err!=nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Insert deparsed configuration
 	outstr += "# Manual changes to configuration may be overwritten\n"
 	outstr += "# Consider using Meta Hook from the Cthulhu component\n"
-	for k,v := range m.config {
-		outstr += k
-		outstr += "="
-		outstr += "\""
-		outstr += v
-		outstr += "\""
-		outstr += "\n"
+	for k,v := range config {
+		outstr += serializePair(k, v)
+	}
+	for name, section := range profiles {
+		outstr += "[" + PROFILE_SECTION_PREFIX + name + "]\n"
+		for k,v := range section {
+			outstr += serializePair(k, v)
+		}
 	}
 	outstr += "# End of config\n"
+	content := []byte(outstr)
+	if m.signingKey!=nil {
+		content = signContent(m.signingKey, content)
+	}
+	if m.compress {
+		content, err = compressContent(content)
+		if err!=nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
 	
-	_, err = file.Write([]byte(outstr))
+	_, err = file.Write(content)
 	if err!=nil {
 		file.Close()
-		return err
+		return nil, nil, err
 	}
 	
 	err = file.Close()
 	if err!=nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Move tmp config to config
 	// This prevents file corruption on unexpected application crashes (e.g. shutdown while writing).
-	return os.Rename(m.configPath + TMP_FILE_EXTENSION, m.configPath)
+	if err = os.Rename(path + TMP_FILE_EXTENSION, path); err!=nil {
+		return nil, nil, err
+	}
+	if !m.conflictDetection {
+		return nil, content, nil
+	}
+	info, err := os.Stat(path)
+	if err!=nil {
+		return nil, nil, err
+	}
+	return newFileStamp(info, content), content, nil
 }
@@ -0,0 +1,227 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metaconfig
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"sync/atomic"
+	"testing"
+)
+
+/**
+ * Number of keys of every bulk update in the benchmarks
+ */
+const BENCHMARK_BULK_SIZE = 256
+
+/**
+ * Creates the bulk updates of a benchmark writer, every writer updates its own keys
+ *
+ * Every key has a range constraint, so that the validation outside of the locks is part of the benchmark.
+ */
+func benchmarkBulk(m *MetaConfig, writer int64) []map[string]string {
+	keys := make([]string, BENCHMARK_BULK_SIZE)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("writer%d.key%d", writer, i)
+		m.Constrain(keys[i], Range(0, 1<<20))
+	}
+	// Alternating values, so that every update changes every key
+	updates := make([]map[string]string, 2)
+	for i := range updates {
+		updates[i] = make(map[string]string, len(keys))
+		for j, key := range keys {
+			updates[i][key] = fmt.Sprint(j*2+i)
+		}
+	}
+	return updates
+}
+
+/**
+ * Bulk updates of a single writer, the baseline of BenchmarkSetConfigParallel
+ */
+func BenchmarkSetConfig(b *testing.B) {
+	m := NewMemoryConfig()
+	updates := benchmarkBulk(m, 0)
+	b.ResetTimer()
+	for i := 0; i<b.N; i++ {
+		if err := m.SetConfig(updates[i%2]); err!=nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*BENCHMARK_BULK_SIZE), "ns/key")
+}
+
+/**
+ * Concurrent bulk updates of distinct keys (run with -cpu 1,2,4,8 to compare the scaling)
+ *
+ * The keys are validated before any lock is acquired,
+ * concurrent updates then pass the shards of the store one after another (see configStore.pipeline).
+ */
+func BenchmarkSetConfigParallel(b *testing.B) {
+	m := NewMemoryConfig()
+	var writers atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		updates := benchmarkBulk(m, writers.Add(1))
+		for i := 0; pb.Next(); i++ {
+			if err := m.SetConfig(updates[i%2]); err!=nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*BENCHMARK_BULK_SIZE), "ns/key")
+}
+
+/**
+ * Concurrent bulk updates interleaved with reads of the updated keys
+ *
+ * Every fourth operation is a bulk update, the others read a single key.
+ */
+func BenchmarkSetConfigParallelReads(b *testing.B) {
+	m := NewMemoryConfig()
+	var writers atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		writer := writers.Add(1)
+		updates := benchmarkBulk(m, writer)
+		key := fmt.Sprintf("writer%d.key0", writer)
+		for i := 0; pb.Next(); i++ {
+			if i%4!=0 {
+				m.GetString(&key)
+				continue
+			}
+			if err := m.SetConfig(updates[i%8/4]); err!=nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+/**
+ * Inputs of the parser edge cases, seeds of FuzzParseConfig
+ *
+ * Crashers found by the fuzzer are added here, so that they are checked on every test run.
+ */
+var parserSeeds = []string{
+	// LF, CRLF and CR-only line endings
+	"a=\"1\"\nb=\"2\"\n",
+	"a=\"1\"\r\nb=\"2\"\r\n",
+	"a=\"1\"\rb=\"2\"\r",
+	// The key ends at the first '=', later ones belong to the value
+	"a=\"b=c\"\n",
+	"a==\"b\"\n",
+	// UTF-8 byte order mark
+	"\xef\xbb\xbfa=\"1\"\n",
+	// Crasher: comment terminated by a CR-only line ending swallowed the next pair
+	"# comment\ra=\"1\"\r",
+	// Crasher: CR-only line ending inside a section header
+	"[profile:x\ra=\"1\"\r",
+	"[profile:x]\ra=\"1\"\r[common]\rb=\"2\"\r",
+	// Crasher: heredoc delimiter terminated by a CR-only line ending
+	"a=<<EOF\rvalue\rEOF\r",
+	"a=<<EOF\r\nline1\r\nline2\r\nEOF\r\n",
+	"a=<<EOF\nline \"1\"\nEOF\n",
+	// Crasher: key starting with a byte order mark lost it when serialized at the file start
+	" \ufeff=\"\"",
+}
+
+/**
+ * Expected common pairs of the parser edge cases
+ */
+func TestParseConfigEdgeCases(t *testing.T) {
+	cases := map[string]map[string]string{
+		"a=\"1\"\rb=\"2\"\r": {"a": "1", "b": "2"},
+		"a=\"1\"\r\nb=\"2\"\r\n": {"a": "1", "b": "2"},
+		"a=\"b=c\"\n": {"a": "b=c"},
+		"\xef\xbb\xbfa=\"1\"\n": {"a": "1"},
+		"# comment\ra=\"1\"\r": {"a": "1"},
+	}
+	for input, expected := range cases {
+		parsed, err := parseConfig(bytes.NewReader([]byte(input)), "test", nil)
+		if err!=nil {
+			t.Errorf("Failed to parse %q: %v", input, err)
+			continue
+		}
+		if !maps.Equal(parsed.common, expected) {
+			t.Errorf("Parsed %q as %v, expected %v", input, parsed.common, expected)
+		}
+	}
+	if checkKey("\ufeffa")==nil {
+		t.Errorf("Accepted key with a leading byte order mark")
+	}
+	for _, input := range []string{"[profile:x\ra=\"1\"\r", "a=<<EOF\rvalue\rEOF\r"} {
+		if _, err := parseConfig(bytes.NewReader([]byte(input)), "test", nil); err==nil {
+			t.Errorf("Parsed %q without an error", input)
+		}
+	}
+}
+
+/**
+ * Every successfully parsed input is serialized and parsed again,
+ * the second parse must succeed and yield exactly the same configuration
+ *
+ * Inputs with keys rejected by checkKey are skipped, they can't be written back.
+ *
+ * Run with: go test -fuzz FuzzParseConfig ./shared/metaconfig
+ */
+func FuzzParseConfig(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parsed, err := parseConfig(bytes.NewReader(data), "fuzz", nil)
+		if err!=nil {
+			return
+		}
+		for _, pair := range parsed.pairs {
+			if checkKey(pair.key)!=nil {
+				return
+			}
+		}
+
+		var outstr string
+		for k,v := range parsed.common {
+			outstr += serializePair(k, v)
+		}
+		for name, section := range parsed.profiles {
+			outstr += "[" + PROFILE_SECTION_PREFIX + name + "]\n"
+			for k,v := range section {
+				outstr += serializePair(k, v)
+			}
+		}
+
+		reparsed, err := parseConfig(bytes.NewReader([]byte(outstr)), "fuzz", nil)
+		if err!=nil {
+			t.Fatalf("Serialized config does not parse: %v\n%q", err, outstr)
+		}
+		if !maps.Equal(parsed.common, reparsed.common)||len(parsed.profiles)!=len(reparsed.profiles) {
+			t.Fatalf("Serialized config differs:\n%q", outstr)
+		}
+		for name, section := range parsed.profiles {
+			if !maps.Equal(section, reparsed.profiles[name]) {
+				t.Fatalf("Serialized profile '%s' differs:\n%q", name, outstr)
+			}
+		}
+	})
+}
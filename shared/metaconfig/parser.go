@@ -0,0 +1,381 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Error emitted when the config file has invalid syntax
+ */
+type ParseError struct {
+	// Path of the parsed config file
+	Path string
+	// Line on which the error occured
+	Line int
+	// Description of the syntax error
+	Msg string
+}
+
+func (p* ParseError) Error() string {
+	return fmt.Sprintf("Failed to parse config file at: %s\n%s on line: %d", p.Path, p.Msg, p.Line)
+}
+
+/**
+ * Configuration parsed from a config file
+ */
+type parsedConfig struct {
+	// Pairs outside of any profile section
+	common map[string]string
+	// Pairs of every profile section by profile name
+	profiles map[string]map[string]string
+	// Every parsed pair in file order, duplicates included
+	pairs []parsedPair
+}
+
+/**
+ * Single pair occurrence in a config file
+ */
+type parsedPair struct {
+	// Profile name of the section (empty for the common section)
+	profile string
+	key string
+	value string
+	// Line of the key (1-based)
+	line int
+}
+
+/**
+ * Parses a configuration from the reader
+ *
+ * If a key is placed multiple times in the same section, only the first one is evaluated
+ *
+ * Path is only used for error messages.
+ *
+ * If parseKey is not nil, every key is passed through it,
+ * it returns the key to insert and false if the pair shall be skipped.
+ *
+ * Values are either quoted ("value") or raw heredoc blocks:
+ *
+ * ```
+ * somekey=<<EOF
+ * Everything until a line containing only the delimiter is taken literally, "quotes" included
+ * EOF
+ * ```
+ *
+ * Pairs following a [profile:<name>] header belong to that profile,
+ * a [common] header switches back to the common section.
+ *
+ * LF, CRLF and CR-only line endings are accepted, heredoc blocks require LF or CRLF.
+ * Values are taken literally, line endings inside of them are not converted.
+ * A leading UTF-8 byte order mark is skipped.
+ */
+func parseConfig(input io.Reader, path string, parseKey func(key string) (string, bool)) (*parsedConfig, error) {
+	parsed := &parsedConfig{
+		common: make(map[string]string),
+		profiles: make(map[string]map[string]string),
+	}
+	// Section the parsed pairs are inserted to
+	mapBuffer := parsed.common
+	// Profile name of the current section
+	var profile string
+
+	// Create buffered reader
+	reader := bufio.NewReader(input)
+	// Skip UTF-8 byte order mark
+	if bom, _ := reader.Peek(3); bytes.Equal(bom, []byte{0xef, 0xbb, 0xbf}) {
+		reader.Discard(3)
+	}
+
+	// Last reader error
+	var err error
+	// Char buffer
+	var c byte
+	// Keeps track of lines for debug messages
+	var lineCount int = 0
+	// Current key buffer
+	var curKey strings.Builder
+	// Current value buffer
+	var curVal strings.Builder
+
+	// Unnamed helper function to read one char at a time
+	getChar := func(char *byte) bool {
+		var val byte
+		// Read next byte from stream
+		val, err = reader.ReadByte()
+		if err!=nil {
+			return false
+		}
+		*char = val
+		return true
+	}
+
+	// Unnamed helper function to check if a '\r' is a CR-only line ending (not followed by '\n')
+	isLoneCR := func() bool {
+		next, err := reader.Peek(1)
+		return err!=nil||next[0]!='\n'
+	}
+
+	// Unnamed helper function to create a parse error on the current line
+	parseErr := func(msg string) error {
+		return &ParseError{path, lineCount, msg}
+	}
+
+	// Iterate over chars
+	for {
+		// Eat next char
+		if !getChar(&c) {
+			break
+		}
+		// Skip newline (LF, CRLF or CR-only)
+		if c=='\n'||(c=='\r'&&isLoneCR()) {
+			lineCount++
+			continue
+		}
+		// Skip space, tab
+		if c==' '||c=='\t'||c=='\r' {
+			continue
+		}
+		// # | / indicate a comment
+		if c=='#'||c=='/' {
+			// Skip til EOF or newline, the newline itself is processed by the main loop
+			for {
+				if !getChar(&c) {
+					break
+				} else if c=='\n'||c=='\r' {
+					reader.UnreadByte()
+					break
+				}
+			}
+			continue
+		}
+		// [ indicates a section header
+		if c=='[' {
+			var sectionBuf strings.Builder
+			for {
+				// EOF or newline in section header is not allowed
+				if !getChar(&c)||c=='\n'||c=='\r' {
+					return nil, parseErr("Unexpected EOF or newline in section header")
+				} else if c==']' {
+					break
+				}
+				sectionBuf.WriteByte(c)
+			}
+			section := strings.TrimSpace(sectionBuf.String())
+			if section==COMMON_SECTION {
+				mapBuffer = parsed.common
+				profile = ""
+			} else if name, found := strings.CutPrefix(section, PROFILE_SECTION_PREFIX); found&&name!="" {
+				if _, exists := parsed.profiles[name]; !exists {
+					parsed.profiles[name] = make(map[string]string)
+				}
+				mapBuffer = parsed.profiles[name]
+				profile = name
+			} else {
+				return nil, parseErr("Unknown section '" + section + "'")
+			}
+			continue
+		}
+
+		// Eat key
+		keyLine := lineCount+1
+		curKey.Reset()
+		for {
+			curKey.WriteByte(c)
+			// EOF or newline in key is not allowed
+			if !getChar(&c)||c=='\n'||c=='\r' {
+				return nil, parseErr("Unexpected EOF or newline")
+			}
+			// Read until '=' char
+			if c=='=' {
+				break
+			}
+		}
+
+		// Read next char which is expected to be '"' or the '<<' heredoc operator
+		if !getChar(&c)||(c!='"'&&c!='<') {
+			return nil, parseErr("Expected '\"' or '<<' after '='")
+		}
+
+		curVal.Reset()
+		if c=='<' {
+			if !getChar(&c)||c!='<' {
+				return nil, parseErr("Expected '<<' after '='")
+			}
+			// Eat heredoc delimiter until newline
+			var delimBuf strings.Builder
+			for {
+				if !getChar(&c) {
+					return nil, parseErr("Unexpected EOF in heredoc delimiter")
+				} else if c=='\n' {
+					break
+				} else if c=='\r'&&isLoneCR() {
+					return nil, parseErr("Heredoc blocks require LF or CRLF line endings")
+				}
+				delimBuf.WriteByte(c)
+			}
+			lineCount++
+			delim := strings.TrimRight(delimBuf.String(), " \t\r")
+			if delim=="" {
+				return nil, parseErr("Empty heredoc delimiter")
+			}
+			// Eat raw lines until the delimiter line
+			var lineBuf strings.Builder
+			first := true
+			for {
+				gotChar := getChar(&c)
+				if gotChar&&c!='\n' {
+					lineBuf.WriteByte(c)
+					continue
+				}
+				line := lineBuf.String()
+				lineBuf.Reset()
+				if strings.TrimRight(line, "\r")==delim {
+					break
+				}
+				if !gotChar {
+					return nil, parseErr("Unexpected EOF in heredoc, missing delimiter '" + delim + "'")
+				}
+				lineCount++
+				if !first {
+					curVal.WriteByte('\n')
+				}
+				curVal.WriteString(line)
+				first = false
+			}
+			if err==nil {
+				lineCount++
+			}
+		} else {
+			// Eat quoted value
+			for {
+				// EOF is not expected in value, every other char can be used
+				if !getChar(&c) {
+					return nil, parseErr("Unexpected EOF")
+				} else if c=='"' {
+					// Read until '"' char
+					break
+				}
+				// Add linecount
+				if c=='\n' {
+					lineCount++
+				}
+				curVal.WriteByte(c)
+			}
+		}
+		// Insert first pair, the later pairs with same key are ignored
+		strKey, strVal := curKey.String(), curVal.String()
+		if parseKey!=nil {
+			var keep bool
+			if strKey, keep = parseKey(strKey); !keep {
+				continue
+			}
+		}
+		if _, exists := mapBuffer[strKey]; !exists {
+			mapBuffer[strKey] = strVal
+		}
+		parsed.pairs = append(parsed.pairs, parsedPair{profile, strKey, strVal, keyLine})
+	}
+
+	// Error is expected to be EOF, if not there was a reading failure
+	if err!=io.EOF {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+/**
+ * Serializes a key-value pair into the config file syntax
+ *
+ * Values containing '"' can't be quoted, they are emitted as heredoc block
+ * with a delimiter that does not collide with any line of the value.
+ */
+func serializePair(key string, value string) string {
+	if !strings.Contains(value, "\"") {
+		return key + "=\"" + value + "\"\n"
+	}
+
+	lines := strings.Split(value, "\n")
+	delim := "EOF"
+	for i := 1; ; i++ {
+		collision := false
+		for _, line := range lines {
+			if strings.TrimRight(line, " \t\r")==delim {
+				collision = true
+				break
+			}
+		}
+		if !collision {
+			break
+		}
+		delim = "EOF" + strconv.Itoa(i)
+	}
+	return key + "=<<" + delim + "\n" + value + "\n" + delim + "\n"
+}
+
+/**
+ * Checks if a key can be serialized into the config file syntax
+ *
+ * Keys must not be empty, must not contain '=' or line breaks
+ * and must not start with whitespace or a char that introduces a comment or section.
+ * A leading UTF-8 byte order mark is rejected, it would be skipped when the key starts the file.
+ */
+func checkKey(key string) error {
+	if key=="" {
+		return errors.New("Invalid key: key must not be empty")
+	} else if strings.ContainsAny(key, "=\n\r") {
+		return fmt.Errorf("Invalid key '%s': key must not contain '=' or line breaks", key)
+	} else if strings.ContainsAny(key[:1], " \t#/[") {
+		return fmt.Errorf("Invalid key '%s': key must not start with whitespace, '#', '/' or '['", key)
+	} else if strings.HasPrefix(key, "\ufeff") {
+		return fmt.Errorf("Invalid key '%s': key must not start with a byte order mark", key)
+	}
+	return nil
+}
+
+/**
+ * Checks the syntax of a config file without loading it
+ *
+ * Gzip-compressed files are decompressed, signatures are not verified.
+ *
+ * Returns a *ParseError if the syntax is invalid, intended for tooling like linters or CI checks.
+ */
+func ValidateFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err!=nil {
+		return err
+	}
+	if isCompressed(content) {
+		content, err = decompressContent(content)
+		if err!=nil {
+			return fmt.Errorf("Failed to decompress config file at: %s\n%w", path, err)
+		}
+	}
+	_, err = parseConfig(bytes.NewReader(content), path, nil)
+	return err
+}
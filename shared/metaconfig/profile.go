@@ -0,0 +1,122 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"sort"
+)
+
+/**
+ * Prefix of profile section headers ([profile:<name>])
+ */
+const PROFILE_SECTION_PREFIX string = "profile:"
+
+/**
+ * Name of the common section header ([common])
+ */
+const COMMON_SECTION string = "common"
+
+/**
+ * Selects the profile that is applied when the config file is read
+ */
+func WithProfile(name string) Option {
+	return func(m *MetaConfig) {
+		m.profile = name
+	}
+}
+
+/**
+ * Selects the active profile and rereads the config file
+ *
+ * Pairs of the active profile section override the common pairs,
+ * the pairs of all other profiles are ignored (but retained on WriteToDisk).
+ *
+ * Set* operations on keys defined by the active profile are written back to its section.
+ *
+ * Passing an empty name deactivates profiles.
+ *
+ * The profile is switched and the file reread under one acquisition of the config file lock,
+ * so that no concurrent read or write observes the new profile with the old content.
+ * If the file fails to load, the previous profile is kept active.
+ */
+func (m* MetaConfig) UseProfile(name string) error {
+	m.lockConfigFile()
+	defer m.configFileLock.Unlock()
+
+	previous := m.profile
+	m.profile = name
+	if m.configPath=="" {
+		return nil
+	}
+	if err := m.readFromDisk(); err!=nil {
+		m.profile = previous
+		return err
+	}
+	return nil
+}
+
+/**
+ * Returns the name of the active profile (empty if none)
+ */
+func (m* MetaConfig) Profile() string {
+	m.rlockConfigFile()
+	defer m.configFileLock.RUnlock()
+	return m.profile
+}
+
+/**
+ * Returns the names of all profiles defined in the config file
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Profiles() []string {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	names := make([]string, 0, len(m.profiles))
+	for name := range m.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+ * Merges the pairs of the profile into the common pairs
+ */
+func (p* parsedConfig) applyProfile(profile string) *loadedConfig {
+	loaded := &loadedConfig{
+		config: make(map[string]string, len(p.common)),
+		profileKeys: make(map[string]bool),
+		profileBase: make(map[string]string),
+		profiles: p.profiles,
+	}
+	for k,v := range p.common {
+		loaded.config[k] = v
+	}
+	for k,v := range p.profiles[profile] {
+		if base, exists := loaded.config[k]; exists {
+			loaded.profileBase[k] = base
+		}
+		loaded.config[k] = v
+		loaded.profileKeys[k] = true
+	}
+	return loaded
+}
@@ -0,0 +1,92 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"io"
+)
+
+/**
+ * Placeholder that replaces redacted values in exports
+ */
+const REDACTED_VALUE string = "<redacted>"
+
+/**
+ * Marks keys as redacted
+ *
+ * Redacted keys are still persisted to the config files with WriteToDisk,
+ * but their values are replaced with REDACTED_VALUE in every plaintext export
+ * (e.g. GetRedactedConfig, ExportJSON).
+ *
+ * This is no replacement for encryption, the values are still held in plaintext in memory and on disk.
+ */
+func (m* MetaConfig) Redact(keys ...string) {
+	m.redactLock.Lock()
+	defer m.redactLock.Unlock()
+
+	if m.redacted==nil {
+		m.redacted = make(map[string]bool)
+	}
+	for _, key := range keys {
+		m.redacted[m.canonicalKey(key)] = true
+	}
+}
+
+/**
+ * Returns true if the key is marked as redacted
+ */
+func (m* MetaConfig) IsRedacted(key *string) bool {
+	m.redactLock.RLock()
+	defer m.redactLock.RUnlock()
+
+	return m.redacted[m.canonicalKey(*key)]
+}
+
+/**
+ * Get full parsed configuration object with redacted values replaced by REDACTED_VALUE
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetRedactedConfig() map[string]string {
+	locked := m.rlockConfig()
+	m.stats.reads.Add(1)
+	config := m.resolve()
+	m.runlockConfig(locked)
+
+	m.redactLock.RLock()
+	defer m.redactLock.RUnlock()
+	for k := range config {
+		if m.redacted[k] {
+			config[k] = REDACTED_VALUE
+		}
+	}
+	return config
+}
+
+/**
+ * Writes the full configuration as JSON object to the writer
+ *
+ * Redacted values are replaced by REDACTED_VALUE.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) ExportJSON(w io.Writer) error {
+	return m.Export(w, EXPORT_JSON, nil)
+}
@@ -0,0 +1,177 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metaconfig
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+/**
+ * Prefix of sealed values (see Seal)
+ */
+const SEALED_PREFIX string = "sealed:v1:"
+
+/**
+ * Error returned by GetSealed if the value of the key is not sealed
+ */
+var ErrNotSealed = errors.New("Value is not sealed")
+
+/**
+ * Error returned by GetSealed if the MetaConfig has no sealing key (see SetSealingKey)
+ */
+var ErrNoSealingKey = errors.New("MetaConfig has no sealing key")
+
+/**
+ * Encrypts the plaintext value of the key for the holder of the private key of pub (X25519)
+ *
+ * The value is encrypted with AES-256-GCM under a key derived from an ephemeral X25519 exchange
+ * and bound to the key, so a sealed value can't be moved to another key
+ * (pass the key as it is stored, see WithCanonicalKeys).
+ * The sealed value is SEALED_PREFIX followed by the base64 encoded ephemeral public key, nonce and ciphertext.
+ *
+ * Sealed values are stored like any other value (in memory and in the config file), only GetSealed reveals the plaintext.
+ */
+func Seal(pub *ecdh.PublicKey, key string, plaintext string) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err!=nil {
+		return "", err
+	}
+	aead, err := sealingCipher(ephemeral, pub, ephemeral.PublicKey())
+	if err!=nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err!=nil {
+		return "", err
+	}
+	envelope := append(ephemeral.PublicKey().Bytes(), nonce...)
+	envelope = aead.Seal(envelope, nonce, []byte(plaintext), []byte(key))
+	return SEALED_PREFIX + base64.StdEncoding.EncodeToString(envelope), nil
+}
+
+/**
+ * Returns true if the value is a well-formed sealed value
+ *
+ * The ciphertext is not authenticated, a sealed value may still fail to unseal.
+ */
+func IsSealed(value string) bool {
+	_, err := parseSealed(value)
+	return err==nil
+}
+
+/**
+ * Sets the X25519 private key used by GetSealed to unseal values
+ *
+ * The key is only held in memory, passing nil removes it.
+ */
+func (m* MetaConfig) SetSealingKey(key *ecdh.PrivateKey) {
+	m.sealingKey.Store(key)
+}
+
+/**
+ * Returns the public key values are sealed with (nil if no sealing key is set)
+ */
+func (m* MetaConfig) SealingPublicKey() *ecdh.PublicKey {
+	key := m.sealingKey.Load()
+	if key==nil {
+		return nil
+	}
+	return key.PublicKey()
+}
+
+/**
+ * Get the plaintext of a sealed value of a specific key
+ *
+ * Returns ErrNotSealed if the key does not exist or its value is not sealed,
+ * and ErrNoSealingKey if no sealing key is set.
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) GetSealed(key *string) (string, error) {
+	private := m.sealingKey.Load()
+	if private==nil {
+		return "", ErrNoSealingKey
+	}
+	envelope, err := parseSealed(m.GetString(key))
+	if err!=nil {
+		return "", err
+	}
+
+	size := len(private.PublicKey().Bytes())
+	ephemeral, err := ecdh.X25519().NewPublicKey(envelope[:size])
+	if err!=nil {
+		return "", ErrNotSealed
+	}
+	aead, err := sealingCipher(private, ephemeral, ephemeral)
+	if err!=nil {
+		return "", err
+	}
+	nonce, ciphertext := envelope[size:size+aead.NonceSize()], envelope[size+aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(m.canonicalKey(*key)))
+	if err!=nil {
+		return "", errors.New("Failed to unseal value, it was sealed for another key or sealing key")
+	}
+	return string(plaintext), nil
+}
+
+/**
+ * Decodes the envelope of a sealed value
+ */
+func parseSealed(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, SEALED_PREFIX) {
+		return nil, ErrNotSealed
+	}
+	envelope, err := base64.StdEncoding.DecodeString(value[len(SEALED_PREFIX):])
+	// Ephemeral public key (32), nonce (12) and GCM tag (16)
+	if err!=nil||len(envelope)<32+12+16 {
+		return nil, ErrNotSealed
+	}
+	return envelope, nil
+}
+
+/**
+ * Derives the AES-256-GCM cipher of the X25519 exchange
+ *
+ * The ephemeral public key is part of the derivation, so that the cipher is bound to the envelope.
+ */
+func sealingCipher(private *ecdh.PrivateKey, remote *ecdh.PublicKey, ephemeral *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := private.ECDH(remote)
+	if err!=nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(SEALED_PREFIX))
+	hash.Write(shared)
+	hash.Write(ephemeral.Bytes())
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err!=nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
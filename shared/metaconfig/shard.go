@@ -0,0 +1,268 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metaconfig
+
+import (
+	"sync"
+)
+
+/**
+ * Number of shards of the primary inmem configuration
+ */
+const CONFIG_SHARDS = 32
+
+/**
+ * Shard of the primary inmem configuration holding the keys with the same hash
+ */
+type configShard struct {
+	lock sync.RWMutex
+	values map[string]string
+	// Source of every key in the shard
+	sources map[string]Source
+	// Version of the last mutation of every key (see KeyVersion)
+	versions map[string]uint64
+}
+
+/**
+ * Primary inmem configuration split into shards, so that concurrent updates don't serialize on a single lock
+ *
+ * The config lock guards the store as a whole:
+ * holders of the exclusive config lock access the shards directly (see peek, put and remove),
+ * holders of the read lock (readers and concurrent writers, see pipeline) lock the shards they access.
+ * Shards are always locked in ascending order, so that readers and writers can't deadlock.
+ */
+type configStore struct {
+	shards [CONFIG_SHARDS]configShard
+}
+
+/**
+ * Returns the shard of the key (FNV-1a hash)
+ */
+func (s* configStore) shard(key string) *configShard {
+	return &s.shards[shardIndex(key)]
+}
+
+func shardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i<len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash%CONFIG_SHARDS)
+}
+
+/**
+ * Replaces all values and sources of the store, versions are retained
+ *
+ * The caller must hold the exclusive config lock.
+ */
+func (s* configStore) replace(values map[string]string, sources map[string]Source) {
+	for i := range s.shards {
+		s.shards[i].values = make(map[string]string)
+		s.shards[i].sources = make(map[string]Source)
+	}
+	for k,v := range values {
+		shard := s.shard(k)
+		shard.values[k] = v
+		shard.sources[k] = sources[k]
+	}
+}
+
+/**
+ * Returns the value of the key without locking its shard
+ *
+ * The caller must hold the exclusive config lock or the lock of the shard (see lockKeys).
+ */
+func (s* configStore) peek(key string) (string, bool) {
+	val, exists := s.shard(key).values[key]
+	return val, exists
+}
+
+/**
+ * Sets the value of the key without locking its shard and returns the replaced value
+ *
+ * The caller must hold the exclusive config lock or the lock of the shard (see lockKeys).
+ */
+func (s* configStore) put(key string, value string, source Source) (string, bool) {
+	shard := s.shard(key)
+	if shard.values==nil {
+		shard.values = make(map[string]string)
+		shard.sources = make(map[string]Source)
+	}
+	old, existed := shard.values[key]
+	shard.values[key] = value
+	shard.sources[key] = source
+	return old, existed
+}
+
+/**
+ * Removes the key without locking its shard
+ *
+ * The caller must hold the exclusive config lock or the lock of the shard (see lockKeys).
+ */
+func (s* configStore) remove(key string) {
+	shard := s.shard(key)
+	delete(shard.values, key)
+	delete(shard.sources, key)
+}
+
+/**
+ * Records the version of the last mutation of the key without locking its shard
+ *
+ * The caller must hold the exclusive config lock or the lock of the shard (see lockKeys).
+ */
+func (s* configStore) setVersion(key string, version uint64) {
+	shard := s.shard(key)
+	if shard.versions==nil {
+		shard.versions = make(map[string]uint64)
+	}
+	shard.versions[key] = version
+}
+
+/**
+ * Returns the value of the key
+ */
+func (s* configStore) get(key string) (string, bool) {
+	shard := s.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	val, exists := shard.values[key]
+	return val, exists
+}
+
+/**
+ * Returns the source of the key (SOURCE_NONE if not found)
+ */
+func (s* configStore) source(key string) Source {
+	shard := s.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	if source, exists := shard.sources[key]; exists {
+		return source
+	}
+	return SOURCE_NONE
+}
+
+/**
+ * Returns the version of the last mutation of the key
+ */
+func (s* configStore) version(key string) uint64 {
+	shard := s.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.versions[key]
+}
+
+/**
+ * Passes a mutation of the keys through all shards with lock coupling
+ *
+ * Every shard is write locked in ascending order and only released after the next shard is locked,
+ * so concurrent writers pass the shards in the order they entered and can't overtake each other:
+ * writers on different shards run in parallel, while every shard observes all writers in the same order.
+ * Readers locking all shards (see rlockAll) observe a writer entirely or not at all.
+ *
+ * Enter is called while the first shard is locked, leave while the last shard is locked
+ * (both in the entry order of the writers, e.g. to allocate and publish versions),
+ * apply is called with the keys of every shard while the shard is locked.
+ */
+func (s* configStore) pipeline(keys []string, enter func(), apply func(keys []string), leave func()) {
+	var groups [CONFIG_SHARDS][]string
+	for _, key := range keys {
+		i := shardIndex(key)
+		groups[i] = append(groups[i], key)
+	}
+	s.shards[0].lock.Lock()
+	enter()
+	for i := range s.shards {
+		if len(groups[i])>0 {
+			apply(groups[i])
+		}
+		if i+1<CONFIG_SHARDS {
+			s.shards[i+1].lock.Lock()
+		} else {
+			leave()
+		}
+		s.shards[i].lock.Unlock()
+	}
+}
+
+/**
+ * Read locks all shards in ascending order and returns the function to unlock them
+ *
+ * Concurrent bulk updates hold the locks of all their shards, so they are observed entirely or not at all.
+ */
+func (s* configStore) rlockAll() func() {
+	for i := range s.shards {
+		s.shards[i].lock.RLock()
+	}
+	return func() {
+		for i := range s.shards {
+			s.shards[i].lock.RUnlock()
+		}
+	}
+}
+
+/**
+ * Calls the callback for every pair until it returns false, order is not specified
+ *
+ * Returns false if the iteration was stopped by the callback.
+ * The caller must hold the exclusive config lock or all shard locks (see rlockAll).
+ */
+func (s* configStore) each(callback func(key string, value string) bool) bool {
+	for i := range s.shards {
+		for k,v := range s.shards[i].values {
+			if !callback(k, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/**
+ * Returns the number of keys
+ *
+ * The caller must hold the exclusive config lock or all shard locks (see rlockAll).
+ */
+func (s* configStore) len() int {
+	n := 0
+	for i := range s.shards {
+		n += len(s.shards[i].values)
+	}
+	return n
+}
+
+/**
+ * Returns a copy of all values and sources
+ *
+ * The caller must hold the exclusive config lock or all shard locks (see rlockAll).
+ */
+func (s* configStore) copy() (map[string]string, map[string]Source) {
+	values := make(map[string]string, s.len())
+	sources := make(map[string]Source, len(values))
+	for i := range s.shards {
+		for k,v := range s.shards[i].values {
+			values[k] = v
+			sources[k] = s.shards[i].sources[k]
+		}
+	}
+	return values, sources
+}
@@ -0,0 +1,93 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+/**
+ * Prefix of the signature line appended to signed config files
+ *
+ * The line starts with '#', so it is treated as a comment by parsers that don't verify signatures.
+ */
+const SIGNATURE_PREFIX string = "#!hmac-sha256="
+
+/**
+ * Enables signing of config files with HMAC-SHA256
+ *
+ * Once a key is set, WriteToDisk appends a signature line to the config file
+ * and ReadFromDisk refuses files with a missing or invalid signature.
+ *
+ * Passing nil disables signing and verification.
+ */
+func (m* MetaConfig) SetSigningKey(key []byte) {
+	m.lockConfigFile()
+	defer m.configFileLock.Unlock()
+
+	if key==nil {
+		m.signingKey = nil
+	} else {
+		m.signingKey = bytes.Clone(key)
+	}
+}
+
+/**
+ * Appends the signature line of the content
+ */
+func signContent(key []byte, content []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	signed := bytes.Clone(content)
+	signed = append(signed, SIGNATURE_PREFIX...)
+	signed = append(signed, hex.EncodeToString(mac.Sum(nil))...)
+	signed = append(signed, '\n')
+	return signed
+}
+
+/**
+ * Verifies the trailing signature line of the content
+ *
+ * Returns the content without the signature line.
+ */
+func verifyContent(key []byte, content []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(content, "\r\n")
+	idx := bytes.LastIndexByte(trimmed, '\n')
+	line := trimmed[idx+1:]
+	if !bytes.HasPrefix(line, []byte(SIGNATURE_PREFIX)) {
+		return nil, errors.New("Missing signature")
+	}
+	signature, err := hex.DecodeString(string(line[len(SIGNATURE_PREFIX):]))
+	if err!=nil {
+		return nil, errors.New("Malformed signature")
+	}
+
+	data := content[:idx+1]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("Invalid signature, file may have been tampered with")
+	}
+	return data, nil
+}
@@ -0,0 +1,187 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+ * Origin of a value in the inmem configuration
+ */
+type Source int
+const (
+	// Key does not exist
+	SOURCE_NONE Source = iota
+	// Value was set with SetDefault
+	SOURCE_DEFAULT
+	// Value was read from the config file
+	SOURCE_FILE
+	// Value was overridden by an environment variable
+	SOURCE_ENV
+	// Value was set at runtime with a Set* operation (e.g. pushed by MetaHook)
+	SOURCE_API
+	// Value is resolved from a layer other than the primary layer (see Layer)
+	SOURCE_LAYER
+)
+
+func (s Source) String() string {
+	switch s {
+	case SOURCE_DEFAULT:
+		return "default"
+	case SOURCE_FILE:
+		return "file"
+	case SOURCE_ENV:
+		return "env"
+	case SOURCE_API:
+		return "api"
+	case SOURCE_LAYER:
+		return "layer"
+	default:
+		return "none"
+	}
+}
+
+/**
+ * Encodes the source by its name (e.g. in JSON)
+ */
+func (s Source) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+/**
+ * Decodes the source from its name
+ */
+func (s* Source) UnmarshalText(text []byte) error {
+	for candidate := SOURCE_NONE; candidate<=SOURCE_LAYER; candidate++ {
+		if candidate.String()==string(text) {
+			*s = candidate
+			return nil
+		}
+	}
+	return errors.New("Unknown source '" + string(text) + "'")
+}
+
+/**
+ * Returns the source of the current value of the key
+ *
+ * If the value is resolved from a layer other than the primary layer, it will return SOURCE_LAYER
+ *
+ * If key is not found, it will return SOURCE_NONE
+ *
+ * This operation does not read / parse anything from disk!
+ */
+func (m* MetaConfig) Source(key *string) Source {
+	defer m.runlockConfig(m.rlockConfig())
+	m.stats.reads.Add(1)
+
+	k := m.canonicalKey(*key)
+	_, layer, exists := m.lookupLayer(k)
+	if !exists {
+		return SOURCE_NONE
+	} else if layer!=PRIMARY_LAYER {
+		return SOURCE_LAYER
+	}
+	return m.config.source(k)
+}
+
+/**
+ * Set default value of specific key
+ *
+ * The default is only applied if the key does not exist yet,
+ * defaults survive ReadFromDisk if the key is not present in the file.
+ *
+ * Returns an error if the value is rejected by a registered validator.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SetDefault(key *string, value *string) error {
+	k := m.canonicalKey(*key)
+	if err := checkKey(k); err!=nil {
+		return err
+	}
+	if err := m.validate(k, *value); err!=nil {
+		return err
+	}
+
+	if err := m.lockConfigMutable(); err!=nil {
+		return err
+	}
+	defer m.configLock.Unlock()
+	m.stats.writes.Add(1)
+
+	if _, exists := m.config.peek(k); !exists {
+		m.config.put(k, *value, SOURCE_DEFAULT)
+		m.recordChanges([]Change{{time.Now(), k, "", *value, false, SOURCE_DEFAULT, PRIMARY_LAYER, ""}})
+	}
+	return nil
+}
+
+/**
+ * Overrides existing keys with environment variables
+ *
+ * The variable name of a key is the prefix followed by the uppercased key,
+ * every char that is not alphanumeric is replaced with '_'
+ * (e.g. prefix "CTHULHU_" and key "disk.size" maps to "CTHULHU_DISK_SIZE").
+ *
+ * Only keys that exist (e.g. read from disk or declared with SetDefault) are overridden.
+ * Overrides are applied to the primary layer.
+ * Overrides are lost on the next ReadFromDisk, call LoadEnv again after reloading.
+ *
+ * Returns an error if a value is rejected by a registered validator, valid overrides are still applied.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) LoadEnv(prefix string) error {
+	overrides := make(map[string]string)
+	locked := m.rlockConfig()
+	for k := range m.resolve() {
+		if val, exists := os.LookupEnv(EnvName(prefix, k)); exists {
+			overrides[k] = val
+		}
+	}
+	m.runlockConfig(locked)
+
+	var errs []error
+	for k,v := range overrides {
+		if err := m.set(k, v, SOURCE_ENV); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/**
+ * Returns the environment variable name of a key
+ *
+ * The name is the prefix followed by the uppercased key,
+ * every char that is not alphanumeric is replaced with '_'.
+ */
+func EnvName(prefix string, key string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		if (r>='a'&&r<='z')||(r>='A'&&r<='Z')||(r>='0'&&r<='9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(key))
+}
@@ -0,0 +1,154 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Snapshot of the operation metrics of a MetaConfig
+ *
+ * Counters are accumulated since the MetaConfig was created.
+ */
+type Stats struct {
+	// Number of inmem read operations (Get*, Exists)
+	Reads uint64 `json:"reads"`
+	// Number of inmem write operations (Set*)
+	Writes uint64 `json:"writes"`
+	// Number of ReadFromDisk calls
+	DiskReads uint64 `json:"disk_reads"`
+	// Number of WriteToDisk calls
+	DiskWrites uint64 `json:"disk_writes"`
+	// Number of ReadFromDisk calls that failed to parse the config file
+	ParseErrors uint64 `json:"parse_errors"`
+	// Number of WriteToDisk calls that failed
+	WriteErrors uint64 `json:"write_errors"`
+	// Accumulated time spent in ReadFromDisk
+	DiskReadTime time.Duration `json:"disk_read_time"`
+	// Accumulated time spent in WriteToDisk
+	DiskWriteTime time.Duration `json:"disk_write_time"`
+	// Accumulated time spent waiting to acquire the config locks
+	LockWaitTime time.Duration `json:"lock_wait_time"`
+}
+
+/**
+ * Internal counters, updated atomically so that recording
+ * does not contend with the config locks
+ */
+type metaStats struct {
+	reads atomic.Uint64
+	writes atomic.Uint64
+	diskReads atomic.Uint64
+	diskWrites atomic.Uint64
+	parseErrors atomic.Uint64
+	writeErrors atomic.Uint64
+	diskReadTime atomic.Int64
+	diskWriteTime atomic.Int64
+	lockWaitTime atomic.Int64
+}
+
+/**
+ * Returns a snapshot of the operation metrics
+ *
+ * Counters are read individually, the snapshot is therefore not
+ * guaranteed to be consistent across fields under concurrent load.
+ */
+func (m* MetaConfig) Stats() Stats {
+	return Stats{
+		Reads: m.stats.reads.Load(),
+		Writes: m.stats.writes.Load(),
+		DiskReads: m.stats.diskReads.Load(),
+		DiskWrites: m.stats.diskWrites.Load(),
+		ParseErrors: m.stats.parseErrors.Load(),
+		WriteErrors: m.stats.writeErrors.Load(),
+		DiskReadTime: time.Duration(m.stats.diskReadTime.Load()),
+		DiskWriteTime: time.Duration(m.stats.diskWriteTime.Load()),
+		LockWaitTime: time.Duration(m.stats.lockWaitTime.Load()),
+	}
+}
+
+/**
+ * Publishes the operation metrics as expvar variable with the specified name
+ *
+ * The variable is evaluated lazily on every access of the expvar handler (/debug/vars).
+ *
+ * Like expvar.Publish, this panics if the name is already registered.
+ */
+func (m* MetaConfig) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return m.Stats()
+	}))
+}
+
+/**
+ * Acquire read lock on the inmem config and record the wait time
+ *
+ * Frozen configs can't be mutated, so the lock is elided.
+ * Returns true if the lock was acquired, pass the result to runlockConfig.
+ */
+func (m* MetaConfig) rlockConfig() bool {
+	m.ensureLoaded()
+	if m.frozen.Load() {
+		return false
+	}
+	start := time.Now()
+	m.configLock.RLock()
+	m.stats.lockWaitTime.Add(int64(time.Since(start)))
+	return true
+}
+
+/**
+ * Release read lock on the inmem config if it was acquired by rlockConfig
+ */
+func (m* MetaConfig) runlockConfig(locked bool) {
+	if locked {
+		m.configLock.RUnlock()
+	}
+}
+
+/**
+ * Acquire write lock on the inmem config and record the wait time
+ */
+func (m* MetaConfig) lockConfig() {
+	start := time.Now()
+	m.configLock.Lock()
+	m.stats.lockWaitTime.Add(int64(time.Since(start)))
+}
+
+/**
+ * Acquire read lock on the config file and record the wait time
+ */
+func (m* MetaConfig) rlockConfigFile() {
+	start := time.Now()
+	m.configFileLock.RLock()
+	m.stats.lockWaitTime.Add(int64(time.Since(start)))
+}
+
+/**
+ * Acquire write lock on the config file and record the wait time
+ */
+func (m* MetaConfig) lockConfigFile() {
+	start := time.Now()
+	m.configFileLock.Lock()
+	m.stats.lockWaitTime.Add(int64(time.Since(start)))
+}
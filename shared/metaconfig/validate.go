@@ -0,0 +1,95 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"errors"
+)
+
+/**
+ * Validator function for a config key
+ *
+ * Receives the key and the raw string value, returns an error if the value is invalid.
+ */
+type Validator func(key string, value string) error
+
+/**
+ * Registers a validator for a specific key
+ *
+ * Validators run on every Set* operation and on ReadFromDisk (like the constraints of the schema, see Constrain),
+ * invalid values are rejected before they are written to the inmem config.
+ *
+ * Multiple validators can be registered for the same key, they are executed in registration order.
+ *
+ * Values that are already in the inmem config are not revalidated.
+ */
+func (m* MetaConfig) RegisterValidator(key string, validator Validator) {
+	m.validatorLock.Lock()
+	defer m.validatorLock.Unlock()
+
+	if m.validators==nil {
+		m.validators = make(map[string][]Validator)
+	}
+	key = m.canonicalKey(key)
+	m.validators[key] = append(m.validators[key], validator)
+}
+
+/**
+ * Removes all validators registered for a specific key
+ */
+func (m* MetaConfig) UnregisterValidators(key string) {
+	m.validatorLock.Lock()
+	defer m.validatorLock.Unlock()
+
+	delete(m.validators, m.canonicalKey(key))
+}
+
+/**
+ * Checks if a value would be accepted for the key without setting it
+ *
+ * Runs the same checks as the Set* operations (key syntax, registered validators and constraints).
+ */
+func (m* MetaConfig) Validate(key *string, value *string) error {
+	k := m.canonicalKey(*key)
+	if err := checkKey(k); err!=nil {
+		return err
+	}
+	return m.validate(k, *value)
+}
+
+/**
+ * Runs all validators and constraints of the key against the value
+ *
+ * Errors of all failing validators and violated constraints are joined together.
+ */
+func (m* MetaConfig) validate(key string, value string) error {
+	key = m.canonicalKey(key)
+	m.validatorLock.RLock()
+	defer m.validatorLock.RUnlock()
+
+	var errs []error
+	for _, validator := range m.validators[key] {
+		if err := validator(key, value); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, checkConstraints(key, m.keyConstraints(key), value))
+	return errors.Join(errs...)
+}
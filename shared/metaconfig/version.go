@@ -0,0 +1,137 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metaconfig
+
+import (
+	"errors"
+	"time"
+)
+
+/**
+ * Error returned by conditional mutations if the MetaConfig was modified since the expected version
+ */
+var ErrVersionMismatch = errors.New("MetaConfig was modified since the expected version")
+
+/**
+ * Error returned by CompareAndSwapAs if the current value of the key differs from the expected value
+ */
+var ErrValueMismatch = errors.New("Current value of the key differs from the expected value")
+
+/**
+ * Returns the version of the inmem configuration
+ *
+ * The version is increased by every mutation that changes at least one value (including layers and reloads),
+ * so two reads returning the same version observed the same configuration.
+ * Versions are increasing but not necessarily consecutive, as mutations that change nothing skip their version.
+ * Versions start at 0 for every MetaConfig instance and are not persisted.
+ */
+func (m* MetaConfig) Version() uint64 {
+	return m.version.Load()
+}
+
+/**
+ * Returns the version of the last mutation that changed or removed the key
+ *
+ * Returns 0 if the key was never changed since the MetaConfig was created.
+ */
+func (m* MetaConfig) KeyVersion(key string) uint64 {
+	defer m.runlockConfig(m.rlockConfig())
+	return m.config.version(m.canonicalKey(key))
+}
+
+/**
+ * Set multiple raw string values like SetConfigAs if the configuration still has the expected version
+ *
+ * The version is checked under the same lock acquisition that applies the values,
+ * so concurrent writers based on the same read can't overwrite each other.
+ *
+ * Returns the version after the mutation, or ErrVersionMismatch if the version differs.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SetConfigIfVersion(actor string, config map[string]string, version uint64) (uint64, error) {
+	return m.setMany(config, SOURCE_API, false, actor, &version, nil)
+}
+
+/**
+ * Set multiple raw string values like SetConfigAs and returns the replaced values
+ *
+ * The previous values are captured while the values are applied,
+ * keys that did not exist before are missing in the returned map (keys are canonicalized).
+ * If version is not nil, nothing is applied unless the configuration has this version (see SetConfigIfVersion).
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SwapConfigAs(actor string, config map[string]string, version *uint64) (map[string]string, error) {
+	previous := make(map[string]string, len(config))
+	if _, err := m.setMany(config, SOURCE_API, false, actor, version, previous); err!=nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+/**
+ * Removes a key like DeleteAs and returns its previous value and whether it existed
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) SwapDeleteAs(actor string, key *string) (string, bool, error) {
+	return m.swapUnsetLayer(PRIMARY_LAYER, *key, actor)
+}
+
+/**
+ * Sets the raw string value of a key if its current value is the expected value
+ *
+ * If expected is nil, the value is only set if the key does not exist.
+ * The current value is compared with layers resolved (like GetString) under the same lock acquisition
+ * that applies the value, so concurrent writers can use the key for lock-free coordination.
+ * The value is always set on PRIMARY_LAYER, layers with a higher priority still take precedence.
+ *
+ * Returns the replaced value of PRIMARY_LAYER and whether it existed (like SwapConfigAs),
+ * or ErrValueMismatch with the current value and existence of the key if the value differs.
+ *
+ * This operation does not write anything to disk!
+ */
+func (m* MetaConfig) CompareAndSwapAs(actor string, key *string, expected *string, value *string) (string, bool, error) {
+	k := m.canonicalKey(*key)
+	if err := checkKey(k); err!=nil {
+		return "", false, err
+	}
+	if err := m.validate(k, *value); err!=nil {
+		return "", false, err
+	}
+
+	if err := m.lockConfigMutable(); err!=nil {
+		return "", false, err
+	}
+	defer m.configLock.Unlock()
+	current, exists := m.lookup(k)
+	if (expected==nil&&exists)||(expected!=nil&&(!exists||current!=*expected)) {
+		return current, exists, ErrValueMismatch
+	}
+	m.stats.writes.Add(1)
+
+	old, existed := m.config.put(k, *value, SOURCE_API)
+	if !existed||old!=*value {
+		m.recordChanges([]Change{{time.Now(), k, old, *value, false, SOURCE_API, PRIMARY_LAYER, actor}})
+	}
+	return old, existed, nil
+}
@@ -0,0 +1,94 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metaconfig
+
+import (
+	"strings"
+)
+
+/**
+ * Subscription to changes of the inmem config
+ */
+type watcher struct {
+	// Only changes of keys with this prefix are delivered
+	prefix string
+	ch chan Change
+}
+
+/**
+ * Subscribes to changes of the inmem config
+ *
+ * Every mutation (Set*, ReadFromDisk, layers, defaults, ...) of keys starting with prefix
+ * is delivered to the returned channel, pass an empty prefix to receive all changes.
+ * Values of redacted keys are replaced by REDACTED_VALUE.
+ *
+ * Changes are delivered without blocking the mutation, if the channel buffer (size) is full,
+ * changes are dropped. Consumers that need a consistent view should resync with GetConfig.
+ *
+ * Call the returned cancel function to unsubscribe, it closes the channel.
+ */
+func (m* MetaConfig) Watch(prefix string, size int) (<-chan Change, func()) {
+	w := &watcher{m.canonicalKey(prefix), make(chan Change, size)}
+	m.watchLock.Lock()
+	if m.watchers==nil {
+		m.watchers = make(map[*watcher]bool)
+	}
+	m.watchers[w] = true
+	m.watchLock.Unlock()
+
+	cancel := func() {
+		m.watchLock.Lock()
+		defer m.watchLock.Unlock()
+		if m.watchers[w] {
+			delete(m.watchers, w)
+			close(w.ch)
+		}
+	}
+	return w.ch, cancel
+}
+
+/**
+ * Delivers changes to all matching watchers without blocking
+ */
+func (m* MetaConfig) notifyWatchers(changes []Change) {
+	m.watchLock.Lock()
+	defer m.watchLock.Unlock()
+	if len(m.watchers)==0 {
+		return
+	}
+
+	m.redactLock.RLock()
+	defer m.redactLock.RUnlock()
+	for _, change := range changes {
+		if m.redacted[change.Key] {
+			change.Old = REDACTED_VALUE
+			change.New = REDACTED_VALUE
+		}
+		for w := range m.watchers {
+			if !strings.HasPrefix(change.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- change:
+			default:
+			}
+		}
+	}
+}
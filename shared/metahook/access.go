@@ -0,0 +1,274 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/logger"
+)
+
+/**
+ * Format of the access log (see WithAccessLog)
+ */
+type ACCESSLOGFORMAT int
+const (
+	// NCSA combined log format, the authenticated user is the client identity (see clientIdentity)
+	ACCESS_LOG_COMBINED ACCESSLOGFORMAT = iota
+	// One JSON object per line
+	ACCESS_LOG_JSON
+)
+
+/**
+ * Default size in bytes at which the access log is rotated (see WithAccessLogRotation)
+ */
+const DEFAULT_ACCESS_LOG_MAX_SIZE int64 = 100 << 20
+
+/**
+ * Default number of rotated access log files kept (see WithAccessLogRotation)
+ */
+const DEFAULT_ACCESS_LOG_BACKUPS = 5
+
+/**
+ * Access log sink of a MetaHook
+ */
+type accessLog struct {
+	// Path of the access log (disabled if empty)
+	path string
+	format ACCESSLOGFORMAT
+	policy logger.RotationPolicy
+	// Key prefix of the rotation policy in the default MetaConfig (see WithAccessLogRotationKeys)
+	policyPrefix string
+	file *logger.RotatingFile
+}
+
+/**
+ * Access log record in the ACCESS_LOG_JSON format
+ */
+type accessEntry struct {
+	Time time.Time `json:"time"`
+	// Remote address, "local" for unix socket and named pipe peers
+	Remote string `json:"remote"`
+	// Identity of the client (see clientIdentity)
+	Client string `json:"client,omitempty"`
+	// Credentials of the unix socket peer (omitted if unknown)
+	Peer *PeerCredentials `json:"peer,omitempty"`
+	Method string `json:"method"`
+	URI string `json:"uri"`
+	Proto string `json:"proto"`
+	Status int `json:"status"`
+	Bytes int64 `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Referer string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+/**
+ * Appends every request to the access log at the path, separate from the diagnostic log (see WithLogger)
+ *
+ * The file is created with mode 0600 if it does not exist and rotated by the logger subsystem (see WithAccessLogRotation).
+ * Requests rejected by the authentication, peer restriction or rate limit are logged aswell.
+ */
+func WithAccessLog(path string, format ACCESSLOGFORMAT) Option {
+	return func(m *MetaHook) {
+		m.access.path = path
+		m.access.format = format
+	}
+}
+
+/**
+ * Rotates the access log once it exceeds maxSize bytes and keeps the specified number of rotated files
+ *
+ * Pass a maxSize <= 0 to disable the rotation (e.g. if the file is rotated externally).
+ */
+func WithAccessLogRotation(maxSize int64, backups int) Option {
+	return func(m *MetaHook) {
+		m.access.policy.MaxSize = maxSize
+		m.access.policy.Backups = backups
+	}
+}
+
+/**
+ * Rotates the access log additionally at the interval and removes rotated files older than maxAge
+ *
+ * Pass a maxAge <= 0 to only limit the number of rotated files (see WithAccessLogRotation).
+ */
+func WithAccessLogRetention(interval logger.ROTATEINTERVAL, maxAge time.Duration) Option {
+	return func(m *MetaHook) {
+		m.access.policy.Interval = interval
+		m.access.policy.MaxAge = maxAge
+	}
+}
+
+/**
+ * Compresses rotated access log files with gzip in the background after the rotation
+ *
+ * If delay is set, the most recent rotated file is left uncompressed until the next rotation
+ * (e.g. for tools still reading the rotated file).
+ */
+func WithAccessLogCompression(delay bool) Option {
+	return func(m *MetaHook) {
+		m.access.policy.Compress = true
+		m.access.policy.DelayCompress = delay
+	}
+}
+
+/**
+ * Reads the rotation policy of the access log from keys of the default MetaConfig below the prefix
+ *
+ * The keys <prefix>.max_size (bytes), <prefix>.backups, <prefix>.interval ("never", "daily" or "weekly"),
+ * <prefix>.max_age_days, <prefix>.compress and <prefix>.delay_compress override the values of
+ * WithAccessLogRotation, WithAccessLogRetention and WithAccessLogCompression.
+ * Updates (of any field type) and deletions of the keys are applied immediately by hooks registered for <prefix>.*.
+ */
+func WithAccessLogRotationKeys(prefix string) Option {
+	return func(m *MetaHook) {
+		m.access.policyPrefix = prefix
+	}
+}
+
+/**
+ * Opens the access log if configured
+ */
+func (m* MetaHook) openAccessLog() error {
+	if m.access.path=="" {
+		return nil
+	}
+	policy, err := m.rotationPolicy(m.access.policyPrefix, m.access.policy)
+	if err!=nil {
+		return err
+	}
+	file, err := logger.OpenRotatingFileWithPolicy(m.access.path, policy)
+	if err!=nil {
+		return err
+	}
+	m.access.file = file
+	if m.access.policyPrefix=="" {
+		return nil
+	}
+	return m.bindRotationKeys(m.access.policyPrefix, m.access.policy, file.SetPolicy)
+}
+
+/**
+ * Wraps the handler with the access log (if enabled)
+ */
+func (m* MetaHook) accessLogHandler(next http.Handler) http.Handler {
+	if m.access.path=="" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status==0 {
+			recorder.status = http.StatusOK
+		}
+
+		peer, _ := requestPeerCredentials(r)
+		entry := accessEntry{
+			Time: start,
+			Remote: accessRemote(r),
+			Client: clientIdentity(r),
+			Peer: peer,
+			Method: r.Method,
+			URI: r.RequestURI,
+			Proto: r.Proto,
+			Status: recorder.status,
+			Bytes: recorder.size,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer: r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+		var line []byte
+		if m.access.format==ACCESS_LOG_JSON {
+			data, err := json.Marshal(entry)
+			if err!=nil {
+				return
+			}
+			line = append(data, '\n')
+		} else {
+			line = []byte(entry.combined())
+		}
+		if _, err := m.access.file.Write(line); err!=nil {
+			m.logError(fmt.Sprintf("Failed to write MetaHook access log: %v", err))
+		}
+	})
+}
+
+/**
+ * Returns the remote host of the request, "local" for unix socket and named pipe peers
+ */
+func accessRemote(r *http.Request) string {
+	if r.RemoteAddr==""||r.RemoteAddr=="@" {
+		return "local"
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err==nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+/**
+ * Formats the entry as line of the combined log format
+ *
+ * Quoted fields are escaped, so that clients cannot forge log lines.
+ */
+func (e* accessEntry) combined() string {
+	user, bytes := "-", "-"
+	if e.Client!="" {
+		user = e.Client
+	}
+	if e.Bytes>0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	referer, userAgent := e.Referer, e.UserAgent
+	if referer=="" {
+		referer = "-"
+	}
+	if userAgent=="" {
+		userAgent = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		e.Remote, accessField(user), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method + " " + e.URI + " " + e.Proto), e.Status, bytes,
+		strconv.Quote(referer), strconv.Quote(userAgent))
+}
+
+/**
+ * Escapes an unquoted field of the combined log format
+ */
+func accessField(value string) string {
+	quoted := strconv.Quote(value)
+	if quoted[1:len(quoted)-1]!=value {
+		return quoted
+	}
+	for _, c := range value {
+		if c==' ' {
+			return quoted
+		}
+	}
+	return value
+}
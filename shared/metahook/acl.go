@@ -0,0 +1,211 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Grants a peer access to key prefixes of the MetaConfigs (see WithACL)
+ */
+type ACLRule struct {
+	// Peer the rule applies to:
+	// "token:<key>" (bearer token equals the value of the key in the default MetaConfig),
+	// "cn:<name>" (common name of the verified client certificate),
+	// "uid:<uid>" / "gid:<gid>" (user / primary group of the process connected to the unix socket, see PeerCredentials)
+	// or "*" (every peer)
+	Peer string
+	// Name of the MetaConfig the rule applies to, every MetaConfig if empty (see AddConfig)
+	Config string
+	// Key prefixes the rule applies to, an empty prefix matches every key
+	Prefixes []string
+	// Allows reading the keys (/get, /wait, /config, /watch and /audit)
+	Read bool
+	// Allows changing the keys (/update, /delete and /reload)
+	Write bool
+}
+
+/**
+ * Restricts the keys peers can read and write
+ *
+ * If at least one rule is configured, every access is denied unless a rule of the peer allows it.
+ * Denied keys of /update and /delete are rejected with 403, /get and /wait respond with 403.
+ * /config, /watch and /audit only return the keys the peer is allowed to read.
+ * /reload changes arbitrary keys and requires a rule with an empty prefix.
+ *
+ * Keys holding the tokens of "token:<key>" peers are redacted,
+ * if token authentication is enabled (see WithTokenAuth), these tokens are accepted aswell.
+ *
+ * Example: a monitoring agent may read everything, while only the controller may change the config:
+ *
+ *	WithACL(
+ *		ACLRule{Peer: "uid:0", Prefixes: []string{""}, Read: true, Write: true},
+ *		ACLRule{Peer: "cn:monitoring", Prefixes: []string{""}, Read: true},
+ *	)
+ */
+func WithACL(rules ...ACLRule) Option {
+	return func(m *MetaHook) {
+		for _, rule := range rules {
+			if key, found := strings.CutPrefix(rule.Peer, "token:"); found {
+				m.configs[DEFAULT_CONFIG].metaConfig.Redact(key)
+				m.aclTokenKeys = append(m.aclTokenKeys, key)
+			}
+		}
+		m.acl = append(m.acl, rules...)
+	}
+}
+
+/**
+ * Checks if the bearer token of the request equals the (non-empty) value of the key in the default MetaConfig
+ */
+func (m* MetaHook) matchToken(r *http.Request, key string) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return false
+	}
+	expected := m.configs[DEFAULT_CONFIG].metaConfig.GetString(&key)
+	return expected!=""&&subtle.ConstantTimeCompare([]byte(token), []byte(expected))==1
+}
+
+/**
+ * Checks if the rule applies to the peer that sent the request
+ */
+func (m* MetaHook) matchPeer(r *http.Request, peer string) bool {
+	kind, value, _ := strings.Cut(peer, ":")
+	switch kind {
+	case "*":
+		return true
+	case "token":
+		return m.matchToken(r, value)
+	case "cn":
+		return certIdentity(r)==value
+	case "uid":
+		cred, _ := requestPeerCredentials(r)
+		return cred!=nil&&strconv.FormatUint(uint64(cred.UID), 10)==value
+	case "gid":
+		cred, _ := requestPeerCredentials(r)
+		return cred!=nil&&strconv.FormatUint(uint64(cred.GID), 10)==value
+	default:
+		return false
+	}
+}
+
+/**
+ * Checks if the peer that sent the request may read (or write) the key
+ *
+ * An empty key is only allowed by rules with an empty prefix (access to every key).
+ */
+func (d* configDomain) aclAllows(r *http.Request, key string, write bool) bool {
+	if len(d.acl)==0 {
+		return true
+	}
+	key = d.metaConfig.CanonicalKey(key)
+	for _, rule := range d.acl {
+		if rule.Config!=""&&rule.Config!=d.name {
+			continue
+		}
+		if (write&&!rule.Write)||(!write&&!rule.Read) {
+			continue
+		}
+		matched := false
+		for _, prefix := range rule.Prefixes {
+			if prefix==""||(key!=""&&strings.HasPrefix(key, d.metaConfig.CanonicalKey(prefix))) {
+				matched = true
+				break
+			}
+		}
+		if matched&&d.matchPeer(r, rule.Peer) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Checks the write access of the peer to all keys (see WithACL)
+ *
+ * If a key is denied, a 403 response reporting the denied keys is written and false is returned.
+ */
+func (d* configDomain) authorizeKeys(w http.ResponseWriter, r *http.Request, res *updateResponse, keys []string) bool {
+	denied := make([]bool, len(keys))
+	allowed := true
+	for i, key := range keys {
+		denied[i] = !d.aclAllows(r, key, true)
+		allowed = allowed&&!denied[i]
+	}
+	if allowed {
+		return true
+	}
+	res.Status = http.StatusForbidden
+	res.Fields = res.Fields[:0]
+	for i, key := range keys {
+		result := fieldResult{Key: key}
+		if denied[i] {
+			result.Err = "Write access to key denied"
+		}
+		res.Fields = append(res.Fields, result)
+	}
+	d.writeVersioned(w, res)
+	return false
+}
+
+/**
+ * Removes the keys the peer may not read from the config
+ */
+func (d* configDomain) filterReadable(r *http.Request, config map[string]string) map[string]string {
+	if len(d.acl)==0 {
+		return config
+	}
+	for key := range config {
+		if !d.aclAllows(r, key, false) {
+			delete(config, key)
+		}
+	}
+	return config
+}
+
+/**
+ * Removes the audit entries containing keys the peer may not read
+ */
+func (m* MetaHook) filterReadableEntries(r *http.Request, entries []auditEntry) []auditEntry {
+	if len(m.acl)==0 {
+		return entries
+	}
+	readable := entries[:0]
+	for _, entry := range entries {
+		d, exists := m.configs[entry.Config]
+		if !exists {
+			continue
+		}
+		allowed := true
+		for _, field := range entry.Fields {
+			allowed = allowed&&d.aclAllows(r, field.Key, false)
+		}
+		if allowed {
+			readable = append(readable, entry)
+		}
+	}
+	return readable
+}
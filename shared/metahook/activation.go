@@ -0,0 +1,101 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+ * First file descriptor passed by systemd socket activation (see sd_listen_fds(3))
+ */
+const SD_LISTEN_FDS_START int = 3
+
+/**
+ * Uses the listener passed by systemd socket activation instead of creating the unix socket
+ *
+ * If the process was started by a matching .socket unit (LISTEN_PID and LISTEN_FDS are set),
+ * the passed socket is served and the socket path and permissions of the MetaHook are ignored.
+ * Connections are queued by systemd, so that clients can connect before the daemon is fully started.
+ *
+ * If name is not empty, the socket with this FileDescriptorName is used, otherwise the first one.
+ * If the process was not socket activated, the unix socket is created as usual.
+ */
+func WithSocketActivation(name string) Option {
+	return func(m *MetaHook) {
+		m.socketActivation = true
+		m.socketActivationName = name
+	}
+}
+
+/**
+ * Checks if the process was started by systemd socket activation
+ */
+func socketActivated() bool {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err!=nil||pid!=os.Getpid() {
+		return false
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	return err==nil&&count>0
+}
+
+/**
+ * Returns the listener passed by systemd or nil if the process was not socket activated
+ *
+ * The activation environment is unset afterwards, so that it is not inherited by child processes.
+ */
+func (m* MetaHook) activatedListener() (net.Listener, error) {
+	if !socketActivated() {
+		return nil, nil
+	}
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	index := 0
+	if m.socketActivationName!="" {
+		index = -1
+		for i, name := range names {
+			if name==m.socketActivationName&&i<count {
+				index = i
+				break
+			}
+		}
+		if index<0 {
+			return nil, errors.New("No socket named '" + m.socketActivationName + "' was passed by systemd")
+		}
+	}
+
+	file := os.NewFile(uintptr(SD_LISTEN_FDS_START + index), "systemd-socket")
+	if file==nil {
+		return nil, errors.New("Invalid file descriptor passed by systemd")
+	}
+	// FileListener duplicates the descriptor
+	defer file.Close()
+	return net.FileListener(file)
+}
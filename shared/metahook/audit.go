@@ -0,0 +1,296 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Logger receiving every audit entry as JSON encoded message (e.g. *logger.Logger)
+ */
+type AuditLogger interface {
+	LogInfo(msg string)
+}
+
+/**
+ * Audit sinks and recent entries of a MetaHook
+ */
+type auditTrail struct {
+	lock sync.Mutex
+	// Path of the append-only audit file (disabled if empty)
+	path string
+	file *os.File
+	logger AuditLogger
+	// Number of recent entries kept for /audit (disabled if <= 0)
+	historySize int
+	history []auditEntry
+}
+
+/**
+ * Audit record of a single field
+ */
+type auditField struct {
+	Key string `json:"key"`
+	// Value before the request (empty if the key did not exist)
+	Old string `json:"old"`
+	// Value requested by the client (empty for deletions)
+	New string `json:"new"`
+	Deleted bool `json:"deleted"`
+	Set bool `json:"set"`
+	HookRan bool `json:"hook_ran"`
+	Err string `json:"err,omitempty"`
+}
+
+/**
+ * Audit record of a mutating request or the completion of an async job
+ */
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Name of the MetaConfig (see AddConfig)
+	Config string `json:"config"`
+	// Identity of the client (see clientIdentity)
+	Client string `json:"client"`
+	// Credentials of the unix socket peer (omitted if unknown)
+	Peer *PeerCredentials `json:"peer,omitempty"`
+	// Either "update", "delete", "cas", "reload", "flush" or "job" (completion of an async update)
+	Operation string `json:"operation"`
+	// Status code of the response, or 200 / 500 for completed jobs
+	Status int `json:"status"`
+	Fields []auditField `json:"fields"`
+	Err []string `json:"err"`
+	Job string `json:"job,omitempty"`
+}
+
+/**
+ * Appends every mutating request as JSON line to the audit file
+ *
+ * The file is created with mode 0600 if it does not exist and kept open for the lifetime of the process.
+ * Values of redacted keys are replaced by metaconfig.REDACTED_VALUE.
+ */
+func WithAuditFile(path string) Option {
+	return func(m *MetaHook) {
+		m.audit.path = path
+	}
+}
+
+/**
+ * Logs every mutating request as JSON encoded info message
+ */
+func WithAuditLogger(logger AuditLogger) Option {
+	return func(m *MetaHook) {
+		m.audit.logger = logger
+	}
+}
+
+/**
+ * Keeps the most recent size audit entries in memory, they can be queried with /audit
+ */
+func WithAuditHistory(size int) Option {
+	return func(m *MetaHook) {
+		m.audit.historySize = size
+	}
+}
+
+/**
+ * Opens the audit file if configured
+ */
+func (m* MetaHook) openAuditFile() error {
+	if m.audit.path=="" {
+		return nil
+	}
+	file, err := os.OpenFile(m.audit.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err!=nil {
+		return err
+	}
+	m.audit.file = file
+	return nil
+}
+
+/**
+ * Closes the audit file if it is open, subsequent entries are only recorded by the other sinks
+ */
+func (m* MetaHook) closeAuditFile() error {
+	m.audit.lock.Lock()
+	defer m.audit.lock.Unlock()
+	if m.audit.file==nil {
+		return nil
+	}
+	err := m.audit.file.Close()
+	m.audit.file = nil
+	return err
+}
+
+/**
+ * Creates an audit entry with the current values of the keys
+ *
+ * Returns nil if auditing is disabled.
+ */
+func (d* configDomain) newAuditEntry(operation string, client string, peer *PeerCredentials, keys []string) *auditEntry {
+	if d.audit.path==""&&d.audit.logger==nil&&d.audit.historySize<=0 {
+		return nil
+	}
+	entry := &auditEntry{Time: time.Now(), Config: d.name, Client: client, Peer: peer, Operation: operation}
+	for _, key := range keys {
+		key := key
+		field := auditField{Key: key}
+		if d.metaConfig.Exists(&key) {
+			field.Old = d.auditValue(key, d.metaConfig.GetString(&key))
+		}
+		entry.Fields = append(entry.Fields, field)
+	}
+	return entry
+}
+
+/**
+ * Completes the audit entry with the response of an update or delete and records it
+ *
+ * Values holds the requested values of an update, nil for other operations.
+ */
+func (d* configDomain) completeAudit(entry *auditEntry, values map[string]string, res *updateResponse) {
+	if entry==nil {
+		return
+	}
+	results := make(map[string]fieldResult, len(res.Fields))
+	for _, result := range res.Fields {
+		results[result.Key] = result
+	}
+	for i := range entry.Fields {
+		field := &entry.Fields[i]
+		result := results[field.Key]
+		if values!=nil {
+			field.New = d.auditValue(field.Key, values[field.Key])
+		} else if entry.Operation=="delete" {
+			field.Deleted = result.Set
+		}
+		field.Set, field.HookRan, field.Err = result.Set, result.HookRan, result.Err
+	}
+	entry.Status, entry.Err, entry.Job = res.Status, res.Err, res.Job
+	d.recordAudit(entry)
+}
+
+/**
+ * Records the changed and deleted keys of a reload
+ */
+func (d* configDomain) auditReload(client string, peer *PeerCredentials, oldConfig map[string]string, newConfig map[string]string, res *reloadResponse) {
+	entry := d.newAuditEntry("reload", client, peer, nil)
+	if entry==nil {
+		return
+	}
+	for _, key := range res.Changed {
+		entry.Fields = append(entry.Fields, auditField{
+			Key: key,
+			Old: d.auditValue(key, oldConfig[key]),
+			New: d.auditValue(key, newConfig[key]),
+			Set: true,
+		})
+	}
+	for _, key := range res.Deleted {
+		entry.Fields = append(entry.Fields, auditField{
+			Key: key,
+			Old: d.auditValue(key, oldConfig[key]),
+			Deleted: true,
+			Set: true,
+		})
+	}
+	entry.Status, entry.Err = res.Status, res.Err
+	d.recordAudit(entry)
+}
+
+/**
+ * Writes the entry to all audit sinks
+ */
+func (m* MetaHook) recordAudit(entry *auditEntry) {
+	if entry==nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err!=nil {
+		return
+	}
+
+	m.audit.lock.Lock()
+	defer m.audit.lock.Unlock()
+	if m.audit.historySize>0 {
+		m.audit.history = append(m.audit.history, *entry)
+		if overflow := len(m.audit.history) - m.audit.historySize; overflow>0 {
+			m.audit.history = append([]auditEntry(nil), m.audit.history[overflow:]...)
+		}
+	}
+	if m.audit.file!=nil {
+		m.audit.file.Write(append(data, '\n'))
+	}
+	if m.audit.logger!=nil {
+		m.audit.logger.LogInfo("MetaHook audit: " + string(data))
+	}
+}
+
+/**
+ * Returns the value or metaconfig.REDACTED_VALUE if the key is redacted
+ */
+func (d* configDomain) auditValue(key string, value string) string {
+	if d.metaConfig.IsRedacted(&key) {
+		return metaconfig.REDACTED_VALUE
+	}
+	return value
+}
+
+/**
+ * Handler audit requests
+ *
+ * Returns the recent audit entries ordered from oldest to newest,
+ * the optional "limit" query parameter restricts the response to the newest entries.
+ * Entries with keys the peer may not read are omitted (see WithACL).
+ */
+func (m* MetaHook) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.audit.historySize<=0 {
+		http.Error(w, "Audit history is disabled", http.StatusNotFound)
+		return
+	}
+
+	m.audit.lock.Lock()
+	entries := append([]auditEntry{}, m.audit.history...)
+	m.audit.lock.Unlock()
+	entries = m.filterReadableEntries(r, entries)
+
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit!="" {
+		limit, err := strconv.Atoi(rawLimit)
+		if err!=nil||limit<0 {
+			http.Error(w, "Invalid query parameter 'limit'", http.StatusBadRequest)
+			return
+		}
+		if limit<len(entries) {
+			entries = entries[len(entries)-limit:]
+		}
+	}
+	writeResponse(w, http.StatusOK, entries)
+}
@@ -0,0 +1,93 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metahook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Requires every request to authenticate with a bearer token
+ *
+ * The token is read from the specified key of the default MetaConfig on every request,
+ * so it can be rotated at runtime. The key is redacted in the MetaConfig,
+ * its value is never exposed through the API.
+ *
+ * If the key is not set or empty, every request is rejected.
+ *
+ * Requests must set the header: `Authorization: Bearer <token>`
+ */
+func WithTokenAuth(key string) Option {
+	return func(m *MetaHook) {
+		m.tokenKey = key
+		m.configs[DEFAULT_CONFIG].metaConfig.Redact(key)
+	}
+}
+
+type authResponse struct {
+	Err string `json:"err"`
+}
+
+/**
+ * Wraps the handler with the token authentication (if enabled)
+ */
+func (m* MetaHook) authHandler(next http.Handler) http.Handler {
+	if m.tokenKey=="" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.authenticate(r); err!="" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(authResponse{err})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Verifies the bearer token of the request
+ *
+ * Returns a description of the failure or an empty string if the request is authenticated.
+ */
+func (m* MetaHook) authenticate(r *http.Request) string {
+	// Tokens of ACL peers are accepted aswell (see WithACL)
+	tokenKeys := append([]string{m.tokenKey}, m.aclTokenKeys...)
+	configured := false
+	for i := range tokenKeys {
+		configured = configured||m.configs[DEFAULT_CONFIG].metaConfig.GetString(&tokenKeys[i])!=""
+	}
+	if !configured {
+		return "Authentication token is not configured"
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return "Missing bearer token"
+	}
+	for _, key := range tokenKeys {
+		if m.matchToken(r, key) {
+			return ""
+		}
+	}
+	return "Invalid bearer token"
+}
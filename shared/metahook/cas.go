@@ -0,0 +1,137 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metahook
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+type casRequest struct {
+	Key string `json:"key"`
+	// Expected current value (null if the key must not exist)
+	Expected *string `json:"expected"`
+	New string `json:"new"`
+	// New value is sealed with the sealing key of the MetaConfig (see WithSealedKeys)
+	Sealed bool `json:"sealed"`
+	// Write the configuration to disk after all hooks succeeded
+	Persist bool `json:"persist"`
+	// Restore the previous value if a hook fails
+	Atomic bool `json:"atomic"`
+}
+
+/**
+ * Handler compare-and-swap requests
+ *
+ * Sets the key to the new value only if its current value is the expected value,
+ * a null expected value only sets the key if it does not exist.
+ * The comparison and the update happen under a single lock acquisition of the MetaConfig,
+ * so multiple controllers can coordinate through a key (e.g. leases or counters) without additional locking.
+ *
+ * The value is handled like a string field of /update: it is authorized, validated, rate limited, audited,
+ * and the string and global hooks of the key are called after it is applied.
+ *
+ * If the value differs, nothing is applied and the result of the field reports the current value (redacted values are masked).
+ *
+ * The response reports the result of the field and an overall status code:
+ * 200 (ok), 403 (denied by the ACL or rejected by ClientHook), 409 (MetaConfig rejected the update, e.g. frozen),
+ * 412 (current value differs from the expected value), 422 (invalid field), 500 (hook or persist failed).
+ */
+func (d* configDomain) casHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method, expected POST!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req casRequest
+	if !d.decodeRequest(w, r, &req) {
+		return
+	}
+	req.Key = d.fullKey(req.Key)
+
+	keys := []string{req.Key}
+	res := updateResponse{Status: http.StatusOK, Fields: []fieldResult{{Key: req.Key}}}
+
+	client := clientIdentity(r)
+	peer, _ := requestPeerCredentials(r)
+	entry := d.newAuditEntry("cas", client, peer, keys)
+	defer func() {
+		d.completeAudit(entry, map[string]string{req.Key: req.New}, &res)
+	}()
+
+	if !d.authorizeKeys(w, r, &res, keys) {
+		return
+	}
+	if err := d.callClientHook(r.Context(), client, keys); err!=nil {
+		res.Status = http.StatusForbidden
+		res.Err = append(res.Err, err.Error())
+		d.writeVersioned(w, &res)
+		return
+	}
+
+	if err := d.checkField(req.Key, req.New, req.Sealed); err!=nil {
+		res.Status = http.StatusUnprocessableEntity
+		res.Fields[0].Err = err.Error()
+		d.writeVersioned(w, &res)
+		return
+	}
+
+	if !d.allowKeys(w, &res, keys) {
+		return
+	}
+
+	unlockKeys := d.lockKeys(keys)
+	defer unlockKeys()
+
+	old, existed, err := d.metaConfig.CompareAndSwapAs(client, &req.Key, req.Expected, &req.New)
+	res.Fields[0].Old, res.Fields[0].Existed = d.auditValue(req.Key, old), existed
+	if err!=nil {
+		res.Status = http.StatusConflict
+		if errors.Is(err, metaconfig.ErrValueMismatch) {
+			res.Status = http.StatusPreconditionFailed
+		}
+		res.Fields[0].Err = err.Error()
+		d.writeVersioned(w, &res)
+		return
+	}
+	res.Fields[0].Set = true
+
+	// Previous values are keyed canonically like the ones of SwapConfigAs
+	previous := map[string]string{}
+	if existed {
+		previous[d.metaConfig.CanonicalKey(req.Key)] = old
+	}
+	update := updateRequest{
+		StringFields: []metaStringField{{Key: req.Key, Value: req.New, Sealed: req.Sealed}},
+		Persist: req.Persist,
+		Atomic: req.Atomic,
+	}
+	errs := d.runUpdateHooks(r.Context(), &update, client, previous, res.Fields, func() {})
+	res.Err = append(res.Err, errorStrings(errs)...)
+	if res.Fields[0].Err!=""||len(errs)>0 {
+		res.Status = http.StatusInternalServerError
+	}
+
+	d.writeVersioned(w, &res)
+}
@@ -0,0 +1,878 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/metahook"
+)
+
+/**
+ * Default timeout of a single request (watch streams are not affected)
+ */
+const DEFAULT_TIMEOUT time.Duration = 30 * time.Second
+
+/**
+ * Default number of retries of a failed request
+ */
+const DEFAULT_RETRIES int = 3
+
+/**
+ * Default delay before the first retry, the delay is doubled on every retry
+ */
+const DEFAULT_RETRY_BACKOFF time.Duration = 200 * time.Millisecond
+
+/**
+ * Client of the MetaHook API
+ *
+ * Example:
+ *
+ * ```
+ * c := client.CreateUnixClient("/run/cthulhu/granit.sock", client.WithToken(token))
+ * if _, err := c.UpdateString(ctx, "log.level", "debug"); err!=nil {
+ *	return err
+ * }
+ * ```
+ */
+type Client struct {
+	// HTTP client dialing the MetaHook
+	httpClient *http.Client
+	// Base url of the versioned API (e.g. http://metahook/v1)
+	baseUrl string
+	// Bearer token sent with every request (omitted if empty)
+	token string
+	// Timeout of a single request (no timeout if <= 0)
+	timeout time.Duration
+	// Number of retries of a failed request
+	retries int
+	// Delay before the first retry
+	retryBackoff time.Duration
+	// Upper bound of the delay between two retries
+	maxBackoff time.Duration
+	// Time connection failures are retried regardless of retries (disabled if <= 0)
+	reconnectTimeout time.Duration
+	// Connection state reported to the conn state hook
+	conn connTracker
+	// Send an Idempotency-Key with every mutating request
+	idempotencyKeys bool
+}
+
+/**
+ * Option to customize the Client on creation
+ */
+type Option func(*Client)
+
+/**
+ * Creates a client that connects to the MetaHook unix socket
+ */
+func CreateUnixClient(socketPath string, opts ...Option) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}
+	// Host is ignored by the unix socket dialer
+	return createClient(transport, "http://metahook", opts...)
+}
+
+/**
+ * Creates a client that connects to the Windows named pipe of the MetaHook (see metahook.WithNamedPipe)
+ */
+func CreatePipeClient(name string, opts ...Option) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return metahook.DialPipe(ctx, name)
+		},
+	}
+	// Host is ignored by the pipe dialer
+	return createClient(transport, "http://metahook", opts...)
+}
+
+/**
+ * Creates a client that connects to the TLS listener of the MetaHook (see metahook.WithTLSListener)
+ *
+ * The tls config holds the trusted CAs and, if the MetaHook requires it, the client certificate.
+ */
+func CreateTCPClient(addr string, tlsConfig *tls.Config, opts ...Option) *Client {
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	return createClient(transport, "https://" + addr, opts...)
+}
+
+func createClient(transport *http.Transport, host string, opts ...Option) *Client {
+	client := &Client{
+		httpClient: &http.Client{Transport: transport},
+		baseUrl: host + "/" + metahook.API_VERSION,
+		timeout: DEFAULT_TIMEOUT,
+		retries: DEFAULT_RETRIES,
+		retryBackoff: DEFAULT_RETRY_BACKOFF,
+		maxBackoff: DEFAULT_MAX_BACKOFF,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+/**
+ * Sends the token as bearer token with every request (see metahook.WithTokenAuth)
+ */
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+/**
+ * Sets the timeout of a single request (no timeout if <= 0)
+ *
+ * Retries are not included, every attempt has its own timeout.
+ */
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+/**
+ * Sets the number of retries and the delay before the first retry
+ *
+ * Only requests that were not processed by the MetaHook are retried
+ * (connection failures, rate limited and unavailable responses), so retries never run hooks twice.
+ * With WithIdempotencyKeys, mutating requests are also retried after other network errors.
+ *
+ * The delay is doubled on every retry up to the maximum backoff (see WithMaxBackoff) and randomized by up to half,
+ * connection failures can be retried beyond the number of retries with WithReconnect.
+ */
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+/**
+ * Sends a random Idempotency-Key with every update, delete and reload
+ *
+ * The key is reused for all retries of a request, which allows retrying after any network error,
+ * as the MetaHook replays the response of an already processed request instead of calling the hooks again.
+ */
+func WithIdempotencyKeys() Option {
+	return func(c *Client) {
+		c.idempotencyKeys = true
+	}
+}
+
+/**
+ * Operates on the named MetaConfig of the MetaHook instead of the default one (see metahook.AddConfig)
+ */
+func WithConfig(name string) Option {
+	return func(c *Client) {
+		c.baseUrl += "/configs/" + url.PathEscape(name)
+	}
+}
+
+/**
+ * Operates on the key space of the named namespace of the MetaHook (see metahook.AddNamespace)
+ *
+ * Keys are passed and reported without the prefix of the namespace.
+ * Namespaces are bound to their MetaConfig, don't combine it with WithConfig.
+ */
+func WithNamespace(name string) Option {
+	return func(c *Client) {
+		c.baseUrl += "/ns/" + url.PathEscape(name)
+	}
+}
+
+type StringField struct {
+	Key string `json:"key"`
+	Value string `json:"value"`
+	// Value is sealed with the sealing key of the MetaConfig (see Seal)
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+type BoolField struct {
+	Key string `json:"key"`
+	Value bool `json:"value"`
+}
+
+type IntField struct {
+	Key string `json:"key"`
+	Value int64 `json:"value"`
+}
+
+type DoubleField struct {
+	Key string `json:"key"`
+	Value float64 `json:"value"`
+}
+
+type ListField struct {
+	Key string `json:"key"`
+	Value []string `json:"value"`
+}
+
+/**
+ * Duration field, sent as string like "1m30s" and parsed by the MetaHook
+ */
+type DurationField struct {
+	Key string `json:"key"`
+	Value time.Duration `json:"value"`
+}
+
+func (f DurationField) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key string `json:"key"`
+		Value string `json:"value"`
+	}{f.Key, f.Value.String()})
+}
+
+/**
+ * Time field, sent as RFC3339 timestamp and parsed by the MetaHook
+ */
+type TimeField struct {
+	Key string `json:"key"`
+	Value time.Time `json:"value"`
+}
+
+func (f TimeField) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key string `json:"key"`
+		Value string `json:"value"`
+	}{f.Key, f.Value.Format(time.RFC3339Nano)})
+}
+
+/**
+ * Update of multiple fields
+ *
+ * Only an Atomic update is all-or-nothing. Otherwise the MetaHook applies the accepted fields
+ * and reports the rejected ones as problems of a 422 response (see UpdateResult).
+ */
+type UpdateRequest struct {
+	StringFields []StringField `json:"string_fields,omitempty"`
+	BoolFields []BoolField `json:"bool_fields,omitempty"`
+	IntFields []IntField `json:"int_fields,omitempty"`
+	DoubleFields []DoubleField `json:"double_fields,omitempty"`
+	ListFields []ListField `json:"list_fields,omitempty"`
+	DurationFields []DurationField `json:"duration_fields,omitempty"`
+	TimeFields []TimeField `json:"time_fields,omitempty"`
+	// Write the configuration to disk after all hooks succeeded
+	Persist bool `json:"persist"`
+	// Apply nothing if any field is rejected and roll back all fields if any hook fails
+	Atomic bool `json:"atomic"`
+	// Run the hooks in the background, the result contains the job id
+	Async bool `json:"async"`
+	// Only validate the fields and report the planned changes, nothing is applied
+	DryRun bool `json:"dry_run"`
+	// Only apply the update if the MetaConfig still has this version (sent as If-Match header)
+	IfVersion *uint64 `json:"-"`
+}
+
+/**
+ * Templated update, expanded by the MetaHook into a single update
+ */
+type TemplateRequest struct {
+	// Value templates by key template (text/template limited to variables, e.g. "disk.{{.id}}.state": "online")
+	Fields map[string]string `json:"fields"`
+	// Types of the fields by key template, either "string" (default), "bool", "int", "double", "duration" or "time"
+	Types map[string]string `json:"types,omitempty"`
+	// Variables of every instantiation, every template is executed once per entry
+	Vars []map[string]string `json:"vars"`
+	// Write the configuration to disk after all hooks succeeded
+	Persist bool `json:"persist"`
+	// Apply nothing if any field is rejected and roll back all fields if any hook fails
+	Atomic bool `json:"atomic"`
+	// Run the hooks in the background, the result contains the job id
+	Async bool `json:"async"`
+	// Only validate the fields and report the planned changes, nothing is applied
+	DryRun bool `json:"dry_run"`
+	// Only apply the update if the MetaConfig still has this version (sent as If-Match header)
+	IfVersion *uint64 `json:"-"`
+}
+
+/**
+ * Result of a single field of an update or delete
+ */
+type FieldResult struct {
+	Key string `json:"key"`
+	// Value is set in (or deleted from) the MetaConfig
+	Set bool `json:"set"`
+	// At least one hook was called for the field
+	HookRan bool `json:"hook_ran"`
+	Err string `json:"err,omitempty"`
+	// At least one hook of the field panicked
+	Panicked bool `json:"panicked,omitempty"`
+	// Dry run only: hooks that would be called as <type>:<pattern> (e.g. "string:disk.*", "global")
+	Hooks []string `json:"hooks,omitempty"`
+	// Value before the update or delete (redacted values are masked)
+	Old string `json:"old,omitempty"`
+	// Key existed before the update or delete
+	Existed bool `json:"existed,omitempty"`
+	// Payload reported by the hooks of the field (see metahook.SetHookResult)
+	Result json.RawMessage `json:"result,omitempty"`
+	// Warnings reported by the hooks of the field
+	Warnings []string `json:"warnings,omitempty"`
+	// Dry run only: requested value (redacted values are masked)
+	New string `json:"new,omitempty"`
+	// Dry run only: requested value differs from the current value
+	Changed bool `json:"changed,omitempty"`
+}
+
+/**
+ * Invalid field of an update with its position in the request
+ */
+type FieldProblem struct {
+	// Array of the field in the request (e.g. "int_fields")
+	Field string `json:"field"`
+	// Index of the field in the array
+	Index int `json:"index"`
+	// Key of the field (empty if the key could not be decoded)
+	Key string `json:"key,omitempty"`
+	Err string `json:"err"`
+}
+
+/**
+ * Result of an update or delete
+ */
+type UpdateResult struct {
+	Status int `json:"status"`
+	Fields []FieldResult `json:"fields"`
+	// Errors that are not bound to a single field
+	Err []string `json:"err"`
+	// Invalid fields of a rejected update (status 422)
+	Problems []FieldProblem `json:"problems,omitempty"`
+	// Id of the background job of async updates
+	Job string `json:"job,omitempty"`
+	// Version of the MetaConfig when the response was written
+	Version uint64 `json:"version"`
+}
+
+/**
+ * Result of a reload
+ */
+type ReloadResult struct {
+	Status int `json:"status"`
+	Changed []string `json:"changed"`
+	Deleted []string `json:"deleted"`
+	Err []string `json:"err"`
+	// Version of the MetaConfig after the reload
+	Version uint64 `json:"version"`
+}
+
+/**
+ * Result of a flush
+ */
+type FlushResult struct {
+	Status int `json:"status"`
+	// Path of the written config file
+	Path string `json:"path,omitempty"`
+	// Size of the written config file in bytes
+	Bytes int64 `json:"bytes"`
+	// Hex encoded SHA-256 checksum of the written config file
+	Checksum string `json:"checksum,omitempty"`
+	Err []string `json:"err"`
+	// Version of the written MetaConfig
+	Version uint64 `json:"version"`
+}
+
+/**
+ * State of a background job of an async update
+ */
+type Job struct {
+	Id string `json:"id"`
+	Status metahook.JobStatus `json:"status"`
+	// Number of fields whose hooks returned
+	Done int `json:"done"`
+	// Number of fields of the update
+	Total int `json:"total"`
+	Fields []FieldResult `json:"fields"`
+	Err []string `json:"err"`
+	Started time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+/**
+ * Error returned if the MetaHook responds with an error status
+ */
+type APIError struct {
+	// HTTP status code of the response
+	Status int
+	// Error message of the response
+	Msg string
+}
+
+func (e* APIError) Error() string {
+	if e.Msg=="" {
+		return fmt.Sprintf("MetaHook request failed with status %d", e.Status)
+	}
+	return fmt.Sprintf("MetaHook request failed with status %d: %s", e.Status, e.Msg)
+}
+
+/**
+ * Sends an update to the MetaHook
+ *
+ * If the update is rejected or a hook fails, the result is returned along with an *APIError,
+ * the result holds the details of every field.
+ * Updates with an IfVersion that doesn't match the current version fail with status 412.
+ */
+func (c* Client) Update(ctx context.Context, req UpdateRequest) (*UpdateResult, error) {
+	res := &UpdateResult{}
+	if err := c.request(ctx, "POST", "/update", ifMatchHeader(req.IfVersion), req, res); err!=nil {
+		return res, updateError(err, res)
+	}
+	return res, nil
+}
+
+/**
+ * Sends a templated update to the MetaHook
+ *
+ * The result holds the expanded fields and is handled like the result of Update,
+ * templates that can't be expanded fail with status 400.
+ */
+func (c* Client) UpdateTemplate(ctx context.Context, req TemplateRequest) (*UpdateResult, error) {
+	res := &UpdateResult{}
+	if err := c.request(ctx, "POST", "/template", ifMatchHeader(req.IfVersion), req, res); err!=nil {
+		return res, updateError(err, res)
+	}
+	return res, nil
+}
+
+/**
+ * Returns the If-Match header of the version (empty if nil)
+ */
+func ifMatchHeader(version *uint64) http.Header {
+	header := http.Header{}
+	if version!=nil {
+		header.Set("If-Match", "\"" + strconv.FormatUint(*version, 10) + "\"")
+	}
+	return header
+}
+
+/**
+ * Sets a string value and calls its update hooks
+ */
+func (c* Client) UpdateString(ctx context.Context, key string, value string) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{StringFields: []StringField{{Key: key, Value: value}}})
+}
+
+/**
+ * Sets a bool value and calls its update hooks
+ */
+func (c* Client) UpdateBool(ctx context.Context, key string, value bool) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{BoolFields: []BoolField{{key, value}}})
+}
+
+/**
+ * Sets an int value and calls its update hooks
+ */
+func (c* Client) UpdateInt(ctx context.Context, key string, value int64) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{IntFields: []IntField{{key, value}}})
+}
+
+/**
+ * Sets a double value and calls its update hooks
+ */
+func (c* Client) UpdateDouble(ctx context.Context, key string, value float64) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{DoubleFields: []DoubleField{{key, value}}})
+}
+
+/**
+ * Sets a list value and calls its update hooks
+ */
+func (c* Client) UpdateList(ctx context.Context, key string, value []string) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{ListFields: []ListField{{key, value}}})
+}
+
+/**
+ * Sets a duration value and calls its update hooks
+ */
+func (c* Client) UpdateDuration(ctx context.Context, key string, value time.Duration) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{DurationFields: []DurationField{{key, value}}})
+}
+
+/**
+ * Sets a time value and calls its update hooks
+ */
+func (c* Client) UpdateTime(ctx context.Context, key string, value time.Time) (*UpdateResult, error) {
+	return c.Update(ctx, UpdateRequest{TimeFields: []TimeField{{key, value}}})
+}
+
+/**
+ * Removes keys and calls their delete hooks
+ */
+func (c* Client) Delete(ctx context.Context, keys ...string) (*UpdateResult, error) {
+	res := &UpdateResult{}
+	if err := c.do(ctx, "POST", "/delete", map[string][]string{"keys": keys}, res); err!=nil {
+		return res, updateError(err, res)
+	}
+	return res, nil
+}
+
+/**
+ * Atomically sets a string value if the current value of the key is expected and calls its update hooks
+ *
+ * If expected is nil, the value is only set if the key does not exist.
+ * If the value differs, the result is returned along with an *APIError with status 412,
+ * the result of the field holds the current value (Old) and whether the key exists (Existed).
+ */
+func (c* Client) CompareAndSwap(ctx context.Context, key string, expected *string, value string) (*UpdateResult, error) {
+	res := &UpdateResult{}
+	req := map[string]any{"key": key, "expected": expected, "new": value}
+	if err := c.do(ctx, "POST", "/cas", req, res); err!=nil {
+		return res, updateError(err, res)
+	}
+	return res, nil
+}
+
+/**
+ * Writes the in-memory configuration of the MetaHook to disk without calling any hooks
+ *
+ * The result reports the size and checksum of the written config file.
+ */
+func (c* Client) Flush(ctx context.Context) (*FlushResult, error) {
+	res := &FlushResult{}
+	if err := c.do(ctx, "POST", "/flush", nil, res); err!=nil {
+		return res, err
+	}
+	return res, nil
+}
+
+/**
+ * Rereads the config file of the MetaHook and calls the hooks of changed keys
+ */
+func (c* Client) Reload(ctx context.Context) (*ReloadResult, error) {
+	res := &ReloadResult{}
+	if err := c.do(ctx, "POST", "/reload", nil, res); err!=nil {
+		return res, updateError(err, &UpdateResult{Err: res.Err})
+	}
+	return res, nil
+}
+
+/**
+ * Returns the value of the key and whether it exists
+ *
+ * Redacted values are returned as metaconfig.REDACTED_VALUE.
+ */
+func (c* Client) Get(ctx context.Context, key string) (string, bool, error) {
+	value, exists, _, err := c.GetVersioned(ctx, key)
+	return value, exists, err
+}
+
+/**
+ * Returns the value of the key, whether it exists and the version of the MetaConfig it was read from
+ *
+ * The version can be passed as IfVersion of an update, so that the update fails if the MetaConfig changed in between.
+ */
+func (c* Client) GetVersioned(ctx context.Context, key string) (string, bool, uint64, error) {
+	var res struct {
+		Value string `json:"value"`
+		Exists bool `json:"exists"`
+		Version uint64 `json:"version"`
+	}
+	if err := c.do(ctx, "GET", "/get?key=" + url.QueryEscape(key), nil, &res); err!=nil {
+		return "", false, 0, err
+	}
+	return res.Value, res.Exists, res.Version, nil
+}
+
+/**
+ * Result of a wait
+ */
+type WaitResult struct {
+	Value string `json:"value"`
+	Exists bool `json:"exists"`
+	// Version of the MetaConfig the value was read from, pass it to the next Wait
+	Version uint64 `json:"version"`
+	// False if the wait timed out without a change of the key
+	Changed bool `json:"changed"`
+}
+
+/**
+ * Blocks until the key changed after the config version or the timeout expired (see GetVersioned)
+ *
+ * The timeout is capped by the MetaHook (see metahook.MAX_WAIT_TIMEOUT)
+ * and must be shorter than the request timeout of the client (see WithTimeout).
+ */
+func (c* Client) Wait(ctx context.Context, key string, version uint64, timeout time.Duration) (*WaitResult, error) {
+	res := &WaitResult{}
+	path := fmt.Sprintf("/wait?key=%s&version=%d&timeout=%g", url.QueryEscape(key), version, timeout.Seconds())
+	if err := c.do(ctx, "GET", path, nil, res); err!=nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/**
+ * Returns the full configuration
+ *
+ * Redacted values are returned as metaconfig.REDACTED_VALUE.
+ */
+func (c* Client) GetConfig(ctx context.Context) (map[string]string, error) {
+	config := make(map[string]string)
+	if err := c.do(ctx, "GET", "/config", nil, &config); err!=nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+/**
+ * Returns the full configuration encoded in the format ("json", "yaml" or "native" config file syntax)
+ *
+ * Redacted values are returned as metaconfig.REDACTED_VALUE.
+ */
+func (c* Client) Export(ctx context.Context, format string) ([]byte, error) {
+	var data []byte
+	if err := c.do(ctx, "GET", "/export?format=" + url.QueryEscape(format), nil, &data); err!=nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/**
+ * Returns the state of the background job of an async update
+ */
+func (c* Client) Job(ctx context.Context, id string) (*Job, error) {
+	res := &Job{}
+	if err := c.do(ctx, "GET", "/jobs/" + url.PathEscape(id), nil, res); err!=nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/**
+ * Sends a request and decodes the JSON response into out
+ *
+ * If out is a *[]byte, the raw body of successful responses is stored instead.
+ * JSON responses are decoded even on error status codes, so that callers can report the details.
+ * Requests that were not processed by the MetaHook are retried with exponential backoff.
+ */
+func (c* Client) do(ctx context.Context, method string, path string, body any, out any) error {
+	return c.request(ctx, method, path, http.Header{}, body, out)
+}
+
+/**
+ * Sends a request with additional headers like do
+ */
+func (c* Client) request(ctx context.Context, method string, path string, header http.Header, body any, out any) error {
+	var payload []byte
+	if body!=nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err!=nil {
+			return err
+		}
+	}
+
+	if c.idempotencyKeys&&method=="POST" {
+		keyBuf := make([]byte, 16)
+		if _, err := rand.Read(keyBuf); err!=nil {
+			return err
+		}
+		header.Set(metahook.IDEMPOTENCY_HEADER, hex.EncodeToString(keyBuf))
+	}
+
+	backoff := c.retryBackoff
+	// Connection failures are retried until the reconnect deadline (see WithReconnect)
+	var reconnectDeadline time.Time
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.attempt(ctx, method, path, payload, header, out)
+		if err==nil||retryAfter<0 {
+			return err
+		}
+		if attempt>=c.retries {
+			if c.reconnectTimeout<=0||!isDialError(err) {
+				return err
+			}
+			if reconnectDeadline.IsZero() {
+				reconnectDeadline = time.Now().Add(c.reconnectTimeout)
+			} else if time.Now().After(reconnectDeadline) {
+				return err
+			}
+		}
+		if delay := jitter(backoff); retryAfter<delay {
+			retryAfter = delay
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(retryAfter):
+		}
+		if backoff *= 2; c.maxBackoff>0&&backoff>c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+/**
+ * Sends a single request
+ *
+ * Returns the minimum delay before the request can be retried, or -1 if it must not be retried.
+ */
+func (c* Client) attempt(
+	ctx context.Context,
+	method string,
+	path string,
+	payload []byte,
+	header http.Header,
+	out any) (time.Duration, error) {
+
+	if c.timeout>0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	res, err := c.send(ctx, method, path, payload, header)
+	if err!=nil {
+		// Only failed dials are guaranteed to not have reached the MetaHook,
+		// other failures are only retried if the MetaHook can deduplicate the request
+		if isDialError(err)||header.Get(metahook.IDEMPOTENCY_HEADER)!="" {
+			return 0, err
+		}
+		return -1, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err!=nil {
+		return -1, err
+	}
+	isJSON := strings.HasPrefix(res.Header.Get("Content-Type"), "application/json")
+	if res.StatusCode<300 {
+		if raw, ok := out.(*[]byte); ok {
+			*raw = body
+			return -1, nil
+		} else if !isJSON {
+			return -1, fmt.Errorf("Unexpected MetaHook response type '%s'", res.Header.Get("Content-Type"))
+		} else if err := json.Unmarshal(body, out); err!=nil {
+			return -1, fmt.Errorf("Failed to decode MetaHook response: %w", err)
+		}
+		return -1, nil
+	}
+
+	apiErr := &APIError{Status: res.StatusCode, Msg: errorMessage(body, isJSON)}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		seconds, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, apiErr
+	default:
+		// Decode the details of the failure, retried responses are not decoded
+		// as they would leak into the result of the next attempt
+		if isJSON {
+			json.Unmarshal(body, out)
+		}
+		return -1, apiErr
+	}
+}
+
+/**
+ * Extracts the error message of a failed response
+ *
+ * JSON responses carry the message in the "err" field (string or list), other responses are plain text.
+ */
+func errorMessage(body []byte, isJSON bool) string {
+	if !isJSON {
+		return strings.TrimSpace(string(body))
+	}
+	var res struct {
+		Err any `json:"err"`
+	}
+	json.Unmarshal(body, &res)
+	switch msg := res.Err.(type) {
+	case string:
+		return msg
+	case []any:
+		msgs := make([]string, 0, len(msg))
+		for _, m := range msg {
+			msgs = append(msgs, fmt.Sprint(m))
+		}
+		return strings.Join(msgs, "; ")
+	default:
+		return ""
+	}
+}
+
+/**
+ * Creates and sends a request to the MetaHook with the token, headers (e.g. idempotency key) and JSON body attached
+ */
+func (c* Client) send(ctx context.Context, method string, path string, payload []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if payload!=nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl + path, reader)
+	if err!=nil {
+		return nil, err
+	}
+	if payload!=nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token!="" {
+		req.Header.Set("Authorization", "Bearer " + c.token)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := c.httpClient.Do(req)
+	c.observeConn(err)
+	return res, err
+}
+
+/**
+ * Adds the general errors and the problems (or field errors) of an update response to the error message
+ */
+func updateError(err error, res *UpdateResult) error {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return err
+	}
+	msgs := append([]string(nil), res.Err...)
+	// Problems reference the position of the field, they include the errors of the rejected fields
+	if len(res.Problems)>0 {
+		for _, problem := range res.Problems {
+			msgs = append(msgs, fmt.Sprintf("%s[%d] %s: %s", problem.Field, problem.Index, problem.Key, problem.Err))
+		}
+	} else {
+		for _, field := range res.Fields {
+			if field.Err!="" {
+				msgs = append(msgs, field.Key + ": " + field.Err)
+			}
+		}
+	}
+	if len(msgs)>0 {
+		apiErr.Msg = strings.Join(msgs, "; ")
+	}
+	return apiErr
+}
@@ -0,0 +1,156 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+ * Default upper bound of the delay between two retries (see WithMaxBackoff)
+ */
+const DEFAULT_MAX_BACKOFF time.Duration = 5 * time.Second
+
+/**
+ * Connection state of the client, reported to the hook of WithConnStateHook
+ */
+type CONNSTATE int
+const (
+	// No request has reached the MetaHook yet
+	CONN_UNKNOWN CONNSTATE = iota
+	// Last request reached the MetaHook
+	CONN_CONNECTED
+	// Last request failed to connect (e.g. connection refused or socket missing)
+	CONN_DISCONNECTED
+)
+
+func (s CONNSTATE) String() string {
+	switch s {
+	case CONN_CONNECTED:
+		return "connected"
+	case CONN_DISCONNECTED:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+ * Tracked connection state and the hook notified on changes
+ */
+type connTracker struct {
+	lock sync.Mutex
+	state CONNSTATE
+	hook func(state CONNSTATE, err error)
+}
+
+/**
+ * Keeps retrying requests that fail to connect until the timeout elapsed
+ *
+ * Connection failures (connection refused, socket or pipe missing) never reach the MetaHook,
+ * so they are retried regardless of the number of retries (see WithRetries),
+ * which lets controllers push their config across a restart of the daemon.
+ * Pass a timeout <= 0 to only retry them like other failures (default).
+ */
+func WithReconnect(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.reconnectTimeout = timeout
+	}
+}
+
+/**
+ * Caps the exponentially growing delay between two retries (default DEFAULT_MAX_BACKOFF)
+ */
+func WithMaxBackoff(backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxBackoff = backoff
+	}
+}
+
+/**
+ * Calls the hook whenever the connection state changes
+ *
+ * The hook receives the new state and, for CONN_DISCONNECTED, the connection error.
+ * It is called synchronously from the goroutine of the request that observed the change, it must not block.
+ */
+func WithConnStateHook(hook func(state CONNSTATE, err error)) Option {
+	return func(c *Client) {
+		c.conn.hook = hook
+	}
+}
+
+/**
+ * Returns the connection state observed by the last request
+ */
+func (c* Client) ConnState() CONNSTATE {
+	c.conn.lock.Lock()
+	defer c.conn.lock.Unlock()
+	return c.conn.state
+}
+
+/**
+ * Updates the connection state with the outcome of a request and notifies the hook on changes
+ *
+ * Errors other than connection failures don't change the state.
+ */
+func (c* Client) observeConn(err error) {
+	state := CONN_CONNECTED
+	if err!=nil {
+		// Dials aborted by the caller say nothing about the MetaHook
+		if !isDialError(err)||errors.Is(err, context.Canceled) {
+			return
+		}
+		state = CONN_DISCONNECTED
+	}
+	c.conn.lock.Lock()
+	changed := c.conn.state!=state
+	c.conn.state = state
+	hook := c.conn.hook
+	c.conn.lock.Unlock()
+	if changed&&hook!=nil {
+		hook(state, err)
+	}
+}
+
+/**
+ * Reports whether the request failed to connect, so that it did not reach the MetaHook
+ */
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr)&&opErr.Op=="dial"
+}
+
+/**
+ * Returns a random delay between half and the full backoff
+ *
+ * The jitter spreads the retries of clients that lost their connection at the same time (e.g. on a daemon restart).
+ */
+func jitter(backoff time.Duration) time.Duration {
+	if backoff<=1 {
+		return backoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,93 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+type sealingKeyResponse struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+	KeyPrefix string `json:"key_prefix"`
+}
+
+/**
+ * Returns the public key values of the MetaConfig are sealed with
+ *
+ * Fails with status 404 if the MetaConfig has no sealing key.
+ */
+func (c* Client) SealingKey(ctx context.Context) (*ecdh.PublicKey, error) {
+	key, _, err := c.sealingKey(ctx)
+	return key, err
+}
+
+/**
+ * Encrypts the plaintext value of the key with the sealing key of the MetaConfig (see metaconfig.Seal)
+ *
+ * Keys of namespaces are sealed for the full key of the MetaConfig (see WithNamespace).
+ */
+func (c* Client) Seal(ctx context.Context, key string, plaintext string) (string, error) {
+	pub, prefix, err := c.sealingKey(ctx)
+	if err!=nil {
+		return "", err
+	}
+	return metaconfig.Seal(pub, prefix + key, plaintext)
+}
+
+/**
+ * Seals a string value and sets it, the plaintext never leaves the client
+ */
+func (c* Client) UpdateSealed(ctx context.Context, key string, plaintext string) (*UpdateResult, error) {
+	sealed, err := c.Seal(ctx, key, plaintext)
+	if err!=nil {
+		return nil, err
+	}
+	return c.Update(ctx, UpdateRequest{StringFields: []StringField{{Key: key, Value: sealed, Sealed: true}}})
+}
+
+/**
+ * Fetches the sealing key and the key prefix of the namespace
+ */
+func (c* Client) sealingKey(ctx context.Context) (*ecdh.PublicKey, string, error) {
+	res := &sealingKeyResponse{}
+	if err := c.do(ctx, "GET", "/sealing-key", nil, res); err!=nil {
+		return nil, "", err
+	}
+	if res.Algorithm!="x25519" {
+		return nil, "", fmt.Errorf("Unsupported sealing key algorithm '%s'", res.Algorithm)
+	}
+	raw, err := base64.StdEncoding.DecodeString(res.PublicKey)
+	if err!=nil {
+		return nil, "", fmt.Errorf("Malformed sealing key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err!=nil {
+		return nil, "", fmt.Errorf("Malformed sealing key: %w", err)
+	}
+	return pub, res.KeyPrefix, nil
+}
@@ -0,0 +1,93 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Streams the changes of keys with the prefix (empty for all keys)
+ *
+ * The channel is closed when the context is cancelled or the stream ends,
+ * the returned function reports the error that ended the stream (nil if cancelled).
+ *
+ * Changes are dropped by the MetaHook if the receiver can't keep up,
+ * resync with GetConfig after the stream ended.
+ */
+func (c* Client) Watch(ctx context.Context, prefix string) (<-chan metaconfig.Change, func() error, error) {
+	path := "/watch"
+	if prefix!="" {
+		path += "?prefix=" + url.QueryEscape(prefix)
+	}
+	// The request timeout does not apply, the stream is open until the context is cancelled
+	res, err := c.send(ctx, "GET", path, nil, nil)
+	if err!=nil {
+		return nil, nil, err
+	}
+	if res.StatusCode!=http.StatusOK {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		isJSON := strings.HasPrefix(res.Header.Get("Content-Type"), "application/json")
+		return nil, nil, &APIError{res.StatusCode, errorMessage(body, isJSON)}
+	}
+
+	changes := make(chan metaconfig.Change)
+	var streamErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(changes)
+		defer res.Body.Close()
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			data, found := strings.CutPrefix(scanner.Text(), "data: ")
+			if !found {
+				continue
+			}
+			var change metaconfig.Change
+			if streamErr = json.Unmarshal([]byte(data), &change); streamErr!=nil {
+				return
+			}
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err()==nil {
+			streamErr = scanner.Err()
+		}
+	}()
+	return changes, func() error {
+		<-done
+		return streamErr
+	}, nil
+}
@@ -0,0 +1,135 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Name of the MetaConfig passed to NewMetaHook
+ */
+const DEFAULT_CONFIG = "default"
+
+/**
+ * MetaConfig served by the MetaHook with its updateHooks
+ *
+ * The handlers of a domain operate on its MetaConfig and hooks,
+ * everything else (hook timeout, rate limits, audit, jobs) is shared by all domains.
+ */
+type configDomain struct {
+	*MetaHook
+	name string
+	metaConfig *metaconfig.MetaConfig
+	// Mutex lock for the updateHooks (see RegisterHook)
+	hookLock sync.RWMutex
+	// Hook maps are never modified, RegisterHook replaces them with modified copies
+	updateHooks UpdateHooks
+	// Handlers of the domain by endpoint (e.g. "/update")
+	routes map[string]http.HandlerFunc
+	// Name of the namespace served by the domain (empty for MetaConfigs, see AddNamespace)
+	namespace string
+	// Prefix of all keys of the namespace
+	keyPrefix string
+	// Domain of the MetaConfig the namespace belongs to, its hooks are used for the namespace
+	parent *configDomain
+}
+
+func (m* MetaHook) newConfigDomain(name string, config *metaconfig.MetaConfig, hooks UpdateHooks) *configDomain {
+	d := &configDomain{
+		MetaHook: m,
+		name: name,
+		metaConfig: config,
+		updateHooks: hooks,
+	}
+	d.routes = map[string]http.HandlerFunc{
+		"/update": m.idempotent(m.queued(d.updateHandler)),
+		"/delete": m.idempotent(m.queued(d.deleteHandler)),
+		"/cas": m.idempotent(m.queued(d.casHandler)),
+		"/template": m.idempotent(m.queued(d.templateHandler)),
+		"/reload": m.idempotent(m.queued(d.reloadHandler)),
+		"/flush": m.idempotent(m.queued(d.flushHandler)),
+		"/get": d.getHandler,
+		"/config": d.configHandler,
+		"/export": d.exportHandler,
+		"/sealing-key": d.sealingKeyHandler,
+		"/watch": d.watchHandler,
+		"/wait": d.waitHandler,
+	}
+	return d
+}
+
+/**
+ * Serves an additional MetaConfig with its own updateHooks
+ *
+ * The endpoints of the MetaConfig are served at /configs/<name>/ (e.g. /v1/configs/storage/update),
+ * the MetaConfig passed to NewMetaHook is served at the root and at /configs/default/.
+ * This allows one socket to manage all configuration domains of a component (e.g. "core", "storage", "network").
+ *
+ * Token authentication always uses the default MetaConfig (see WithTokenAuth).
+ *
+ * Must be called before Serve().
+ */
+func (m* MetaHook) AddConfig(name string, config *metaconfig.MetaConfig, hooks UpdateHooks) error {
+	if name==""||strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid config name '%s'", name)
+	}
+	if config==nil {
+		return errors.New("MetaConfig must not be nil")
+	}
+	if _, exists := m.configs[name]; exists {
+		return fmt.Errorf("Config '%s' is already registered", name)
+	}
+	m.configs[name] = m.newConfigDomain(name, config, hooks)
+	return nil
+}
+
+/**
+ * Handler requests to /configs/<name>/<endpoint>
+ *
+ * Dispatches the request to the endpoint of the named MetaConfig,
+ * jobs are shared by all MetaConfigs and can also be queried with /configs/<name>/jobs/<id>.
+ */
+func (m* MetaHook) configsHandler(w http.ResponseWriter, r *http.Request) {
+	_, rest, _ := strings.Cut(r.URL.Path, "/configs/")
+	name, endpoint, _ := strings.Cut(rest, "/")
+	d, exists := m.configs[name]
+	if !exists {
+		http.Error(w, "Config '" + name + "' not found", http.StatusNotFound)
+		return
+	}
+	if strings.HasPrefix(endpoint, "jobs/") {
+		m.jobHandler(w, r)
+		return
+	}
+	handler, exists := d.routes["/" + endpoint]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	handler(w, r)
+}
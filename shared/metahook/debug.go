@@ -0,0 +1,67 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metahook
+
+import (
+	"net/http"
+)
+
+/**
+ * Serves the handler at the pattern with the access restrictions of the debug endpoints
+ *
+ * The handlers are served on all listeners of the MetaHook and are subject to its authentication
+ * and peer restrictions (see WithTokenAuth, WithPeerUsers).
+ * If an ACL is configured, only peers with write access to every key of the default MetaConfig may use them (see WithACL).
+ *
+ * Used by the metahook/debug package to serve the runtime profiles and expvar variables (see debug.WithEndpoints),
+ * which keeps net/http/pprof and expvar out of binaries that don't enable them.
+ */
+func WithDebugHandler(pattern string, handler http.Handler) Option {
+	return func(m *MetaHook) {
+		if m.debugHandlers==nil {
+			m.debugHandlers = make(map[string]http.Handler)
+		}
+		m.debugHandlers[pattern] = handler
+	}
+}
+
+/**
+ * Registers the debug handlers on the mux
+ */
+func (m* MetaHook) registerDebugEndpoints(mux *http.ServeMux) {
+	for pattern, handler := range m.debugHandlers {
+		mux.Handle(pattern, m.debugHandler(handler))
+	}
+}
+
+/**
+ * Rejects peers without write access to the default MetaConfig
+ */
+func (m* MetaHook) debugHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.configs[DEFAULT_CONFIG].aclAllows(r, "", true) {
+			http.Error(w, "Access to the debug endpoints denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+/**
+ * Debug endpoints of the MetaHook
+ *
+ * Kept separate from the metahook package, because importing net/http/pprof and expvar registers their handlers
+ * on http.DefaultServeMux as a side effect. Only binaries importing this package pay for the registration.
+ */
+package debug
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/megakuul/cthulhu/shared/metahook"
+)
+
+/**
+ * Serves the runtime profiles of net/http/pprof at /debug/pprof/ and the expvar variables at /debug/vars
+ *
+ * The endpoints have the access restrictions of metahook.WithDebugHandler, so live daemons can be profiled
+ * through the secured socket (e.g. curl --unix-socket <socket> http://localhost/debug/pprof/heap > heap.pprof).
+ *
+ * Profiles and goroutine dumps reveal internals of the process, only enable them where needed.
+ * The handlers registered on http.DefaultServeMux by importing this package are never served by the MetaHook,
+ * http.DefaultServeMux must not be served elsewhere either (e.g. http.ListenAndServe(addr, nil)),
+ * it would expose them without any authentication.
+ */
+func WithEndpoints() metahook.Option {
+	options := []metahook.Option{
+		metahook.WithDebugHandler("/debug/pprof/", http.HandlerFunc(pprof.Index)),
+		metahook.WithDebugHandler("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline)),
+		metahook.WithDebugHandler("/debug/pprof/profile", http.HandlerFunc(pprof.Profile)),
+		metahook.WithDebugHandler("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol)),
+		metahook.WithDebugHandler("/debug/pprof/trace", http.HandlerFunc(pprof.Trace)),
+		metahook.WithDebugHandler("/debug/vars", http.HandlerFunc(serveVars)),
+	}
+	return func(m *metahook.MetaHook) {
+		for _, opt := range options {
+			opt(m)
+		}
+	}
+}
+
+/**
+ * Writes all expvar variables as one JSON object (same format as expvar.Handler)
+ *
+ * Implemented with expvar.Do, so that the endpoint does not depend on the handler registered on http.DefaultServeMux.
+ */
+func serveVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
@@ -0,0 +1,134 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+/**
+ * Registers the keys or key patterns whose hooks must be called before the hooks of the key or pattern
+ * of the named MetaConfig (see UpdateHooks.Dependencies)
+ *
+ * Replaces the dependencies registered for the key, passing no dependencies removes them.
+ * Safe to call while the MetaHook is serving, requests that already started keep their order.
+ */
+func (m* MetaHook) RegisterHookDependencies(config string, key string, dependencies ...string) error {
+	d, exists := m.configs[config]
+	if !exists {
+		return fmt.Errorf("Config '%s' not found", config)
+	}
+	d.hookLock.Lock()
+	defer d.hookLock.Unlock()
+	hooks := d.updateHooks
+	hooks.Dependencies, _ = removeHook(hooks.Dependencies, key)
+	if len(dependencies)>0 {
+		hooks.Dependencies, _ = addHook(hooks.Dependencies, key, append([]string(nil), dependencies...))
+	}
+	d.updateHooks = hooks
+	return nil
+}
+
+/**
+ * Returns the order in which the hooks of the keys of a batch are called
+ *
+ * The hooks of a key are called after the hooks of its dependencies that are part of the batch,
+ * otherwise keys keep their batch order. Dependencies on keys outside of the batch are ignored.
+ * Keys of a dependency cycle can't be ordered, they are reported in cyclic (by index)
+ * and the dependency closing the cycle is ignored.
+ */
+func hookOrder(dependencies map[string][]string, keys []string) (order []int, cyclic map[int]bool) {
+	if len(dependencies)==0 {
+		order = make([]int, len(keys))
+		for i := range order {
+			order[i] = i
+		}
+		return order, nil
+	}
+	indexes := make(map[string][]int, len(keys))
+	for i, key := range keys {
+		indexes[key] = append(indexes[key], i)
+	}
+	// Indexes of the keys every key depends on
+	edges := make([][]int, len(keys))
+	for i, key := range keys {
+		deps, exists := findHook(dependencies, key)
+		if !exists {
+			continue
+		}
+		for _, dep := range deps {
+			if !strings.ContainsAny(dep, "*?[") {
+				edges[i] = append(edges[i], indexes[dep]...)
+				continue
+			}
+			for j, other := range keys {
+				if matched, _ := path.Match(dep, other); matched {
+					edges[i] = append(edges[i], j)
+				}
+			}
+		}
+	}
+
+	// Depth first search, dependencies are emitted before their dependents
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(keys))
+	var stack []int
+	var visit func(i int)
+	visit = func(i int) {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, j := range edges[i] {
+			switch state[j] {
+			case unvisited:
+				visit(j)
+			case visiting:
+				if j==i {
+					continue
+				}
+				// Every key on the stack since the dependency is part of the cycle
+				if cyclic==nil {
+					cyclic = make(map[int]bool)
+				}
+				for k := len(stack)-1; k>=0; k-- {
+					cyclic[stack[k]] = true
+					if stack[k]==j {
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		order = append(order, i)
+	}
+	for i := range keys {
+		if state[i]==unvisited {
+			visit(i)
+		}
+	}
+	return order, cyclic
+}
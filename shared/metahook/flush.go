@@ -0,0 +1,85 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+type flushResponse struct {
+	// HTTP status code of the response
+	Status int `json:"status"`
+	// Path of the written config file
+	Path string `json:"path,omitempty"`
+	// Size of the written config file in bytes
+	Bytes int64 `json:"bytes"`
+	// Hex encoded SHA-256 checksum of the written config file
+	Checksum string `json:"checksum,omitempty"`
+	Err []string `json:"err"`
+	// Version of the written MetaConfig (also sent as ETag)
+	Version uint64 `json:"version"`
+}
+
+/**
+ * Handler flush requests
+ *
+ * Writes the in-memory configuration to disk (see metaconfig.MetaConfig.Flush) without calling any hooks,
+ * so that controllers can decide independently of updates when changes become durable.
+ * Reports the size and checksum of the written config file.
+ *
+ * Responds with status 403 if the peer may not write every key (see WithACL),
+ * 409 if the MetaConfig has no config file or the file was modified externally (see metaconfig.WithConflictDetection)
+ * and 500 if the write failed.
+ */
+func (d* configDomain) flushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method, expected POST!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := flushResponse{Status: http.StatusOK}
+	peer, _ := requestPeerCredentials(r)
+	entry := d.newAuditEntry("flush", clientIdentity(r), peer, nil)
+	// A flush writes every key
+	if !d.aclAllows(r, "", true) {
+		res.Status = http.StatusForbidden
+		res.Err = append(res.Err, "Write access to the config denied")
+		res.Version = d.metaConfig.Version()
+	} else if result, err := d.metaConfig.Flush(); err!=nil {
+		res.Status = http.StatusInternalServerError
+		if errors.Is(err, metaconfig.ErrMemoryOnly)||errors.Is(err, metaconfig.ErrConflict) {
+			res.Status = http.StatusConflict
+		}
+		res.Err = append(res.Err, err.Error())
+		res.Version = d.metaConfig.Version()
+	} else {
+		res.Path, res.Bytes, res.Checksum, res.Version = result.Path, result.Bytes, result.Checksum, result.Version
+	}
+	if entry!=nil {
+		entry.Status, entry.Err = res.Status, res.Err
+		d.recordAudit(entry)
+	}
+	w.Header().Set("ETag", formatETag(res.Version))
+	writeResponse(w, res.Status, res)
+}
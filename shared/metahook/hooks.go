@@ -0,0 +1,527 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metahook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Sets the updateHooks of the default MetaConfig (see RegisterHook to add hooks after creation)
+ */
+func WithUpdateHooks(hooks UpdateHooks) Option {
+	return func(m *MetaHook) {
+		m.configs[DEFAULT_CONFIG].updateHooks = hooks
+	}
+}
+
+/**
+ * Sets the maximum duration of a single hook call (default DEFAULT_HOOK_TIMEOUT)
+ *
+ * Pass a duration <= 0 to disable the timeout, hooks are then only canceled if the client disconnects.
+ */
+func WithHookTimeout(timeout time.Duration) Option {
+	return func(m *MetaHook) {
+		m.hookTimeout = timeout
+	}
+}
+
+/**
+ * Limits the number of hooks running at the same time across all requests and async jobs
+ *
+ * Hooks exceeding the limit wait for a free slot, pass 1 to run all hooks sequentially.
+ * Timed out hooks keep their slot until they actually return, so that hanging hooks can't overload the system.
+ * Pass a limit <= 0 to disable the limit (default).
+ *
+ * Hooks of a single request are always called one after another in request order.
+ */
+func WithHookConcurrency(limit int) Option {
+	return func(m *MetaHook) {
+		if limit>0 {
+			m.hookSlots = make(chan struct{}, limit)
+		} else {
+			m.hookSlots = nil
+		}
+	}
+}
+
+/**
+ * Serializes updates and deletions per key
+ *
+ * A request holds its keys from applying the values until its hooks returned (including async jobs),
+ * concurrent requests touching the same keys wait, so that the hooks of a key observe its values in the order they were applied.
+ * Reloads are not serialized.
+ */
+func WithKeySerialization() Option {
+	return func(m *MetaHook) {
+		m.keyLocks = &keyLocks{keys: make(map[string]*keyLock)}
+	}
+}
+
+/**
+ * Runs a hook with the hook timeout applied to the context
+ *
+ * Kind labels the hook in the metrics (e.g. "string", "delete", "global"),
+ * kind and key (empty for hooks not bound to a key) are recorded in the span of the hook (see WithTracer).
+ *
+ * Returns a timeout error if the hook does not return in time, the hook keeps running in the background.
+ */
+func (m* MetaHook) runHook(parent context.Context, kind string, key string, hook func(ctx context.Context) error) (err error) {
+	parent, span := m.startHookSpan(parent, kind, key)
+	defer func() { endHookSpan(span, err) }()
+
+	// Tracked until the hook actually returns (see WaitForHooks)
+	m.inflight.add()
+	tracked := hook
+	hook = func(ctx context.Context) error {
+		defer m.inflight.release()
+		return tracked(ctx)
+	}
+	if m.hookSlots!=nil {
+		select {
+		case m.hookSlots <- struct{}{}:
+		case <-parent.Done():
+			m.inflight.release()
+			return fmt.Errorf("Hook was not started: %w", parent.Err())
+		}
+		limited := hook
+		hook = func(ctx context.Context) error {
+			defer func() { <-m.hookSlots }()
+			return limited(ctx)
+		}
+	}
+	start := time.Now()
+	err = m.callHook(parent, m.recoverHook(kind, hook))
+	m.metrics.observeHook(kind, time.Since(start), err)
+	if _, verbose := m.logger.(VerboseLogger); verbose {
+		if err!=nil {
+			m.logDebug(fmt.Sprintf("MetaHook %s hook of '%s' failed after %s: %v", kind, key, time.Since(start), err))
+		} else {
+			m.logDebug(fmt.Sprintf("MetaHook %s hook of '%s' returned after %s", kind, key, time.Since(start)))
+		}
+	}
+	return err
+}
+
+var errHookTimeout = errors.New("Hook did not return in time")
+
+/**
+ * Error of a hook that panicked
+ */
+type HookPanicError struct {
+	// Value passed to panic
+	Value any
+	// Stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e* HookPanicError) Error() string {
+	return fmt.Sprintf("Hook panicked: %v", e.Value)
+}
+
+/**
+ * Wraps the hook, so that a panic is returned as *HookPanicError instead of crashing the process
+ *
+ * The stack trace of the panic is logged (see WithLogger).
+ */
+func (m* MetaHook) recoverHook(kind string, hook func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) (err error) {
+		defer func() {
+			if r := recover(); r!=nil {
+				panicErr := &HookPanicError{Value: r, Stack: debug.Stack()}
+				m.logError(fmt.Sprintf("MetaHook %s hook panicked: %v\n%s", kind, r, panicErr.Stack))
+				err = panicErr
+			}
+		}()
+		return hook(ctx)
+	}
+}
+
+/**
+ * Calls the hook with the hook timeout applied to the context
+ */
+func (m* MetaHook) callHook(parent context.Context, hook func(ctx context.Context) error) error {
+	if m.hookTimeout<=0 {
+		return hook(parent)
+	}
+	ctx, cancel := context.WithTimeout(parent, m.hookTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hook(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errHookTimeout, ctx.Err())
+	}
+}
+
+/**
+ * Returns the hook registered for the key
+ *
+ * Hooks can be registered for exact keys or for patterns (e.g. "disk.*"),
+ * using the syntax of path.Match where '*' matches any sequence of chars except '/'.
+ *
+ * An exact match takes precedence, otherwise the longest matching pattern is used.
+ */
+func findHook[T any](hooks map[string]T, key string) (T, bool) {
+	pattern, found := matchHook(hooks, key)
+	return hooks[pattern], found
+}
+
+/**
+ * Returns the key or pattern of the hook registered for the key (see findHook)
+ */
+func matchHook[T any](hooks map[string]T, key string) (string, bool) {
+	if _, exists := hooks[key]; exists {
+		return key, true
+	}
+	var matchPattern string
+	found := false
+	for pattern := range hooks {
+		if !strings.ContainsAny(pattern, "*?[") {
+			continue
+		}
+		if matched, _ := path.Match(pattern, key); !matched {
+			continue
+		}
+		// Prefer the longest pattern, on equal length the lexically smaller one for determinism
+		if !found||len(pattern)>len(matchPattern)||(len(pattern)==len(matchPattern)&&pattern<matchPattern) {
+			matchPattern, found = pattern, true
+		}
+	}
+	return matchPattern, found
+}
+
+/**
+ * Result payload and warnings reported by the hooks of a field
+ */
+type hookFeedback struct {
+	lock sync.Mutex
+	result any
+	warnings []string
+}
+
+type hookFeedbackKey struct{}
+
+/**
+ * Reports a result payload of the hook to the caller (e.g. the effective value after clamping)
+ *
+ * The payload is encoded as JSON and returned in the result of the field in the update or delete response.
+ * If multiple hooks of a field (e.g. typed hook and GlobalHook) report a result, the last one is returned.
+ * Reports of hooks that are not called for a field of a request (e.g. /reload) or that already timed out are discarded.
+ */
+func SetHookResult(ctx context.Context, result any) {
+	if feedback, ok := ctx.Value(hookFeedbackKey{}).(*hookFeedback); ok {
+		feedback.lock.Lock()
+		feedback.result = result
+		feedback.lock.Unlock()
+	}
+}
+
+/**
+ * Reports a warning of the hook to the caller, it is returned in the result of the field (see SetHookResult)
+ *
+ * Warnings don't fail the field, return an error to reject the value.
+ */
+func AddHookWarning(ctx context.Context, warning string) {
+	if feedback, ok := ctx.Value(hookFeedbackKey{}).(*hookFeedback); ok {
+		feedback.lock.Lock()
+		feedback.warnings = append(feedback.warnings, warning)
+		feedback.lock.Unlock()
+	}
+}
+
+/**
+ * Returns the encoded result and the warnings reported so far
+ *
+ * Results that can't be encoded as JSON are replaced by a warning.
+ */
+func (f* hookFeedback) collect() (json.RawMessage, []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	warnings := append([]string(nil), f.warnings...)
+	if f.result==nil {
+		return nil, warnings
+	}
+	encoded, err := json.Marshal(f.result)
+	if err!=nil {
+		return nil, append(warnings, "Hook result can't be encoded: " + err.Error())
+	}
+	return encoded, warnings
+}
+
+/**
+ * Counts hooks and async jobs that did not finish yet
+ */
+type inflightHooks struct {
+	lock sync.Mutex
+	count int
+	// Closed as soon as the count drops to zero
+	idle chan struct{}
+}
+
+func (i* inflightHooks) add() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.count==0 {
+		i.idle = make(chan struct{})
+	}
+	i.count++
+}
+
+func (i* inflightHooks) release() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.count--
+	if i.count==0 {
+		close(i.idle)
+	}
+}
+
+/**
+ * Returns the number of running hooks and a channel closed once none are running
+ */
+func (i* inflightHooks) state() (int, <-chan struct{}) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.count==0 {
+		idle := make(chan struct{})
+		close(idle)
+		return 0, idle
+	}
+	return i.count, i.idle
+}
+
+/**
+ * Blocks until all running hooks and async jobs finished or the context expired
+ *
+ * Hooks that timed out but are still running in the background are awaited aswell,
+ * so that a restarting process doesn't exit with half-applied reconfiguration.
+ * Hooks started while waiting are awaited too, stop serving requests before calling it during shutdown.
+ *
+ * Returns an error wrapping the context error if hooks are still running when the context expired.
+ */
+func (m* MetaHook) WaitForHooks(ctx context.Context) error {
+	_, idle := m.inflight.state()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		count, _ := m.inflight.state()
+		return fmt.Errorf("%d hooks are still running: %w", count, ctx.Err())
+	}
+}
+
+/**
+ * Reference counted locks of individual keys
+ */
+type keyLocks struct {
+	lock sync.Mutex
+	keys map[string]*keyLock
+}
+
+type keyLock struct {
+	mutex sync.Mutex
+	// Number of requests holding or waiting for the lock
+	refs int
+}
+
+/**
+ * Locks the keys (see WithKeySerialization) and returns the function to unlock them
+ */
+func (d* configDomain) lockKeys(keys []string) func() {
+	if d.keyLocks==nil {
+		return func() {}
+	}
+	// Lock in sorted order, so that requests with overlapping keys can't deadlock
+	canonical := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		canonical[d.name + "/" + d.metaConfig.CanonicalKey(key)] = true
+	}
+	sorted := make([]string, 0, len(canonical))
+	for key := range canonical {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	locks := make([]*keyLock, len(sorted))
+	for i, key := range sorted {
+		d.keyLocks.lock.Lock()
+		l, exists := d.keyLocks.keys[key]
+		if !exists {
+			l = &keyLock{}
+			d.keyLocks.keys[key] = l
+		}
+		l.refs++
+		d.keyLocks.lock.Unlock()
+		l.mutex.Lock()
+		locks[i] = l
+	}
+
+	return func() {
+		for i := len(sorted)-1; i>=0; i-- {
+			locks[i].mutex.Unlock()
+			d.keyLocks.lock.Lock()
+			locks[i].refs--
+			if locks[i].refs==0 {
+				delete(d.keyLocks.keys, sorted[i])
+			}
+			d.keyLocks.lock.Unlock()
+		}
+	}
+}
+
+/**
+ * Registers a hook for the key or pattern of the named MetaConfig (DEFAULT_CONFIG for the one passed to NewMetaHook)
+ *
+ * The type of the hook determines the hook map it is added to:
+ * func(context.Context, string, string) error (string fields), func(context.Context, string, bool) error (bool fields),
+ * func(context.Context, string, int64) error (int fields),
+ * func(context.Context, string, float64) error (double fields), func(context.Context, string, []string) error (list fields),
+ * func(context.Context, string, time.Duration) error (duration fields), func(context.Context, string, time.Time) error (time fields)
+ * and func(context.Context, string) error (deleted fields).
+ *
+ * Safe to call while the MetaHook is serving, e.g. for plugins loaded after startup.
+ * Requests that already started keep calling the hooks registered when they started.
+ *
+ * Returns an error if the config does not exist, the hook type is unsupported
+ * or a hook of the same type is already registered for the key.
+ */
+func (m* MetaHook) RegisterHook(config string, key string, hook any) error {
+	d, exists := m.configs[config]
+	if !exists {
+		return fmt.Errorf("Config '%s' not found", config)
+	}
+	d.hookLock.Lock()
+	defer d.hookLock.Unlock()
+	hooks := d.updateHooks
+	var err error
+	switch hook := hook.(type) {
+	case func(context.Context, string, string) error:
+		hooks.StringFieldHooks, err = addHook(hooks.StringFieldHooks, key, hook)
+	case func(context.Context, string, bool) error:
+		hooks.BoolFieldHooks, err = addHook(hooks.BoolFieldHooks, key, hook)
+	case func(context.Context, string, int64) error:
+		hooks.IntFieldHooks, err = addHook(hooks.IntFieldHooks, key, hook)
+	case func(context.Context, string, float64) error:
+		hooks.DoubleFieldHooks, err = addHook(hooks.DoubleFieldHooks, key, hook)
+	case func(context.Context, string, []string) error:
+		hooks.ListFieldHooks, err = addHook(hooks.ListFieldHooks, key, hook)
+	case func(context.Context, string, time.Duration) error:
+		hooks.DurationFieldHooks, err = addHook(hooks.DurationFieldHooks, key, hook)
+	case func(context.Context, string, time.Time) error:
+		hooks.TimeFieldHooks, err = addHook(hooks.TimeFieldHooks, key, hook)
+	case func(context.Context, string) error:
+		hooks.DeleteHooks, err = addHook(hooks.DeleteHooks, key, hook)
+	default:
+		return fmt.Errorf("Unsupported hook type %T", hook)
+	}
+	if err!=nil {
+		return err
+	}
+	d.updateHooks = hooks
+	return nil
+}
+
+/**
+ * Removes the hooks of every type registered for the key or pattern of the named MetaConfig
+ *
+ * Safe to call while the MetaHook is serving, hooks of requests that already started may still be called.
+ *
+ * Returns false if no hook was registered for the key.
+ */
+func (m* MetaHook) UnregisterHook(config string, key string) bool {
+	d, exists := m.configs[config]
+	if !exists {
+		return false
+	}
+	d.hookLock.Lock()
+	defer d.hookLock.Unlock()
+	hooks := d.updateHooks
+	var removed [8]bool
+	hooks.StringFieldHooks, removed[0] = removeHook(hooks.StringFieldHooks, key)
+	hooks.BoolFieldHooks, removed[1] = removeHook(hooks.BoolFieldHooks, key)
+	hooks.IntFieldHooks, removed[2] = removeHook(hooks.IntFieldHooks, key)
+	hooks.DoubleFieldHooks, removed[3] = removeHook(hooks.DoubleFieldHooks, key)
+	hooks.ListFieldHooks, removed[4] = removeHook(hooks.ListFieldHooks, key)
+	hooks.DurationFieldHooks, removed[5] = removeHook(hooks.DurationFieldHooks, key)
+	hooks.TimeFieldHooks, removed[6] = removeHook(hooks.TimeFieldHooks, key)
+	hooks.DeleteHooks, removed[7] = removeHook(hooks.DeleteHooks, key)
+	d.updateHooks = hooks
+	return removed!=[8]bool{}
+}
+
+/**
+ * Returns the currently registered updateHooks
+ *
+ * The returned hooks are never modified, they can be used without holding the lock.
+ */
+func (d* configDomain) hooks() UpdateHooks {
+	if d.parent!=nil {
+		return d.parent.hooks()
+	}
+	d.hookLock.RLock()
+	defer d.hookLock.RUnlock()
+	return d.updateHooks
+}
+
+/**
+ * Returns a copy of the hooks with the hook added for the key
+ */
+func addHook[T any](hooks map[string]T, key string, hook T) (map[string]T, error) {
+	if _, exists := hooks[key]; exists {
+		return hooks, fmt.Errorf("Hook for '%s' is already registered", key)
+	}
+	modified := make(map[string]T, len(hooks)+1)
+	for k, v := range hooks {
+		modified[k] = v
+	}
+	modified[key] = hook
+	return modified, nil
+}
+
+/**
+ * Returns a copy of the hooks without the hook of the key
+ */
+func removeHook[T any](hooks map[string]T, key string) (map[string]T, bool) {
+	if _, exists := hooks[key]; !exists {
+		return hooks, false
+	}
+	modified := make(map[string]T, len(hooks))
+	for k, v := range hooks {
+		if k!=key {
+			modified[k] = v
+		}
+	}
+	return modified, true
+}
@@ -0,0 +1,269 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+ * Default duration responses of requests with an Idempotency-Key are cached
+ */
+const DEFAULT_IDEMPOTENCY_WINDOW time.Duration = 10 * time.Minute
+
+/**
+ * Maximum number of cached responses, requests exceeding it are processed without caching
+ */
+const IDEMPOTENCY_MAX_ENTRIES int = 10000
+
+/**
+ * Header carrying the client chosen idempotency key
+ */
+const IDEMPOTENCY_HEADER string = "Idempotency-Key"
+
+/**
+ * Header set on responses that are replayed from the cache
+ */
+const IDEMPOTENCY_REPLAYED_HEADER string = "Idempotent-Replayed"
+
+/**
+ * Sets the duration responses of requests with an Idempotency-Key are cached (default DEFAULT_IDEMPOTENCY_WINDOW)
+ *
+ * Pass a duration <= 0 to disable idempotency keys, the header is then ignored.
+ */
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(m *MetaHook) {
+		m.idempotency.window = window
+	}
+}
+
+type idempotencyKey struct {
+	client string
+	path string
+	key string
+}
+
+/**
+ * Cached response of a request with an Idempotency-Key
+ */
+type idempotencyEntry struct {
+	// Hash of the request body, reusing a key with another body is rejected
+	fingerprint [sha256.Size]byte
+	// Closed once the response is recorded
+	done chan struct{}
+	expires time.Time
+	// False if the response must not be replayed (e.g. rate limited), waiting requests are processed again
+	cached bool
+	status int
+	header http.Header
+	body []byte
+}
+
+/**
+ * Response cache of requests with an Idempotency-Key
+ */
+type idempotencyCache struct {
+	lock sync.Mutex
+	window time.Duration
+	entries map[idempotencyKey]*idempotencyEntry
+}
+
+/**
+ * Response writer recording the response in memory
+ */
+type responseCapture struct {
+	header http.Header
+	status int
+	body bytes.Buffer
+}
+
+func (c* responseCapture) Header() http.Header {
+	return c.header
+}
+
+func (c* responseCapture) WriteHeader(status int) {
+	if c.status==0 {
+		c.status = status
+	}
+}
+
+func (c* responseCapture) Write(data []byte) (int, error) {
+	if c.status==0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(data)
+}
+
+/**
+ * Wraps a mutating handler with Idempotency-Key support
+ *
+ * The first request with a key is processed and its response cached for the idempotency window,
+ * retries with the same key (of the same client and path) get the cached response without calling any hook.
+ * Retries arriving while the first request is processed wait for its response.
+ *
+ * Reusing a key with a different body is rejected with 422 (Unprocessable Entity).
+ * Rate limited (429) and shed (503, see WithUpdateQueue) responses are not cached, so that the request can be retried later.
+ */
+func (m* MetaHook) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IDEMPOTENCY_HEADER)
+		if key==""||m.idempotency.window<=0 {
+			next(w, r)
+			return
+		}
+
+		// Read the body for the fingerprint, oversized bodies are rejected by the handler
+		body, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodySize+1))
+		if err!=nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(body)
+		cacheKey := idempotencyKey{clientIdentity(r), r.URL.Path, key}
+
+		for {
+			entry, owner := m.idempotency.acquire(cacheKey, fingerprint)
+			if entry==nil {
+				// Cache is full
+				next(w, r)
+				return
+			}
+			if entry.fingerprint!=fingerprint {
+				http.Error(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+				return
+			}
+			if owner {
+				m.processIdempotent(w, r, next, cacheKey, entry)
+				return
+			}
+
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.cached {
+				w.Header().Set(IDEMPOTENCY_REPLAYED_HEADER, "true")
+				writeCaptured(w, entry.header, entry.status, entry.body)
+				return
+			}
+			// Response was not cached, process the request like a new one
+		}
+	}
+}
+
+/**
+ * Processes the request and caches its response in the entry
+ */
+func (m* MetaHook) processIdempotent(
+	w http.ResponseWriter,
+	r *http.Request,
+	next http.HandlerFunc,
+	key idempotencyKey,
+	entry *idempotencyEntry) {
+
+	capture := &responseCapture{header: make(http.Header)}
+	completed := false
+	defer func() {
+		if !completed {
+			// Handler panicked, release the waiting requests without caching
+			m.idempotency.complete(key, entry, nil)
+		}
+	}()
+	next(capture, r)
+	m.idempotency.complete(key, entry, capture)
+	completed = true
+	writeCaptured(w, capture.header, capture.status, capture.body.Bytes())
+}
+
+/**
+ * Returns the entry of the key and true if the caller must process the request
+ *
+ * Returns nil if the key is unknown and the cache is full.
+ */
+func (c* idempotencyCache) acquire(key idempotencyKey, fingerprint [sha256.Size]byte) (*idempotencyEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries==nil {
+		c.entries = make(map[idempotencyKey]*idempotencyEntry)
+	}
+
+	now := time.Now()
+	if entry, exists := c.entries[key]; exists {
+		if entry.expires.IsZero()||now.Before(entry.expires) {
+			return entry, false
+		}
+		delete(c.entries, key)
+	}
+	if len(c.entries)>=IDEMPOTENCY_MAX_ENTRIES {
+		for k, entry := range c.entries {
+			if !entry.expires.IsZero()&&now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries)>=IDEMPOTENCY_MAX_ENTRIES {
+			return nil, false
+		}
+	}
+	entry := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+/**
+ * Stores the captured response in the entry and releases waiting requests
+ *
+ * If capture is nil, the entry is dropped without caching.
+ */
+func (c* idempotencyCache) complete(key idempotencyKey, entry *idempotencyEntry, capture *responseCapture) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if capture!=nil&&capture.status==0 {
+		capture.status = http.StatusOK
+	}
+	if capture==nil||capture.status==http.StatusTooManyRequests||capture.status==http.StatusServiceUnavailable {
+		delete(c.entries, key)
+	} else {
+		entry.cached = true
+		entry.status = capture.status
+		entry.header = capture.header
+		entry.body = capture.body.Bytes()
+		entry.expires = time.Now().Add(c.window)
+	}
+	close(entry.done)
+}
+
+/**
+ * Writes a recorded response
+ */
+func writeCaptured(w http.ResponseWriter, header http.Header, status int, body []byte) {
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,165 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metahook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+ * Duration finished jobs are kept before they are pruned
+ */
+const JOB_RETENTION time.Duration = time.Hour
+
+/**
+ * State of a background job
+ */
+type JobStatus string
+
+const (
+	JOB_RUNNING JobStatus = "running"
+	JOB_SUCCEEDED JobStatus = "succeeded"
+	JOB_FAILED JobStatus = "failed"
+)
+
+/**
+ * Background job running the hooks of an async update
+ */
+type job struct {
+	Id string `json:"id"`
+	Status JobStatus `json:"status"`
+	// Number of fields whose hooks returned
+	Done int `json:"done"`
+	// Number of fields of the update
+	Total int `json:"total"`
+	// Results of every field, final once the job finished
+	Fields []fieldResult `json:"fields"`
+	// Errors that are not bound to a single field
+	Err []string `json:"err"`
+	Started time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+/**
+ * Starts a background job for the fields and returns its id
+ *
+ * The completion of the job is audited as operation "job" of the client.
+ * Run is called on a new goroutine with a private copy of the field results,
+ * it reports progress by calling the passed function.
+ */
+func (d* configDomain) startJob(client string, peer *PeerCredentials, fields []fieldResult, run func(results []fieldResult, progress func()) []error) string {
+	idBuf := make([]byte, 16)
+	rand.Read(idBuf)
+	j := &job{
+		Id: hex.EncodeToString(idBuf),
+		Status: JOB_RUNNING,
+		Total: len(fields),
+		Fields: append([]fieldResult(nil), fields...),
+		Started: time.Now(),
+	}
+	results := append([]fieldResult(nil), fields...)
+
+	d.jobLock.Lock()
+	if d.jobs==nil {
+		d.jobs = make(map[string]*job)
+	}
+	// Prune finished jobs exceeding the retention
+	for id, old := range d.jobs {
+		if old.Status!=JOB_RUNNING&&time.Since(old.Finished)>JOB_RETENTION {
+			delete(d.jobs, id)
+		}
+	}
+	d.jobs[j.Id] = j
+	d.jobLock.Unlock()
+
+	// The job counts as running hook until it completed, also between its hooks
+	d.inflight.add()
+	go func() {
+		defer d.inflight.release()
+		errs := run(results, func() {
+			d.jobLock.Lock()
+			j.Done++
+			d.jobLock.Unlock()
+		})
+
+		d.jobLock.Lock()
+		j.Finished = time.Now()
+		j.Fields = results
+		j.Err = errorStrings(errs)
+		j.Status = JOB_SUCCEEDED
+		// Fields rejected by the validation are reported by the update response
+		for _, result := range results {
+			if result.HookRan&&result.Err!="" {
+				j.Status = JOB_FAILED
+			}
+		}
+		if len(errs)>0 {
+			j.Status = JOB_FAILED
+		}
+		res := updateResponse{Status: http.StatusOK, Fields: j.Fields, Err: j.Err, Job: j.Id}
+		if j.Status==JOB_FAILED {
+			res.Status = http.StatusInternalServerError
+		}
+		d.jobLock.Unlock()
+
+		// Old and new values are part of the audit entry of the update request
+		entry := d.newAuditEntry("job", client, peer, nil)
+		if entry!=nil {
+			for _, result := range results {
+				entry.Fields = append(entry.Fields, auditField{Key: result.Key})
+			}
+		}
+		d.completeAudit(entry, nil, &res)
+	}()
+	return j.Id
+}
+
+/**
+ * Handler job requests
+ *
+ * Returns the state of the background job with the id /jobs/<id>
+ */
+func (m* MetaHook) jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, id, _ := strings.Cut(r.URL.Path, "/jobs/")
+	m.jobLock.Lock()
+	j, exists := m.jobs[id]
+	var res job
+	if exists {
+		res = *j
+	}
+	m.jobLock.Unlock()
+	if !exists {
+		http.Error(w, "Job '" + id + "' not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
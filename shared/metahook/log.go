@@ -0,0 +1,182 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/logger"
+)
+
+/**
+ * Logger receiving the diagnostic messages of the MetaHook (e.g. *logger.Logger)
+ */
+type Logger interface {
+	LogError(msg string)
+	LogWarn(msg string)
+	LogInfo(msg string)
+}
+
+/**
+ * Verbose levels of a Logger, used if the Logger implements them (e.g. *logger.Logger)
+ */
+type VerboseLogger interface {
+	LogDebug(msg string)
+	LogTrace(msg string)
+}
+
+/**
+ * Logger writing to a rotated log file (e.g. *logger.Logger), required by WithLogRotationKeys
+ */
+type RotatingLogger interface {
+	RotationPolicy() logger.RotationPolicy
+	SetRotationPolicy(policy logger.RotationPolicy)
+}
+
+/**
+ * Logs diagnostic messages (e.g. panicking hooks) to the logger
+ *
+ * If the logger implements VerboseLogger, the calls of hooks are logged as debug messages.
+ */
+func WithLogger(logger Logger) Option {
+	return func(m *MetaHook) {
+		m.logger = logger
+	}
+}
+
+/**
+ * Logs every request with method, path, peer, duration and status code to the logger (see WithLogger)
+ *
+ * Requests are logged at the specified level, requests failing with a server error (5xx) always as error.
+ * The DEBUG and TRACE levels are only logged if the logger implements VerboseLogger.
+ */
+func WithRequestLogging(level logger.LOGLEVEL) Option {
+	return func(m *MetaHook) {
+		m.requestLogging = true
+		m.requestLogLevel = level
+	}
+}
+
+/**
+ * Reads the rotation policy of the log file of the logger (see WithLogger) from keys of the default MetaConfig below the prefix
+ *
+ * The keys are the same as of the access log (see WithAccessLogRotationKeys), they override the policy
+ * the logger was opened with (see logger.InitLoggerWithPolicy).
+ * Updates (of any field type) and deletions of the keys are applied immediately by hooks registered for <prefix>.*.
+ *
+ * The logger must implement RotatingLogger, otherwise NewMetaHook fails.
+ */
+func WithLogRotationKeys(prefix string) Option {
+	return func(m *MetaHook) {
+		m.logPolicyPrefix = prefix
+	}
+}
+
+/**
+ * Applies the rotation keys to the log file of the logger if configured (see WithLogRotationKeys)
+ */
+func (m* MetaHook) bindLogRotation() error {
+	if m.logPolicyPrefix=="" {
+		return nil
+	}
+	rotating, ok := m.logger.(RotatingLogger)
+	if !ok {
+		return errors.New("WithLogRotationKeys requires a logger with a rotated log file (e.g. *logger.Logger)")
+	}
+	base := rotating.RotationPolicy()
+	policy, err := m.rotationPolicy(m.logPolicyPrefix, base)
+	if err!=nil {
+		return err
+	}
+	rotating.SetRotationPolicy(policy)
+	return m.bindRotationKeys(m.logPolicyPrefix, base, rotating.SetRotationPolicy)
+}
+
+/**
+ * Wraps the handler with the request logging (if enabled)
+ */
+func (m* MetaHook) requestLogHandler(next http.Handler) http.Handler {
+	if !m.requestLogging||m.logger==nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status==0 {
+			recorder.status = http.StatusOK
+		}
+
+		// Unix socket and named pipe peers have no address
+		peer := r.RemoteAddr
+		if peer==""||peer=="@" {
+			peer = "local"
+		}
+		if client := clientIdentity(r); client!="" {
+			peer += " (" + client + ")"
+		}
+		msg := fmt.Sprintf("MetaHook request: %s %s from %s returned %d %s in %s",
+			r.Method, r.URL.Path, peer, recorder.status, http.StatusText(recorder.status), time.Since(start))
+
+		switch {
+		case recorder.status>=500||m.requestLogLevel==logger.ERROR:
+			m.logger.LogError(msg)
+		case m.requestLogLevel==logger.WARN:
+			m.logger.LogWarn(msg)
+		case m.requestLogLevel==logger.DEBUG:
+			m.logDebug(msg)
+		case m.requestLogLevel==logger.TRACE:
+			m.logTrace(msg)
+		default:
+			m.logger.LogInfo(msg)
+		}
+	})
+}
+
+/**
+ * Logs an error message if a logger is configured
+ */
+func (m* MetaHook) logError(msg string) {
+	if m.logger!=nil {
+		m.logger.LogError(msg)
+	}
+}
+
+/**
+ * Logs a debug message if the logger implements VerboseLogger
+ */
+func (m* MetaHook) logDebug(msg string) {
+	if verbose, ok := m.logger.(VerboseLogger); ok {
+		verbose.LogDebug(msg)
+	}
+}
+
+/**
+ * Logs a trace message if the logger implements VerboseLogger
+ */
+func (m* MetaHook) logTrace(msg string) {
+	if verbose, ok := m.logger.(VerboseLogger); ok {
+		verbose.LogTrace(msg)
+	}
+}
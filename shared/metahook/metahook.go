@@ -20,36 +20,103 @@
 package metahook
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/megakuul/cthulhu/shared/logger"
 	"github.com/megakuul/cthulhu/shared/metaconfig"
 )
 
+/**
+ * Default maximum duration of a single hook call (see WithHookTimeout)
+ */
+const DEFAULT_HOOK_TIMEOUT time.Duration = 30 * time.Second
+
+/**
+ * Default maximum size of request bodies in bytes (see WithMaxBodySize)
+ */
+const DEFAULT_MAX_BODY_SIZE int64 = 1 << 20
+
+/**
+ * Number of changes buffered per /watch subscriber before changes are dropped
+ */
+const WATCH_BUFFER_SIZE int = 256
+
+/**
+ * Default and maximum duration a /wait request blocks
+ */
+const DEFAULT_WAIT_TIMEOUT time.Duration = 30 * time.Second
+const MAX_WAIT_TIMEOUT time.Duration = 5 * time.Minute
+
 /**
  * Structure which holds function definitions for specific MetaConfig fields
  *
  * The hook function callback is called when the API is called to change the specified MetaConfig field.
  *
- * Every hook is executed synchroniously, make sure they do not use cost-intensive IO operations.
+ * Hooks can also be registered for key patterns like "disk.*" (path.Match syntax),
+ * an exact key match takes precedence over patterns, otherwise the longest matching pattern is used.
+ *
+ * The hooks of an update are called one after another, the request (or the job of an async update, see /jobs/)
+ * waits for every hook until it returns or the hook timeout (see WithHookTimeout) expires.
+ * Hooks receive a context derived from the HTTP request, which is canceled when the client disconnects
+ * (except for async updates) or the hook timeout expires. If a hook does not return in time,
+ * the request continues with a timeout error while the hook keeps running in the background,
+ * so hooks must honor the context and must not block indefinitely.
+ *
+ * A panicking hook fails like a hook returning an error (see HookPanicError), it does not crash the process.
+ *
+ * Besides the error, hooks can report a result payload and warnings to the caller (see SetHookResult, AddHookWarning).
  *
  * Hooks are expected to bring the system into a state where it operates like
  * the field was set at application start!
  */
 type UpdateHooks struct {
 	// Hooks for string fields
-	StringFieldHooks map[string]func(string, string) error
+	StringFieldHooks map[string]func(context.Context, string, string) error
 	// Hooks for bool fields
-	BoolFieldHooks map[string]func(string, bool) error
+	BoolFieldHooks map[string]func(context.Context, string, bool) error
+	// Hooks for int fields
+	IntFieldHooks map[string]func(context.Context, string, int64) error
 	// Hooks for double fields
-	DoubleFieldHooks map[string]func(string, float64) error
+	DoubleFieldHooks map[string]func(context.Context, string, float64) error
 	// Hooks for list fields
-	ListFieldHooks map[string]func(string, []string) error
+	ListFieldHooks map[string]func(context.Context, string, []string) error
+	// Hooks for duration fields
+	DurationFieldHooks map[string]func(context.Context, string, time.Duration) error
+	// Hooks for time fields
+	TimeFieldHooks map[string]func(context.Context, string, time.Time) error
+	// Hooks for deleted fields
+	DeleteHooks map[string]func(context.Context, string) error
+	// Hook called with the client identity (certificate common name or "uid:<uid>" of unix socket peers) and the affected keys
+	// before an update or delete request is applied, an error rejects the request
+	// The credentials of unix socket peers are available to every hook (see PeerCredentialsFromContext)
+	ClientHook func(context.Context, string, []string) error
+	// Hook called for every updated field regardless of its type (after the typed hook),
+	// the value has the type of the field (fields updated by /reload are passed as raw string)
+	GlobalHook func(context.Context, string, any) error
+	// Hook called for every field of a failed atomic update after its previous value was restored,
+	// it is expected to undo the effects of the hooks that already ran for the field
+	RevertHook func(context.Context, string) error
+	// Retry policies of the hooks of keys or key patterns, the policy of the matching key is applied to all its hooks
+	// except the ClientHook (see RetryPolicy)
+	RetryPolicies map[string]RetryPolicy
+	// Keys or key patterns whose hooks are called before the hooks of the key or key pattern if they are updated
+	// in the same request or reload (e.g. "network.bond": {"network.mtu"}), other fields keep the request order
+	Dependencies map[string][]string
 }
 
 /**
@@ -62,87 +129,338 @@ type UpdateHooks struct {
  *
  * MetaHook launches a HTTP API over a UNIX socket on the specified location
  *
+ * Additional MetaConfigs with their own updateHooks can be served by the same API (see AddConfig).
+ *
  * Main purpose for this API is that infrastructure controllers like juju
  * can manage the MetaConfig at runtime.
  */
 type MetaHook struct {
-	metaConfig *metaconfig.MetaConfig
-	updateHooks UpdateHooks
+	// Served MetaConfigs by name, the default one is passed on creation (see AddConfig)
+	configs map[string]*configDomain
+	// Creation time, reported as uptime on the status page
+	started time.Time
+	// Key spaces of the MetaConfigs served as namespace by name (see AddNamespace)
+	namespaces map[string]*configDomain
 	socketPath string
 	socketPerm fs.FileMode
+	// Key of the default MetaConfig holding the socket path (see WithSocketKey)
+	socketKey string
+	// Served unix sockets (see AddSocket)
+	sockets socketSet
+	// Policy if the socket is served by another process
+	socketPolicy SOCKETPOLICY
+	// Users and groups allowed to connect to the unix socket (unrestricted if both are empty)
+	peerUsers map[uint32]bool
+	peerGroups map[uint32]bool
+	// Access rules of the keys (all access allowed if empty)
+	acl []ACLRule
+	// MetaConfig keys holding the tokens of ACL peers
+	aclTokenKeys []string
 	socketServer *http.Server
 	socketServerMux *http.ServeMux
+	// MetaConfig key holding the API token (authentication disabled if empty)
+	tokenKey string
+	// Don't serve the unix socket
+	disableSocket bool
+	// TCP address of the TLS listener (disabled if empty)
+	tcpAddr string
+	tlsCertFile string
+	tlsKeyFile string
+	// CA for client certificates (client authentication disabled if empty)
+	tlsCAFile string
+	// Middlewares wrapped around all handlers, the first one is the outermost
+	middlewares []Middleware
+	// Maximum duration of a single hook call (no timeout if <= 0)
+	hookTimeout time.Duration
+	// Mutex lock for the jobs
+	jobLock sync.Mutex
+	// Background jobs of async updates by id
+	jobs map[string]*job
+	// Rate limiter of all requests (nil if disabled)
+	requestLimiter *rateLimiter
+	// Rate limiter of updates per key (nil if disabled)
+	keyLimiter *rateLimiter
+	// Maximum size of request bodies in bytes
+	maxBodySize int64
+	// Reject request bodies with unknown fields
+	disallowUnknownFields bool
+	// Request and hook metrics served at /metrics
+	metrics metrics
+	// Audit sinks of mutating requests
+	audit auditTrail
+	// Access log of every request (see WithAccessLog)
+	access accessLog
+	// Cached responses of requests with an Idempotency-Key
+	idempotency idempotencyCache
+	// Slots of concurrently running hooks (nil if unbounded)
+	hookSlots chan struct{}
+	// Locks of keys with pending hooks (nil if keys are not serialized)
+	keyLocks *keyLocks
+	// Running hooks and async jobs (see WaitForHooks)
+	inflight inflightHooks
+	// Reload all MetaConfigs on SIGHUP while serving
+	signalReload bool
+	// Keys or key patterns that only accept sealed values (see WithSealedKeys)
+	sealedKeys map[string]bool
+	// Queue of mutating requests (nil if disabled)
+	updateQueue *updateQueue
+	// Handlers served with the access restrictions of the debug endpoints by pattern (see WithDebugHandler)
+	debugHandlers map[string]http.Handler
+	// Receivers of change events (see WithWebhook)
+	webhooks []webhook
+	// Serve the listener passed by systemd if available
+	socketActivation bool
+	// FileDescriptorName of the passed listener (first one if empty)
+	socketActivationName string
+	// Name of the Windows named pipe (disabled if empty)
+	pipeName string
+	// Tracer of requests and hooks (disabled if nil)
+	tracer Tracer
+	// Logger of diagnostic messages (disabled if nil)
+	logger Logger
+	// Key prefix of the rotation policy of the logger in the default MetaConfig (see WithLogRotationKeys)
+	logPolicyPrefix string
+	// Log every request at the requestLogLevel
+	requestLogging bool
+	requestLogLevel logger.LOGLEVEL
 }
 
+/**
+ * Middleware wrapping the handlers of the MetaHook (e.g. logging, panic recovery, metrics)
+ */
+type Middleware func(http.Handler) http.Handler
+
+/**
+ * Option to customize the MetaHook on creation
+ */
+type Option func(*MetaHook)
+
 /**
  * Initialize MetaHook API
+ *
+ * Equivalent to NewMetaHook with WithSocket and WithUpdateHooks,
+ * kept for components predating the functional options.
  */
 func CreateMetaHook(
 	socketpath string,
 	socketperm fs.FileMode,
 	updatehooks UpdateHooks,
-	config *metaconfig.MetaConfig) (*MetaHook, error) {
-	
-	// Create path recursively
-	parentpath := filepath.Dir(socketpath)
-	if err:=os.MkdirAll(parentpath, 0755); err!=nil {
-		return nil, err
-	}
-	// Cleanup old socket
-	if err:=os.Remove(socketpath); err!=nil&&!os.IsNotExist(err) {
-		return nil, err
+	config *metaconfig.MetaConfig,
+	opts ...Option) (*MetaHook, error) {
+
+	return NewMetaHook(config, append([]Option{WithSocket(socketpath, socketperm), WithUpdateHooks(updatehooks)}, opts...)...)
+}
+
+/**
+ * Initialize MetaHook API serving the MetaConfig
+ *
+ * Listeners (WithSocket, WithSocketActivation, WithNamedPipe, WithTLSListener), authentication (WithTokenAuth, WithACL),
+ * timeouts (WithServerTimeouts, WithHookTimeout) and the updateHooks (WithUpdateHooks) are configured with options.
+ * At least one listener must be configured, the unix socket is served unless WithoutSocket or WithNamedPipe is passed.
+ */
+func NewMetaHook(config *metaconfig.MetaConfig, opts ...Option) (_ *MetaHook, err error) {
+	if config==nil {
+		return nil, errors.New("MetaConfig must not be nil")
 	}
-	
+
 	// Create ServeMux
 	sockMux := http.NewServeMux()
 	
 	// Create HTTP Server
 	sockSrv := &http.Server{
-		Handler: sockMux,
+		ConnContext: peerConnContext,
+		ReadTimeout: DEFAULT_READ_TIMEOUT,
+		WriteTimeout: DEFAULT_WRITE_TIMEOUT,
+		IdleTimeout: DEFAULT_IDLE_TIMEOUT,
+		MaxHeaderBytes: DEFAULT_MAX_HEADER_BYTES,
 	}
 
 	metaHook := &MetaHook{
-		config,
-		updatehooks,
-		socketpath,
-		socketperm,
-		sockSrv,
-		sockMux,
+		configs: make(map[string]*configDomain),
+		socketPerm: DEFAULT_SOCKET_PERM,
+		socketServer: sockSrv,
+		socketServerMux: sockMux,
+		hookTimeout: DEFAULT_HOOK_TIMEOUT,
+		maxBodySize: DEFAULT_MAX_BODY_SIZE,
+		idempotency: idempotencyCache{window: DEFAULT_IDEMPOTENCY_WINDOW},
+		started: time.Now(),
+		access: accessLog{policy: logger.RotationPolicy{MaxSize: DEFAULT_ACCESS_LOG_MAX_SIZE, Backups: DEFAULT_ACCESS_LOG_BACKUPS}},
+	}
+	metaHook.configs[DEFAULT_CONFIG] = metaHook.newConfigDomain(DEFAULT_CONFIG, config, UpdateHooks{})
+	for _, opt := range opts {
+		opt(metaHook)
+	}
+	// Files opened below are closed if a later step fails
+	defer func() {
+		if err!=nil {
+			metaHook.Close()
+		}
+	}()
+	if err := metaHook.openAuditFile(); err!=nil {
+		return nil, err
+	}
+	if err := metaHook.openAccessLog(); err!=nil {
+		return nil, err
+	}
+	if err := metaHook.bindLogRotation(); err!=nil {
+		return nil, err
+	}
+	if err := metaHook.registerSocketKey(); err!=nil {
+		return nil, err
+	}
+
+	// Sockets passed by systemd are owned by systemd
+	if !metaHook.disableSocket&&!(metaHook.socketActivation&&socketActivated()) {
+		if metaHook.socketPath=="" {
+			return nil, errors.New("No socket path configured, use WithSocket or disable the socket with WithoutSocket")
+		}
+		// Create path recursively
+		parentpath := filepath.Dir(metaHook.socketPath)
+		if err:=os.MkdirAll(parentpath, 0755); err!=nil {
+			return nil, err
+		}
+		// Cleanup stale socket (see WithSocketPolicy)
+		if err:=metaHook.removeStaleSocket(metaHook.socketPath); err!=nil {
+			return nil, err
+		}
 	}
 
-	// Register handlers
-	sockMux.HandleFunc("/update", metaHook.updateHandler)
+	// Register handlers under the versioned prefix (/v1/update)
+	// Unversioned paths (/update) are kept for clients predating the versioned API
+	// Endpoints of the default MetaConfig are served at the root,
+	// every MetaConfig is also served at /configs/<name>/ (see AddConfig)
+	routes := map[string]http.HandlerFunc{}
+	for path, handler := range metaHook.configs[DEFAULT_CONFIG].routes {
+		routes[path] = handler
+	}
+	routes["/jobs/"] = metaHook.jobHandler
+	routes["/openapi.json"] = metaHook.openAPIHandler
+	routes["/audit"] = metaHook.auditHandler
+	routes["/configs/"] = metaHook.configsHandler
+	routes["/ns/"] = metaHook.namespaceHandler
+	for path, handler := range routes {
+		sockMux.HandleFunc("/" + API_VERSION + path, handler)
+		sockMux.HandleFunc(path, handler)
+	}
+	sockMux.HandleFunc("/version", metaHook.versionHandler)
+	sockMux.HandleFunc("/metrics", metaHook.metricsHandler)
+	sockMux.HandleFunc("/", metaHook.statusHandler)
+	metaHook.registerDebugEndpoints(sockMux)
 
 	return metaHook, nil
 }
 
+/**
+ * Adds middlewares around all handlers
+ *
+ * Middlewares are applied in the order they are added, the first one is the outermost.
+ * They wrap the rate limit and token authentication (see WithRateLimit, WithTokenAuth),
+ * so they also see rejected requests.
+ *
+ * Must be called before Serve().
+ */
+func (m* MetaHook) Use(middlewares ...Middleware) {
+	m.middlewares = append(m.middlewares, middlewares...)
+}
+
+/**
+ * Builds the handler chain of the HTTP server
+ */
+func (m* MetaHook) handler() http.Handler {
+	handler := m.accessLogHandler(m.requestLogHandler(m.requestMetricsHandler(m.tracingHandler(m.rateLimitHandler(m.peerHandler(m.authHandler(m.socketServerMux)))))))
+	for i := len(m.middlewares)-1; i>=0; i-- {
+		handler = m.middlewares[i](handler)
+	}
+	return handler
+}
+
 /**
  * Create unix socket / listener and start HTTP server
  *
+ * If a TLS listener or named pipe is configured (see WithTLSListener, WithNamedPipe), it is served aswell.
+ *
  * Serve() will block execution, you can safely push it to a goroutine
+ * It returns as soon as one of the listeners fails.
  */
 func (m* MetaHook) Serve() error {
-	// Remove socket if already existent
-	if err:=os.Remove(m.socketPath); err!=nil && !os.IsNotExist(err) {
-		return err
+	// Unix sockets are closed when serving stops, including the ones added before (see AddSocket)
+	defer m.closeSockets()
+	var listeners []net.Listener
+	if m.socketActivation {
+		activated, err := m.activatedListener()
+		if err!=nil {
+			return err
+		}
+		if activated!=nil {
+			// The socket file is owned by systemd and must not be removed
+			defer activated.Close()
+			listeners = append(listeners, activated)
+		}
 	}
-	// Create socket and open listener
-	unixListener, err := net.Listen("unix", m.socketPath)
-	if err!=nil {
-		return err
+	if !m.disableSocket&&len(listeners)==0 {
+		// Create socket and open listener, unless it was already added (see AddSocket)
+		m.sockets.lock.Lock()
+		_, exists := m.sockets.sockets[filepath.Clean(m.socketPath)]
+		var err error
+		if !exists {
+			err = m.addSocket(m.socketPath, m.socketPerm)
+		}
+		m.sockets.lock.Unlock()
+		if err!=nil {
+			return err
+		}
 	}
-	defer unixListener.Close()
-	defer os.Remove(m.socketPath)
-	
-	// Change socket permissions
-	if err:=os.Chmod(m.socketPath, m.socketPerm); err!=nil {
-		return err
+	if m.pipeName!="" {
+		pipeListener, err := listenPipe(m.pipeName)
+		if err!=nil {
+			return err
+		}
+		defer pipeListener.Close()
+		listeners = append(listeners, pipeListener)
 	}
-	// Start HTTP server
-	if err:=m.socketServer.Serve(unixListener); err!=nil {
-		return err
+	if m.tcpAddr!="" {
+		tlsListener, err := m.listenTLS()
+		if err!=nil {
+			return err
+		}
+		defer tlsListener.Close()
+		listeners = append(listeners, tlsListener)
 	}
-	return nil
+	if len(listeners)==0&&len(m.Sockets())==0 {
+		return errors.New("MetaHook has no listener configured")
+	}
+
+	if m.signalReload {
+		defer m.handleReloadSignal()()
+	}
+	defer m.startWebhooks()()
+
+	// Start HTTP server on every listener, unix sockets are served until they are closed (see RemoveSocket)
+	m.socketServer.Handler = m.handler()
+	errs := make(chan error, 1)
+	m.serveSockets(errs)
+	for _, listener := range listeners {
+		go func(l net.Listener) {
+			reportServeError(errs, m.socketServer.Serve(l))
+		}(listener)
+	}
+	return <-errs
+}
+
+/**
+ * Closes the access log and the audit file, waiting for a running compression of the rotated access log files
+ *
+ * Call it once serving stopped (see Serve), requests served afterwards fail to write the access log
+ * and are no longer appended to the audit file (the other audit sinks keep recording).
+ * Closing the MetaHook again has no effect.
+ */
+func (m* MetaHook) Close() error {
+	var errs []error
+	if m.access.file!=nil {
+		errs = append(errs, m.access.file.Close())
+	}
+	errs = append(errs, m.closeAuditFile())
+	return errors.Join(errs...)
 }
 
 // Meta Handlers
@@ -150,6 +468,8 @@ func (m* MetaHook) Serve() error {
 type metaStringField struct {
 	Key string `json:"key"`
 	Value string `json:"value"`
+	// Value is sealed with the sealing key of the MetaConfig (see WithSealedKeys)
+	Sealed bool `json:"sealed,omitempty"`
 }
 
 type metaBoolField struct {
@@ -157,6 +477,11 @@ type metaBoolField struct {
 	Value bool `json:"value"`
 }
 
+type metaIntField struct {
+	Key string `json:"key"`
+	Value int64 `json:"value"`
+}
+
 type metaDoubleField struct {
 	Key string `json:"key"`
 	Value float64 `json:"value"`
@@ -167,86 +492,1363 @@ type metaListField struct {
 	Value []string `json:"value"`
 }
 
+type metaDurationField struct {
+	Key string `json:"key"`
+	Value durationValue `json:"value"`
+}
+
+type metaTimeField struct {
+	Key string `json:"key"`
+	Value timeValue `json:"value"`
+}
+
+/**
+ * Duration decoded from a string like "30s" (see time.ParseDuration)
+ */
+type durationValue time.Duration
+
+func (v* durationValue) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err!=nil {
+		return &json.UnmarshalTypeError{Value: jsonValueKind(data), Type: reflect.TypeOf(raw), Field: "value"}
+	}
+	d, err := metaconfig.ParseDuration(raw)
+	if err!=nil {
+		return fmt.Errorf("Invalid duration '%s'", raw)
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+/**
+ * Time decoded from an RFC3339 timestamp
+ */
+type timeValue time.Time
+
+func (v* timeValue) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err!=nil {
+		return &json.UnmarshalTypeError{Value: jsonValueKind(data), Type: reflect.TypeOf(raw), Field: "value"}
+	}
+	t, err := metaconfig.ParseTime(raw)
+	if err!=nil {
+		return fmt.Errorf("Invalid RFC3339 time '%s'", raw)
+	}
+	*v = timeValue(t)
+	return nil
+}
+
 type updateRequest struct {
 	StringFields []metaStringField `json:"string_fields"`
 	BoolFields []metaBoolField `json:"bool_fields"`
+	IntFields []metaIntField `json:"int_fields"`
 	DoubleFields []metaDoubleField `json:"double_fields"`
 	ListFields []metaListField `json:"list_fields"`
+	DurationFields []metaDurationField `json:"duration_fields"`
+	TimeFields []metaTimeField `json:"time_fields"`
+	// Write the configuration to disk after all hooks succeeded
+	Persist bool `json:"persist"`
+	// Apply nothing if any field is rejected and roll back all fields if any hook fails
+	Atomic bool `json:"atomic"`
+	// Run the hooks in the background and return a job id (see /jobs/)
+	Async bool `json:"async"`
+	// Only validate the fields and report the planned changes, nothing is applied
+	DryRun bool `json:"dry_run"`
+	// Problems of fields that could not be decoded (see decodeFields)
+	problems []fieldProblem
+	// Index of every decoded field in its array of the request by array name (see decodeFields)
+	indexes map[string][]int
+}
+
+/**
+ * Result of a single submitted field
+ */
+type fieldResult struct {
+	Key string `json:"key"`
+	// Value is set in (or deleted from) the MetaConfig
+	Set bool `json:"set"`
+	// At least one hook was called for the field
+	HookRan bool `json:"hook_ran"`
+	// Error of the set operation or the hooks
+	Err string `json:"err,omitempty"`
+	// At least one hook of the field panicked (see HookPanicError)
+	Panicked bool `json:"panicked,omitempty"`
+	// Dry run only: hooks that would be called as <type>:<pattern> (e.g. "string:disk.*", "global")
+	Hooks []string `json:"hooks,omitempty"`
+	// Value before the update or delete (redacted values are masked)
+	Old string `json:"old,omitempty"`
+	// Key existed before the update or delete
+	Existed bool `json:"existed,omitempty"`
+	// Dry run only: requested value (redacted values are masked)
+	New string `json:"new,omitempty"`
+	// Dry run only: requested value differs from the current value
+	Changed bool `json:"changed,omitempty"`
+	// Payload reported by the hooks of the field (see SetHookResult)
+	Result json.RawMessage `json:"result,omitempty"`
+	// Warnings reported by the hooks of the field (see AddHookWarning)
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 type updateResponse struct {
-	Err []error `json:"err"`
+	// HTTP status code of the response
+	Status int `json:"status"`
+	// Results of every submitted field in hook order
+	Fields []fieldResult `json:"fields"`
+	// Errors that are not bound to a single field
+	Err []string `json:"err"`
+	// Invalid fields with their position in the request (status 422)
+	Problems []fieldProblem `json:"problems,omitempty"`
+	// Id of the background job of async updates
+	Job string `json:"job,omitempty"`
+	// Version of the MetaConfig when the response was written (also sent as ETag)
+	Version uint64 `json:"version"`
+}
+
+/**
+ * Sets the maximum size of request bodies in bytes (default DEFAULT_MAX_BODY_SIZE)
+ *
+ * Larger bodies are rejected with 413 (Request Entity Too Large).
+ */
+func WithMaxBodySize(size int64) Option {
+	return func(m *MetaHook) {
+		m.maxBodySize = size
+	}
+}
+
+/**
+ * Rejects request bodies containing unknown fields with 400 (Bad Request)
+ *
+ * Helps to detect typos and version mismatches of clients, which would otherwise be ignored silently.
+ */
+func WithDisallowUnknownFields() Option {
+	return func(m *MetaHook) {
+		m.disallowUnknownFields = true
+	}
+}
+
+/**
+ * Decodes the JSON request body into req
+ *
+ * The body is limited to the maximum body size and must contain exactly one JSON object.
+ * If the body is rejected, an error response is written and false is returned.
+ */
+func (m* MetaHook) decodeRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, m.maxBodySize))
+	if m.disallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(req)
+	if err==nil {
+		// Reject trailing data after the JSON object
+		if _, tokenErr := decoder.Token(); tokenErr!=io.EOF {
+			err = errors.New("Unexpected data after the JSON object")
+		}
+	}
+	if err!=nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Request body exceeds the limit of %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Malformed request body: " + err.Error(), http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
+
+/**
+ * Writes the response with its status code as JSON
+ */
+func writeResponse(w http.ResponseWriter, status int, res any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+/**
+ * Converts errors to their messages
+ */
+func errorStrings(errs []error) []string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
 }
 
 /**
  * Handler update requests
  *
- * Updates a value in the associated MetaConfig
- * and calls the updateHook for it (if defined)
+ * Updates the values in the associated MetaConfig
+ * and calls the updateHook for every field (if defined)
+ *
+ * Every field is validated first, fields rejected (e.g. by a validator, the schema of the MetaConfig
+ * or because their key was already submitted earlier in the request) are reported and skipped,
+ * the accepted fields are applied at once (see MetaConfig.SwapConfigAs) and their hooks are called afterwards.
+ * The status is 422 if any field was rejected (unless a hook failed or the hooks run async),
+ * the set flag of the fields reports which of them were applied.
+ *
+ * If persist is set, the configuration is written to disk after all hooks succeeded.
+ *
+ * If atomic is set, the update is applied entirely or not at all:
+ * if any field is rejected, nothing is applied and no hook is called,
+ * if any hook fails, the previous values of all fields are restored
+ * and the RevertHook is called for every field in reverse order.
+ *
+ * If async is set, the values are applied immediately but the hooks are called in the background,
+ * the response contains the job id to query the state of the hooks with /jobs/<id>.
+ *
+ * If dry_run is set, the fields are authorized and validated like a regular update,
+ * but instead of applying them, the response reports the planned value changes
+ * and the hooks that would be called. Dry runs are neither rate limited nor audited.
+ *
+ * If the If-Match header holds a config version (see ETag of /get, /config and all mutating responses),
+ * the update is only applied if the MetaConfig still has this version, so that writes based on stale reads are rejected.
+ *
+ * The response reports the result of every field and an overall status code:
+ * 200 (ok), 202 (async job started), 403 (denied by the ACL or rejected by ClientHook),
+ * 409 (MetaConfig rejected the update, e.g. frozen), 412 (config version differs from If-Match),
+ * 422 (invalid fields), 500 (hook or persist failed).
+ *
+ * Fields with values of the wrong type and fields rejected by the validation are all reported at once
+ * in the problems of the response, each with its array, index and key in the request.
  */
-func (m* MetaHook) updateHandler(w http.ResponseWriter, r *http.Request) {
+func (d* configDomain) updateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Invalid request method, expected POST!", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req updateRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	var raw rawUpdateRequest
+	if !d.decodeRequest(w, r, &raw) {
+		return
+	}
+	req, problems := d.decodeFields(&raw)
+	req.problems = problems
+	d.applyUpdate(w, r, req)
+}
+
+/**
+ * Applies a decoded update request and writes the response (see updateHandler)
+ */
+func (d* configDomain) applyUpdate(w http.ResponseWriter, r *http.Request, req *updateRequest) {
+	d.prefixUpdate(req)
+	expected, err := parseIfMatch(r)
 	if err!=nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var res updateResponse
-	
+	res := updateResponse{Status: http.StatusOK}
+
+	// Collect all fields, so that bulk updates don't contend on the config lock per field
+	// Keys are collected in the order their hooks are called
+	fields := make(map[string]string)
+	sealed := make(map[string]bool)
+	var keys []string
+	// Submitted value of every key, keys submitted multiple times hold the last value in fields
+	var values []string
+	var origins []fieldOrigin
+	for i,field := range req.StringFields {
+		fields[field.Key] = field.Value
+		values = append(values, fields[field.Key])
+		sealed[field.Key] = sealed[field.Key]||field.Sealed
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("string_fields", i))
+	}
+	for i,field := range req.BoolFields {
+		fields[field.Key] = metaconfig.FormatBool(field.Value)
+		values = append(values, fields[field.Key])
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("bool_fields", i))
+	}
+	for i,field := range req.IntFields {
+		fields[field.Key] = metaconfig.FormatInt(field.Value)
+		values = append(values, fields[field.Key])
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("int_fields", i))
+	}
+	for i,field := range req.DoubleFields {
+		fields[field.Key] = metaconfig.FormatDouble(field.Value)
+		values = append(values, fields[field.Key])
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("double_fields", i))
+	}
+	for i,field := range req.ListFields {
+		fields[field.Key] = metaconfig.FormatList(field.Value)
+		values = append(values, fields[field.Key])
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("list_fields", i))
+	}
+	for i,field := range req.DurationFields {
+		fields[field.Key] = metaconfig.FormatDuration(time.Duration(field.Value))
+		values = append(values, fields[field.Key])
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("duration_fields", i))
+	}
+	for i,field := range req.TimeFields {
+		fields[field.Key] = metaconfig.FormatTime(time.Time(field.Value))
+		values = append(values, fields[field.Key])
+		keys = append(keys, field.Key)
+		origins = append(origins, req.origin("time_fields", i))
+	}
+	res.Fields = make([]fieldResult, len(keys))
+	for i, key := range keys {
+		res.Fields[i].Key = key
+	}
+
+	client := clientIdentity(r)
+	peer, _ := requestPeerCredentials(r)
+	entry := d.newAuditEntry("update", client, peer, keys)
+	defer func() {
+		d.completeAudit(entry, fields, &res)
+	}()
+
+	if !d.authorizeKeys(w, r, &res, keys) {
+		return
+	}
+	if err := d.callClientHook(r.Context(), client, keys); err!=nil {
+		res.Status = http.StatusForbidden
+		res.Err = append(res.Err, err.Error())
+		d.writeVersioned(w, &res)
+		return
+	}
+
+	// Validate every field individually, so that errors can be reported per field
+	// Repeated submissions of a key (also with different types) are rejected,
+	// as only one value could be applied while the hooks of every submission would be called
+	// Fields that could not be decoded are reported along with them
+	res.Problems = append(res.Problems, req.problems...)
+	seen := make(map[string]bool, len(keys))
+	for i := range res.Fields {
+		value := values[i]
+		canonical := d.metaConfig.CanonicalKey(keys[i])
+		if seen[canonical] {
+			res.Fields[i].Err = "Key is submitted multiple times"
+		} else {
+			seen[canonical] = true
+			if err := d.checkField(keys[i], value, sealed[keys[i]]); err!=nil {
+				res.Fields[i].Err = err.Error()
+			}
+		}
+		if res.Fields[i].Err!="" {
+			res.Problems = append(res.Problems, fieldProblem{
+				Field: origins[i].field,
+				Index: origins[i].index,
+				Key: strings.TrimPrefix(keys[i], d.keyPrefix),
+				Err: res.Fields[i].Err,
+			})
+		}
+	}
+	// Values of the accepted fields
+	accepted := make(map[string]string, len(keys))
+	for i := range res.Fields {
+		if res.Fields[i].Err=="" {
+			accepted[keys[i]] = values[i]
+		}
+	}
+	if len(res.Problems)>0 {
+		res.Status = http.StatusUnprocessableEntity
+		sort.SliceStable(res.Problems, func(i, j int) bool {
+			if res.Problems[i].Field!=res.Problems[j].Field {
+				return fieldOrder[res.Problems[i].Field] < fieldOrder[res.Problems[j].Field]
+			}
+			return res.Problems[i].Index < res.Problems[j].Index
+		})
+		// Atomic updates are applied entirely or not at all, others apply the accepted fields
+		if req.Atomic||len(accepted)<1 {
+			d.writeVersioned(w, &res)
+			return
+		}
+	}
+
+	if req.DryRun {
+		entry = nil
+		if d.metaConfig.IsFrozen() {
+			res.Status = http.StatusConflict
+			res.Err = append(res.Err, "MetaConfig is frozen")
+		} else if expected!=nil&&*expected!=d.metaConfig.Version() {
+			res.Status = http.StatusPreconditionFailed
+			res.Err = append(res.Err, metaconfig.ErrVersionMismatch.Error())
+		}
+		d.planUpdate(req, accepted, res.Fields)
+		d.writeVersioned(w, &res)
+		return
+	}
+
+	// Only the accepted keys are rate limited and locked
+	keys = keys[:0:0]
+	for i := range res.Fields {
+		if res.Fields[i].Err=="" {
+			keys = append(keys, res.Fields[i].Key)
+		}
+	}
+	if !d.allowKeys(w, &res, keys) {
+		return
+	}
+
+	// Hold the keys until the hooks returned (see WithKeySerialization)
+	unlockKeys := d.lockKeys(keys)
+
+	// All accepted fields are set at once
+	// The previous values are reported and used to roll back atomic updates
+	previous, err := d.metaConfig.SwapConfigAs(client, accepted, expected)
+	if err!=nil {
+		unlockKeys()
+		res.Status = http.StatusConflict
+		if errors.Is(err, metaconfig.ErrVersionMismatch) {
+			res.Status = http.StatusPreconditionFailed
+		}
+		res.Err = append(res.Err, err.Error())
+		d.writeVersioned(w, &res)
+		return
+	}
+	for i := range res.Fields {
+		if res.Fields[i].Err!="" {
+			continue
+		}
+		key := res.Fields[i].Key
+		res.Fields[i].Set = true
+		old, existed := previous[d.metaConfig.CanonicalKey(key)]
+		res.Fields[i].Old, res.Fields[i].Existed = d.auditValue(key, old), existed
+	}
+
+	if req.Async {
+		// Hooks of async updates must outlive the request
+		res.Status = http.StatusAccepted
+		ctx := detachedPeerContext(r)
+		releaseSlot := detachQueueSlot(r.Context())
+		res.Job = d.startJob(client, peer, res.Fields, func(results []fieldResult, progress func()) []error {
+			defer releaseSlot()
+			defer unlockKeys()
+			return d.runUpdateHooks(ctx, req, client, previous, results, progress)
+		})
+	} else {
+		errs := d.runUpdateHooks(r.Context(), req, client, previous, res.Fields, func() {})
+		unlockKeys()
+		res.Err = append(res.Err, errorStrings(errs)...)
+		// Rejected fields keep the status 422
+		for _, result := range res.Fields {
+			if result.HookRan&&result.Err!="" {
+				res.Status = http.StatusInternalServerError
+			}
+		}
+		if len(errs)>0 {
+			res.Status = http.StatusInternalServerError
+		}
+	}
+
+	d.writeVersioned(w, &res)
+}
+
+/**
+ * Calls the hooks of every field of an applied update request
+ *
+ * The hook results are recorded in the results of the fields (in hook order),
+ * progress is called after the hooks of a field returned.
+ * Atomic updates are rolled back and persistent updates written to disk afterwards.
+ *
+ * Returns the errors that are not bound to a single field.
+ */
+func (d* configDomain) runUpdateHooks(
+	ctx context.Context,
+	req *updateRequest,
+	client string,
+	previous map[string]string,
+	results []fieldResult,
+	progress func()) []error {
+	hooks := d.hooks()
+
+	// Index of the current field in results
+	var i int
+	failed := false
+	// Unnamed helper function to record the result of a hook
+	record := func(ran bool, err error) {
+		results[i].HookRan = results[i].HookRan||ran
+		if err!=nil {
+			failed = true
+			var panicErr *HookPanicError
+			results[i].Panicked = results[i].Panicked||errors.As(err, &panicErr)
+			if results[i].Err!="" {
+				results[i].Err += "\n"
+			}
+			results[i].Err += err.Error()
+		}
+	}
+	// Hooks of every field get their own feedback (see SetHookResult), so that late reports of timed out hooks can't leak into other fields
+	var feedback *hookFeedback
+	fieldContext := func() context.Context {
+		feedback = &hookFeedback{}
+		return context.WithValue(ctx, hookFeedbackKey{}, feedback)
+	}
+	// Unnamed helper function to complete the current field
+	next := func() {
+		results[i].Result, results[i].Warnings = feedback.collect()
+		progress()
+	}
+	// Hook calls of every field in results order
+	var calls []func()
+
 	// String fields
 	for _,field := range req.StringFields {
-		m.metaConfig.SetString(&field.Key, &field.Value)
-		hook, exists := m.updateHooks.StringFieldHooks[field.Key]
-		if exists {
-			err := hook(field.Key, field.Value)
-			if err!=nil {
-				res.Err = append(res.Err, err)
+		// Hooks may outlive the iteration if they time out
+		field := field
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.StringFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "string", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, field.Value)
+				}))
 			}
-		}
+			record(d.callGlobalHook(ctx, field.Key, field.Value))
+			next()
+		})
 	}
 
 	// Bool fields
 	for _,field := range req.BoolFields {
-		m.metaConfig.SetBool(&field.Key, &field.Value)
-		hook, exists := m.updateHooks.BoolFieldHooks[field.Key]
-		if exists {
-			err := hook(field.Key, field.Value)
-			if err!=nil {
-				res.Err = append(res.Err, err)
+		field := field
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.BoolFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "bool", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, field.Value)
+				}))
 			}
-		}
+			record(d.callGlobalHook(ctx, field.Key, field.Value))
+			next()
+		})
+	}
+
+	// Int fields
+	for _,field := range req.IntFields {
+		field := field
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.IntFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "int", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, field.Value)
+				}))
+			}
+			record(d.callGlobalHook(ctx, field.Key, field.Value))
+			next()
+		})
 	}
 
 	// Double fields
 	for _,field := range req.DoubleFields {
-		m.metaConfig.SetDouble(&field.Key, &field.Value)
-		hook, exists := m.updateHooks.DoubleFieldHooks[field.Key]
-		if exists {
-			err := hook(field.Key, field.Value)
-			if err!=nil {
-				res.Err = append(res.Err, err)
+		field := field
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.DoubleFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "double", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, field.Value)
+				}))
 			}
-		}
+			record(d.callGlobalHook(ctx, field.Key, field.Value))
+			next()
+		})
 	}
 
 	// List fields
 	for _,field := range req.ListFields {
-		m.metaConfig.SetList(&field.Key, &field.Value)
-		hook, exists := m.updateHooks.ListFieldHooks[field.Key]
+		field := field
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.ListFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "list", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, field.Value)
+				}))
+			}
+			record(d.callGlobalHook(ctx, field.Key, field.Value))
+			next()
+		})
+	}
+
+	// Duration fields
+	for _,field := range req.DurationFields {
+		field, value := field, time.Duration(field.Value)
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.DurationFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "duration", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, value)
+				}))
+			}
+			record(d.callGlobalHook(ctx, field.Key, value))
+			next()
+		})
+	}
+
+	// Time fields
+	for _,field := range req.TimeFields {
+		field, value := field, time.Time(field.Value)
+		calls = append(calls, func() {
+			ctx := fieldContext()
+			if hook, exists := findHook(hooks.TimeFieldHooks, field.Key); exists {
+				record(true, d.runKeyHook(ctx, "time", field.Key, func(ctx context.Context) error {
+					return hook(ctx, field.Key, value)
+				}))
+			}
+			record(d.callGlobalHook(ctx, field.Key, value))
+			next()
+		})
+	}
+
+	// Fields are completed in dependency order (see UpdateHooks.Dependencies)
+	keys := make([]string, len(results))
+	for i := range results {
+		keys[i] = results[i].Key
+	}
+	order, cyclic := hookOrder(hooks.Dependencies, keys)
+	for _, index := range order {
+		i = index
+		// Fields rejected by the validation are not applied
+		if !results[i].Set {
+			progress()
+			continue
+		}
+		calls[i]()
+		if cyclic[i] {
+			results[i].Warnings = append(results[i].Warnings, "Hook dependencies of the key are cyclic, the cycle is not ordered")
+		}
+	}
+
+	var errs []error
+	if req.Atomic&&failed {
+		for i := range results {
+			results[i].Set = false
+		}
+		errs = append(errs, d.rollback(ctx, client, keys, previous)...)
+	}
+
+	if req.Persist&&!failed {
+		if err := d.metaConfig.WriteToDisk(); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	
+	return errs
+}
+
+/**
+ * Records the planned changes and the hooks that would be called into the results of a dry run
+ *
+ * Results are expected in hook order (string, bool, int, double, list, duration and time fields),
+ * fields holds the values of the accepted fields.
+ */
+func (d* configDomain) planUpdate(req *updateRequest, fields map[string]string, results []fieldResult) {
+	hooks := d.hooks()
+	for i := range results {
+		// Rejected fields are not applied
+		if results[i].Err!="" {
+			continue
+		}
+		key := results[i].Key
+		var pattern string
+		var found bool
+		var kind string
+		switch {
+		case i<len(req.StringFields):
+			kind = "string"
+			pattern, found = matchHook(hooks.StringFieldHooks, key)
+		case i<len(req.StringFields)+len(req.BoolFields):
+			kind = "bool"
+			pattern, found = matchHook(hooks.BoolFieldHooks, key)
+		case i<len(req.StringFields)+len(req.BoolFields)+len(req.IntFields):
+			kind = "int"
+			pattern, found = matchHook(hooks.IntFieldHooks, key)
+		case i<len(req.StringFields)+len(req.BoolFields)+len(req.IntFields)+len(req.DoubleFields):
+			kind = "double"
+			pattern, found = matchHook(hooks.DoubleFieldHooks, key)
+		case i<len(req.StringFields)+len(req.BoolFields)+len(req.IntFields)+len(req.DoubleFields)+len(req.ListFields):
+			kind = "list"
+			pattern, found = matchHook(hooks.ListFieldHooks, key)
+		case i<len(results)-len(req.TimeFields):
+			kind = "duration"
+			pattern, found = matchHook(hooks.DurationFieldHooks, key)
+		default:
+			kind = "time"
+			pattern, found = matchHook(hooks.TimeFieldHooks, key)
+		}
+		if found {
+			results[i].Hooks = append(results[i].Hooks, kind + ":" + pattern)
+		}
+		if hooks.GlobalHook!=nil {
+			results[i].Hooks = append(results[i].Hooks, "global")
+		}
+
+		exists := d.metaConfig.Exists(&key)
+		old := d.metaConfig.GetString(&key)
+		results[i].Changed = !exists||old!=fields[key]
+		results[i].Existed = exists
+		if d.metaConfig.IsRedacted(&key) {
+			results[i].Old, results[i].New = metaconfig.REDACTED_VALUE, metaconfig.REDACTED_VALUE
+		} else {
+			results[i].Old, results[i].New = old, fields[key]
+		}
+	}
+}
+
+type deleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+/**
+ * Handler delete requests
+ *
+ * Removes the keys from the associated MetaConfig
+ * and calls the deleteHook for it (if defined)
+ *
+ * The response reports the result of every key and an overall status code:
+ * 200 (ok), 403 (denied by the ACL or rejected by ClientHook), 409 (MetaConfig rejected the deletion), 500 (hook failed).
+ */
+func (d* configDomain) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method, expected POST!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req deleteRequest
+	if !d.decodeRequest(w, r, &req) {
+		return
+	}
+	for i := range req.Keys {
+		req.Keys[i] = d.fullKey(req.Keys[i])
+	}
+
+	res := updateResponse{Status: http.StatusOK}
+
+	client := clientIdentity(r)
+	peer, _ := requestPeerCredentials(r)
+	entry := d.newAuditEntry("delete", client, peer, req.Keys)
+	defer func() {
+		d.completeAudit(entry, nil, &res)
+	}()
+
+	if !d.authorizeKeys(w, r, &res, req.Keys) {
+		return
+	}
+	if err := d.callClientHook(r.Context(), client, req.Keys); err!=nil {
+		res.Status = http.StatusForbidden
+		res.Err = append(res.Err, err.Error())
+		d.writeVersioned(w, &res)
+		return
+	}
+
+	if !d.allowKeys(w, &res, req.Keys) {
+		return
+	}
+
+	unlockKeys := d.lockKeys(req.Keys)
+	defer unlockKeys()
+
+	hooks := d.hooks()
+
+	for _,key := range req.Keys {
+		// Hooks may outlive the iteration if they time out
+		key := key
+		result := fieldResult{Key: key}
+		old, existed, err := d.metaConfig.SwapDeleteAs(client, &key)
+		if err!=nil {
+			result.Err = err.Error()
+			res.Status = http.StatusConflict
+			res.Fields = append(res.Fields, result)
+			continue
+		}
+		result.Set = true
+		result.Old, result.Existed = d.auditValue(key, old), existed
+		hook, exists := findHook(hooks.DeleteHooks, key)
 		if exists {
-			err := hook(field.Key, field.Value)
+			result.HookRan = true
+			feedback := &hookFeedback{}
+			err := d.runKeyHook(context.WithValue(r.Context(), hookFeedbackKey{}, feedback), "delete", key, func(ctx context.Context) error {
+				return hook(ctx, key)
+			})
+			result.Result, result.Warnings = feedback.collect()
 			if err!=nil {
-				res.Err = append(res.Err, err)
+				var panicErr *HookPanicError
+				result.Panicked = errors.As(err, &panicErr)
+				result.Err = err.Error()
+				res.Status = http.StatusInternalServerError
 			}
 		}
+		res.Fields = append(res.Fields, result)
 	}
-	
+
+	d.writeVersioned(w, &res)
+}
+
+type reloadResponse struct {
+	// HTTP status code of the response
+	Status int `json:"status"`
+	Changed []string `json:"changed"`
+	Deleted []string `json:"deleted"`
+	Err []string `json:"err"`
+	// Version of the MetaConfig after the reload (also sent as ETag)
+	Version uint64 `json:"version"`
+}
+
+/**
+ * Handler reload requests
+ *
+ * Rereads the associated MetaConfig from disk and calls the updateHooks
+ * of every changed key and the deleteHooks of every removed key (if defined)
+ *
+ * Responds with status 409 if the config file can't be loaded and 500 if a hook failed.
+ */
+func (d* configDomain) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method, expected POST!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var res reloadResponse
+	// A reload may change every key
+	if !d.aclAllows(r, "", true) {
+		res.Status = http.StatusForbidden
+		res.Err = append(res.Err, "Write access to the config denied")
+		res.Version = d.metaConfig.Version()
+	} else {
+		peer, _ := requestPeerCredentials(r)
+		res = d.reload(r.Context(), clientIdentity(r), peer)
+	}
+	w.Header().Set("ETag", formatETag(res.Version))
+	writeResponse(w, res.Status, res)
+}
+
+/**
+ * Rereads the MetaConfig from disk and calls the hooks of every changed and removed key
+ *
+ * Shared by /reload and the SIGHUP handler (see WithSignalReload).
+ */
+func (d* configDomain) reload(ctx context.Context, client string, peer *PeerCredentials) reloadResponse {
+	res := reloadResponse{Status: http.StatusOK}
+
+	oldConfig := d.metaConfig.GetConfig(nil)
+	if err := d.metaConfig.ReadFromDisk(); err!=nil {
+		res.Status = http.StatusConflict
+		res.Err = append(res.Err, err.Error())
+		d.auditReload(client, peer, oldConfig, oldConfig, &res)
+		res.Version = d.metaConfig.Version()
+		return res
+	}
+	newConfig := d.metaConfig.GetConfig(nil)
+
+	hooks := d.hooks()
+	var errs []error
+	for key, value := range newConfig {
+		if oldValue, existed := oldConfig[key]; !existed||oldValue!=value {
+			res.Changed = append(res.Changed, key)
+		}
+	}
+	// Hooks of changed keys are called in dependency order (see UpdateHooks.Dependencies)
+	sort.Strings(res.Changed)
+	order, _ := hookOrder(hooks.Dependencies, res.Changed)
+	for _, index := range order {
+		key := res.Changed[index]
+		errs = append(errs, d.callUpdateHooks(ctx, key)...)
+		if _, err := d.callGlobalHook(ctx, key, newConfig[key]); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	for key := range oldConfig {
+		key := key
+		if _, exists := newConfig[key]; !exists {
+			res.Deleted = append(res.Deleted, key)
+			if hook, exists := findHook(hooks.DeleteHooks, key); exists {
+				if err := d.runKeyHook(ctx, "delete", key, func(ctx context.Context) error {
+					return hook(ctx, key)
+				}); err!=nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if len(errs)>0 {
+		res.Status = http.StatusInternalServerError
+		res.Err = errorStrings(errs)
+	}
+
+	d.auditReload(client, peer, oldConfig, newConfig, &res)
+	res.Version = d.metaConfig.Version()
+	return res
+}
+
+/**
+ * Calls the updateHooks of the key with its current value
+ */
+func (d* configDomain) callUpdateHooks(ctx context.Context, key string) []error {
+	hooks := d.hooks()
+	var errs []error
+	if hook, exists := findHook(hooks.StringFieldHooks, key); exists {
+		value := d.metaConfig.GetString(&key)
+		if err := d.runKeyHook(ctx, "string", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if hook, exists := findHook(hooks.BoolFieldHooks, key); exists {
+		value := d.metaConfig.GetBool(&key)
+		if err := d.runKeyHook(ctx, "bool", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if hook, exists := findHook(hooks.IntFieldHooks, key); exists {
+		value := d.metaConfig.GetInt(&key)
+		if err := d.runKeyHook(ctx, "int", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if hook, exists := findHook(hooks.DoubleFieldHooks, key); exists {
+		value := d.metaConfig.GetDouble(&key)
+		if err := d.runKeyHook(ctx, "double", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if hook, exists := findHook(hooks.ListFieldHooks, key); exists {
+		value := d.metaConfig.GetList(&key)
+		if err := d.runKeyHook(ctx, "list", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if hook, exists := findHook(hooks.DurationFieldHooks, key); exists {
+		value := d.metaConfig.GetDuration(&key)
+		if err := d.runKeyHook(ctx, "duration", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if hook, exists := findHook(hooks.TimeFieldHooks, key); exists {
+		value := d.metaConfig.GetTime(&key)
+		if err := d.runKeyHook(ctx, "time", key, func(ctx context.Context) error {
+			return hook(ctx, key, value)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+/**
+ * Calls the ClientHook (if defined) with the sorted keys of the request
+ */
+func (d* configDomain) callClientHook(ctx context.Context, client string, keys []string) error {
+	hooks := d.hooks()
+	if hooks.ClientHook==nil {
+		return nil
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	return d.runHook(ctx, "client", "", func(ctx context.Context) error {
+		return hooks.ClientHook(ctx, client, sorted)
+	})
+}
+
+/**
+ * Restores the previous values of the keys and calls the RevertHook (if defined) in reverse order
+ */
+func (d* configDomain) rollback(ctx context.Context, client string, keys []string, previous map[string]string) []error {
+	hooks := d.hooks()
+	var errs []error
+	restore := make(map[string]string)
+	for _,key := range keys {
+		if value, existed := previous[d.metaConfig.CanonicalKey(key)]; existed {
+			restore[key] = value
+		} else if err := d.metaConfig.DeleteAs(client, &key); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := d.metaConfig.SetConfigAs(client, restore); err!=nil {
+		errs = append(errs, err)
+	}
+	if hooks.RevertHook==nil {
+		return errs
+	}
+	for i := len(keys)-1; i>=0; i-- {
+		key := keys[i]
+		if err := d.runKeyHook(ctx, "revert", key, func(ctx context.Context) error {
+			return hooks.RevertHook(ctx, key)
+		}); err!=nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+/**
+ * Checks a submitted field against the sealing requirements, the schema and the validators of the MetaConfig
+ *
+ * The validators only run if the schema accepts the value, both evaluate the constraints of the key
+ * and a violation would be reported twice otherwise.
+ */
+func (d* configDomain) checkField(key string, value string, sealed bool) error {
+	if err := errors.Join(
+		d.checkSealed(key, value, sealed),
+		d.metaConfig.CheckSchema(&key, &value),
+	); err!=nil {
+		return err
+	}
+	return d.metaConfig.Validate(&key, &value)
+}
+
+/**
+ * Checks the per-key rate limit (if enabled) of all keys
+ *
+ * If a key exceeded its limit, a 429 response reporting the limited keys is written and false is returned.
+ */
+func (d* configDomain) allowKeys(w http.ResponseWriter, res *updateResponse, keys []string) bool {
+	if d.keyLimiter==nil {
+		return true
+	}
+	// Keys of different MetaConfigs are limited independently
+	scoped := make([]string, len(keys))
+	for i, key := range keys {
+		scoped[i] = d.name + "/" + key
+	}
+	limited := d.keyLimiter.allow(scoped...)
+	if limited==nil {
+		return true
+	}
+	isLimited := make(map[string]bool, len(limited))
+	for _, key := range limited {
+		isLimited[strings.TrimPrefix(key, d.name + "/")] = true
+	}
+	res.Status = http.StatusTooManyRequests
+	res.Fields = res.Fields[:0]
+	for _, key := range keys {
+		result := fieldResult{Key: key}
+		if isLimited[key] {
+			result.Err = "Update rate limit of key exceeded"
+		}
+		res.Fields = append(res.Fields, result)
+	}
+	w.Header().Set("Retry-After", d.keyLimiter.retryAfter())
+	writeResponse(w, res.Status, d.localResponse(*res))
+	return false
+}
+
+/**
+ * Calls the GlobalHook (if defined)
+ *
+ * Returns true if the hook was called.
+ */
+func (d* configDomain) callGlobalHook(ctx context.Context, key string, value any) (bool, error) {
+	hooks := d.hooks()
+	if hooks.GlobalHook==nil {
+		return false, nil
+	}
+	return true, d.runKeyHook(ctx, "global", key, func(ctx context.Context) error {
+		return hooks.GlobalHook(ctx, key, value)
+	})
+}
+
+type getResponse struct {
+	Key string `json:"key"`
+	Value string `json:"value"`
+	Exists bool `json:"exists"`
+	// Version of the MetaConfig the value was read from (also sent as ETag)
+	Version uint64 `json:"version"`
+}
+
+/**
+ * Handler get requests
+ *
+ * Returns the current value of the key specified by the "key" query parameter
+ *
+ * Redacted values are replaced by metaconfig.REDACTED_VALUE.
+ */
+func (d* configDomain) getHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("key")
+	if name=="" {
+		http.Error(w, "Missing query parameter 'key'", http.StatusBadRequest)
+		return
+	}
+	key := d.fullKey(name)
+	if !d.aclAllows(r, key, false) {
+		http.Error(w, "Read access to key denied", http.StatusForbidden)
+		return
+	}
+
+	// The version is read first, so that it never claims changes the value does not contain
+	res := getResponse{Key: name, Version: d.metaConfig.Version()}
+	res.Exists = d.metaConfig.Exists(&key)
+	if res.Exists {
+		if d.metaConfig.IsRedacted(&key) {
+			res.Value = metaconfig.REDACTED_VALUE
+		} else {
+			res.Value = d.metaConfig.GetString(&key)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(res.Version))
 	json.NewEncoder(w).Encode(res)
 }
+
+/**
+ * Handler config requests
+ *
+ * Returns the full configuration as JSON object
+ *
+ * Redacted values are replaced by metaconfig.REDACTED_VALUE,
+ * keys the peer may not read are omitted (see WithACL).
+ *
+ * The configuration is streamed in chunks and gzip compressed if the client accepts it (Accept-Encoding),
+ * so that very large configurations are never serialized in memory as a whole.
+ */
+func (d* configDomain) configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(d.metaConfig.Version()))
+	body, done := compressedWriter(w, r)
+	defer done()
+	d.exportReadable(body, r, metaconfig.EXPORT_JSON)
+}
+
+/**
+ * Streams the keys of the domain the peer may read in the format to the writer (see metaconfig.ExportMapped)
+ */
+func (d* configDomain) exportReadable(w io.Writer, r *http.Request, format string) error {
+	return d.metaConfig.ExportMapped(w, format, func(key string) (string, bool) {
+		if len(d.acl)>0&&!d.aclAllows(r, key, false) {
+			return "", false
+		}
+		return d.localKey(key)
+	})
+}
+
+/**
+ * Content types of the export formats (see exportHandler)
+ */
+var exportContentTypes = map[string]string{
+	metaconfig.EXPORT_JSON: "application/json",
+	metaconfig.EXPORT_YAML: "application/yaml",
+	metaconfig.EXPORT_NATIVE: "text/plain; charset=utf-8",
+}
+
+/**
+ * Handler export requests
+ *
+ * Returns the full configuration as JSON, YAML or in the config file syntax (see metaconfig.Export)
+ * for backup and inspection tooling. The format is selected by the "format" query parameter (json, yaml or native),
+ * otherwise by the Accept header (application/json, application/yaml or text/plain), JSON is the default.
+ *
+ * Redacted values are replaced by metaconfig.REDACTED_VALUE,
+ * keys the peer may not read are omitted (see WithACL).
+ * The export is streamed and compressed like /config.
+ */
+func (d* configDomain) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format!="" {
+		if _, exists := exportContentTypes[format]; !exists {
+			http.Error(w, "Invalid query parameter 'format', expected json, yaml or native", http.StatusBadRequest)
+			return
+		}
+	} else if format = negotiateExportFormat(r.Header.Get("Accept")); format=="" {
+		http.Error(w, "No acceptable export format, expected application/json, application/yaml or text/plain", http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("ETag", formatETag(d.metaConfig.Version()))
+	body, done := compressedWriter(w, r)
+	defer done()
+	d.exportReadable(body, r, format)
+}
+
+/**
+ * Selects the export format of the first supported media type of the Accept header
+ *
+ * Quality values are ignored, an empty header or wildcard selects JSON.
+ * Returns an empty string if no media type is supported.
+ */
+func negotiateExportFormat(accept string) string {
+	if strings.TrimSpace(accept)=="" {
+		return metaconfig.EXPORT_JSON
+	}
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json", "application/*", "*/*":
+			return metaconfig.EXPORT_JSON
+		case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+			return metaconfig.EXPORT_YAML
+		case "text/plain", "text/*":
+			return metaconfig.EXPORT_NATIVE
+		}
+	}
+	return ""
+}
+
+/**
+ * Handler watch requests
+ *
+ * Streams every change of the associated MetaConfig as server-sent events (event: change)
+ * until the client disconnects. The optional "prefix" query parameter filters the keys,
+ * changes of keys the peer may not read are omitted (see WithACL).
+ *
+ * Changes are dropped if the client can't keep up, clients should resync with /config after reconnecting.
+ */
+func (d* configDomain) watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	changes, cancel := d.metaConfig.Watch(d.fullKey(r.URL.Query().Get("prefix")), WATCH_BUFFER_SIZE)
+	defer cancel()
+	// Streams are not limited by the server timeouts
+	d.extendDeadlines(w, 0)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change := <-changes:
+			if !d.aclAllows(r, change.Key, false) {
+				continue
+			}
+			change.Key, _ = d.localKey(change.Key)
+			data, err := json.Marshal(change)
+			if err!=nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", data); err!=nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+type waitResponse struct {
+	Key string `json:"key"`
+	Value string `json:"value"`
+	Exists bool `json:"exists"`
+	// Version of the MetaConfig the value was read from, pass it to the next /wait
+	Version uint64 `json:"version"`
+	// False if the wait timed out without a change of the key
+	Changed bool `json:"changed"`
+}
+
+/**
+ * Handler wait requests
+ *
+ * Blocks until the key specified by the "key" query parameter changed after the config version
+ * of the "version" query parameter (default: current version), or until the timeout expired.
+ * The "timeout" query parameter sets the timeout in seconds (default DEFAULT_WAIT_TIMEOUT, at most MAX_WAIT_TIMEOUT).
+ *
+ * Responds with the current value like /get, the changed field reports whether the key changed.
+ * Clients can long-poll a key by passing the returned version to the next request.
+ */
+func (d* configDomain) waitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("key")
+	if name=="" {
+		http.Error(w, "Missing query parameter 'key'", http.StatusBadRequest)
+		return
+	}
+	key := d.fullKey(name)
+	if !d.aclAllows(r, key, false) {
+		http.Error(w, "Read access to key denied", http.StatusForbidden)
+		return
+	}
+	version := d.metaConfig.Version()
+	if rawVersion := query.Get("version"); rawVersion!="" {
+		var err error
+		version, err = strconv.ParseUint(rawVersion, 10, 64)
+		if err!=nil {
+			http.Error(w, "Invalid query parameter 'version'", http.StatusBadRequest)
+			return
+		}
+	}
+	timeout := DEFAULT_WAIT_TIMEOUT
+	if rawTimeout := query.Get("timeout"); rawTimeout!="" {
+		seconds, err := strconv.ParseFloat(rawTimeout, 64)
+		if err!=nil||seconds<0 {
+			http.Error(w, "Invalid query parameter 'timeout'", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout>MAX_WAIT_TIMEOUT {
+		timeout = MAX_WAIT_TIMEOUT
+	}
+	d.extendDeadlines(w, timeout)
+
+	// Subscribe before checking the key, so that no change is missed in between
+	// The subscription only wakes the request, a single buffered change is sufficient
+	changes, cancel := d.metaConfig.Watch(key, 1)
+	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	res := waitResponse{Key: name}
+	timedOut := false
+	for !timedOut {
+		if d.metaConfig.KeyVersion(key)>version {
+			res.Changed = true
+			break
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			timedOut = true
+		case <-changes:
+		}
+	}
+
+	res.Version = d.metaConfig.Version()
+	res.Exists = d.metaConfig.Exists(&key)
+	if res.Exists {
+		if d.metaConfig.IsRedacted(&key) {
+			res.Value = metaconfig.REDACTED_VALUE
+		} else {
+			res.Value = d.metaConfig.GetString(&key)
+		}
+	}
+	w.Header().Set("ETag", formatETag(res.Version))
+	writeResponse(w, http.StatusOK, res)
+}
@@ -0,0 +1,302 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Upper bounds (in seconds) of the hook latency histogram buckets
+ */
+var hookLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type requestLabels struct {
+	path string
+	code int
+}
+
+/**
+ * Latency histogram and failures of a hook kind
+ */
+type hookMetrics struct {
+	// Cumulative count of every bucket of hookLatencyBuckets
+	buckets []uint64
+	count uint64
+	sum float64
+	failures uint64
+}
+
+/**
+ * Request and hook metrics of a MetaHook
+ *
+ * The zero value is ready to use.
+ */
+type metrics struct {
+	lock sync.Mutex
+	// Handled requests by normalized path and status code
+	requests map[requestLabels]uint64
+	// Hook metrics by hook kind
+	hooks map[string]*hookMetrics
+}
+
+/**
+ * Records a handled request
+ */
+func (m* metrics) observeRequest(path string, code int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.requests==nil {
+		m.requests = make(map[requestLabels]uint64)
+	}
+	m.requests[requestLabels{path, code}]++
+}
+
+/**
+ * Records a hook call
+ */
+func (m* metrics) observeHook(kind string, duration time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.hooks==nil {
+		m.hooks = make(map[string]*hookMetrics)
+	}
+	h, exists := m.hooks[kind]
+	if !exists {
+		h = &hookMetrics{buckets: make([]uint64, len(hookLatencyBuckets))}
+		m.hooks[kind] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range hookLatencyBuckets {
+		if seconds<=bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+	if err!=nil {
+		h.failures++
+	}
+}
+
+/**
+ * Writes the metrics in the Prometheus text exposition format
+ */
+func (m* metrics) write(w *strings.Builder) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].path!=requests[j].path {
+			return requests[i].path < requests[j].path
+		}
+		return requests[i].code < requests[j].code
+	})
+	writeHeader(w, "metahook_requests_total", "counter", "Handled requests by path and status code.")
+	for _, labels := range requests {
+		fmt.Fprintf(w, "metahook_requests_total{path=%q,code=\"%d\"} %d\n", labels.path, labels.code, m.requests[labels])
+	}
+
+	kinds := make([]string, 0, len(m.hooks))
+	for kind := range m.hooks {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	writeHeader(w, "metahook_hook_duration_seconds", "histogram", "Duration of hook calls by hook kind.")
+	for _, kind := range kinds {
+		h := m.hooks[kind]
+		for i, bound := range hookLatencyBuckets {
+			fmt.Fprintf(w, "metahook_hook_duration_seconds_bucket{hook=%q,le=%q} %d\n",
+				kind, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "metahook_hook_duration_seconds_bucket{hook=%q,le=\"+Inf\"} %d\n", kind, h.count)
+		fmt.Fprintf(w, "metahook_hook_duration_seconds_sum{hook=%q} %g\n", kind, h.sum)
+		fmt.Fprintf(w, "metahook_hook_duration_seconds_count{hook=%q} %d\n", kind, h.count)
+	}
+	writeHeader(w, "metahook_hook_failures_total", "counter", "Failed hook calls (errors, timeouts and panics) by hook kind.")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "metahook_hook_failures_total{hook=%q} %d\n", kind, m.hooks[kind].failures)
+	}
+}
+
+func writeHeader(w *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+/**
+ * Response writer recording the status code and body size of the response
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	// Bytes written to the response body
+	size int64
+}
+
+func (s* statusRecorder) WriteHeader(status int) {
+	if s.status==0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s* statusRecorder) Write(data []byte) (int, error) {
+	if s.status==0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(data)
+	s.size += int64(n)
+	return n, err
+}
+
+/**
+ * Exposes the underlying writer to http.ResponseController (see extendDeadlines)
+ */
+func (s* statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+/**
+ * Passes flushes through, so that streaming handlers (watch) keep working
+ */
+func (s* statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/**
+ * Counts every request by its normalized path and status code
+ *
+ * Paths are reduced to the registered route without API version (e.g. /v1/jobs/<id> is counted as /jobs),
+ * unknown paths are counted as "unknown" so that the number of series stays bounded.
+ */
+func (m* MetaHook) requestMetricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := m.routePath(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status==0 {
+			recorder.status = http.StatusOK
+		}
+		m.metrics.observeRequest(path, recorder.status)
+	})
+}
+
+/**
+ * Returns the registered route of the request without API version ("unknown" if no route matches)
+ */
+func (m* MetaHook) routePath(r *http.Request) string {
+	_, pattern := m.socketServerMux.Handler(r)
+	// The status page at the root matches every path
+	if pattern==""||(pattern=="/"&&r.URL.Path!="/") {
+		return "unknown"
+	}
+	path := strings.TrimPrefix(pattern, "/" + API_VERSION)
+	if trimmed := strings.TrimSuffix(path, "/"); trimmed!="" {
+		path = trimmed
+	}
+	return path
+}
+
+/**
+ * Handler metrics requests
+ *
+ * Serves the request, hook and config metrics in the Prometheus text exposition format
+ */
+func (m* MetaHook) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var out strings.Builder
+	m.metrics.write(&out)
+
+	// Config series are labeled with the name of the MetaConfig (see AddConfig)
+	names := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([]int, len(names))
+	sizes := make([]int, len(names))
+	stats := make([]metaconfig.Stats, len(names))
+	for i, name := range names {
+		config := m.configs[name].metaConfig
+		config.Range(func(key string, value string) bool {
+			keys[i]++
+			sizes[i] += len(key) + len(value)
+			return true
+		})
+		stats[i] = config.Stats()
+	}
+	writeHeader(&out, "metahook_config_keys", "gauge", "Number of keys in the configuration.")
+	for i, name := range names {
+		fmt.Fprintf(&out, "metahook_config_keys{config=%q} %d\n", name, keys[i])
+	}
+	writeHeader(&out, "metahook_config_size_bytes", "gauge", "Summed size of all keys and values in the configuration.")
+	for i, name := range names {
+		fmt.Fprintf(&out, "metahook_config_size_bytes{config=%q} %d\n", name, sizes[i])
+	}
+	writeHeader(&out, "metahook_config_disk_reads_total", "counter", "Reads of the config file.")
+	for i, name := range names {
+		fmt.Fprintf(&out, "metahook_config_disk_reads_total{config=%q} %d\n", name, stats[i].DiskReads)
+	}
+	writeHeader(&out, "metahook_config_disk_writes_total", "counter", "Writes of the config file.")
+	for i, name := range names {
+		fmt.Fprintf(&out, "metahook_config_disk_writes_total{config=%q} %d\n", name, stats[i].DiskWrites)
+	}
+	writeHeader(&out, "metahook_config_parse_errors_total", "counter", "Reads of the config file that failed to parse.")
+	for i, name := range names {
+		fmt.Fprintf(&out, "metahook_config_parse_errors_total{config=%q} %d\n", name, stats[i].ParseErrors)
+	}
+	writeHeader(&out, "metahook_config_write_errors_total", "counter", "Writes of the config file that failed.")
+	for i, name := range names {
+		fmt.Fprintf(&out, "metahook_config_write_errors_total{config=%q} %d\n", name, stats[i].WriteErrors)
+	}
+
+	if q := m.updateQueue; q!=nil {
+		running := len(q.slots)
+		writeHeader(&out, "metahook_update_queue_running", "gauge", "Mutating requests and async jobs holding a slot of the update queue.")
+		fmt.Fprintf(&out, "metahook_update_queue_running %d\n", running)
+		writeHeader(&out, "metahook_update_queue_waiting", "gauge", "Mutating requests waiting for a slot of the update queue.")
+		fmt.Fprintf(&out, "metahook_update_queue_waiting %d\n", max(0, len(q.admitted)-running))
+		writeHeader(&out, "metahook_update_queue_shed_total", "counter", "Mutating requests rejected because the update queue was full.")
+		fmt.Fprintf(&out, "metahook_update_queue_shed_total %d\n", q.shed.Load())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(out.String()))
+}
@@ -0,0 +1,163 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metahook
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Serves the keys of the named MetaConfig starting with prefix as namespace at /ns/<name>/
+ *
+ * The endpoints of a namespace (update, delete, cas, template, get, config, export, watch and wait)
+ * operate on the key space of the prefix: keys of requests are prefixed and keys of responses are reported without the prefix,
+ * e.g. updating "state" at /v1/ns/disk1/update sets "disk.1.state" if the namespace disk1 has the prefix "disk.1.".
+ * This allows one MetaHook to serve several logical tenants or sub-components, none of them can address keys outside of its prefix.
+ *
+ * Hooks, ACL rules (see WithACL), rate limits and the audit trail operate on the full keys of the MetaConfig,
+ * so hooks registered on the MetaConfig also run for updates of the namespace.
+ * Reloads and flushes affect the whole MetaConfig and are not served in namespaces, async jobs are shared and report the full keys.
+ *
+ * Must be called before Serve().
+ */
+func (m* MetaHook) AddNamespace(name string, config string, prefix string) error {
+	if name==""||strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid namespace name '%s'", name)
+	}
+	if prefix=="" {
+		return fmt.Errorf("Namespace '%s' requires a key prefix", name)
+	}
+	parent, exists := m.configs[config]
+	if !exists {
+		return fmt.Errorf("Config '%s' is not registered", config)
+	}
+	if _, exists := m.namespaces[name]; exists {
+		return fmt.Errorf("Namespace '%s' is already registered", name)
+	}
+
+	d := m.newConfigDomain(parent.name, parent.metaConfig, UpdateHooks{})
+	d.parent = parent
+	d.namespace = name
+	d.keyPrefix = prefix
+	delete(d.routes, "/reload")
+	delete(d.routes, "/flush")
+	if m.namespaces==nil {
+		m.namespaces = make(map[string]*configDomain)
+	}
+	m.namespaces[name] = d
+	return nil
+}
+
+/**
+ * Handler requests to /ns/<name>/<endpoint>
+ *
+ * Dispatches the request to the endpoint of the named namespace,
+ * jobs are shared by all namespaces and can also be queried with /ns/<name>/jobs/<id>.
+ */
+func (m* MetaHook) namespaceHandler(w http.ResponseWriter, r *http.Request) {
+	_, rest, _ := strings.Cut(r.URL.Path, "/ns/")
+	name, endpoint, _ := strings.Cut(rest, "/")
+	d, exists := m.namespaces[name]
+	if !exists {
+		http.Error(w, "Namespace '" + name + "' not found", http.StatusNotFound)
+		return
+	}
+	if strings.HasPrefix(endpoint, "jobs/") {
+		m.jobHandler(w, r)
+		return
+	}
+	handler, exists := d.routes["/" + endpoint]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	handler(w, r)
+}
+
+/**
+ * Returns the key of the MetaConfig addressed by the key of a request
+ */
+func (d* configDomain) fullKey(key string) string {
+	return d.keyPrefix + key
+}
+
+/**
+ * Prefixes the keys of all fields of the update
+ */
+func (d* configDomain) prefixUpdate(req *updateRequest) {
+	if d.keyPrefix=="" {
+		return
+	}
+	for i := range req.StringFields {
+		req.StringFields[i].Key = d.fullKey(req.StringFields[i].Key)
+	}
+	for i := range req.BoolFields {
+		req.BoolFields[i].Key = d.fullKey(req.BoolFields[i].Key)
+	}
+	for i := range req.IntFields {
+		req.IntFields[i].Key = d.fullKey(req.IntFields[i].Key)
+	}
+	for i := range req.DoubleFields {
+		req.DoubleFields[i].Key = d.fullKey(req.DoubleFields[i].Key)
+	}
+	for i := range req.ListFields {
+		req.ListFields[i].Key = d.fullKey(req.ListFields[i].Key)
+	}
+	for i := range req.DurationFields {
+		req.DurationFields[i].Key = d.fullKey(req.DurationFields[i].Key)
+	}
+	for i := range req.TimeFields {
+		req.TimeFields[i].Key = d.fullKey(req.TimeFields[i].Key)
+	}
+}
+
+/**
+ * Returns the key of the namespace of a MetaConfig key and whether it belongs to the namespace
+ *
+ * Keys of MetaConfigs are returned unchanged.
+ */
+func (d* configDomain) localKey(key string) (string, bool) {
+	if d.keyPrefix=="" {
+		return key, true
+	}
+	prefix := d.metaConfig.CanonicalKey(d.keyPrefix)
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	return key[len(prefix):], true
+}
+
+/**
+ * Returns a copy of the response with the keys of the fields reported without the prefix of the namespace
+ */
+func (d* configDomain) localResponse(res updateResponse) updateResponse {
+	if d.keyPrefix=="" {
+		return res
+	}
+	res.Fields = append([]fieldResult(nil), res.Fields...)
+	for i := range res.Fields {
+		res.Fields[i].Key = strings.TrimPrefix(res.Fields[i].Key, d.keyPrefix)
+	}
+	return res
+}
@@ -0,0 +1,156 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+/**
+ * Credentials of the process connected to the unix socket (read with SO_PEERCRED)
+ */
+type PeerCredentials struct {
+	UID uint32 `json:"uid"`
+	// Primary group of the process
+	GID uint32 `json:"gid"`
+	PID int32 `json:"pid"`
+}
+
+type peerCredentialsKey struct{}
+
+/**
+ * Only allows unix socket peers running as one of the users (or in one of the groups, see WithPeerGroups)
+ *
+ * The credentials of the connecting process are read with SO_PEERCRED (Linux only),
+ * peers with unknown credentials are rejected with 403. Other listeners (TLS, named pipe) are not restricted.
+ */
+func WithPeerUsers(uids ...uint32) Option {
+	return func(m *MetaHook) {
+		if m.peerUsers==nil {
+			m.peerUsers = make(map[uint32]bool)
+		}
+		for _, uid := range uids {
+			m.peerUsers[uid] = true
+		}
+	}
+}
+
+/**
+ * Only allows unix socket peers whose primary group is one of the groups (or running as one of the users, see WithPeerUsers)
+ *
+ * Supplementary groups of the peer are not considered.
+ */
+func WithPeerGroups(gids ...uint32) Option {
+	return func(m *MetaHook) {
+		if m.peerGroups==nil {
+			m.peerGroups = make(map[uint32]bool)
+		}
+		for _, gid := range gids {
+			m.peerGroups[gid] = true
+		}
+	}
+}
+
+/**
+ * Returns the credentials of the unix socket peer the hook was called for
+ *
+ * The context of every hook called for a request over the unix socket carries the credentials,
+ * false is returned for other listeners, reloads triggered locally or platforms without SO_PEERCRED.
+ */
+func PeerCredentialsFromContext(ctx context.Context) (*PeerCredentials, bool) {
+	cred, _ := ctx.Value(peerCredentialsKey{}).(*PeerCredentials)
+	return cred, cred!=nil
+}
+
+/**
+ * Attaches the peer credentials of unix socket connections to the connection context
+ *
+ * Unix socket connections always carry the value, it is nil if the credentials can't be read
+ * (e.g. on unsupported platforms).
+ */
+func peerConnContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, _ := readPeerCredentials(unixConn)
+	return context.WithValue(ctx, peerCredentialsKey{}, cred)
+}
+
+/**
+ * Returns the credentials of the unix socket peer that sent the request (nil if unknown)
+ *
+ * isUnix reports whether the request was sent over the unix socket.
+ */
+func requestPeerCredentials(r *http.Request) (cred *PeerCredentials, isUnix bool) {
+	cred, isUnix = r.Context().Value(peerCredentialsKey{}).(*PeerCredentials)
+	return cred, isUnix
+}
+
+/**
+ * Returns a context carrying the peer credentials and trace context of the request, detached from its cancellation
+ *
+ * Used for hooks that outlive the request (e.g. async jobs).
+ */
+func detachedPeerContext(r *http.Request) context.Context {
+	return context.WithoutCancel(r.Context())
+}
+
+/**
+ * Wraps the handler with the peer credential restriction (if enabled)
+ */
+func (m* MetaHook) peerHandler(next http.Handler) http.Handler {
+	if len(m.peerUsers)==0&&len(m.peerGroups)==0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.authorizePeer(r); err!="" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(authResponse{err})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Checks the credentials of unix socket peers against the allowed users and groups
+ *
+ * Returns a description of the failure or an empty string if the peer is allowed.
+ */
+func (m* MetaHook) authorizePeer(r *http.Request) string {
+	cred, isUnix := requestPeerCredentials(r)
+	if !isUnix {
+		return ""
+	}
+	if cred==nil {
+		return "Peer credentials are not available"
+	}
+	if m.peerUsers[cred.UID]||m.peerGroups[cred.GID] {
+		return ""
+	}
+	return "Peer uid " + strconv.FormatUint(uint64(cred.UID), 10) + " is not allowed"
+}
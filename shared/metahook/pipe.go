@@ -0,0 +1,37 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+/**
+ * Serves the API on a Windows named pipe in place of the unix socket
+ *
+ * The name has the form \\.\pipe\<name> (e.g. \\.\pipe\cthulhu-granit).
+ * The pipe uses the default security descriptor, which grants full access to
+ * LocalSystem, administrators and the owner of the process, remote clients are rejected.
+ *
+ * On other platforms Serve() fails, use the unix socket instead.
+ */
+func WithNamedPipe(name string) Option {
+	return func(m *MetaHook) {
+		m.pipeName = name
+		m.disableSocket = true
+	}
+}
@@ -0,0 +1,44 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+//go:build !windows
+
+package metahook
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errPipeUnsupported = errors.New("Named pipes are only supported on Windows")
+
+func listenPipe(name string) (net.Listener, error) {
+	return nil, errPipeUnsupported
+}
+
+/**
+ * Connects to a MetaHook served on a Windows named pipe (see WithNamedPipe)
+ *
+ * Always fails on platforms other than Windows.
+ */
+func DialPipe(ctx context.Context, name string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: "pipe", Err: errPipeUnsupported}
+}
@@ -0,0 +1,298 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+//go:build windows
+
+package metahook
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	procCreateNamedPipeW = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe = kernel32.NewProc("ConnectNamedPipe")
+	procCancelIoEx = kernel32.NewProc("CancelIoEx")
+)
+
+// Win32 constants not provided by the syscall package
+const (
+	pipeAccessDuplex = 0x3
+	pipeTypeByte = 0x0
+	pipeReadmodeByte = 0x0
+	pipeWait = 0x0
+	pipeRejectRemoteClients = 0x8
+	pipeUnlimitedInstances = 255
+	pipeBufferSize = 65536
+	fileFlagFirstPipeInstance = 0x80000
+	errorPipeBusy syscall.Errno = 231
+	errorPipeConnected syscall.Errno = 535
+	errorOperationAborted syscall.Errno = 995
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+/**
+ * Listener accepting clients of a named pipe
+ *
+ * Every accepted client gets its own pipe instance.
+ */
+type pipeListener struct {
+	name string
+	lock sync.Mutex
+	closed bool
+	// Instance waiting for the next client (InvalidHandle if none)
+	next syscall.Handle
+}
+
+func listenPipe(name string) (net.Listener, error) {
+	l := &pipeListener{name: name}
+	// Create the first instance immediately, so that a pipe already owned by another process is reported
+	next, err := l.createInstance(true)
+	if err!=nil {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(name), Err: err}
+	}
+	l.next = next
+	return l, nil
+}
+
+/**
+ * Creates a new instance of the pipe
+ */
+func (l* pipeListener) createInstance(first bool) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(l.name)
+	if err!=nil {
+		return syscall.InvalidHandle, err
+	}
+	var openMode uintptr = pipeAccessDuplex
+	if first {
+		openMode |= fileFlagFirstPipeInstance
+	}
+	handle, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(name)),
+		openMode,
+		pipeTypeByte|pipeReadmodeByte|pipeWait|pipeRejectRemoteClients,
+		pipeUnlimitedInstances,
+		pipeBufferSize,
+		pipeBufferSize,
+		0,
+		0,
+	)
+	if syscall.Handle(handle)==syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+	return syscall.Handle(handle), nil
+}
+
+func (l* pipeListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	handle := l.next
+	l.next = syscall.InvalidHandle
+	l.lock.Unlock()
+
+	if handle==syscall.InvalidHandle {
+		var err error
+		handle, err = l.createInstance(false)
+		if err!=nil {
+			return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.name), Err: err}
+		}
+	}
+	// Blocks until a client connects, a client that connected in between is reported as ERROR_PIPE_CONNECTED
+	if ok, _, err := procConnectNamedPipe.Call(uintptr(handle), 0); ok==0&&err!=errorPipeConnected {
+		syscall.CloseHandle(handle)
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.name), Err: err}
+	}
+
+	l.lock.Lock()
+	closed := l.closed
+	l.lock.Unlock()
+	if closed {
+		syscall.CloseHandle(handle)
+		return nil, net.ErrClosed
+	}
+	return &pipeConn{handle: handle, name: l.name}, nil
+}
+
+func (l* pipeListener) Close() error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return nil
+	}
+	l.closed = true
+	next := l.next
+	l.next = syscall.InvalidHandle
+	l.lock.Unlock()
+
+	if next!=syscall.InvalidHandle {
+		syscall.CloseHandle(next)
+	}
+	// Unblock a pending Accept by connecting to its instance
+	if conn, err := openPipe(l.name); err==nil {
+		conn.Close()
+	}
+	return nil
+}
+
+func (l* pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+/**
+ * Connection over a synchronous pipe handle
+ *
+ * Deadlines in the past abort pending reads (as used by net/http), later deadlines are not enforced.
+ */
+type pipeConn struct {
+	handle syscall.Handle
+	name string
+	lock sync.Mutex
+	readExpired bool
+	closeOnce sync.Once
+}
+
+func (c* pipeConn) Read(b []byte) (int, error) {
+	if c.isReadExpired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	var n uint32
+	err := syscall.ReadFile(c.handle, b, &n, nil)
+	switch {
+	case err==nil:
+		return int(n), nil
+	case err==errorOperationAborted&&c.isReadExpired():
+		return int(n), os.ErrDeadlineExceeded
+	case err==syscall.ERROR_BROKEN_PIPE:
+		return int(n), io.EOF
+	default:
+		return int(n), err
+	}
+}
+
+func (c* pipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for written<len(b) {
+		var n uint32
+		if err := syscall.WriteFile(c.handle, b[written:], &n, nil); err!=nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+func (c* pipeConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		// Abort pending reads of other goroutines, unread data stays readable for the peer
+		procCancelIoEx.Call(uintptr(c.handle), 0)
+		err = syscall.CloseHandle(c.handle)
+	})
+	return err
+}
+
+func (c* pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(c.name)
+}
+
+func (c* pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.name)
+}
+
+func (c* pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c* pipeConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readExpired = !t.IsZero()&&!t.After(time.Now())
+	expired := c.readExpired
+	c.lock.Unlock()
+	if expired {
+		procCancelIoEx.Call(uintptr(c.handle), 0)
+	}
+	return nil
+}
+
+func (c* pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c* pipeConn) isReadExpired() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.readExpired
+}
+
+/**
+ * Opens the client end of the pipe
+ */
+func openPipe(name string) (*pipeConn, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err!=nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err!=nil {
+		return nil, err
+	}
+	return &pipeConn{handle: handle, name: name}, nil
+}
+
+/**
+ * Connects to a MetaHook served on a Windows named pipe (see WithNamedPipe)
+ *
+ * Waits until an instance of the pipe is free or the context is done.
+ */
+func DialPipe(ctx context.Context, name string) (net.Conn, error) {
+	for {
+		conn, err := openPipe(name)
+		if err==nil {
+			return conn, nil
+		} else if err!=errorPipeBusy {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(name), Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(name), Err: ctx.Err()}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
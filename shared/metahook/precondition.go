@@ -0,0 +1,64 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Formats the config version as entity tag
+ */
+func formatETag(version uint64) string {
+	return "\"" + strconv.FormatUint(version, 10) + "\""
+}
+
+/**
+ * Parses the config version of the If-Match header
+ *
+ * Returns nil if the header is missing or "*" (any version).
+ */
+func parseIfMatch(r *http.Request) (*uint64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header==""||header=="*" {
+		return nil, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), "\"")
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err!=nil {
+		return nil, errors.New("Invalid If-Match header, expected a single config version (e.g. \"42\")")
+	}
+	return &version, nil
+}
+
+/**
+ * Writes the response of an update or delete with the current config version (body and ETag header)
+ *
+ * Keys of namespaces are reported without the prefix (see AddNamespace).
+ */
+func (d* configDomain) writeVersioned(w http.ResponseWriter, res *updateResponse) {
+	res.Version = d.metaConfig.Version()
+	w.Header().Set("ETag", formatETag(res.Version))
+	writeResponse(w, res.Status, d.localResponse(*res))
+}
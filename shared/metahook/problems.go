@@ -0,0 +1,193 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/**
+ * Problem of a single submitted field of an update, referencing its position in the request
+ */
+type fieldProblem struct {
+	// Array of the field in the request (e.g. "int_fields")
+	Field string `json:"field"`
+	// Index of the field in the array
+	Index int `json:"index"`
+	// Key of the field (empty if the key could not be decoded)
+	Key string `json:"key,omitempty"`
+	Err string `json:"err"`
+}
+
+/**
+ * Origin of a field of an update request
+ */
+type fieldOrigin struct {
+	field string
+	index int
+}
+
+/**
+ * Position of the field arrays in update requests, problems are reported in this order
+ */
+var fieldOrder = map[string]int{
+	"string_fields": 0,
+	"bool_fields": 1,
+	"int_fields": 2,
+	"double_fields": 3,
+	"list_fields": 4,
+	"duration_fields": 5,
+	"time_fields": 6,
+}
+
+/**
+ * Update request with undecoded fields
+ *
+ * The fields are decoded one by one (see decodeFields), so that the problems of all fields are reported at once
+ * instead of failing the request on the first field with an invalid value.
+ */
+type rawUpdateRequest struct {
+	updateRequest
+	StringFields []json.RawMessage `json:"string_fields"`
+	BoolFields []json.RawMessage `json:"bool_fields"`
+	IntFields []json.RawMessage `json:"int_fields"`
+	DoubleFields []json.RawMessage `json:"double_fields"`
+	ListFields []json.RawMessage `json:"list_fields"`
+	DurationFields []json.RawMessage `json:"duration_fields"`
+	TimeFields []json.RawMessage `json:"time_fields"`
+}
+
+/**
+ * Decodes the fields into the update request and returns the problems of the fields that could not be decoded
+ */
+func (d* configDomain) decodeFields(raw *rawUpdateRequest) (*updateRequest, []fieldProblem) {
+	req := raw.updateRequest
+	req.indexes = make(map[string][]int)
+	var problems []fieldProblem
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "string_fields", raw.StringFields, &req.StringFields, req.indexes)...)
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "bool_fields", raw.BoolFields, &req.BoolFields, req.indexes)...)
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "int_fields", raw.IntFields, &req.IntFields, req.indexes)...)
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "double_fields", raw.DoubleFields, &req.DoubleFields, req.indexes)...)
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "list_fields", raw.ListFields, &req.ListFields, req.indexes)...)
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "duration_fields", raw.DurationFields, &req.DurationFields, req.indexes)...)
+	problems = append(problems, decodeFieldList(d.disallowUnknownFields, "time_fields", raw.TimeFields, &req.TimeFields, req.indexes)...)
+	return &req, problems
+}
+
+/**
+ * Decodes every raw field into the list and returns the problems of the fields that could not be decoded
+ *
+ * The index of every decoded field in the raw list is recorded in indexes under the name of the list.
+ */
+func decodeFieldList[T any](disallowUnknown bool, name string, raw []json.RawMessage, fields *[]T, indexes map[string][]int) []fieldProblem {
+	var problems []fieldProblem
+	for i, data := range raw {
+		var field T
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		if disallowUnknown {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(&field); err!=nil {
+			// The key is reported if the field is an object with a string key
+			var keyed struct {
+				Key string `json:"key"`
+			}
+			json.Unmarshal(data, &keyed)
+			problems = append(problems, fieldProblem{Field: name, Index: i, Key: keyed.Key, Err: decodeErrorMessage(err)})
+			continue
+		}
+		*fields = append(*fields, field)
+		indexes[name] = append(indexes[name], i)
+	}
+	return problems
+}
+
+/**
+ * Returns a readable message of a decode error of a field
+ */
+func decodeErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field=="" {
+			return fmt.Sprintf("Invalid field, expected object but got %s", typeErr.Value)
+		}
+		return fmt.Sprintf("Invalid type of '%s', expected %s but got %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	}
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
+
+/**
+ * Returns the JSON name of the type
+ */
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array of " + jsonTypeName(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+/**
+ * Returns the JSON kind of the raw value as reported by json.UnmarshalTypeError (e.g. "number")
+ */
+func jsonValueKind(data []byte) string {
+	switch data := bytes.TrimSpace(data); {
+	case len(data)==0:
+		return "nothing"
+	case data[0]=='{':
+		return "object"
+	case data[0]=='[':
+		return "array"
+	case data[0]=='"':
+		return "string"
+	case data[0]=='t', data[0]=='f':
+		return "bool"
+	case data[0]=='n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+/**
+ * Returns the origin of the field at index i of the decoded array
+ */
+func (r* updateRequest) origin(field string, i int) fieldOrigin {
+	if indexes, exists := r.indexes[field]; exists&&i<len(indexes) {
+		return fieldOrigin{field, indexes[i]}
+	}
+	return fieldOrigin{field, i}
+}
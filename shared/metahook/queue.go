@@ -0,0 +1,173 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metahook
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Retry-After of rejected updates as long as no update completed (see WithUpdateQueue)
+ */
+const DEFAULT_QUEUE_RETRY_AFTER time.Duration = time.Second
+
+/**
+ * Processes at most concurrency mutating requests (update, delete, cas, template, reload) at the same time
+ * and queues up to depth further requests in arrival order
+ *
+ * Requests exceeding the queue are rejected with 503 (Service Unavailable) and a Retry-After header
+ * estimated from the recent processing durations, so that slow hooks can't pile up unbounded goroutines.
+ * Async updates keep their slot until their job completed.
+ * Queued requests leave the queue if the client disconnects.
+ *
+ * Pass a concurrency <= 0 to disable the queue (default).
+ */
+func WithUpdateQueue(concurrency int, depth int) Option {
+	return func(m *MetaHook) {
+		if concurrency<=0 {
+			m.updateQueue = nil
+			return
+		}
+		m.updateQueue = &updateQueue{
+			admitted: make(chan struct{}, concurrency + max(depth, 0)),
+			slots: make(chan struct{}, concurrency),
+		}
+	}
+}
+
+/**
+ * Bounded queue of mutating requests
+ */
+type updateQueue struct {
+	// Admitted requests (running and queued), full if no further request is accepted
+	admitted chan struct{}
+	// Running requests
+	slots chan struct{}
+	lock sync.Mutex
+	// Moving average of the duration requests hold their slot
+	average time.Duration
+	// Requests rejected because the queue was full
+	shed atomic.Uint64
+}
+
+type queueTicketKey struct{}
+
+/**
+ * Slot of a running request
+ */
+type queueTicket struct {
+	queue *updateQueue
+	started time.Time
+	// Slot is released by an async job instead of the request (see detachQueueSlot)
+	detached bool
+	once sync.Once
+}
+
+func (t* queueTicket) release() {
+	t.once.Do(func() {
+		t.queue.observe(time.Since(t.started))
+		<-t.queue.slots
+		<-t.queue.admitted
+	})
+}
+
+/**
+ * Wraps a mutating handler with the update queue (if enabled)
+ */
+func (m* MetaHook) queued(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := m.updateQueue
+		if q==nil {
+			next(w, r)
+			return
+		}
+		select {
+		case q.admitted <- struct{}{}:
+		default:
+			q.shed.Add(1)
+			w.Header().Set("Retry-After", q.retryAfter())
+			http.Error(w, "Update queue is full, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case q.slots <- struct{}{}:
+		case <-r.Context().Done():
+			<-q.admitted
+			return
+		}
+
+		ticket := &queueTicket{queue: q, started: time.Now()}
+		defer func() {
+			if !ticket.detached {
+				ticket.release()
+			}
+		}()
+		next(w, r.WithContext(context.WithValue(r.Context(), queueTicketKey{}, ticket)))
+	}
+}
+
+/**
+ * Keeps the queue slot of the request until the returned function is called
+ *
+ * Used by async updates, so that their jobs count against the queue until they completed.
+ */
+func detachQueueSlot(ctx context.Context) func() {
+	ticket, _ := ctx.Value(queueTicketKey{}).(*queueTicket)
+	if ticket==nil {
+		return func() {}
+	}
+	ticket.detached = true
+	return ticket.release
+}
+
+/**
+ * Records the duration a request held its slot
+ */
+func (q* updateQueue) observe(duration time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.average==0 {
+		q.average = duration
+	} else {
+		q.average += (duration - q.average) / 8
+	}
+}
+
+/**
+ * Returns the estimated seconds until the queued requests are processed
+ */
+func (q* updateQueue) retryAfter() string {
+	q.lock.Lock()
+	average := q.average
+	q.lock.Unlock()
+	if average==0 {
+		average = DEFAULT_QUEUE_RETRY_AFTER
+	}
+	wait := average * time.Duration(len(q.admitted)) / time.Duration(cap(q.slots))
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
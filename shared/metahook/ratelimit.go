@@ -0,0 +1,170 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metahook
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * Number of tracked buckets after which idle buckets are pruned
+ */
+const RATE_LIMIT_PRUNE_THRESHOLD int = 1024
+
+/**
+ * Limits the rate of all API requests
+ *
+ * Allows rate requests per second on average with bursts of up to burst requests,
+ * exceeding requests are rejected with 429 (Too Many Requests).
+ */
+func WithRateLimit(rate float64, burst int) Option {
+	return func(m *MetaHook) {
+		m.requestLimiter = newRateLimiter(rate, burst)
+	}
+}
+
+/**
+ * Limits the rate of updates and deletions per key
+ *
+ * Allows rate updates per second and key on average with bursts of up to burst updates,
+ * requests containing a key that exceeds its limit are rejected as a whole with 429 (Too Many Requests).
+ */
+func WithKeyRateLimit(rate float64, burst int) Option {
+	return func(m *MetaHook) {
+		m.keyLimiter = newRateLimiter(rate, burst)
+	}
+}
+
+/**
+ * Token bucket of a single limited entity
+ */
+type tokenBucket struct {
+	tokens float64
+	last time.Time
+}
+
+/**
+ * Token bucket rate limiter for multiple entities
+ */
+type rateLimiter struct {
+	lock sync.Mutex
+	// Tokens refilled per second
+	rate float64
+	// Maximum tokens of a bucket
+	burst float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate: rate,
+		burst: float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+/**
+ * Takes one token of every entity if all of them have a token left
+ *
+ * Returns the entities that exceeded their limit, no token is taken if any entity is limited.
+ */
+func (l* rateLimiter) allow(entities ...string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if len(l.buckets)>RATE_LIMIT_PRUNE_THRESHOLD {
+		l.prune(now)
+	}
+
+	var limited []string
+	for _, entity := range entities {
+		if l.refill(entity, now).tokens<1 {
+			limited = append(limited, entity)
+		}
+	}
+	if len(limited)>0 {
+		return limited
+	}
+	for _, entity := range entities {
+		l.buckets[entity].tokens--
+	}
+	return nil
+}
+
+/**
+ * Returns the bucket of the entity with the tokens refilled up to now
+ */
+func (l* rateLimiter) refill(entity string, now time.Time) *tokenBucket {
+	bucket, exists := l.buckets[entity]
+	if !exists {
+		bucket = &tokenBucket{l.burst, now}
+		l.buckets[entity] = bucket
+		return bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens + now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	return bucket
+}
+
+/**
+ * Removes buckets that are full again, they behave like new buckets
+ */
+func (l* rateLimiter) prune(now time.Time) {
+	for entity := range l.buckets {
+		if l.refill(entity, now).tokens>=l.burst {
+			delete(l.buckets, entity)
+		}
+	}
+}
+
+/**
+ * Returns the seconds until a token is refilled (for the Retry-After header)
+ */
+func (l* rateLimiter) retryAfter() string {
+	if l.rate<=0 {
+		return "60"
+	}
+	return strconv.Itoa(int(math.Ceil(1/l.rate)))
+}
+
+/**
+ * Wraps the handler with the request rate limit (if enabled)
+ */
+func (m* MetaHook) rateLimitHandler(next http.Handler) http.Handler {
+	if m.requestLimiter==nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited := m.requestLimiter.allow(""); limited!=nil {
+			w.Header().Set("Retry-After", m.requestLimiter.retryAfter())
+			writeResponse(w, http.StatusTooManyRequests, updateResponse{
+				Status: http.StatusTooManyRequests,
+				Err: []string{"Request rate limit exceeded"},
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
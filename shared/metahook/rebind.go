@@ -0,0 +1,282 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * Unix sockets served by the MetaHook
+ *
+ * Sockets can be added, removed and rebound while serving (see AddSocket, RemoveSocket, RebindSocket).
+ * Closing a socket only stops accepting new connections, requests of accepted connections are completed
+ * and keep-alive connections are served until they are idle (see WithServerTimeouts).
+ */
+type socketSet struct {
+	lock sync.Mutex
+	// Bound sockets by cleaned path
+	sockets map[string]*boundSocket
+	// Errors of failed listeners, nil if the MetaHook is not serving
+	errs chan error
+}
+
+/**
+ * Unix socket created by the MetaHook
+ */
+type boundSocket struct {
+	path string
+	listener *net.UnixListener
+	created os.FileInfo
+	// Closed on purpose, the error returned by the server is expected
+	closed atomic.Bool
+}
+
+/**
+ * Serves the unix socket at the path stored in the key of the default MetaConfig
+ *
+ * If the key is set on creation, its value replaces the path passed to WithSocket.
+ * Updates of the key rebind the socket to the new path (see RebindSocket), e.g. to migrate clients between socket locations.
+ * The rebinding is registered as string field hook of the key.
+ */
+func WithSocketKey(key string) Option {
+	return func(m *MetaHook) {
+		m.socketKey = key
+	}
+}
+
+/**
+ * Applies the socket key of the default MetaConfig and registers its hook (see WithSocketKey)
+ */
+func (m* MetaHook) registerSocketKey() error {
+	if m.socketKey=="" {
+		return nil
+	}
+	config := m.configs[DEFAULT_CONFIG].metaConfig
+	if path := config.GetString(&m.socketKey); path!="" {
+		m.socketPath = path
+	}
+	return m.RegisterHook(DEFAULT_CONFIG, m.socketKey, func(ctx context.Context, key string, value string) error {
+		if value=="" {
+			return errors.New("Socket path must not be empty")
+		}
+		m.sockets.lock.Lock()
+		perm := m.socketPerm
+		m.sockets.lock.Unlock()
+		return m.RebindSocket(value, perm)
+	})
+}
+
+/**
+ * Serves an additional unix socket at the path with the permissions of the socket file
+ *
+ * The socket is created immediately (see WithSocketPolicy), if the MetaHook is not serving yet it is served once Serve() is called.
+ * Parent directories of the path are created if they don't exist.
+ */
+func (m* MetaHook) AddSocket(path string, perm fs.FileMode) error {
+	m.sockets.lock.Lock()
+	defer m.sockets.lock.Unlock()
+	return m.addSocket(path, perm)
+}
+
+/**
+ * Stops serving the unix socket at the path and removes the socket file
+ *
+ * Requests of already accepted connections are completed.
+ */
+func (m* MetaHook) RemoveSocket(path string) error {
+	m.sockets.lock.Lock()
+	defer m.sockets.lock.Unlock()
+	return m.removeSocket(path)
+}
+
+/**
+ * Moves the unix socket of the MetaHook (see WithSocket) to the path
+ *
+ * The socket at the new path is served before the old one is closed, so that clients can always connect.
+ * Requests of connections accepted on the old socket are completed.
+ * If the MetaHook is not serving yet, the path is used once Serve() is called.
+ */
+func (m* MetaHook) RebindSocket(path string, perm fs.FileMode) error {
+	m.sockets.lock.Lock()
+	defer m.sockets.lock.Unlock()
+	if m.disableSocket {
+		return errors.New("MetaHook socket is disabled")
+	}
+	if m.sockets.errs==nil {
+		m.socketPath, m.socketPerm = path, perm
+		return nil
+	}
+	old, target := filepath.Clean(m.socketPath), filepath.Clean(path)
+	if _, exists := m.sockets.sockets[old]; exists&&old==target {
+		if err := os.Chmod(path, perm); err!=nil {
+			return err
+		}
+		m.socketPerm = perm
+		return nil
+	}
+	if err := m.addSocket(path, perm); err!=nil {
+		return err
+	}
+	// The old socket is not registered if it was removed with RemoveSocket
+	if _, exists := m.sockets.sockets[old]; exists {
+		m.removeSocket(old)
+	}
+	if m.logger!=nil {
+		m.logger.LogInfo(fmt.Sprintf("Rebound MetaHook socket from '%s' to '%s'", m.socketPath, path))
+	}
+	m.socketPath, m.socketPerm = path, perm
+	return nil
+}
+
+/**
+ * Returns the paths of the served unix sockets, sorted
+ */
+func (m* MetaHook) Sockets() []string {
+	m.sockets.lock.Lock()
+	defer m.sockets.lock.Unlock()
+	paths := mapKeys(m.sockets.sockets)
+	sort.Strings(paths)
+	return paths
+}
+
+/**
+ * Creates, registers and (if serving) serves the socket, the lock must be held
+ */
+func (m* MetaHook) addSocket(path string, perm fs.FileMode) error {
+	key := filepath.Clean(path)
+	if _, exists := m.sockets.sockets[key]; exists {
+		return fmt.Errorf("MetaHook socket '%s' is already served", path)
+	}
+	socket, err := m.bindSocket(path, perm)
+	if err!=nil {
+		return err
+	}
+	if m.sockets.sockets==nil {
+		m.sockets.sockets = make(map[string]*boundSocket)
+	}
+	m.sockets.sockets[key] = socket
+	if m.sockets.errs!=nil {
+		go m.serveSocket(socket, m.sockets.errs)
+	}
+	return nil
+}
+
+/**
+ * Unregisters and closes the socket, the lock must be held
+ */
+func (m* MetaHook) removeSocket(path string) error {
+	key := filepath.Clean(path)
+	socket, exists := m.sockets.sockets[key]
+	if !exists {
+		return fmt.Errorf("MetaHook socket '%s' is not served", path)
+	}
+	delete(m.sockets.sockets, key)
+	socket.close()
+	return nil
+}
+
+/**
+ * Creates the unix socket at the path and sets its permissions
+ */
+func (m* MetaHook) bindSocket(path string, perm fs.FileMode) (*boundSocket, error) {
+	// Create path recursively
+	if err:=os.MkdirAll(filepath.Dir(path), 0755); err!=nil {
+		return nil, err
+	}
+	// Remove socket if stale (see WithSocketPolicy)
+	if err:=m.removeStaleSocket(path); err!=nil {
+		return nil, err
+	}
+	listener, created, err := listenSocket(path)
+	if err!=nil {
+		return nil, err
+	}
+	socket := &boundSocket{path: path, listener: listener, created: created}
+	if err:=os.Chmod(path, perm); err!=nil {
+		socket.close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+/**
+ * Serves the registered sockets and every socket added until they are closed (see closeSockets)
+ */
+func (m* MetaHook) serveSockets(errs chan error) {
+	m.sockets.lock.Lock()
+	defer m.sockets.lock.Unlock()
+	m.sockets.errs = errs
+	for _, socket := range m.sockets.sockets {
+		go m.serveSocket(socket, errs)
+	}
+}
+
+/**
+ * Stops serving and closes every registered socket
+ */
+func (m* MetaHook) closeSockets() {
+	m.sockets.lock.Lock()
+	defer m.sockets.lock.Unlock()
+	for _, socket := range m.sockets.sockets {
+		socket.close()
+	}
+	m.sockets.sockets = nil
+	m.sockets.errs = nil
+}
+
+/**
+ * Serves the socket until it fails or is closed, errors of sockets that were not closed on purpose are reported to errs
+ */
+func (m* MetaHook) serveSocket(socket *boundSocket, errs chan error) {
+	err := m.socketServer.Serve(socket.listener)
+	if !socket.closed.Load() {
+		reportServeError(errs, err)
+	}
+}
+
+/**
+ * Reports the error of a listener, only the first error is reported
+ */
+func reportServeError(errs chan error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+/**
+ * Closes the listener and removes the socket file (see closeSocket)
+ */
+func (s* boundSocket) close() {
+	if s.closed.CompareAndSwap(false, true) {
+		closeSocket(s.listener, s.path, s.created)
+	}
+}
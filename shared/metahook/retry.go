@@ -0,0 +1,107 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/**
+ * Retries of failed hooks of a key (see UpdateHooks.RetryPolicies)
+ *
+ * Panicking hooks, timed out hooks (they keep running in the background)
+ * and hooks of canceled requests are never retried.
+ */
+type RetryPolicy struct {
+	// Number of retries after the first failed attempt
+	Attempts int
+	// Delay before the first retry, the delay is doubled on every retry
+	Backoff time.Duration
+	// Decides if the error of a failed attempt is retried,
+	// if nil only errors marked as transient are retried (see Retryable)
+	Retryable func(error) bool
+}
+
+/**
+ * Error of a hook that failed transiently
+ */
+type RetryableError struct {
+	Err error
+}
+
+func (e* RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e* RetryableError) Unwrap() error {
+	return e.Err
+}
+
+/**
+ * Marks the error of a hook as transient, so that it is retried by the default RetryPolicy
+ *
+ * Returns nil if err is nil.
+ */
+func Retryable(err error) error {
+	if err==nil {
+		return nil
+	}
+	return &RetryableError{err}
+}
+
+/**
+ * Checks if the error of a failed attempt can be retried under the policy
+ */
+func (p* RetryPolicy) retryable(err error) bool {
+	var panicErr *HookPanicError
+	if errors.As(err, &panicErr)||errors.Is(err, errHookTimeout) {
+		return false
+	}
+	if p.Retryable!=nil {
+		return p.Retryable(err)
+	}
+	var retryErr *RetryableError
+	return errors.As(err, &retryErr)
+}
+
+/**
+ * Runs a hook of the key (see runHook) and retries it according to the RetryPolicy of the key
+ */
+func (d* configDomain) runKeyHook(ctx context.Context, kind string, key string, hook func(ctx context.Context) error) error {
+	policy, exists := findHook(d.hooks().RetryPolicies, key)
+	err := d.runHook(ctx, kind, key, hook)
+	if !exists {
+		return err
+	}
+	backoff := policy.Backoff
+	for attempt := 0; err!=nil&&attempt<policy.Attempts&&policy.retryable(err); attempt++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = d.runHook(ctx, kind, key, hook)
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/logger"
+)
+
+/**
+ * Returns the rotation policy with the overrides of the keys of the default MetaConfig below the prefix
+ *
+ * The keys are <prefix>.max_size (bytes), <prefix>.backups, <prefix>.interval ("never", "daily" or "weekly"),
+ * <prefix>.max_age_days, <prefix>.compress and <prefix>.delay_compress (see WithAccessLogRotationKeys, WithLogRotationKeys).
+ */
+func (m* MetaHook) rotationPolicy(prefix string, policy logger.RotationPolicy) (logger.RotationPolicy, error) {
+	if prefix=="" {
+		return policy, nil
+	}
+	config := m.configs[DEFAULT_CONFIG].metaConfig
+	key := func(name string) *string {
+		key := prefix + "." + name
+		return &key
+	}
+	if config.Exists(key("max_size")) {
+		policy.MaxSize = config.GetInt(key("max_size"))
+	}
+	if config.Exists(key("backups")) {
+		policy.Backups = int(config.GetInt(key("backups")))
+	}
+	if config.Exists(key("interval")) {
+		interval, err := logger.ParseRotateInterval(config.GetString(key("interval")))
+		if err!=nil {
+			return policy, err
+		}
+		policy.Interval = interval
+	}
+	if config.Exists(key("max_age_days")) {
+		policy.MaxAge = time.Duration(config.GetInt(key("max_age_days"))) * 24 * time.Hour
+	}
+	if config.Exists(key("compress")) {
+		policy.Compress = config.GetBool(key("compress"))
+	}
+	if config.Exists(key("delay_compress")) {
+		policy.DelayCompress = config.GetBool(key("delay_compress"))
+	}
+	return policy, nil
+}
+
+/**
+ * Validates the rotation keys below the prefix and applies the policy on every update or deletion of them
+ *
+ * Apply receives the base policy with the overrides of the keys (see rotationPolicy).
+ */
+func (m* MetaHook) bindRotationKeys(prefix string, base logger.RotationPolicy, apply func(logger.RotationPolicy)) error {
+	// Invalid values are rejected before they are set, so that the policy can always be applied
+	config := m.configs[DEFAULT_CONFIG].metaConfig
+	config.RegisterValidator(prefix + ".interval", func(key string, value string) error {
+		_, err := logger.ParseRotateInterval(value)
+		return err
+	})
+	for _, name := range []string{"max_size", "backups", "max_age_days"} {
+		config.RegisterValidator(prefix + "." + name, func(key string, value string) error {
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err!=nil||n<0 {
+				return fmt.Errorf("Expected a non-negative integer, got '%s'", value)
+			}
+			return nil
+		})
+	}
+
+	// Every hook rereads the whole policy, so that the type of the updated field does not matter,
+	// a hook is registered for every field type
+	reapply := func() error {
+		policy, err := m.rotationPolicy(prefix, base)
+		if err!=nil {
+			return err
+		}
+		apply(policy)
+		return nil
+	}
+	pattern := prefix + ".*"
+	return errors.Join(
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value string) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value int64) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value bool) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value float64) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value []string) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value time.Duration) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string, value time.Time) error {
+			return reapply()
+		}),
+		m.RegisterHook(DEFAULT_CONFIG, pattern, func(ctx context.Context, key string) error {
+			return reapply()
+		}),
+	)
+}
@@ -0,0 +1,101 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metahook
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Requires the keys (or key patterns, see UpdateHooks) to be updated with sealed values
+ *
+ * Sealed values are encrypted by the client with the public key of the MetaConfig (see /sealing-key and metaconfig.Seal)
+ * and marked with "sealed" in the string fields of updates. The MetaHook only checks their format and stores them as they are,
+ * so the plaintext never reaches the MetaHook, its logs, the audit trail or the config file.
+ * The component unseals them with metaconfig.GetSealed.
+ *
+ * Updates of these keys with plain values (including typed fields, templates and /cas) are rejected with 422.
+ * Fields marked as sealed are always checked, also for other keys.
+ */
+func WithSealedKeys(patterns ...string) Option {
+	return func(m *MetaHook) {
+		if m.sealedKeys==nil {
+			m.sealedKeys = make(map[string]bool)
+		}
+		for _, pattern := range patterns {
+			m.sealedKeys[pattern] = true
+		}
+	}
+}
+
+/**
+ * Checks that the value of a field is sealed if it is marked as sealed or its key requires sealed values
+ */
+func (d* configDomain) checkSealed(key string, value string, sealed bool) error {
+	if sealed {
+		if !metaconfig.IsSealed(value) {
+			return errors.New("Value is not sealed")
+		}
+		return nil
+	}
+	if _, required := findHook(d.sealedKeys, d.metaConfig.CanonicalKey(key)); required {
+		return errors.New("Key requires a sealed value")
+	}
+	return nil
+}
+
+type sealingKeyResponse struct {
+	// Key agreement of the sealing key
+	Algorithm string `json:"algorithm"`
+	// Base64 encoded public key
+	PublicKey string `json:"public_key"`
+	// Prefix of the keys of the namespace, values must be sealed for the full key (see AddNamespace)
+	KeyPrefix string `json:"key_prefix,omitempty"`
+}
+
+/**
+ * Handler sealing-key requests
+ *
+ * Returns the public key values of the MetaConfig are sealed with (see metaconfig.Seal),
+ * responds with status 404 if the MetaConfig has no sealing key.
+ */
+func (d* configDomain) sealingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := d.metaConfig.SealingPublicKey()
+	if key==nil {
+		http.Error(w, "MetaConfig has no sealing key", http.StatusNotFound)
+		return
+	}
+	writeResponse(w, http.StatusOK, sealingKeyResponse{
+		Algorithm: "x25519",
+		PublicKey: base64.StdEncoding.EncodeToString(key.Bytes()),
+		KeyPrefix: d.keyPrefix,
+	})
+}
@@ -0,0 +1,79 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"net/http"
+	"time"
+)
+
+/**
+ * Default limits of the HTTP server (see WithServerTimeouts, WithMaxHeaderBytes)
+ *
+ * The write timeout must exceed the duration of the hooks of synchronous requests.
+ */
+const DEFAULT_READ_TIMEOUT time.Duration = 1 * time.Minute
+const DEFAULT_WRITE_TIMEOUT time.Duration = 5 * time.Minute
+const DEFAULT_IDLE_TIMEOUT time.Duration = 2 * time.Minute
+const DEFAULT_MAX_HEADER_BYTES int = 64 << 10
+
+/**
+ * Sets the timeouts of the HTTP server (default DEFAULT_READ_TIMEOUT, DEFAULT_WRITE_TIMEOUT, DEFAULT_IDLE_TIMEOUT)
+ *
+ * The read timeout limits reading the request, the write timeout limits the handling of the request including its hooks,
+ * the idle timeout limits how long keep-alive connections wait for the next request. A timeout of 0 disables it.
+ *
+ * /watch streams are not limited, /wait requests extend the timeouts by their wait timeout.
+ */
+func WithServerTimeouts(read time.Duration, write time.Duration, idle time.Duration) Option {
+	return func(m *MetaHook) {
+		m.socketServer.ReadTimeout = read
+		m.socketServer.WriteTimeout = write
+		m.socketServer.IdleTimeout = idle
+	}
+}
+
+/**
+ * Sets the maximum size of the request headers in bytes (default DEFAULT_MAX_HEADER_BYTES)
+ */
+func WithMaxHeaderBytes(size int) Option {
+	return func(m *MetaHook) {
+		m.socketServer.MaxHeaderBytes = size
+	}
+}
+
+/**
+ * Extends the read and write deadline of a long-lived request by the duration (0 removes them)
+ *
+ * Fails silently if a middleware hides the underlying connection (see http.ResponseController).
+ */
+func (m* MetaHook) extendDeadlines(w http.ResponseWriter, duration time.Duration) {
+	controller := http.NewResponseController(w)
+	var readDeadline, writeDeadline time.Time
+	if duration>0&&m.socketServer.ReadTimeout>0 {
+		readDeadline = time.Now().Add(duration + m.socketServer.ReadTimeout)
+	}
+	if duration>0&&m.socketServer.WriteTimeout>0 {
+		writeDeadline = time.Now().Add(duration + m.socketServer.WriteTimeout)
+	}
+	controller.SetReadDeadline(readDeadline)
+	controller.SetWriteDeadline(writeDeadline)
+}
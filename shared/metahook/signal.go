@@ -0,0 +1,97 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+/**
+ * Audit identity of reloads triggered by SIGHUP
+ */
+const SIGNAL_CLIENT string = "signal:SIGHUP"
+
+/**
+ * Reloads every MetaConfig from disk when the process receives SIGHUP
+ *
+ * The reload calls the hooks of changed and removed keys like the /reload endpoint,
+ * MetaConfigs without backing config file are skipped.
+ * Failures are logged (see WithLogger) and recorded in the audit trail.
+ *
+ * The signal handler is installed while Serve() is running. SIGHUP is not delivered on Windows.
+ */
+func WithSignalReload() Option {
+	return func(m *MetaHook) {
+		m.signalReload = true
+	}
+}
+
+/**
+ * Installs the SIGHUP handler and returns the function to remove it
+ */
+func (m* MetaHook) handleReloadSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				m.reloadAll()
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+/**
+ * Reloads every file-backed MetaConfig in name order
+ */
+func (m* MetaHook) reloadAll() {
+	names := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := m.configs[name]
+		if d.metaConfig.Path()=="" {
+			continue
+		}
+		res := d.reload(context.Background(), SIGNAL_CLIENT, nil)
+		if len(res.Err)>0 {
+			m.logError(fmt.Sprintf("SIGHUP reload of config '%s' failed: %s", name, strings.Join(res.Err, "; ")))
+		} else if m.logger!=nil {
+			m.logger.LogInfo(fmt.Sprintf("SIGHUP reload of config '%s': %d changed, %d deleted", name, len(res.Changed), len(res.Deleted)))
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+)
+
+/**
+ * Policy applied if the socket path is served by another live process
+ */
+type SOCKETPOLICY int
+const (
+	// Refuse to start with ErrSocketInUse
+	SOCKET_REFUSE SOCKETPOLICY = iota
+	// Replace the socket, the other process no longer receives new connections
+	SOCKET_TAKEOVER
+)
+
+/**
+ * Default permissions of the socket file (see WithSocket)
+ */
+const DEFAULT_SOCKET_PERM fs.FileMode = 0600
+
+/**
+ * Timeout of the connect attempt used to check if an existing socket is still served
+ */
+const SOCKET_PROBE_TIMEOUT = time.Second
+
+/**
+ * Returned if the socket path is served by another live process (see WithSocketPolicy)
+ */
+var ErrSocketInUse = errors.New("MetaHook socket is in use by another process")
+
+/**
+ * Serves the API on a unix socket at the path with the permissions of the socket file
+ *
+ * Parent directories of the path are created if they don't exist.
+ */
+func WithSocket(path string, perm fs.FileMode) Option {
+	return func(m *MetaHook) {
+		m.socketPath = path
+		m.socketPerm = perm
+	}
+}
+
+/**
+ * Sets the policy applied if the socket path is already served by another process
+ *
+ * Before the socket is created, an existing socket file is probed with a connect attempt.
+ * Stale sockets (left over by a crashed process) are always removed,
+ * live sockets are handled according to the policy (default SOCKET_REFUSE).
+ */
+func WithSocketPolicy(policy SOCKETPOLICY) Option {
+	return func(m *MetaHook) {
+		m.socketPolicy = policy
+	}
+}
+
+/**
+ * Removes an existing socket file if it is stale or the policy allows taking it over
+ *
+ * Regular files and directories are never removed.
+ */
+func (m* MetaHook) removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err!=nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// Socket files are not reported as such on every platform, so only plain files and directories are rejected
+	if info.IsDir()||info.Mode().IsRegular() {
+		return fmt.Errorf("MetaHook socket path '%s' exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, SOCKET_PROBE_TIMEOUT)
+	if err==nil {
+		conn.Close()
+		if m.socketPolicy!=SOCKET_TAKEOVER {
+			return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+		}
+		if m.logger!=nil {
+			m.logger.LogWarn(fmt.Sprintf("Taking over MetaHook socket '%s' from a live process", path))
+		}
+	} else if netErr, ok := err.(net.Error); ok&&netErr.Timeout() {
+		// The backlog of a live but busy process is full
+		if m.socketPolicy!=SOCKET_TAKEOVER {
+			return fmt.Errorf("%w: %s (probe timed out)", ErrSocketInUse, path)
+		}
+	}
+
+	if err:=os.Remove(path); err!=nil&&!os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/**
+ * Creates the unix socket at the path and its listener
+ *
+ * The listener does not unlink the socket on close (see closeSocket).
+ */
+func listenSocket(path string) (*net.UnixListener, os.FileInfo, error) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err!=nil {
+		return nil, nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	created, err := os.Lstat(path)
+	if err!=nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	return listener, created, nil
+}
+
+/**
+ * Closes the listener and removes the socket file, unless it was replaced by another process
+ *
+ * Otherwise a process that was taken over would remove the socket of its successor.
+ */
+func closeSocket(listener *net.UnixListener, path string, created os.FileInfo) {
+	listener.Close()
+	if current, err := os.Lstat(path); err==nil&&os.SameFile(created, current) {
+		os.Remove(path)
+	}
+}
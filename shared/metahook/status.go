@@ -0,0 +1,342 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Number of recent audit entries shown on the status page
+ */
+const STATUS_RECENT_UPDATES = 20
+
+/**
+ * Summary of a MetaConfig on the status page
+ */
+type statusConfig struct {
+	Name string
+	Path string
+	Version uint64
+	Frozen bool
+	Stats metaconfig.Stats
+	// Readable keys with redacted values, sorted by key
+	Keys []statusValue
+	Hooks []statusHook
+}
+
+type statusValue struct {
+	Key string
+	Value string
+}
+
+/**
+ * Registered hook of a MetaConfig, the pattern is empty for hooks of all keys
+ */
+type statusHook struct {
+	Kind string
+	Pattern string
+	Retry string
+	// Keys or patterns whose hooks are called first (see UpdateHooks.Dependencies)
+	After string
+}
+
+type statusNamespace struct {
+	Name string
+	Config string
+	Prefix string
+}
+
+/**
+ * Data of the status page template
+ */
+type statusPage struct {
+	Build string
+	APIVersion string
+	Uptime time.Duration
+	// Problems shown in the health section, healthy if empty
+	Warnings []string
+	RunningHooks int
+	RunningJobs int
+	QueueEnabled bool
+	QueueRunning int
+	QueueWaiting int
+	QueueShed uint64
+	Configs []statusConfig
+	Namespaces []statusNamespace
+	Jobs []job
+	AuditEnabled bool
+	Updates []auditEntry
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"keys": func(fields []auditField) string {
+		keys := make([]string, 0, len(fields))
+		for _, field := range fields {
+			keys = append(keys, field.Key)
+		}
+		return strings.Join(keys, ", ")
+	},
+	"time": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>MetaHook status</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #999; padding: 2px 8px; text-align: left; vertical-align: top; }
+.ok { color: #080; }
+.degraded { color: #c00; }
+</style>
+</head>
+<body>
+<h1>MetaHook status</h1>
+<p>Build {{.Build}} (API {{.APIVersion}}), up {{.Uptime}}</p>
+
+<h2>Health</h2>
+{{if .Warnings}}<p class="degraded">degraded</p>
+<ul>{{range .Warnings}}<li>{{.}}</li>{{end}}</ul>
+{{else}}<p class="ok">ok</p>{{end}}
+<table>
+<tr><th>Running hooks</th><td>{{.RunningHooks}}</td></tr>
+<tr><th>Running jobs</th><td>{{.RunningJobs}}</td></tr>
+{{if .QueueEnabled}}<tr><th>Update queue</th><td>{{.QueueRunning}} running, {{.QueueWaiting}} waiting, {{.QueueShed}} shed</td></tr>{{end}}
+</table>
+
+{{range .Configs}}
+<h2>Config {{.Name}}</h2>
+<table>
+<tr><th>Path</th><td>{{if .Path}}{{.Path}}{{else}}-{{end}}</td></tr>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Frozen</th><td>{{.Frozen}}</td></tr>
+<tr><th>Disk reads / writes</th><td>{{.Stats.DiskReads}} / {{.Stats.DiskWrites}}</td></tr>
+<tr><th>Parse / write errors</th><td>{{.Stats.ParseErrors}} / {{.Stats.WriteErrors}}</td></tr>
+</table>
+<h3>Values ({{len .Keys}})</h3>
+<table>
+<tr><th>Key</th><th>Value</th></tr>
+{{range .Keys}}<tr><td>{{.Key}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+<h3>Hooks</h3>
+{{if .Hooks}}<table>
+<tr><th>Kind</th><th>Pattern</th><th>Retry</th><th>After</th></tr>
+{{range .Hooks}}<tr><td>{{.Kind}}</td><td>{{if .Pattern}}{{.Pattern}}{{else}}*{{end}}</td><td>{{.Retry}}</td><td>{{.After}}</td></tr>
+{{end}}</table>
+{{else}}<p>No hooks registered</p>{{end}}
+{{end}}
+
+{{if .Namespaces}}
+<h2>Namespaces</h2>
+<table>
+<tr><th>Name</th><th>Config</th><th>Prefix</th></tr>
+{{range .Namespaces}}<tr><td>{{.Name}}</td><td>{{.Config}}</td><td>{{.Prefix}}</td></tr>
+{{end}}</table>
+{{end}}
+
+<h2>Jobs</h2>
+{{if .Jobs}}<table>
+<tr><th>Id</th><th>Status</th><th>Progress</th><th>Started</th><th>Errors</th></tr>
+{{range .Jobs}}<tr><td>{{.Id}}</td><td>{{.Status}}</td><td>{{.Done}}/{{.Total}}</td><td>{{time .Started}}</td><td>{{range .Err}}{{.}}<br>{{end}}{{range .Fields}}{{if .Err}}{{.Key}}: {{.Err}}<br>{{end}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No jobs</p>{{end}}
+
+<h2>Recent updates</h2>
+{{if not .AuditEnabled}}<p>Audit history is disabled</p>
+{{else if .Updates}}<table>
+<tr><th>Time</th><th>Config</th><th>Client</th><th>Operation</th><th>Status</th><th>Keys</th><th>Errors</th></tr>
+{{range .Updates}}<tr><td>{{time .Time}}</td><td>{{.Config}}</td><td>{{.Client}}</td><td>{{.Operation}}</td><td>{{.Status}}</td><td>{{keys .Fields}}</td><td>{{range .Err}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No updates</p>{{end}}
+</body>
+</html>
+`))
+
+/**
+ * Handler status page requests
+ *
+ * Serves a minimal HTML page for emergency debugging (e.g. with curl --unix-socket) at the root:
+ * health, every MetaConfig with its readable values (redacted and sealed values are masked) and hooks,
+ * namespaces, jobs and the recent updates of the audit history (see WithAuditHistory).
+ * Values and updates with keys the peer may not read are omitted (see WithACL).
+ */
+func (m* MetaHook) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path!="/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := statusPage{
+		Build: buildVersion(),
+		APIVersion: API_VERSION,
+		Uptime: time.Since(m.started).Truncate(time.Second),
+		AuditEnabled: m.audit.historySize>0,
+	}
+	page.RunningHooks, _ = m.inflight.state()
+	if q := m.updateQueue; q!=nil {
+		page.QueueEnabled = true
+		page.QueueRunning = len(q.slots)
+		page.QueueWaiting = max(0, len(q.admitted)-page.QueueRunning)
+		page.QueueShed = q.shed.Load()
+	}
+
+	names := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := m.configs[name]
+		config := statusConfig{
+			Name: name,
+			Path: d.metaConfig.Path(),
+			Version: d.metaConfig.Version(),
+			Frozen: d.metaConfig.IsFrozen(),
+			Stats: d.metaConfig.Stats(),
+			Hooks: d.statusHooks(),
+		}
+		for key, value := range d.filterReadable(r, d.metaConfig.GetRedactedConfig()) {
+			if metaconfig.IsSealed(value) {
+				value = metaconfig.REDACTED_VALUE
+			}
+			config.Keys = append(config.Keys, statusValue{key, value})
+		}
+		sort.Slice(config.Keys, func(i, j int) bool {
+			return config.Keys[i].Key < config.Keys[j].Key
+		})
+		if config.Stats.ParseErrors>0||config.Stats.WriteErrors>0 {
+			page.Warnings = append(page.Warnings, "Config '" + name + "' had errors reading or writing its config file")
+		}
+		page.Configs = append(page.Configs, config)
+	}
+
+	for name, d := range m.namespaces {
+		page.Namespaces = append(page.Namespaces, statusNamespace{name, d.parent.name, d.keyPrefix})
+	}
+	sort.Slice(page.Namespaces, func(i, j int) bool {
+		return page.Namespaces[i].Name < page.Namespaces[j].Name
+	})
+
+	m.jobLock.Lock()
+	for _, j := range m.jobs {
+		page.Jobs = append(page.Jobs, *j)
+	}
+	m.jobLock.Unlock()
+	sort.Slice(page.Jobs, func(i, j int) bool {
+		return page.Jobs[i].Started.After(page.Jobs[j].Started)
+	})
+	failedJobs := 0
+	for _, j := range page.Jobs {
+		switch j.Status {
+		case JOB_RUNNING:
+			page.RunningJobs++
+		case JOB_FAILED:
+			failedJobs++
+		}
+	}
+	if failedJobs>0 {
+		page.Warnings = append(page.Warnings, strconv.Itoa(failedJobs) + " recent jobs failed")
+	}
+
+	if page.AuditEnabled {
+		m.audit.lock.Lock()
+		entries := append([]auditEntry{}, m.audit.history...)
+		m.audit.lock.Unlock()
+		entries = m.filterReadableEntries(r, entries)
+		if len(entries)>STATUS_RECENT_UPDATES {
+			entries = entries[len(entries)-STATUS_RECENT_UPDATES:]
+		}
+		// Newest first
+		for i := len(entries)-1; i>=0; i-- {
+			page.Updates = append(page.Updates, entries[i])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := statusTemplate.Execute(w, page); err!=nil {
+		m.logError("Failed to render MetaHook status page: " + err.Error())
+	}
+}
+
+/**
+ * Returns the registered hooks of the domain sorted by kind and pattern
+ */
+func (d* configDomain) statusHooks() []statusHook {
+	hooks := d.hooks()
+	var registry []statusHook
+	add := func(kind string, patterns []string) {
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			entry := statusHook{Kind: kind, Pattern: pattern}
+			if policy, exists := hooks.RetryPolicies[pattern]; exists&&pattern!="" {
+				entry.Retry = strconv.Itoa(policy.Attempts) + " retries, backoff " + policy.Backoff.String()
+			}
+			if deps, exists := hooks.Dependencies[pattern]; exists&&pattern!="" {
+				entry.After = strings.Join(deps, ", ")
+			}
+			registry = append(registry, entry)
+		}
+	}
+	add("string", mapKeys(hooks.StringFieldHooks))
+	add("bool", mapKeys(hooks.BoolFieldHooks))
+	add("int", mapKeys(hooks.IntFieldHooks))
+	add("double", mapKeys(hooks.DoubleFieldHooks))
+	add("list", mapKeys(hooks.ListFieldHooks))
+	add("duration", mapKeys(hooks.DurationFieldHooks))
+	add("time", mapKeys(hooks.TimeFieldHooks))
+	add("delete", mapKeys(hooks.DeleteHooks))
+	if hooks.GlobalHook!=nil {
+		add("global", []string{""})
+	}
+	if hooks.ClientHook!=nil {
+		add("client", []string{""})
+	}
+	if hooks.RevertHook!=nil {
+		add("revert", []string{""})
+	}
+	return registry
+}
+
+/**
+ * Returns the keys of the map in random order
+ */
+func mapKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
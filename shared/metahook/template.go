@@ -0,0 +1,264 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+
+package metahook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Maximum number of fields a templated update may expand to
+ */
+const MAX_TEMPLATE_FIELDS = 10000
+
+type templateRequest struct {
+	// Value templates by key template (e.g. "disk.{{.id}}.state": "online")
+	Fields map[string]string `json:"fields"`
+	// Types of the fields by key template, either "string" (default), "bool", "int", "double", "duration" or "time"
+	Types map[string]string `json:"types"`
+	// Variables of every instantiation, every template is executed once per entry
+	Vars []map[string]string `json:"vars"`
+	// Write the configuration to disk after all hooks succeeded
+	Persist bool `json:"persist"`
+	// Apply nothing if any field is rejected and roll back all fields if any hook fails
+	Atomic bool `json:"atomic"`
+	// Run the hooks in the background and return a job id (see /jobs/)
+	Async bool `json:"async"`
+	// Only validate the fields and report the planned changes, nothing is applied
+	DryRun bool `json:"dry_run"`
+}
+
+/**
+ * Handler templated update requests
+ *
+ * Executes the key and value templates (text/template) once for every entry of vars
+ * and applies the resulting fields as a single update (see updateHandler),
+ * e.g. {"fields": {"disk.{{.id}}.state": "online"}, "vars": [{"id": "1"}, {"id": "2"}]} sets disk.1.state and disk.2.state.
+ * This reconfigures large arrays of resources with a single request.
+ *
+ * Templates are executed with missingkey=error, so referencing an undefined variable rejects the request.
+ * Templates may only reference variables (e.g. {{.id}} or {{$.id}}), actions like range, with, if, template
+ * and function calls are rejected, so that executing a client template is bounded by its size.
+ * Fields are expanded in the order of vars and the key templates sorted, which is also the order their hooks are called in
+ * (typed fields are called in the usual type order, see updateHandler).
+ * Keys expanded multiple times are rejected like keys submitted multiple times to /update.
+ *
+ * The expanded keys and values are limited to the maximum body size (see WithMaxBodySize) in total.
+ *
+ * Responds with status 400 if a template can't be parsed or executed, or a value doesn't match its type,
+ * the expanded update responds like /update.
+ */
+func (d* configDomain) templateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method, expected POST!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req templateRequest
+	if !d.decodeRequest(w, r, &req) {
+		return
+	}
+	update, err := req.expand(d.maxBodySize)
+	if err!=nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.applyUpdate(w, r, update)
+}
+
+/**
+ * Template of a single field
+ */
+type fieldTemplate struct {
+	source string
+	fieldType string
+	key *template.Template
+	value *template.Template
+}
+
+/**
+ * Expands the templates into an update request
+ *
+ * Limit is the maximum size of all expanded keys and values in bytes.
+ */
+func (t* templateRequest) expand(limit int64) (*updateRequest, error) {
+	sources := make([]string, 0, len(t.Fields))
+	for source := range t.Fields {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for source := range t.Types {
+		if _, exists := t.Fields[source]; !exists {
+			return nil, fmt.Errorf("Type of unknown key template '%s'", source)
+		}
+	}
+	if len(sources)*len(t.Vars)>MAX_TEMPLATE_FIELDS {
+		return nil, fmt.Errorf("Templates expand to more than %d fields", MAX_TEMPLATE_FIELDS)
+	}
+
+	templates := make([]fieldTemplate, len(sources))
+	for i, source := range sources {
+		field := fieldTemplate{source: source, fieldType: t.Types[source]}
+		switch field.fieldType {
+		case "":
+			field.fieldType = "string"
+		case "string", "bool", "int", "double", "duration", "time":
+		default:
+			return nil, fmt.Errorf("Invalid type '%s' of key template '%s'", field.fieldType, source)
+		}
+		var err error
+		if field.key, err = parseTemplate(source); err!=nil {
+			return nil, fmt.Errorf("Invalid key template '%s': %w", source, err)
+		}
+		if field.value, err = parseTemplate(t.Fields[source]); err!=nil {
+			return nil, fmt.Errorf("Invalid value template of '%s': %w", source, err)
+		}
+		templates[i] = field
+	}
+
+	update := &updateRequest{Persist: t.Persist, Atomic: t.Atomic, Async: t.Async, DryRun: t.DryRun}
+	out := &limitedBuilder{limit: limit}
+	for i, vars := range t.Vars {
+		for _, field := range templates {
+			key, err := executeTemplate(out, field.key, vars)
+			if err!=nil {
+				return nil, fmt.Errorf("Failed to execute key template '%s' for vars[%d]: %w", field.source, i, err)
+			}
+			value, err := executeTemplate(out, field.value, vars)
+			if err!=nil {
+				return nil, fmt.Errorf("Failed to execute value template of '%s' for vars[%d]: %w", field.source, i, err)
+			}
+			switch field.fieldType {
+			case "string":
+				update.StringFields = append(update.StringFields, metaStringField{Key: key, Value: value})
+			case "bool":
+				b, err := strconv.ParseBool(value)
+				if err!=nil {
+					return nil, fmt.Errorf("Invalid bool value '%s' of key '%s'", value, key)
+				}
+				update.BoolFields = append(update.BoolFields, metaBoolField{key, b})
+			case "int":
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err!=nil {
+					return nil, fmt.Errorf("Invalid int value '%s' of key '%s'", value, key)
+				}
+				update.IntFields = append(update.IntFields, metaIntField{key, n})
+			case "double":
+				f, err := strconv.ParseFloat(value, 64)
+				if err!=nil {
+					return nil, fmt.Errorf("Invalid double value '%s' of key '%s'", value, key)
+				}
+				update.DoubleFields = append(update.DoubleFields, metaDoubleField{key, f})
+			case "duration":
+				duration, err := metaconfig.ParseDuration(value)
+				if err!=nil {
+					return nil, fmt.Errorf("Invalid duration value '%s' of key '%s'", value, key)
+				}
+				update.DurationFields = append(update.DurationFields, metaDurationField{key, durationValue(duration)})
+			case "time":
+				t, err := metaconfig.ParseTime(value)
+				if err!=nil {
+					return nil, fmt.Errorf("Invalid time value '%s' of key '%s'", value, key)
+				}
+				update.TimeFields = append(update.TimeFields, metaTimeField{key, timeValue(t)})
+			}
+		}
+	}
+	return update, nil
+}
+
+/**
+ * Parses the template, rejecting every action except the output of a field or variable (see checkTemplateNodes)
+ */
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err!=nil {
+		return nil, err
+	}
+	if len(tmpl.Templates())>1 {
+		return nil, errors.New("Template definitions are not allowed")
+	}
+	if tmpl.Tree!=nil {
+		if err := checkTemplateNodes(tmpl.Tree.Root); err!=nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+/**
+ * Checks that the nodes only contain text, comments and actions outputting a single field or variable
+ */
+func checkTemplateNodes(list *parse.ListNode) error {
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode, *parse.CommentNode:
+			continue
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl)<1&&len(n.Pipe.Cmds)==1&&len(n.Pipe.Cmds[0].Args)==1 {
+				switch n.Pipe.Cmds[0].Args[0].(type) {
+				case *parse.FieldNode, *parse.VariableNode, *parse.DotNode:
+					continue
+				}
+			}
+		}
+		return fmt.Errorf("Unsupported action '%s', only variables (e.g. {{.id}}) are allowed", node)
+	}
+	return nil
+}
+
+/**
+ * Executes the template into the builder and returns the output
+ */
+func executeTemplate(out *limitedBuilder, tmpl *template.Template, vars map[string]string) (string, error) {
+	out.Reset()
+	if err := tmpl.Execute(out, vars); err!=nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+/**
+ * Builder failing once the summed size of all outputs exceeds the limit
+ */
+type limitedBuilder struct {
+	strings.Builder
+	limit int64
+	written int64
+}
+
+func (b* limitedBuilder) Write(data []byte) (int, error) {
+	b.written += int64(len(data))
+	if b.written>b.limit {
+		return 0, fmt.Errorf("Templates expand to more than %d bytes", b.limit)
+	}
+	return b.Builder.Write(data)
+}
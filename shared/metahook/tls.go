@@ -0,0 +1,134 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metahook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+/**
+ * Additionally serves the API on a TCP address secured with TLS
+ *
+ * The certificate and key are loaded when Serve() is called.
+ *
+ * The unix socket is still served, use WithoutSocket to only serve the TCP listener.
+ */
+func WithTLSListener(addr string, certFile string, keyFile string) Option {
+	return func(m *MetaHook) {
+		m.tcpAddr = addr
+		m.tlsCertFile = certFile
+		m.tlsKeyFile = keyFile
+	}
+}
+
+/**
+ * Requires clients of the TLS listener to present a certificate signed by the CA
+ *
+ * The CA certificate (PEM) is loaded when Serve() is called.
+ * The common name of the client certificate is used as client identity,
+ * it is passed to the ClientHook and recorded in the audit trail of the MetaConfig.
+ */
+func WithClientCA(caFile string) Option {
+	return func(m *MetaHook) {
+		m.tlsCAFile = caFile
+	}
+}
+
+/**
+ * Disables the unix socket listener
+ *
+ * Only meaningful in combination with WithTLSListener.
+ */
+func WithoutSocket() Option {
+	return func(m *MetaHook) {
+		m.disableSocket = true
+	}
+}
+
+/**
+ * Creates the TLS configuration of the TCP listener
+ */
+func (m* MetaHook) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(m.tlsCertFile, m.tlsKeyFile)
+	if err!=nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS12,
+	}
+	if m.tlsCAFile!="" {
+		caPem, err := os.ReadFile(m.tlsCAFile)
+		if err!=nil {
+			return nil, err
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("Failed to parse client CA certificate at: %s", m.tlsCAFile)
+		}
+		config.ClientCAs = caPool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/**
+ * Opens the TLS listener on the TCP address
+ */
+func (m* MetaHook) listenTLS() (net.Listener, error) {
+	config, err := m.tlsConfig()
+	if err!=nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", m.tcpAddr, config)
+}
+
+/**
+ * Returns the identity of the client that sent the request
+ *
+ * The identity is the common name of the verified client certificate,
+ * or "uid:<uid>" for unix socket peers with known credentials (see PeerCredentials).
+ * Other requests (e.g. over the named pipe) have no identity.
+ */
+func clientIdentity(r *http.Request) string {
+	if name := certIdentity(r); name!="" {
+		return name
+	}
+	if cred, _ := requestPeerCredentials(r); cred!=nil {
+		return "uid:" + strconv.FormatUint(uint64(cred.UID), 10)
+	}
+	return ""
+}
+
+/**
+ * Returns the common name of the verified client certificate of the request (empty if none)
+ */
+func certIdentity(r *http.Request) string {
+	if r.TLS==nil||len(r.TLS.VerifiedChains)==0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,122 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+/**
+ * Span of a trace, started by the Tracer
+ */
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+/**
+ * Tracer creating the spans of requests and hooks (e.g. an adapter to an OpenTelemetry tracer)
+ *
+ * Extract returns the context carrying the remote trace context of the incoming headers (e.g. W3C traceparent),
+ * Start creates a span as child of the span in the context and returns the context carrying the new span.
+ *
+ * With OpenTelemetry, Extract is implemented with the propagator of the SDK
+ * (otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))) and Start with trace.Tracer.Start.
+ */
+type Tracer interface {
+	Extract(ctx context.Context, header http.Header) context.Context
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+/**
+ * Traces every request and hook execution with the tracer
+ *
+ * Requests are traced as child of the trace context sent by the client,
+ * every hook call (including retries and hooks of async jobs) is traced as child span of the request.
+ * The context passed to the hooks carries the span of the hook, so hooks can add their own child spans.
+ */
+func WithTracer(tracer Tracer) Option {
+	return func(m *MetaHook) {
+		m.tracer = tracer
+	}
+}
+
+/**
+ * Wraps the handler with the request tracing (if enabled)
+ */
+func (m* MetaHook) tracingHandler(next http.Handler) http.Handler {
+	if m.tracer==nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := m.routePath(r)
+		ctx := m.tracer.Extract(r.Context(), r.Header)
+		ctx, span := m.tracer.Start(ctx, "MetaHook " + r.Method + " " + route)
+		defer span.End()
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("url.path", r.URL.Path)
+		if client := clientIdentity(r); client!="" {
+			span.SetAttribute("enduser.id", client)
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status==0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", recorder.status)
+		if recorder.status>=500 {
+			span.RecordError(fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status)))
+		}
+	})
+}
+
+/**
+ * Starts the span of a hook call (nil if tracing is disabled)
+ */
+func (m* MetaHook) startHookSpan(ctx context.Context, kind string, key string) (context.Context, Span) {
+	if m.tracer==nil {
+		return ctx, nil
+	}
+	ctx, span := m.tracer.Start(ctx, "MetaHook " + kind + " hook")
+	span.SetAttribute("metahook.hook.kind", kind)
+	if key!="" {
+		span.SetAttribute("metahook.key", key)
+	}
+	return ctx, span
+}
+
+/**
+ * Records the result of the hook call and ends the span
+ */
+func endHookSpan(span Span, err error) {
+	if span==nil {
+		return
+	}
+	if err!=nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
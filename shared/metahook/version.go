@@ -0,0 +1,79 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metahook
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+/**
+ * Current version of the MetaHook API, endpoints are served under /<API_VERSION>/
+ */
+const API_VERSION string = "v1"
+
+/**
+ * Build version reported by /version
+ *
+ * Set at link time with: -ldflags "-X github.com/megakuul/cthulhu/shared/metahook.BuildVersion=<version>"
+ * If empty, the version of the main module from the build info is reported.
+ */
+var BuildVersion string
+
+/**
+ * API versions served by this MetaHook, ordered from newest to oldest
+ */
+var supportedVersions = []string{API_VERSION}
+
+type versionResponse struct {
+	// Current API version
+	Api string `json:"api"`
+	// All served API versions, clients should pick the newest one they support
+	Supported []string `json:"supported"`
+	// Build version of the serving application
+	Build string `json:"build"`
+}
+
+/**
+ * Handler version requests
+ *
+ * Reports the API versions and the build version, so that clients can negotiate the API version
+ */
+func (m* MetaHook) versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method, expected GET!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, versionResponse{API_VERSION, supportedVersions, buildVersion()})
+}
+
+/**
+ * Returns the BuildVersion or the module version of the binary if it is not set
+ */
+func buildVersion() string {
+	if BuildVersion!="" {
+		return BuildVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+/**
+ * Cthulhu System
+ *
+ * Copyright (C) 2024  Linus Ilian Moser <linus.moser@megakuul.ch>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metahook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/megakuul/cthulhu/shared/metaconfig"
+)
+
+/**
+ * Number of change events queued per webhook before events are dropped
+ */
+const WEBHOOK_BUFFER_SIZE int = 1024
+
+/**
+ * Timeout of a single webhook delivery attempt
+ */
+const WEBHOOK_TIMEOUT time.Duration = 10 * time.Second
+
+/**
+ * Number of retries of a failed delivery, the delay starts at WEBHOOK_RETRY_BACKOFF and is doubled on every retry
+ */
+const WEBHOOK_RETRIES int = 5
+const WEBHOOK_RETRY_BACKOFF time.Duration = 1 * time.Second
+
+/**
+ * Headers of webhook deliveries
+ *
+ * The signature is "sha256=<hex HMAC-SHA256 of the body>", the delivery id is the same for all attempts of an event.
+ */
+const WEBHOOK_SIGNATURE_HEADER string = "X-Cthulhu-Signature"
+const WEBHOOK_DELIVERY_HEADER string = "X-Cthulhu-Delivery"
+
+type webhook struct {
+	url string
+	// Key of the HMAC signature (unsigned if empty)
+	secret []byte
+}
+
+/**
+ * Change event POSTed to webhooks as JSON
+ */
+type webhookEvent struct {
+	// Name of the MetaConfig (see AddConfig)
+	Config string `json:"config"`
+	metaconfig.Change
+}
+
+/**
+ * POSTs every change of the served MetaConfigs to the URL, so that external systems (e.g. a CMDB) stay in sync
+ *
+ * Every change is sent as JSON object holding the name of the MetaConfig and the metaconfig.Change,
+ * values of redacted keys are replaced by metaconfig.REDACTED_VALUE.
+ * If secret is not empty, the body is signed with HMAC-SHA256 (see WEBHOOK_SIGNATURE_HEADER).
+ *
+ * Changes are delivered in order, failed deliveries (network errors, 429 and 5xx) are retried with backoff (see WEBHOOK_RETRIES).
+ * Changes are dropped if the webhook can't keep up, failures are logged (see WithLogger).
+ *
+ * Webhooks are notified while Serve() is running, can be used multiple times to add several webhooks.
+ */
+func WithWebhook(url string, secret string) Option {
+	return func(m *MetaHook) {
+		m.webhooks = append(m.webhooks, webhook{url, []byte(secret)})
+	}
+}
+
+/**
+ * Subscribes to all MetaConfigs and starts the delivery to the webhooks
+ *
+ * Returns the function to stop the delivery, pending events are discarded.
+ */
+func (m* MetaHook) startWebhooks() func() {
+	if len(m.webhooks)==0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	httpClient := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	var wg sync.WaitGroup
+
+	queues := make([]chan []byte, len(m.webhooks))
+	for i, hook := range m.webhooks {
+		queues[i] = make(chan []byte, WEBHOOK_BUFFER_SIZE)
+		wg.Add(1)
+		go func(hook webhook, queue chan []byte) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case body := <-queue:
+					m.deliverWebhook(ctx, httpClient, hook, body)
+				}
+			}
+		}(hook, queues[i])
+	}
+
+	for name, d := range m.configs {
+		changes, cancelWatch := d.metaConfig.Watch("", WEBHOOK_BUFFER_SIZE)
+		wg.Add(1)
+		go func(name string, changes <-chan metaconfig.Change) {
+			defer wg.Done()
+			defer cancelWatch()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case change := <-changes:
+					body, err := json.Marshal(webhookEvent{name, change})
+					if err!=nil {
+						m.logError(fmt.Sprintf("Failed to encode webhook event: %s", err))
+						continue
+					}
+					for i, queue := range queues {
+						select {
+						case queue <- body:
+						default:
+							m.logError(fmt.Sprintf("Webhook %s can't keep up, change of key '%s' dropped",
+								redactURL(m.webhooks[i].url), change.Key))
+						}
+					}
+				}
+			}
+		}(name, changes)
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+/**
+ * Delivers an event to the webhook, retrying failed attempts
+ */
+func (m* MetaHook) deliverWebhook(ctx context.Context, httpClient *http.Client, hook webhook, body []byte) {
+	idBuf := make([]byte, 16)
+	rand.Read(idBuf)
+	id := hex.EncodeToString(idBuf)
+
+	backoff := WEBHOOK_RETRY_BACKOFF
+	for attempt := 0; ; attempt++ {
+		retry, err := postWebhook(ctx, httpClient, hook, id, body)
+		if err==nil {
+			return
+		}
+		if !retry||attempt>=WEBHOOK_RETRIES {
+			m.logError(fmt.Sprintf("Webhook delivery %s to %s failed: %s", id, redactURL(hook.url), err))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+/**
+ * Sends a single delivery attempt
+ *
+ * Returns whether a failed attempt can be retried.
+ */
+func postWebhook(ctx context.Context, httpClient *http.Client, hook webhook, id string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.url, bytes.NewReader(body))
+	if err!=nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, id)
+	if len(hook.secret)>0 {
+		mac := hmac.New(sha256.New, hook.secret)
+		mac.Write(body)
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := httpClient.Do(req)
+	if err!=nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode<300 {
+		return false, nil
+	}
+	err = fmt.Errorf("Webhook responded with status %d", res.StatusCode)
+	return res.StatusCode==http.StatusTooManyRequests||res.StatusCode>=500, err
+}
+
+/**
+ * Removes the password of the webhook URL for log messages
+ */
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err!=nil {
+		return "<invalid url>"
+	}
+	return parsed.Redacted()
+}